@@ -7,9 +7,11 @@ import (
 )
 
 type SinaDocument struct {
-	Catgory string `xml:"catgory"`
-	Title   string `xml:"title"`
-	Content string `xml:"content"`
+	Catgory     string `xml:"catgory"`
+	Title       string `xml:"title"`
+	Content     string `xml:"content"`
+	PublishTime int64  `xml:"publishtime"` // unix时间戳(秒)
+	Alias       int64  `xml:"-"`           // UUID冲突时改用的ID
 }
 
 // Implement For Document
@@ -33,9 +35,18 @@ func (sd *SinaDocument) Serial() []byte {
 }
 
 func (sd *SinaDocument) UUID() int64 {
-	id := common.MergeString(sd.meta(), sd.Catgory, sd.Title)
-	return common.StringHashToInt64(id)
+	if sd.Alias != 0 {
+		return sd.Alias
+	}
+	return common.StringHashToInt64(sd.Identity())
+}
 
+func (sd *SinaDocument) Identity() string {
+	return common.MergeString(sd.meta(), sd.Catgory, sd.Title)
+}
+
+func (sd *SinaDocument) SetUUID(id int64) {
+	sd.Alias = id
 }
 func (sd *SinaDocument) FieldExist(f string) bool {
 	switch f {
@@ -78,3 +89,13 @@ func (sd *SinaDocument) FetchField(f string) []byte {
 func (sd *SinaDocument) EnumFields() []string {
 	return []string{"Catgory", "Ttile", "Content"}
 }
+
+// Implement For NumericDocument
+func (sd *SinaDocument) NumericField(f string) (int64, bool) {
+	switch f {
+	case "PublishTime":
+		return sd.PublishTime, sd.PublishTime != 0
+	default:
+		return 0, false
+	}
+}
@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fts/internal/common"
-	"fts/internal/types"
+	"fts/internal/index"
 )
 
 // type Index interface {
@@ -16,10 +14,13 @@ import (
 // 	QueryAllDoc() IndexQueryResult
 // }
 
-// implement Index
+// implement Index，倒排按块编码存储，查询时可以跳读
 type SinaTitleIndex struct {
-	Maps  map[int64]int16 `xml:"Docs"`
-	Token string          `xml:"Token"`
+	index.BlockPostings
+}
+
+func NewSinaTitleIndex(token string, docs map[int64]int16) *SinaTitleIndex {
+	return &SinaTitleIndex{index.NewBlockPostings(token, docs)}
 }
 
 func (sti *SinaTitleIndex) meta() string {
@@ -30,74 +31,11 @@ func (sti *SinaTitleIndex) field() string {
 	return "Title"
 }
 
-func (sti *SinaTitleIndex) Dump(b []byte) {
-	d := gob.NewDecoder(bytes.NewReader(b))
-
-	d.Decode(sti)
-}
-
-func (sti *SinaTitleIndex) Serial() []byte {
-	buf := new(bytes.Buffer)
-
-	e := gob.NewEncoder(buf)
-
-	e.Encode(sti)
-
-	return buf.Bytes()
-}
-
 func (sti *SinaTitleIndex) Field() string {
 	return sti.field()
 }
 
 func (sti *SinaTitleIndex) UUID() int64 {
-	sid := common.MergeString(sti.meta(), sti.field(), sti.Token)
+	sid := common.MergeString(sti.meta(), sti.field(), sti.Token())
 	return common.StringHashToInt64(sid)
 }
-
-func (sti *SinaTitleIndex) Merge(i interface{}) bool {
-	in, ok := i.(SinaTitleIndex)
-	if !ok {
-		return false
-	}
-	if in.Token != sti.Token {
-		return false
-	}
-	for id, v := range in.Maps {
-		xid, ok := sti.Maps[id]
-		if ok {
-			sti.Maps[id] += xid
-		} else {
-			sti.Maps[id] = v
-		}
-	}
-	return true
-}
-
-func (sti *SinaTitleIndex) QueryDoc(id int64) int16 {
-	return sti.Maps[id]
-}
-
-func (sti *SinaTitleIndex) QueryAllDoc() types.IndexQueryResult {
-	res := types.IndexQueryResult{
-		Info: sti.Maps,
-	}
-	ids := []int64{}
-	for k := range sti.Maps {
-		idx := 0
-		for ; idx < len(ids); idx++ {
-			if ids[idx] > k {
-				break
-			}
-		}
-
-		if idx == len(ids) {
-			ids = append(ids, k)
-		} else {
-			ids = append(ids[:idx], append([]int64{k}, ids[idx+1:]...)...)
-		}
-	}
-
-	res.Ids = ids
-	return res
-}
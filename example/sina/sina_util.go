@@ -144,9 +144,10 @@ func (sdl *TxtSinaDocLoader) Load(chd chan types.Document, che chan error) {
 				title, _, _ := bio.ReadLine()
 				reb := len(title)
 				doc := &SinaDocument{
-					Title:   string(title),
-					Catgory: path.Base(rp),
-					Content: string(b[reb:]), // +1 means pass "\r\n" or "\n"
+					Title:       string(title),
+					Catgory:     path.Base(rp),
+					Content:     string(b[reb:]),       // +1 means pass "\r\n" or "\n"
+					PublishTime: info.ModTime().Unix(), // 语料没有发布时间，用文件的修改时间代替
 				}
 				count++
 				chd <- doc
@@ -196,11 +197,8 @@ func (sid *SinaIndexBuilder) Build(doc types.Document, tokens []types.TokenMeta)
 			kmap := make(map[int64]int16)
 			kmap[doc.UUID()] = 1
 			res = append(res, types.IndexMeta{
-				Token: v.Token(),
-				Zindex: &SinaTitleIndex{
-					Token: v.Token(),
-					Maps:  kmap,
-				},
+				Token:  v.Token(),
+				Zindex: NewSinaTitleIndex(v.Token(), kmap),
 			})
 		}
 	default:
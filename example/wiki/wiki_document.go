@@ -23,6 +23,7 @@ type Document struct {
 	URL      string    `xml:"url"`
 	Text     string    `xml:"abstract"`
 	Sublinks []Sublink `xml:"links>sublink"`
+	Alias    int64     `xml:"-"` // UUID冲突时改用的ID
 }
 
 func (doc *Document) meta() string {
@@ -44,11 +45,21 @@ func (doc *Document) Serial() []byte {
 }
 
 func (doc *Document) UUID() int64 {
-	xid := common.MergeString(doc.meta(), doc.Title, doc.URL)
-	id := common.StringHashToInt64(xid)
+	if doc.Alias != 0 {
+		return doc.Alias
+	}
+	id := common.StringHashToInt64(doc.Identity())
 
 	return id
 }
+
+func (doc *Document) Identity() string {
+	return common.MergeString(doc.meta(), doc.Title, doc.URL)
+}
+
+func (doc *Document) SetUUID(id int64) {
+	doc.Alias = id
+}
 func (doc *Document) EnumFields(s string) string {
 	switch s {
 	case "Title":
@@ -92,3 +103,13 @@ func (doc *Document) FieldLen(s string) int64 {
 
 	return int64(utf8.RuneCount(b))
 }
+
+// Implement For NumericDocument
+func (doc *Document) NumericField(s string) (int64, bool) {
+	switch s {
+	case "Links":
+		return int64(len(doc.Sublinks)), true
+	default:
+		return 0, false
+	}
+}
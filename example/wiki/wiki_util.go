@@ -91,11 +91,8 @@ func (wa *WikiAbstractIndexBuilder) Build(doc types.Document, tokens []types.Tok
 			// xid, _ := strconv.ParseInt(doc.UUID(), 10, 64)
 			kmap[doc.UUID()] = 1
 			res = append(res, types.IndexMeta{
-				Token: v.Token(),
-				Zindex: &WikiAbstractIndex{
-					Token: v.Token(),
-					Docs:  kmap,
-				},
+				Token:  v.Token(),
+				Zindex: NewWikiAbstractIndex(v.Token(), kmap),
 			})
 		}
 	default:
@@ -0,0 +1,322 @@
+package bitmap
+
+import (
+	"math/bits"
+	"sort"
+)
+
+const (
+	arrayMaxSize = 4096 // 数组容器的上限，超过时改用位图
+	bitmapWords  = 1024 // 2^16位
+)
+
+// 低16位的集合
+type container interface {
+	card() int
+	contains(uint16) bool
+	add(uint16) container // 可能转换为其它类型的容器
+	remove(uint16) container
+	iterate(func(uint16) bool) bool // 回调返回false时停止，整体返回是否遍历完
+	words() *[bitmapWords]uint64    // 转换为位图，返回新的数组
+	clone() container
+}
+
+// 有序数组
+type arrayContainer struct {
+	vals []uint16
+}
+
+// 位图
+type bitmapContainer struct {
+	w [bitmapWords]uint64
+	n int
+}
+
+// 连续区间[start, last]
+type interval struct {
+	start uint16
+	last  uint16
+}
+
+// 有序且不相交的区间
+type runContainer struct {
+	runs []interval
+}
+
+// 由位图构造较小的容器
+func fromWords(w *[bitmapWords]uint64) container {
+	n := 0
+	for _, v := range w {
+		n += bits.OnesCount64(v)
+	}
+	if n > arrayMaxSize {
+		return &bitmapContainer{w: *w, n: n}
+	}
+	ac := &arrayContainer{vals: make([]uint16, 0, n)}
+	for i, v := range w {
+		for v != 0 {
+			ac.vals = append(ac.vals, uint16(i*64+bits.TrailingZeros64(v)))
+			v &= v - 1
+		}
+	}
+	return ac
+}
+
+func (ac *arrayContainer) card() int {
+	return len(ac.vals)
+}
+
+func (ac *arrayContainer) search(x uint16) int {
+	return sort.Search(len(ac.vals), func(i int) bool { return ac.vals[i] >= x })
+}
+
+func (ac *arrayContainer) contains(x uint16) bool {
+	i := ac.search(x)
+	return i < len(ac.vals) && ac.vals[i] == x
+}
+
+func (ac *arrayContainer) add(x uint16) container {
+	i := ac.search(x)
+	if i < len(ac.vals) && ac.vals[i] == x {
+		return ac
+	}
+	if len(ac.vals) == arrayMaxSize {
+		bc := &bitmapContainer{w: *ac.words(), n: len(ac.vals)}
+		return bc.add(x)
+	}
+	ac.vals = append(ac.vals, 0)
+	copy(ac.vals[i+1:], ac.vals[i:])
+	ac.vals[i] = x
+	return ac
+}
+
+func (ac *arrayContainer) remove(x uint16) container {
+	i := ac.search(x)
+	if i < len(ac.vals) && ac.vals[i] == x {
+		ac.vals = append(ac.vals[:i], ac.vals[i+1:]...)
+	}
+	return ac
+}
+
+func (ac *arrayContainer) iterate(f func(uint16) bool) bool {
+	for _, v := range ac.vals {
+		if !f(v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ac *arrayContainer) words() *[bitmapWords]uint64 {
+	w := &[bitmapWords]uint64{}
+	for _, v := range ac.vals {
+		w[v>>6] |= 1 << (v & 63)
+	}
+	return w
+}
+
+func (ac *arrayContainer) clone() container {
+	return &arrayContainer{vals: append([]uint16{}, ac.vals...)}
+}
+
+func (bc *bitmapContainer) card() int {
+	return bc.n
+}
+
+func (bc *bitmapContainer) contains(x uint16) bool {
+	return bc.w[x>>6]&(1<<(x&63)) != 0
+}
+
+func (bc *bitmapContainer) add(x uint16) container {
+	if !bc.contains(x) {
+		bc.w[x>>6] |= 1 << (x & 63)
+		bc.n++
+	}
+	return bc
+}
+
+func (bc *bitmapContainer) remove(x uint16) container {
+	if !bc.contains(x) {
+		return bc
+	}
+	bc.w[x>>6] &^= 1 << (x & 63)
+	bc.n--
+	if bc.n <= arrayMaxSize {
+		return fromWords(&bc.w)
+	}
+	return bc
+}
+
+func (bc *bitmapContainer) iterate(f func(uint16) bool) bool {
+	for i, v := range bc.w {
+		for v != 0 {
+			if !f(uint16(i*64 + bits.TrailingZeros64(v))) {
+				return false
+			}
+			v &= v - 1
+		}
+	}
+	return true
+}
+
+func (bc *bitmapContainer) words() *[bitmapWords]uint64 {
+	w := bc.w
+	return &w
+}
+
+func (bc *bitmapContainer) clone() container {
+	c := *bc
+	return &c
+}
+
+func (rc *runContainer) card() int {
+	n := 0
+	for _, r := range rc.runs {
+		n += int(r.last-r.start) + 1
+	}
+	return n
+}
+
+func (rc *runContainer) contains(x uint16) bool {
+	i := sort.Search(len(rc.runs), func(i int) bool { return rc.runs[i].last >= x })
+	return i < len(rc.runs) && rc.runs[i].start <= x
+}
+
+// 区间容器只由RunOptimize产生，修改时先转换回数组或位图
+func (rc *runContainer) add(x uint16) container {
+	if rc.contains(x) {
+		return rc
+	}
+	return fromWords(rc.words()).add(x)
+}
+
+func (rc *runContainer) remove(x uint16) container {
+	if !rc.contains(x) {
+		return rc
+	}
+	return fromWords(rc.words()).remove(x)
+}
+
+func (rc *runContainer) iterate(f func(uint16) bool) bool {
+	for _, r := range rc.runs {
+		for v := int(r.start); v <= int(r.last); v++ {
+			if !f(uint16(v)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (rc *runContainer) words() *[bitmapWords]uint64 {
+	w := &[bitmapWords]uint64{}
+	for _, r := range rc.runs {
+		for v := int(r.start); v <= int(r.last); v++ {
+			w[v>>6] |= 1 << (v & 63)
+		}
+	}
+	return w
+}
+
+func (rc *runContainer) clone() container {
+	return &runContainer{runs: append([]interval{}, rc.runs...)}
+}
+
+// 计算容器的区间表示，区间个数的序列化大小小于当前表示时返回区间容器
+func optimize(c container) container {
+	runs := []interval{}
+	c.iterate(func(v uint16) bool {
+		if n := len(runs); n > 0 && int(runs[n-1].last)+1 == int(v) {
+			runs[n-1].last = v
+		} else {
+			runs = append(runs, interval{start: v, last: v})
+		}
+		return true
+	})
+	if 2+4*len(runs) < serializedSize(c) {
+		return &runContainer{runs: runs}
+	}
+	if _, ok := c.(*runContainer); ok {
+		// 区间不再有优势，转换回数组或位图
+		return fromWords(c.words())
+	}
+	return c
+}
+
+// 序列化时容器数据的字节数
+func serializedSize(c container) int {
+	switch v := c.(type) {
+	case *arrayContainer:
+		return 2 + 2*len(v.vals)
+	case *bitmapContainer:
+		return 8 * bitmapWords
+	case *runContainer:
+		return 2 + 4*len(v.runs)
+	}
+	return 0
+}
+
+func and(a, b container) container {
+	if aa, ok := a.(*arrayContainer); ok {
+		return filter(aa, b, true)
+	}
+	if ba, ok := b.(*arrayContainer); ok {
+		return filter(ba, a, true)
+	}
+	w, o := a.words(), b.words()
+	for i := range w {
+		w[i] &= o[i]
+	}
+	return fromWords(w)
+}
+
+func or(a, b container) container {
+	aa, ok1 := a.(*arrayContainer)
+	ba, ok2 := b.(*arrayContainer)
+	if ok1 && ok2 && len(aa.vals)+len(ba.vals) <= arrayMaxSize {
+		res := &arrayContainer{vals: make([]uint16, 0, len(aa.vals)+len(ba.vals))}
+		i, j := 0, 0
+		for i < len(aa.vals) || j < len(ba.vals) {
+			switch {
+			case j == len(ba.vals) || (i < len(aa.vals) && aa.vals[i] < ba.vals[j]):
+				res.vals = append(res.vals, aa.vals[i])
+				i++
+			case i == len(aa.vals) || ba.vals[j] < aa.vals[i]:
+				res.vals = append(res.vals, ba.vals[j])
+				j++
+			default:
+				res.vals = append(res.vals, aa.vals[i])
+				i++
+				j++
+			}
+		}
+		return res
+	}
+	w, o := a.words(), b.words()
+	for i := range w {
+		w[i] |= o[i]
+	}
+	return fromWords(w)
+}
+
+func andNot(a, b container) container {
+	if aa, ok := a.(*arrayContainer); ok {
+		return filter(aa, b, false)
+	}
+	w, o := a.words(), b.words()
+	for i := range w {
+		w[i] &^= o[i]
+	}
+	return fromWords(w)
+}
+
+// 保留a中在(keep为true)或者不在(keep为false)b中的值
+func filter(a *arrayContainer, b container, keep bool) container {
+	res := &arrayContainer{vals: make([]uint16, 0, len(a.vals))}
+	for _, v := range a.vals {
+		if b.contains(v) == keep {
+			res.vals = append(res.vals, v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,445 @@
+package bitmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"fts/internal/types"
+	"io"
+	"sort"
+)
+
+var ErrBitmapFormat = errors.New("invalid bitmap data")
+
+const (
+	bitmapCookie = 0x4d425246 // "FRBM"
+
+	kindArray  = 1
+	kindBitmap = 2
+	kindRun    = 3
+)
+
+// 内部文档编号的压缩集合(roaring bitmap)
+// 按高16位分成若干容器，容器内的低16位根据密度用有序数组、位图或区间表示
+// 零值可以直接使用，不是并发安全的
+type Bitmap struct {
+	keys       []uint16
+	containers []container
+}
+
+func New() *Bitmap {
+	return &Bitmap{}
+}
+
+func Of(vals ...uint32) *Bitmap {
+	b := New()
+	for _, v := range vals {
+		b.Add(v)
+	}
+	return b
+}
+
+func (b *Bitmap) index(key uint16) (int, bool) {
+	i := sort.Search(len(b.keys), func(i int) bool { return b.keys[i] >= key })
+	return i, i < len(b.keys) && b.keys[i] == key
+}
+
+func (b *Bitmap) Add(x uint32) {
+	key, low := uint16(x>>16), uint16(x)
+	i, ok := b.index(key)
+	if ok {
+		b.containers[i] = b.containers[i].add(low)
+		return
+	}
+	b.keys = append(b.keys, 0)
+	copy(b.keys[i+1:], b.keys[i:])
+	b.keys[i] = key
+	b.containers = append(b.containers, nil)
+	copy(b.containers[i+1:], b.containers[i:])
+	b.containers[i] = &arrayContainer{vals: []uint16{low}}
+}
+
+func (b *Bitmap) Remove(x uint32) {
+	i, ok := b.index(uint16(x >> 16))
+	if !ok {
+		return
+	}
+	c := b.containers[i].remove(uint16(x))
+	if c.card() == 0 {
+		b.keys = append(b.keys[:i], b.keys[i+1:]...)
+		b.containers = append(b.containers[:i], b.containers[i+1:]...)
+		return
+	}
+	b.containers[i] = c
+}
+
+func (b *Bitmap) Contains(x uint32) bool {
+	i, ok := b.index(uint16(x >> 16))
+	return ok && b.containers[i].contains(uint16(x))
+}
+
+func (b *Bitmap) Cardinality() uint64 {
+	n := uint64(0)
+	for _, c := range b.containers {
+		n += uint64(c.card())
+	}
+	return n
+}
+
+func (b *Bitmap) IsEmpty() bool {
+	return len(b.keys) == 0
+}
+
+// 按升序遍历，f返回false时停止
+func (b *Bitmap) ForEach(f func(uint32) bool) {
+	for i, c := range b.containers {
+		high := uint32(b.keys[i]) << 16
+		if !c.iterate(func(v uint16) bool { return f(high | uint32(v)) }) {
+			return
+		}
+	}
+}
+
+func (b *Bitmap) ToArray() []uint32 {
+	res := make([]uint32, 0, b.Cardinality())
+	b.ForEach(func(v uint32) bool {
+		res = append(res, v)
+		return true
+	})
+	return res
+}
+
+func (b *Bitmap) Clone() *Bitmap {
+	res := &Bitmap{
+		keys:       append([]uint16{}, b.keys...),
+		containers: make([]container, len(b.containers)),
+	}
+	for i, c := range b.containers {
+		res.containers[i] = c.clone()
+	}
+	return res
+}
+
+func (b *Bitmap) Equal(o *Bitmap) bool {
+	if len(b.keys) != len(o.keys) || b.Cardinality() != o.Cardinality() {
+		return false
+	}
+	for i, key := range b.keys {
+		if o.keys[i] != key || and(b.containers[i], o.containers[i]).card() != b.containers[i].card() {
+			return false
+		}
+	}
+	return true
+}
+
+// 交集
+func (b *Bitmap) And(o *Bitmap) *Bitmap {
+	res := New()
+	i, j := 0, 0
+	for i < len(b.keys) && j < len(o.keys) {
+		switch {
+		case b.keys[i] < o.keys[j]:
+			i++
+		case b.keys[i] > o.keys[j]:
+			j++
+		default:
+			if c := and(b.containers[i], o.containers[j]); c.card() > 0 {
+				res.keys = append(res.keys, b.keys[i])
+				res.containers = append(res.containers, c)
+			}
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// 并集
+func (b *Bitmap) Or(o *Bitmap) *Bitmap {
+	res := New()
+	i, j := 0, 0
+	for i < len(b.keys) || j < len(o.keys) {
+		switch {
+		case j == len(o.keys) || (i < len(b.keys) && b.keys[i] < o.keys[j]):
+			res.keys = append(res.keys, b.keys[i])
+			res.containers = append(res.containers, b.containers[i].clone())
+			i++
+		case i == len(b.keys) || o.keys[j] < b.keys[i]:
+			res.keys = append(res.keys, o.keys[j])
+			res.containers = append(res.containers, o.containers[j].clone())
+			j++
+		default:
+			res.keys = append(res.keys, b.keys[i])
+			res.containers = append(res.containers, or(b.containers[i], o.containers[j]))
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// 差集，例如从命中的文档中去掉已删除的文档
+func (b *Bitmap) AndNot(o *Bitmap) *Bitmap {
+	res := New()
+	j := 0
+	for i, key := range b.keys {
+		for j < len(o.keys) && o.keys[j] < key {
+			j++
+		}
+		c := b.containers[i].clone()
+		if j < len(o.keys) && o.keys[j] == key {
+			c = andNot(b.containers[i], o.containers[j])
+		}
+		if c.card() > 0 {
+			res.keys = append(res.keys, key)
+			res.containers = append(res.containers, c)
+		}
+	}
+	return res
+}
+
+// 连续的编号较多时改用区间表示，适合构建完成后不再修改的集合
+func (b *Bitmap) RunOptimize() {
+	for i, c := range b.containers {
+		b.containers[i] = optimize(c)
+	}
+}
+
+// 格式: cookie(4) | 容器数(4) | 每个容器: 高16位(2), 类型(1), 数据
+// 数组: 个数-1(2), 值(2*n)；位图: 1024个uint64；区间: 区间数(2), 起点与终点(4*n)，均为小端
+func (b *Bitmap) MarshalBinary() ([]byte, error) {
+	size := 8
+	for _, c := range b.containers {
+		size += 3 + serializedSize(c)
+	}
+	buf := make([]byte, 0, size)
+	buf = binary.LittleEndian.AppendUint32(buf, bitmapCookie)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(b.keys)))
+	for i, c := range b.containers {
+		buf = binary.LittleEndian.AppendUint16(buf, b.keys[i])
+		switch v := c.(type) {
+		case *arrayContainer:
+			buf = append(buf, kindArray)
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(len(v.vals)-1))
+			for _, x := range v.vals {
+				buf = binary.LittleEndian.AppendUint16(buf, x)
+			}
+		case *bitmapContainer:
+			buf = append(buf, kindBitmap)
+			for _, x := range v.w {
+				buf = binary.LittleEndian.AppendUint64(buf, x)
+			}
+		case *runContainer:
+			buf = append(buf, kindRun)
+			buf = binary.LittleEndian.AppendUint16(buf, uint16(len(v.runs)))
+			for _, r := range v.runs {
+				buf = binary.LittleEndian.AppendUint16(buf, r.start)
+				buf = binary.LittleEndian.AppendUint16(buf, r.last)
+			}
+		}
+	}
+	return buf, nil
+}
+
+func (b *Bitmap) UnmarshalBinary(data []byte) error {
+	bad := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrBitmapFormat, fmt.Sprintf(format, args...))
+	}
+	if len(data) < 8 || binary.LittleEndian.Uint32(data) != bitmapCookie {
+		return bad("bad cookie")
+	}
+	n := int(binary.LittleEndian.Uint32(data[4:]))
+	data = data[8:]
+	if n > 1<<16 {
+		return bad("%d containers", n)
+	}
+	res := Bitmap{
+		keys:       make([]uint16, 0, n),
+		containers: make([]container, 0, n),
+	}
+	need := func(size int) bool {
+		return len(data) >= size
+	}
+	for i := 0; i < n; i++ {
+		if !need(3) {
+			return bad("container %d truncated", i)
+		}
+		key, kind := binary.LittleEndian.Uint16(data), data[2]
+		data = data[3:]
+		if i > 0 && key <= res.keys[i-1] {
+			return bad("container keys out of order at %d", i)
+		}
+		var c container
+		switch kind {
+		case kindArray:
+			if !need(2) {
+				return bad("container %d truncated", i)
+			}
+			card := int(binary.LittleEndian.Uint16(data)) + 1
+			if card > arrayMaxSize || !need(2+2*card) {
+				return bad("array container %d with %d values", i, card)
+			}
+			ac := &arrayContainer{vals: make([]uint16, card)}
+			for j := range ac.vals {
+				ac.vals[j] = binary.LittleEndian.Uint16(data[2+2*j:])
+				if j > 0 && ac.vals[j] <= ac.vals[j-1] {
+					return bad("array container %d out of order", i)
+				}
+			}
+			data = data[2+2*card:]
+			c = ac
+		case kindBitmap:
+			if !need(8 * bitmapWords) {
+				return bad("container %d truncated", i)
+			}
+			w := &[bitmapWords]uint64{}
+			for j := range w {
+				w[j] = binary.LittleEndian.Uint64(data[8*j:])
+			}
+			data = data[8*bitmapWords:]
+			c = fromWords(w)
+		case kindRun:
+			if !need(2) {
+				return bad("container %d truncated", i)
+			}
+			nruns := int(binary.LittleEndian.Uint16(data))
+			if !need(2 + 4*nruns) {
+				return bad("container %d truncated", i)
+			}
+			rc := &runContainer{runs: make([]interval, nruns)}
+			for j := range rc.runs {
+				r := interval{
+					start: binary.LittleEndian.Uint16(data[2+4*j:]),
+					last:  binary.LittleEndian.Uint16(data[4+4*j:]),
+				}
+				if r.last < r.start || (j > 0 && int(r.start) <= int(rc.runs[j-1].last)+1) {
+					return bad("run container %d has bad run %d", i, j)
+				}
+				rc.runs[j] = r
+			}
+			data = data[2+4*nruns:]
+			c = rc
+		default:
+			return bad("container %d of kind %d", i, kind)
+		}
+		if c.card() == 0 {
+			return bad("container %d is empty", i)
+		}
+		res.keys = append(res.keys, key)
+		res.containers = append(res.containers, c)
+	}
+	if len(data) != 0 {
+		return bad("%d trailing bytes", len(data))
+	}
+	*b = res
+	return nil
+}
+
+func (b *Bitmap) WriteTo(w io.Writer) (int64, error) {
+	data, err := b.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// 读取r中剩余的全部数据
+func (b *Bitmap) ReadFrom(r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	return int64(len(data)), b.UnmarshalBinary(data)
+}
+
+func (b *Bitmap) String() string {
+	return fmt.Sprintf("bitmap(%d values in %d containers)", b.Cardinality(), len(b.keys))
+}
+
+var _ types.PostingsIterator = (*Iterator)(nil)
+
+// 升序遍历，可以与倒排迭代器一起求交集，Freq总是1
+type Iterator struct {
+	b    *Bitmap
+	ci   int // 当前容器
+	vals []uint16
+	pos  int
+}
+
+func (b *Bitmap) Iterator() *Iterator {
+	return &Iterator{b: b, ci: -1}
+}
+
+// 作为过滤条件(types.DocFilter)与倒排求交集
+func (b *Bitmap) Postings() types.PostingsIterator {
+	return b.Iterator()
+}
+
+func (it *Iterator) load(ci int) bool {
+	it.ci, it.pos, it.vals = ci, 0, it.vals[:0]
+	if ci >= len(it.b.containers) {
+		return false
+	}
+	it.b.containers[ci].iterate(func(v uint16) bool {
+		it.vals = append(it.vals, v)
+		return true
+	})
+	return true
+}
+
+func (it *Iterator) Next() bool {
+	if it.ci >= len(it.b.containers) {
+		return false
+	}
+	if it.ci >= 0 && it.pos+1 < len(it.vals) {
+		it.pos++
+		return true
+	}
+	return it.load(it.ci + 1)
+}
+
+func (it *Iterator) Advance(target int64) bool {
+	if it.ci >= len(it.b.containers) {
+		return false
+	}
+	if target < 0 {
+		target = 0
+	}
+	if it.ci >= 0 && it.Doc() >= target {
+		return true
+	}
+	if target > 1<<32-1 {
+		it.ci = len(it.b.containers)
+		return false
+	}
+	key := uint16(target >> 16)
+	if it.ci < 0 || it.b.keys[it.ci] != key {
+		from := it.ci + 1
+		ci := from + sort.Search(len(it.b.keys)-from, func(i int) bool { return it.b.keys[from+i] >= key })
+		if !it.load(ci) {
+			return false
+		}
+		if it.b.keys[ci] > key {
+			return true
+		}
+	}
+	low := uint16(target)
+	it.pos += sort.Search(len(it.vals)-it.pos, func(i int) bool { return it.vals[it.pos+i] >= low })
+	if it.pos == len(it.vals) {
+		return it.load(it.ci + 1)
+	}
+	return true
+}
+
+func (it *Iterator) Doc() int64 {
+	return int64(it.b.keys[it.ci])<<16 | int64(it.vals[it.pos])
+}
+
+func (it *Iterator) Freq() int16 {
+	return 1
+}
+
+func (it *Iterator) Cost() int64 {
+	return int64(it.b.Cardinality())
+}
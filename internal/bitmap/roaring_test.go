@@ -0,0 +1,158 @@
+package bitmap
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sortedKeys(m map[uint32]bool) []uint32 {
+	res := make([]uint32, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// 稀疏、稠密与连续的编号混合，覆盖三种容器
+func randomSet(r *rand.Rand) map[uint32]bool {
+	m := make(map[uint32]bool)
+	for i := 0; i < 2000; i++ {
+		m[uint32(r.Int63n(1<<32))] = true
+	}
+	for i := 0; i < 10000; i++ {
+		m[uint32(1<<16+r.Intn(1<<16))] = true
+	}
+	start := uint32(5<<16 + r.Intn(1000))
+	for i := uint32(0); i < 20000; i++ {
+		m[start+i] = true
+	}
+	return m
+}
+
+func TestBitmapAddRemove(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b := New()
+	m := make(map[uint32]bool)
+	for i := 0; i < 50000; i++ {
+		// 集中在少数容器内，触发数组与位图之间的转换
+		x := uint32(r.Intn(3))<<16 | uint32(r.Intn(12000))
+		if r.Intn(3) == 0 {
+			b.Remove(x)
+			delete(m, x)
+		} else {
+			b.Add(x)
+			m[x] = true
+		}
+	}
+	assert.Equal(t, uint64(len(m)), b.Cardinality())
+	assert.Equal(t, sortedKeys(m), b.ToArray())
+	for i := 0; i < 1000; i++ {
+		x := uint32(r.Intn(3))<<16 | uint32(r.Intn(12000))
+		assert.Equal(t, m[x], b.Contains(x))
+	}
+	for x := range m {
+		b.Remove(x)
+	}
+	assert.True(t, b.IsEmpty())
+}
+
+func TestBitmapOps(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	ma, mb := randomSet(r), randomSet(r)
+	a, b := Of(sortedKeys(ma)...), Of(sortedKeys(mb)...)
+
+	and, or, andNot := map[uint32]bool{}, map[uint32]bool{}, map[uint32]bool{}
+	for x := range ma {
+		or[x] = true
+		if mb[x] {
+			and[x] = true
+		} else {
+			andNot[x] = true
+		}
+	}
+	for x := range mb {
+		or[x] = true
+	}
+	check := func() {
+		assert.Equal(t, sortedKeys(and), a.And(b).ToArray())
+		assert.Equal(t, sortedKeys(or), a.Or(b).ToArray())
+		assert.Equal(t, sortedKeys(andNot), a.AndNot(b).ToArray())
+		assert.True(t, a.And(b).Equal(b.And(a)))
+		assert.False(t, a.Equal(b))
+	}
+	check()
+
+	// 区间表示不改变集合
+	ra := a.Clone()
+	ra.RunOptimize()
+	assert.True(t, ra.Equal(a))
+	assert.Equal(t, a.ToArray(), ra.ToArray())
+	a.RunOptimize()
+	b.RunOptimize()
+	check()
+	ra.Add(5<<16 + 100000)
+	ra.Remove(ra.ToArray()[0])
+	assert.Equal(t, a.Cardinality(), ra.Cardinality())
+}
+
+func TestBitmapSerialize(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	b := Of(sortedKeys(randomSet(r))...)
+	for _, optimize := range []bool{false, true} {
+		if optimize {
+			b.RunOptimize()
+		}
+		buf := new(bytes.Buffer)
+		_, err := b.WriteTo(buf)
+		assert.Nil(t, err)
+		data := append([]byte{}, buf.Bytes()...)
+
+		c := New()
+		_, err = c.ReadFrom(buf)
+		assert.Nil(t, err)
+		assert.True(t, b.Equal(c))
+		assert.Equal(t, b.ToArray(), c.ToArray())
+
+		for _, i := range []int{0, 5, 9, len(data) / 2, len(data) - 1} {
+			assert.True(t, errors.Is(New().UnmarshalBinary(data[:i]), ErrBitmapFormat), "truncate at %d", i)
+		}
+	}
+	empty, _ := New().MarshalBinary()
+	c := Of(1)
+	assert.Nil(t, c.UnmarshalBinary(empty))
+	assert.True(t, c.IsEmpty())
+}
+
+func TestBitmapIterator(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	vals := sortedKeys(randomSet(r))
+	b := Of(vals...)
+	b.RunOptimize()
+
+	it := b.Iterator()
+	for _, v := range vals {
+		assert.True(t, it.Next())
+		assert.Equal(t, int64(v), it.Doc())
+	}
+	assert.False(t, it.Next())
+
+	it = b.Iterator()
+	target := int64(-10)
+	for {
+		target += r.Int63n(1 << 20)
+		idx := sort.Search(len(vals), func(i int) bool { return int64(vals[i]) >= target })
+		if idx == len(vals) {
+			assert.False(t, it.Advance(target))
+			break
+		}
+		assert.True(t, it.Advance(target))
+		assert.Equal(t, int64(vals[idx]), it.Doc())
+	}
+	assert.False(t, New().Iterator().Next())
+}
@@ -13,6 +13,7 @@ import (
 
 // ATTETION!!!
 // 1.一个数据扩展页的大小最大为512MB，所以键值的理论上限不会超过这个值
+// 2.页面开头8字节，低32位为序列化后的长度，高32位为内容的crc32
 
 type BPTItem interface {
 	Bytes() []byte
@@ -36,8 +37,9 @@ const (
 )
 
 const (
-	INVALID_OFFSET = 0xdeadbeef
-	MAX_FREEBLOCKS = 100
+	INVALID_OFFSET       = 0xdeadbeef
+	MAX_FREEBLOCKS       = 100
+	MAX_EXTEND_PAGE_SIZE = 512 * 1024 * 1024
 )
 
 var HasExistedKeyError = errors.New("hasExistedKey")
@@ -47,7 +49,15 @@ var ErrExceed = errors.New("data page overflow")
 
 type OFFTYPE uint64
 
+// 一棵树同一时刻只有一个写者，读者之间可以并发
+// 写者对页面写时复制(见bptree_snapshot.go)，读者在开始时的版本上读取，不等待写者
+// 只有替换整个文件(Compact、Close)时才需要等所有读者退出
 type BPlusTree struct {
+	lock           sync.RWMutex // 读者持有读锁，替换文件时持有写锁
+	wlock          sync.Mutex   // 写者之间互斥
+	cow            *treeShadows
+	snapshot       bool   // 是否是读者的只读视图
+	version        uint64 // 只读视图看到的版本
 	rootOff        OFFTYPE
 	nodePool       *sync.Pool
 	freeBlocks     []OFFTYPE
@@ -91,6 +101,7 @@ func NewBPlusTree(filename string) (*BPlusTree, error) {
 	t := &BPlusTree{}
 	t.path = filename
 	t.rootOff = INVALID_OFFSET
+	t.cow = newTreeShadows()
 	t.nodePool = &sync.Pool{
 		New: func() interface{} {
 			return &Node{}
@@ -121,6 +132,7 @@ func NewBPlusTree(filename string) (*BPlusTree, error) {
 		return nil, err
 	}
 
+	t.initFreeBlocks()
 	t.fileSize = uint64(fstat.Size())
 	if t.fileSize != 0 {
 		//读取b+树元信息
@@ -131,14 +143,67 @@ func NewBPlusTree(filename string) (*BPlusTree, error) {
 			return nil, err
 		}
 	}
-
-	t.initFreeBlocks()
+	t.cow.reset(t.rootOff, t.fileSize)
 	return t, nil
 }
 func (t *BPlusTree) Path() string {
 	return t.path
 }
+func (t *BPlusTree) Empty() bool {
+	rt := t.beginRead()
+	defer t.endRead(rt)
+	return rt.rootOff == INVALID_OFFSET
+}
 func (t *BPlusTree) Close() error {
+	t.wlock.Lock()
+	defer t.wlock.Unlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.close()
+}
+
+// 读者的只读视图，共享文件与内存池，根节点是读者开始时已发布的版本
+func (t *BPlusTree) beginRead() *BPlusTree {
+	t.lock.RLock()
+	v := t.cow.acquire()
+	return &BPlusTree{
+		cow:           t.cow,
+		snapshot:      true,
+		version:       v.version,
+		rootOff:       v.rootOff,
+		nodePool:      t.nodePool,
+		file:          t.file,
+		path:          t.path,
+		blockSize:     t.blockSize,
+		fileSize:      v.fileSize,
+		indexPageSize: t.indexPageSize,
+		dataPageSize:  t.dataPageSize,
+	}
+}
+
+func (t *BPlusTree) endRead(rt *BPlusTree) {
+	t.cow.unacquire(rt.version)
+	t.lock.RUnlock()
+}
+
+// 写操作结束时发布新的根
+func (t *BPlusTree) beginWrite() {
+	t.wlock.Lock()
+	t.cow.begin()
+}
+
+func (t *BPlusTree) endWrite() {
+	t.cow.commit(t.rootOff, t.fileSize)
+	t.wlock.Unlock()
+}
+
+func (t *BPlusTree) readAt(buf []byte, off int64) (int, error) {
+	if t.snapshot {
+		return t.cow.readAt(t.file, buf, off, t.version, t.indexPageSize)
+	}
+	return t.file.ReadAt(buf, off)
+}
+func (t *BPlusTree) close() error {
 	if t.file != nil {
 		t.file.Sync()
 		return t.file.Close()
@@ -157,23 +222,23 @@ func (t *BPlusTree) restructRootNode() error {
 	node := &Node{}
 	//寻找第一个二进制格式符合的Node
 	//位置为0处的一定是叶子节点!
-	for off := uint64(0); off < t.fileSize; off += t.dataPageSize {
-		if err = t.seekNode(node, OFFTYPE(off)); err != nil {
+	for off := uint64(0); off+8 <= t.fileSize; off += t.pageSpan(node) {
+		if err = t.seekNodePage(node, OFFTYPE(off)); err != nil {
 			return err
 		}
 		if node.IsActive {
 			break
 		}
-		//
 	}
-	// 如果扫描全部文件完毕还没有找到根节点，则此文件格式已损坏
+	// 扫描全部文件完毕还没有找到有效节点，说明所有key都已删除，是一棵空树
 	if !node.IsActive {
-		return InvalidDBFormat
+		t.rootOff = INVALID_OFFSET
+		return nil
 	}
 	// root 节点的Parent指向 INVALID_OFFSET
 	// 如果找到的节点不是Root，找到为止
 	for node.Parent != INVALID_OFFSET {
-		if err = t.seekNode(node, node.Parent); err != nil {
+		if err = t.seekNodePage(node, node.Parent); err != nil {
 			return err
 		}
 	}
@@ -194,81 +259,57 @@ func (t *BPlusTree) freeDiskPageType(typ uint8, off OFFTYPE) {
 		t.freeDataPage(off)
 	}
 }
+
+// 有序插入空闲页偏移
+func insertFreeOffsets(sl []OFFTYPE, offs ...OFFTYPE) []OFFTYPE {
+	for _, off := range offs {
+		idx := sort.Search(len(sl), func(i int) bool {
+			return sl[i] >= off
+		})
+		if idx < len(sl) && sl[idx] == off {
+			continue
+		}
+		sl = append(sl, 0)
+		copy(sl[idx+1:], sl[idx:])
+		sl[idx] = off
+	}
+	return sl
+}
+
 func (t *BPlusTree) freeExtendPage(off OFFTYPE, plus int) {
 	xl := make([]OFFTYPE, plus)
 	for idx := range xl {
 		xl[idx] = off + OFFTYPE(idx*int(t.dataPageSize))
 	}
-	sl := t.freePageBlocks[DATA_PAGE]
-	idx := len(sl) - 1
-	for idx >= 0 && sl[idx] > off {
-		idx--
-	}
-	idx++
-	if idx == len(sl) {
-		sl = append(sl, xl...)
-	} else {
-		sl = append(sl[:idx], append(xl, sl[:idx+1]...)...)
-	}
-
-	t.freePageBlocks[DATA_PAGE] = sl
+	t.freePageBlocks[DATA_PAGE] = insertFreeOffsets(t.freePageBlocks[DATA_PAGE], xl...)
 }
 
 // 返还INDEX_PAGE,会保证有序性
 func (t *BPlusTree) freeIndexPage(off OFFTYPE) {
-	sl := t.freePageBlocks[INDEX_PAGE]
-	idx := len(sl) - 1
-	for idx >= 0 && sl[idx] > off {
-		idx--
-	}
-	idx++
-	if idx == len(sl) {
-		sl = append(sl, off)
-	} else {
-		sl = append(sl[:idx], append([]OFFTYPE{off}, sl[idx+1:]...)...)
-	}
-	// 二分插入
-
-	// 插入可能引起合并操作
-	left := idx - int(t.getRate())
-	right := idx + int(t.getRate())
-	if left < 0 {
-		left = 0
+	sl := insertFreeOffsets(t.freePageBlocks[INDEX_PAGE], off)
+	idx := sort.Search(len(sl), func(i int) bool {
+		return sl[i] >= off
+	})
+	// 插入可能引起合并操作，找到off所在的连续区间
+	rate := int(t.getRate())
+	left, right := idx, idx
+	for left > 0 && sl[left-1]+OFFTYPE(t.indexPageSize) == sl[left] {
+		left--
 	}
-	if right > len(sl) {
-		right = len(sl)
+	for right < len(sl)-1 && sl[right]+OFFTYPE(t.indexPageSize) == sl[right+1] {
+		right++
 	}
-	// 合并区间只可能在[left,right)
-	for left < right {
-		cnt := left
-		for cnt < right-1 && sl[cnt]+OFFTYPE(t.indexPageSize) == sl[cnt+1] {
-			cnt++
-		}
-		if cnt-left+1 == int(t.getRate()) {
-			//找到了连续的区块，执行合并逻辑
-			t.freePageBlocks[DATA_PAGE] = append(t.freePageBlocks[DATA_PAGE], sl[left])
-			sl = append(sl[:left], sl[cnt+1:]...)
-			return
-		}
-		left = cnt
+	if right-left+1 >= rate {
+		//找到了连续的区块，执行合并逻辑
+		t.freePageBlocks[DATA_PAGE] = insertFreeOffsets(t.freePageBlocks[DATA_PAGE], sl[left])
+		sl = append(sl[:left], sl[left+rate:]...)
 	}
+	t.freePageBlocks[INDEX_PAGE] = sl
 }
 
 // 返还DATA_PAGE
 func (t *BPlusTree) freeDataPage(off OFFTYPE) {
-	sl := t.freePageBlocks[DATA_PAGE]
-	idx := len(sl) - 1
-	for idx >= 0 && sl[idx] > off {
-		idx--
-	}
-	idx++
-	// 二分插入
-	if idx == len(sl) {
-		sl = append(sl, off)
-	} else {
-		sl = append(sl[:idx], append([]OFFTYPE{off}, sl[idx+1:]...)...)
-	}
-
+	t.freePageBlocks[DATA_PAGE] = insertFreeOffsets(t.freePageBlocks[DATA_PAGE], off)
 }
 
 // 分配一个索引页
@@ -299,95 +340,57 @@ func (t *BPlusTree) allocPage(typ uint8) OFFTYPE {
 	case uint8(INDEX_PAGE):
 		return t.allocIndexPage()
 	case uint8(DATA_PAGE):
-	case uint8(EXTEND_DATA_PAGE):
 		return t.allocDataPage()
+	case uint8(EXTEND_DATA_PAGE):
+		return t.allocExtendPage(1)
 	}
 	return INVALID_OFFSET
 }
 
+// 分配plus个连续的数据页，空闲链表中没有时直接扩展文件
 func (t *BPlusTree) allocExtendPage(plus uint16) OFFTYPE {
-	if plus < 255 {
-		// 有当前freeList申请
-		idx := 0
-		if len(t.freePageBlocks[DATA_PAGE]) < int(plus) {
-			t.paddingFreeBlocks(2 * int(plus)) //填充至两倍，保证至少本次能合并出大页面
-		}
-		pos := 0
-		for pos <= len(t.freePageBlocks[DATA_PAGE]) {
-			cnt := pos
-
-			for cnt < len(t.freePageBlocks[DATA_PAGE])-1 {
-				if t.freePageBlocks[DATA_PAGE][cnt]+OFFTYPE(t.blockSize) != t.freePageBlocks[DATA_PAGE][cnt+1] {
-					break
-				}
-			}
-			if pos-cnt == int(plus)-1 {
-				idx = pos
-				break
-			}
-			pos = cnt + 1
+	sl := t.freePageBlocks[DATA_PAGE]
+	pos := 0
+	for pos+int(plus) <= len(sl) {
+		cnt := pos
+		for cnt-pos+1 < int(plus) && sl[cnt]+OFFTYPE(t.dataPageSize) == sl[cnt+1] {
+			cnt++
 		}
-
-		if idx != 0 {
-			off := t.freePageBlocks[DATA_PAGE][idx]
-			t.freePageBlocks[DATA_PAGE] = append(t.freePageBlocks[DATA_PAGE][:idx], t.freePageBlocks[DATA_PAGE][idx+int(plus):]...)
+		if cnt-pos+1 == int(plus) {
+			off := sl[pos]
+			t.freePageBlocks[DATA_PAGE] = append(sl[:pos], sl[pos+int(plus):]...)
 			return off
 		}
-	} else {
-		// 直接扩展文件大小
-		pos := t.fileSize
-		t.fileSize += uint64(plus) * t.dataPageSize
-		return OFFTYPE(pos)
+		pos = cnt + 1
 	}
-
-	return INVALID_OFFSET
+	// 直接扩展文件大小
+	off := ((t.fileSize + t.indexPageSize - 1) / t.indexPageSize) * t.indexPageSize
+	t.fileSize = off + uint64(plus)*t.dataPageSize
+	return OFFTYPE(off)
 }
 
-// 调整合并磁盘空间
+// 调整合并磁盘空间，连续getRate()个索引页合并成一个数据页
 func (t *BPlusTree) adjustFreeBlockList() {
-	idx := []int{}
+	sort.Slice(t.freeBlocks, func(i, j int) bool {
+		return t.freeBlocks[i] < t.freeBlocks[j]
+	})
+	rate := int(t.getRate())
 	i := 0
 	for i < len(t.freeBlocks) {
 		cnt := i
-		for {
-			if cnt == len(t.freeBlocks)-1 {
-				cnt++
-				break
-			}
-			if t.freeBlocks[cnt]+OFFTYPE(t.indexPageSize) != t.freeBlocks[cnt+1] ||
-				cnt-i == int(t.getRate()) {
-				break
-			}
+		for cnt-i+1 < rate && cnt+1 < len(t.freeBlocks) &&
+			t.freeBlocks[cnt]+OFFTYPE(t.indexPageSize) == t.freeBlocks[cnt+1] {
 			cnt++
 		}
-		if cnt-i == int(t.getRate()) {
-			idx = append(idx, i) // merge page
+		if cnt-i+1 == rate {
+			// 合并data_page
+			t.freePageBlocks[DATA_PAGE] = insertFreeOffsets(t.freePageBlocks[DATA_PAGE], t.freeBlocks[i])
+			i = cnt + 1
+			continue
 		}
-		i = cnt
-	}
-	plus := int(t.getRate())
-	t.freePageBlocks[0] = nil
-	// 合并data_page
-	for _, v := range idx {
-		t.freePageBlocks[DATA_PAGE] = append(t.freePageBlocks[DATA_PAGE], t.freeBlocks[v])
-		//t.freeBlocks = append(t.freeBlocks[:v], t.freeBlocks[v+plus:]...)
+		t.freePageBlocks[INDEX_PAGE] = insertFreeOffsets(t.freePageBlocks[INDEX_PAGE], t.freeBlocks[i])
+		i++
 	}
-	sl := []OFFTYPE{}
-	//剔除合并成大片磁盘空间的freeBlock
-	last := 0
-	for _, v := range idx {
-		if v == 0 {
-			sl = append(t.freeBlocks[:v], t.freeBlocks[v+plus:]...)
-		} else {
-			sl = append(t.freeBlocks[last:v], t.freeBlocks[v+plus:]...)
-		}
-		last = v + plus
-	}
-	// 合并index_page
-	// for _, v := range sl {
-	// 	t.freePageBlocks[INDEX_PAGE] = append(t.freePageBlocks[INDEX_PAGE], v)
-	// }
-	t.freePageBlocks[INDEX_PAGE] = append(t.freePageBlocks[INDEX_PAGE], sl...)
 	// 清空t.freeBlocks
 	t.freeBlocks = make([]OFFTYPE, 0)
 }
@@ -428,32 +431,56 @@ func (t *BPlusTree) paddingFreeBlocks(limit int) {
 	t.fileSize = next_file
 }
 
+// 页面在磁盘上占用的大小，未使用的页面按索引页计算
+func (t *BPlusTree) pageSpan(n *Node) uint64 {
+	if adv := t.advanceOffset(n); adv > 0 && n.IsActive {
+		return uint64(adv)
+	}
+	return t.indexPageSize
+}
+
+// 在磁盘上把[off, off+span)按索引页逐个标记为未使用
+// 释放的页面可能被拆开重新分配，重新打开时只能按索引页大小扫描
+func (t *BPlusTree) markFreePages(off OFFTYPE, span uint64) error {
+	node := &Node{}
+	t.clearNodeForUsage(node)
+	for b := uint64(0); b < span; b += t.indexPageSize {
+		node.Self = off + OFFTYPE(b)
+		data, err := t.encodeNode(node, 0)
+		if err != nil {
+			return err
+		}
+		if err = t.writePage(node.Self, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // 校验已存在的数据文件中的Node
 // 收回未使用的Block
 func (t *BPlusTree) checkDiskBlockForFreeNodeList() error {
 	var (
 		err error
+		end uint64
 	)
 	node := &Node{}
-	bs := t.dataPageSize
 	//原有文件上如果有未分配的Block，加入freeBlocks
 	// len(t.freeBlocks) < MAX_FREEBLOCKS
 	// 这里删除了这个判断因为 可能删除的扩展页合并成索引页面会轻易超过限制
-	for off := uint64(0); off < t.fileSize; off += bs {
-		if off+bs > t.fileSize {
-			break
-		}
-		if err = t.seekNode(node, OFFTYPE(off)); err != nil {
+	for off := uint64(0); off+8 <= t.fileSize; {
+		if err = t.seekNodePage(node, OFFTYPE(off)); err != nil {
 			return err
 		}
-
+		bs := t.pageSpan(node)
 		if !node.IsActive {
 			t.freeBlocks = append(t.freeBlocks, OFFTYPE(off))
-			bs = t.indexPageSize
-		} else {
-			bs = uint64(t.advanceOffset(node))
 		}
+		off += bs
+		end = off
 	}
+	// 文件末尾的页可能没有写满，逻辑大小以页的边界为准
+	t.fileSize = end
 
 	t.paddingFreeBlocks(MAX_FREEBLOCKS)
 	return nil
@@ -489,8 +516,27 @@ func (t *BPlusTree) clearNodeForUsage(node *Node) {
 	node.PagePlus = 0
 }
 
-// 序列化，将文件off处的字节序列化至 Node中
+// 序列化，将文件off处的字节序列化至 Node中，含有扩展页时合并扩展页的keys
 func (t *BPlusTree) seekNode(node *Node, off OFFTYPE) error {
+	if err := t.seekNodePage(node, off); err != nil {
+		return err
+	}
+	// 扩展数据页
+	if node.ExtendPage != 0 && node.ExtendPage != INVALID_OFFSET {
+		// 调用者可能在放回内存池之后还在使用节点，这里不从内存池取
+		nn := &Node{}
+		if err := t.seekNodePage(nn, node.ExtendPage); err != nil {
+			return err
+		}
+
+		node.Keys = append(node.Keys, nn.Keys...)
+		node.Records = append(node.Records, nn.Records...)
+	}
+	return nil
+}
+
+// 只读取off处的一个页面，不处理扩展页
+func (t *BPlusTree) seekNodePage(node *Node, off OFFTYPE) error {
 	if node == nil {
 		return fmt.Errorf("cant use nil for seekNode")
 	}
@@ -498,26 +544,34 @@ func (t *BPlusTree) seekNode(node *Node, off OFFTYPE) error {
 
 	var err error
 	buf := make([]byte, 8)
-	if n, err := t.file.ReadAt(buf, int64(off)); err != nil {
+	if n, err := t.readAt(buf, int64(off)); err != nil {
 		return err
 	} else if uint64(n) != 8 {
-		return fmt.Errorf("readat %d from %s, expected len = %d but get %d", off, t.file.Name(), 4, n)
+		return fmt.Errorf("readat %d from %s, expected len = %d but get %d", off, t.file.Name(), 8, n)
 	}
 	bs := bytes.NewBuffer(buf)
 
-	dataLen := uint64(0)
-	if err = binary.Read(bs, binary.LittleEndian, &dataLen); err != nil {
+	header := uint64(0)
+	if err = binary.Read(bs, binary.LittleEndian, &header); err != nil {
 		return err
 	}
-	if uint64(dataLen)+8 > t.blockSize {
-		return fmt.Errorf("flushNode len(node) = %d exceed t.blockSize %d", uint64(dataLen)+4, t.blockSize)
+	dataLen, checksum := header&0xffffffff, uint32(header>>32)
+	// 分配了但还没有写入的页面
+	if dataLen == 0 {
+		return nil
+	}
+	if dataLen+8 > MAX_EXTEND_PAGE_SIZE {
+		return fmt.Errorf("%w: len(node) = %d at %d exceed %d", InvalidDBFormat, dataLen, off, MAX_EXTEND_PAGE_SIZE)
 	}
 
 	buf = make([]byte, dataLen)
-	if n, err := t.file.ReadAt(buf, int64(off)+8); err != nil {
+	if n, err := t.readAt(buf, int64(off)+8); err != nil {
 		return err
 	} else if uint64(n) != uint64(dataLen) {
-		return fmt.Errorf("readat %d from %s, expected len = %d but get %d", int64(off)+4, t.file.Name(), dataLen, n)
+		return fmt.Errorf("readat %d from %s, expected len = %d but get %d", int64(off)+8, t.file.Name(), dataLen, n)
+	}
+	if err = common.VerifyCrc32(t.file.Name(), int64(off), buf, checksum); err != nil {
+		return err
 	}
 
 	bs = bytes.NewBuffer(buf)
@@ -530,10 +584,6 @@ func (t *BPlusTree) seekNode(node *Node, off OFFTYPE) error {
 	if err = binary.Read(bs, binary.LittleEndian, &node.PageType); err != nil {
 		return err
 	}
-	// // ExtendPage
-	// if err = binary.Read(bs, binary.LittleEndian, &node.ExtendPage); err != nil {
-	// 	return err
-	// }
 
 	// Children
 	childCount := uint8(0)
@@ -586,6 +636,10 @@ func (t *BPlusTree) seekNode(node *Node, off OFFTYPE) error {
 		return err
 	}
 	node.ExtendPage = OFFTYPE(extend)
+	// PagePlus
+	if err = binary.Read(bs, binary.LittleEndian, &node.PagePlus); err != nil {
+		return err
+	}
 	// Keys
 	keysCount := uint8(0)
 	if err = binary.Read(bs, binary.LittleEndian, &keysCount); err != nil {
@@ -605,50 +659,37 @@ func (t *BPlusTree) seekNode(node *Node, off OFFTYPE) error {
 	}
 	node.Records = make([]string, recordCount)
 	for i := uint8(0); i < recordCount; i++ {
-		l := uint8(0)
+		l := uint32(0)
 		if err = binary.Read(bs, binary.LittleEndian, &l); err != nil {
 			return err
 		}
-		v := make([]byte, l)
-		if err = binary.Read(bs, binary.LittleEndian, &v); err != nil {
-			return err
+		if uint64(l) > uint64(bs.Len()) {
+			return fmt.Errorf("%w: record len %d at %d", InvalidDBFormat, l, off)
 		}
-		node.Records[i] = string(v)
-	}
-	// 扩展数据页
-	if node.ExtendPage != 0 && node.ExtendPage != INVALID_OFFSET {
-		nn, _ := t.newMappingNodeFromPool(INVALID_OFFSET)
-
-		err = t.seekNode(nn, node.ExtendPage)
-		if err == nil {
-			return err
-		}
-
-		node.Keys = append(node.Keys, nn.Keys...)
-		node.Records = append(node.Records, nn.Records...)
+		node.Records[i] = string(bs.Next(int(l)))
 	}
 	return nil
 }
 
-func (t *BPlusTree) flushNodesAndPutNodesPool(nodes ...*Node) error {
+func (t *BPlusTree) writeNodes(nodes ...*Node) error {
 	for _, n := range nodes {
-		if err := t.flushNodeAndPutNodePool(n); err != nil {
+		if err := t.writeNode(n); err != nil {
 			return err
 		}
 	}
-	return err
+	return nil
 }
 
 // 将改动变更到磁盘上
-func (t *BPlusTree) flushNodeAndPutNodePool(n *Node) error {
+// 写入后调用者往往还会用到节点(例如Self、Keys)，所以不放回内存池，
+// 否则并发的读者可能从内存池取到同一个节点
+func (t *BPlusTree) writeNode(n *Node) error {
 	if err := t.flushNode(n); err != nil {
 		if err == ErrExceed { //数据超出正常数据页大小
 			return t.exceedFlushNode(n)
 		}
-
 		return err
 	}
-	t.putNodePool(n)
 	return nil
 }
 
@@ -657,252 +698,254 @@ func (t *BPlusTree) putNodePool(n *Node) {
 	t.nodePool.Put(n)
 }
 
+// 数据超出一个数据页，前stop个记录留在数据页，其余写入扩展页
 func (t *BPlusTree) exceedFlushNode(n *Node) error {
 	var (
-		new_node *Node
-		err      error
+		extend *Node
+		data   []byte
+		err    error
 	)
-	bs := bytes.NewBuffer(make([]byte, 0))
-	// IsActive
-	if err = binary.Write(bs, binary.LittleEndian, n.IsActive); err != nil {
-		return nil
-	}
-	// PageType
-	if err = binary.Write(bs, binary.LittleEndian, n.PageType); err != nil {
-		return err
-	}
-	// Children
-	childCount := uint8(len(n.Children))
-	if err = binary.Write(bs, binary.LittleEndian, childCount); err != nil {
-		return err
-	}
-	for _, v := range n.Children {
-		if err = binary.Write(bs, binary.LittleEndian, uint64(v)); err != nil {
-			return err
+	// 统计针对keys的分割位置
+	stop := 0
+	lens := 8 + t.encodeSize(n, 0)
+	for stop < len(n.Keys) {
+		lens += 8 + 4 + len(n.Records[stop]) // key + record len + record
+		if uint64(lens) > t.dataPageSize {
+			break
 		}
+		stop++
 	}
 
-	// Self
-	if err = binary.Write(bs, binary.LittleEndian, uint64(n.Self)); err != nil {
-		return err
-	}
-
-	// Next
-	if err = binary.Write(bs, binary.LittleEndian, uint64(n.Next)); err != nil {
-		return err
+	if stop == len(n.Keys) {
+		// 已经不需要扩展页了
+		if n.ExtendPage != INVALID_OFFSET {
+			if err = t.freeExtendNode(n.ExtendPage); err != nil {
+				return err
+			}
+			n.ExtendPage = INVALID_OFFSET
+		}
+		return t.flushNode(n)
 	}
 
-	// Prev
-	if err = binary.Write(bs, binary.LittleEndian, uint64(n.Prev)); err != nil {
-		return err
-	}
+	// 调用者可能在放回内存池之后还在使用节点，这里不从内存池取
+	extend = &Node{}
+	t.initNodeForUsage(extend)
+	extend.PageType = uint8(EXTEND_DATA_PAGE)
+	extend.IsLeaf = true
+	extend.Parent = n.Self
+	extend.Keys = n.Keys[stop:]
+	extend.Records = n.Records[stop:]
+	// 向上取整至数据页大小的整数倍
+	size := 8 + uint64(t.encodeSize(extend, len(extend.Keys)))
+	plus := uint16((size + t.dataPageSize - 1) / t.dataPageSize)
 
-	// Parent
-	if err = binary.Write(bs, binary.LittleEndian, uint64(n.Parent)); err != nil {
-		return err
-	}
-	// IsLeaf
-	if err = binary.Write(bs, binary.LittleEndian, n.IsLeaf); err != nil {
-		return err
-	}
-
-	// 统计针对keys的分割位置
-	stop := 0
-	leftSize := 0
-	lens := len(bs.Bytes())
-	lens += 8 // datalen
-	lens += 1 // keysCount 一个节点最多只能存255个keys
-	lens += 1 // recordsCount
-	for idx := range n.Keys {
-		prev := lens
-		lens += 8 //uint64
-		lens += 4 //record lens int
-		lens += len(n.Records[idx])
-		if lens > int(t.dataPageSize) && stop == 0 {
-			stop = idx
-			leftSize = prev + 8 // ExtendPage
-		}
-	}
-
-	right := lens - leftSize + 1024 // 1024 分给没录的元数据，如Self,Parent等等
-	// 向上取整至 数据页大小的整数倍
-	rightSize := (right + int(t.dataPageSize) - 1) / int(t.dataPageSize) * int(t.dataPageSize)
-	// 倍率
-	plus := uint16(rightSize / int(t.dataPageSize))
 	// 判断原有的扩展页是否能够放下新数据
+	extend.Self = INVALID_OFFSET
 	if n.ExtendPage != INVALID_OFFSET {
-		new_node, err = t.newMappingNodeFromPool(n.ExtendPage)
-		if new_node.PagePlus < plus {
-			// 原来的扩展页空间也不够了
-			t.freeExtendPage(new_node.Self, int(new_node.PagePlus))
-			new_node, err = t.newExtendNodeFromDisk(plus)
+		old := &Node{}
+		if err = t.seekNodePage(old, n.ExtendPage); err != nil {
+			return err
 		}
-	} else {
-		new_node, err = t.newExtendNodeFromDisk(plus)
-		new_node.Parent = n.Self
-		n.ExtendPage = new_node.Self
-	}
-	new_node.Records = n.Records[stop:]
-	new_node.Keys = n.Keys[stop:]
-	defer func() {
-		err = t.flushNode(new_node) //刷新扩展页
-	}()
-	// ExtendPage
-	if err = binary.Write(bs, binary.LittleEndian, n.ExtendPage); err != nil {
-		return err
-	}
-
-	// Keys
-	keysCount := uint8(len(n.Keys[:stop]))
-	if err = binary.Write(bs, binary.LittleEndian, keysCount); err != nil {
-		return err
-	}
-	for _, v := range n.Keys[:stop] {
-		if err = binary.Write(bs, binary.LittleEndian, v); err != nil {
+		if old.PagePlus >= plus {
+			extend.Self = old.Self
+			extend.PagePlus = old.PagePlus
+		} else if err = t.freeExtendNode(old.Self); err != nil {
+			// 原来的扩展页空间也不够了
 			return err
 		}
 	}
+	if extend.Self == INVALID_OFFSET {
+		extend.Self = t.allocExtendPage(plus)
+		extend.PagePlus = plus
+	}
+	n.ExtendPage = extend.Self
 
-	// Record
-	recordCount := uint8(len(n.Records[:stop]))
-	if err = binary.Write(bs, binary.LittleEndian, recordCount); err != nil {
+	//刷新扩展页
+	if err = t.flushNode(extend); err != nil {
 		return err
 	}
-	for _, v := range n.Records[:stop] {
-		if err = binary.Write(bs, binary.LittleEndian, len([]byte(v))); err != nil {
-			return err
-		}
-		if err = binary.Write(bs, binary.LittleEndian, []byte(v)); err != nil {
-			return err
-		}
+	if data, err = t.encodeNode(n, stop); err != nil {
+		return err
 	}
+	return t.writePage(n.Self, data)
+}
 
-	dataLen := len(bs.Bytes())
-	tmpbs := bytes.NewBuffer(make([]byte, 0))
-	if err = binary.Write(tmpbs, binary.LittleEndian, uint64(dataLen)); err != nil {
+// 释放扩展页，并在磁盘上标记为未使用
+func (t *BPlusTree) freeExtendNode(off OFFTYPE) error {
+	node := &Node{}
+	if err := t.seekNodePage(node, off); err != nil {
 		return err
 	}
-	var length int
-	data := append(tmpbs.Bytes(), bs.Bytes()...)
-	if length, err = t.file.WriteAt(data, int64(n.Self)); err != nil {
+	if err := t.markFreePages(off, uint64(node.PagePlus)*t.dataPageSize); err != nil {
 		return err
-	} else if len(data) != length {
-		return fmt.Errorf("writeat %d into %s, expected len = %d but get %d", int64(n.Self), t.file.Name(), len(data), length)
 	}
+	t.freeExtendPage(off, int(node.PagePlus))
 	return nil
 }
 
-// 将Node刷新至磁盘
-func (t *BPlusTree) flushNode(n *Node) error {
-	if n == nil {
-		return fmt.Errorf("flushNode == nil")
-	}
-	if t.file == nil {
-		return fmt.Errorf("flush node into disk, but not open file")
+// 序列化Node前stop个key与记录后的长度，不含开头8字节的长度字段
+func (t *BPlusTree) encodeSize(n *Node, stop int) int {
+	lens := 1 + 1 + 1 + 8*len(n.Children) // IsActive PageType Children
+	lens += 8 * 4                         // Self Next Prev Parent
+	lens += 1 + 8 + 2                     // IsLeaf ExtendPage PagePlus
+	lens += 1 + 1                         // keysCount recordsCount 一个节点最多只能存255个keys
+	keys, records := splitNodeAt(n, stop)
+	lens += 8 * len(keys)
+	for _, v := range records {
+		lens += 4 + len(v)
+	}
+	return lens
+}
+
+// 前stop个key与记录，索引节点没有记录
+func splitNodeAt(n *Node, stop int) ([]uint64, []string) {
+	keys, records := n.Keys, n.Records
+	if stop < len(keys) {
+		keys = keys[:stop]
 	}
-	// 不负责含有扩展页的节点刷新
-	if n.ExtendPage != INVALID_OFFSET {
-		return ErrExceed
+	if stop < len(records) {
+		records = records[:stop]
 	}
-	var (
-		length int
-		err    error
-	)
+	return keys, records
+}
 
-	bs := bytes.NewBuffer(make([]byte, 0))
+// 序列化Node，只写入前stop个key与记录，未使用的节点不写入key
+func (t *BPlusTree) encodeNode(n *Node, stop int) ([]byte, error) {
+	var err error
+	if !n.IsActive {
+		stop = 0
+	}
+	bs := bytes.NewBuffer(make([]byte, 0, 8+t.encodeSize(n, stop)))
+	// 长度字段最后回填
+	bs.Write(make([]byte, 8))
 
 	// IsActive
 	if err = binary.Write(bs, binary.LittleEndian, n.IsActive); err != nil {
-		return nil
+		return nil, err
 	}
 	// PageType
 	if err = binary.Write(bs, binary.LittleEndian, n.PageType); err != nil {
-		return err
+		return nil, err
 	}
 	// Children
-	childCount := uint8(len(n.Children))
+	children := n.Children
+	if !n.IsActive {
+		children = nil
+	}
+	childCount := uint8(len(children))
 	if err = binary.Write(bs, binary.LittleEndian, childCount); err != nil {
-		return err
+		return nil, err
 	}
-	for _, v := range n.Children {
+	for _, v := range children {
 		if err = binary.Write(bs, binary.LittleEndian, uint64(v)); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	// Self
 	if err = binary.Write(bs, binary.LittleEndian, uint64(n.Self)); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Next
 	if err = binary.Write(bs, binary.LittleEndian, uint64(n.Next)); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Prev
 	if err = binary.Write(bs, binary.LittleEndian, uint64(n.Prev)); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Parent
 	if err = binary.Write(bs, binary.LittleEndian, uint64(n.Parent)); err != nil {
-		return err
+		return nil, err
 	}
 	// IsLeaf
 	if err = binary.Write(bs, binary.LittleEndian, n.IsLeaf); err != nil {
-		return err
+		return nil, err
 	}
 	// ExtendPage
-	if err = binary.Write(bs, binary.LittleEndian, n.ExtendPage); err != nil {
-		return err
+	if err = binary.Write(bs, binary.LittleEndian, uint64(n.ExtendPage)); err != nil {
+		return nil, err
+	}
+	// PagePlus
+	if err = binary.Write(bs, binary.LittleEndian, n.PagePlus); err != nil {
+		return nil, err
 	}
 	// Keys
-	keysCount := uint8(len(n.Keys))
+	keys, records := splitNodeAt(n, stop)
+	keysCount := uint8(len(keys))
 	if err = binary.Write(bs, binary.LittleEndian, keysCount); err != nil {
-		return err
+		return nil, err
 	}
-	for _, v := range n.Keys {
+	for _, v := range keys {
 		if err = binary.Write(bs, binary.LittleEndian, v); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	// Record
-	recordCount := uint8(len(n.Records))
+	recordCount := uint8(len(records))
 	if err = binary.Write(bs, binary.LittleEndian, recordCount); err != nil {
-		return err
+		return nil, err
 	}
-	for _, v := range n.Records {
-		if err = binary.Write(bs, binary.LittleEndian, uint8(len([]byte(v)))); err != nil {
-			return err
-		}
-		if err = binary.Write(bs, binary.LittleEndian, []byte(v)); err != nil {
-			return err
+	for _, v := range records {
+		if err = binary.Write(bs, binary.LittleEndian, uint32(len(v))); err != nil {
+			return nil, err
 		}
+		bs.WriteString(v)
 	}
 
-	dataLen := len(bs.Bytes())
-	// 仅对正常的数据页判断是否溢出
-	if uint64(dataLen)+8 > t.dataPageSize && n.PageType == uint8(DATA_PAGE) {
-		return ErrExceed
-		// return fmt.Errorf("flushNode len(node) = %d exceed t.blockSize %d", uint64(dataLen)+4, t.blockSize)
-	}
+	data := bs.Bytes()
+	binary.LittleEndian.PutUint32(data, uint32(len(data)-8))
+	binary.LittleEndian.PutUint32(data[4:], common.GetCrc32(data[8:]))
+	return data, nil
+}
 
-	tmpbs := bytes.NewBuffer(make([]byte, 0))
-	if err = binary.Write(tmpbs, binary.LittleEndian, uint64(dataLen)); err != nil {
+func (t *BPlusTree) writePage(off OFFTYPE, data []byte) error {
+	if err := t.cow.preserve(t.file, int64(off), len(data), t.indexPageSize); err != nil {
 		return err
 	}
-
-	data := append(tmpbs.Bytes(), bs.Bytes()...)
-	if length, err = t.file.WriteAt(data, int64(n.Self)); err != nil {
+	if length, err := t.file.WriteAt(data, int64(off)); err != nil {
 		return err
 	} else if len(data) != length {
-		return fmt.Errorf("writeat %d into %s, expected len = %d but get %d", int64(n.Self), t.file.Name(), len(data), length)
+		return fmt.Errorf("writeat %d into %s, expected len = %d but get %d", int64(off), t.file.Name(), len(data), length)
 	}
 	return nil
 }
 
+// 将Node刷新至磁盘
+func (t *BPlusTree) flushNode(n *Node) error {
+	if n == nil {
+		return fmt.Errorf("flushNode == nil")
+	}
+	if t.file == nil {
+		return fmt.Errorf("flush node into disk, but not open file")
+	}
+	// 不负责含有扩展页的节点刷新
+	if n.ExtendPage != INVALID_OFFSET && n.IsActive {
+		return ErrExceed
+	}
+
+	data, err := t.encodeNode(n, len(n.Keys))
+	if err != nil {
+		return err
+	}
+	// 仅对正常的数据页判断是否溢出
+	switch n.PageType {
+	case uint8(DATA_PAGE):
+		if uint64(len(data)) > t.dataPageSize && n.IsActive {
+			return ErrExceed
+		}
+	case uint8(EXTEND_DATA_PAGE):
+		if uint64(len(data)) > uint64(n.PagePlus)*t.dataPageSize {
+			return fmt.Errorf("flushNode len(node) = %d exceed extend page %d", len(data), uint64(n.PagePlus)*t.dataPageSize)
+		}
+	}
+	return t.writePage(n.Self, data)
+}
+
 // 如果指定off为非法值，则返回一个空的Node对象，如果off不是非法值。则从磁盘读取这个Node
 func (t *BPlusTree) newMappingNodeFromPool(off OFFTYPE) (*Node, error) {
 	node := t.nodePool.Get().(*Node)
@@ -1016,6 +1059,12 @@ func (t *BPlusTree) putFreeBlocks(n *Node) {
 	if len(t.freeBlocks) >= MAX_FREEBLOCKS {
 		return
 	}
+	if n.ExtendPage != INVALID_OFFSET {
+		// 叶子的扩展页随叶子一起释放
+		t.freeExtendNode(n.ExtendPage)
+		n.ExtendPage = INVALID_OFFSET
+	}
+	t.markFreePages(n.Self, t.pageSpan(&Node{IsActive: true, PageType: n.PageType, PagePlus: n.PagePlus}))
 	if n.PageType == uint8(EXTEND_DATA_PAGE) {
 		t.freeExtendPage(n.Self, int(n.PagePlus))
 	} else {
@@ -1023,14 +1072,21 @@ func (t *BPlusTree) putFreeBlocks(n *Node) {
 	}
 }
 
+// 查找key对应的记录，key不存在时返回NotFoundKey，空树也一样
 func (t *BPlusTree) Find(key uint64) (string, error) {
+	rt := t.beginRead()
+	defer t.endRead(rt)
+	return rt.find(key)
+}
+
+func (t *BPlusTree) find(key uint64) (string, error) {
 	var (
 		node *Node
 		err  error
 	)
 
 	if t.rootOff == INVALID_OFFSET {
-		return "", nil
+		return "", NotFoundKey
 	}
 
 	if node, err = t.newMappingNodeFromPool(INVALID_OFFSET); err != nil {
@@ -1179,12 +1235,12 @@ func (t *BPlusTree) splitLeafIntoTowleaves(leaf *Node, new_leaf *Node) error {
 			return err
 		}
 		nextNode.Prev = new_leaf.Self
-		if err = t.flushNodesAndPutNodesPool(nextNode); err != nil {
+		if err = t.writeNodes(nextNode); err != nil {
 			return err
 		}
 	}
 
-	return err
+	return nil
 }
 
 func (t *BPlusTree) insertIntoLeaf(key uint64, rec string) error {
@@ -1216,7 +1272,7 @@ func (t *BPlusTree) insertIntoLeaf(key uint64, rec string) error {
 	// insert key/val into leaf
 	// 如果叶子节点小于当前b树的阶数
 	if len(leaf.Keys) <= order {
-		return t.flushNodeAndPutNodePool(leaf)
+		return t.writeNode(leaf)
 	}
 	// 叶子节点已满，执行分裂逻辑
 	// split leaf so new leaf node
@@ -1228,7 +1284,7 @@ func (t *BPlusTree) insertIntoLeaf(key uint64, rec string) error {
 		return err
 	}
 	//将改动持久化到磁盘中
-	if err = t.flushNodesAndPutNodesPool(new_leaf, leaf); err != nil {
+	if err = t.writeNodes(new_leaf, leaf); err != nil {
 		return err
 	}
 
@@ -1287,7 +1343,7 @@ func (t *BPlusTree) insertIntoNodeAfterSplitting(old_node *Node) error {
 			return err
 		}
 		child.Parent = newNode.Self
-		if err = t.flushNodesAndPutNodesPool(child); err != nil {
+		if err = t.writeNodes(child); err != nil {
 			return err
 		}
 	}
@@ -1306,12 +1362,12 @@ func (t *BPlusTree) insertIntoNodeAfterSplitting(old_node *Node) error {
 			return err
 		}
 		nextNode.Prev = newNode.Self
-		if err = t.flushNodesAndPutNodesPool(nextNode); err != nil {
+		if err = t.writeNodes(nextNode); err != nil {
 			return err
 		}
 	}
 
-	if err = t.flushNodesAndPutNodesPool(old_node, newNode); err != nil {
+	if err = t.writeNodes(old_node, newNode); err != nil {
 		return err
 	}
 	//只要有分裂出现，都需要调整原始节点的父节点的相关数据
@@ -1339,7 +1395,7 @@ func (t *BPlusTree) insertIntoParent(parent_off OFFTYPE, left_off OFFTYPE, key u
 		if err = t.newRootNode(left, right); err != nil {
 			return err
 		}
-		return t.flushNodesAndPutNodesPool(left, right)
+		return t.writeNodes(left, right)
 	}
 
 	if parent, err = t.newMappingNodeFromPool(parent_off); err != nil {
@@ -1350,7 +1406,7 @@ func (t *BPlusTree) insertIntoParent(parent_off OFFTYPE, left_off OFFTYPE, key u
 	insertIntoNode(parent, idx, left_off, key, right_off)
 
 	if len(parent.Keys) <= order {
-		return t.flushNodesAndPutNodesPool(parent)
+		return t.writeNodes(parent)
 	}
 	// 如果索引节点也满了
 	return t.insertIntoNodeAfterSplitting(parent)
@@ -1373,11 +1429,13 @@ func (t *BPlusTree) newRootNode(left *Node, right *Node) error {
 	right.Parent = root.Self
 
 	t.rootOff = root.Self
-	return t.flushNodeAndPutNodePool(root)
+	return t.writeNode(root)
 }
 
 // InsertOrUpdateWhat! c return the newval @bool = true insert, = false update
 func (t *BPlusTree) InsertOrUpdateWhat(key uint64, c func(bool, string) string) error {
+	t.beginWrite()
+	defer t.endWrite()
 	var (
 		node *Node
 		err  error
@@ -1396,7 +1454,7 @@ func (t *BPlusTree) InsertOrUpdateWhat(key uint64, c func(bool, string) string)
 		node.Keys = append(node.Keys, key)
 		node.Records = append(node.Records, c(true, ""))
 		node.IsLeaf = true
-		return t.flushNodeAndPutNodePool(node)
+		return t.writeNode(node)
 	}
 
 	if node, err = t.newMappingNodeFromPool(INVALID_OFFSET); err != nil {
@@ -1410,7 +1468,7 @@ func (t *BPlusTree) InsertOrUpdateWhat(key uint64, c func(bool, string) string)
 	for i, nkey := range node.Keys {
 		if nkey == key {
 			node.Records[i] = c(false, node.Records[i])
-			return t.flushNodesAndPutNodesPool(node)
+			return t.writeNodes(node)
 		}
 	}
 
@@ -1431,7 +1489,7 @@ func (t *BPlusTree) InsertOrUpdateWhat(key uint64, c func(bool, string) string)
 	// insert key/val into leaf
 	// 如果叶子节点小于当前b树的阶数
 	if len(leaf.Keys) <= order {
-		return t.flushNodeAndPutNodePool(leaf)
+		return t.writeNode(leaf)
 	}
 	var new_leaf *Node
 	// 叶子节点已满，执行分裂逻辑
@@ -1444,7 +1502,7 @@ func (t *BPlusTree) InsertOrUpdateWhat(key uint64, c func(bool, string) string)
 		return err
 	}
 	//将改动持久化到磁盘中
-	if err = t.flushNodesAndPutNodesPool(new_leaf, leaf); err != nil {
+	if err = t.writeNodes(new_leaf, leaf); err != nil {
 		return err
 	}
 
@@ -1453,6 +1511,8 @@ func (t *BPlusTree) InsertOrUpdateWhat(key uint64, c func(bool, string) string)
 	return t.insertIntoParent(leaf.Parent, leaf.Self, leaf.Keys[len(leaf.Keys)-1], new_leaf.Self)
 }
 func (t *BPlusTree) InsertOrUpdate(key uint64, val string) error {
+	t.beginWrite()
+	defer t.endWrite()
 	var (
 		node *Node
 		err  error
@@ -1468,7 +1528,7 @@ func (t *BPlusTree) InsertOrUpdate(key uint64, val string) error {
 		node.Keys = append(node.Keys, key)
 		node.Records = append(node.Records, val)
 		node.IsLeaf = true
-		return t.flushNodeAndPutNodePool(node)
+		return t.writeNode(node)
 	}
 
 	if node, err = t.newMappingNodeFromPool(INVALID_OFFSET); err != nil {
@@ -1482,7 +1542,7 @@ func (t *BPlusTree) InsertOrUpdate(key uint64, val string) error {
 	for i, nkey := range node.Keys {
 		if nkey == key {
 			node.Records[i] = val
-			return t.flushNodesAndPutNodesPool(node)
+			return t.writeNodes(node)
 		}
 	}
 
@@ -1503,7 +1563,7 @@ func (t *BPlusTree) InsertOrUpdate(key uint64, val string) error {
 	// insert key/val into leaf
 	// 如果叶子节点小于当前b树的阶数
 	if len(leaf.Keys) <= order {
-		return t.flushNodeAndPutNodePool(leaf)
+		return t.writeNode(leaf)
 	}
 	var new_leaf *Node
 	// 叶子节点已满，执行分裂逻辑
@@ -1516,7 +1576,7 @@ func (t *BPlusTree) InsertOrUpdate(key uint64, val string) error {
 		return err
 	}
 	//将改动持久化到磁盘中
-	if err = t.flushNodesAndPutNodesPool(new_leaf, leaf); err != nil {
+	if err = t.writeNodes(new_leaf, leaf); err != nil {
 		return err
 	}
 
@@ -1526,6 +1586,8 @@ func (t *BPlusTree) InsertOrUpdate(key uint64, val string) error {
 
 }
 func (t *BPlusTree) Insert(key uint64, val string) error {
+	t.beginWrite()
+	defer t.endWrite()
 	var (
 		err  error
 		node *Node
@@ -1541,13 +1603,15 @@ func (t *BPlusTree) Insert(key uint64, val string) error {
 		node.Keys = append(node.Keys, key)
 		node.Records = append(node.Records, val)
 		node.IsLeaf = true
-		return t.flushNodeAndPutNodePool(node)
+		return t.writeNode(node)
 	}
 
 	return t.insertIntoLeaf(key, val)
 }
 
 func (t *BPlusTree) Update(key uint64, val string) error {
+	t.beginWrite()
+	defer t.endWrite()
 	var (
 		node *Node
 		err  error
@@ -1568,7 +1632,7 @@ func (t *BPlusTree) Update(key uint64, val string) error {
 	for i, nkey := range node.Keys {
 		if nkey == key {
 			node.Records[i] = val
-			return t.flushNodesAndPutNodesPool(node)
+			return t.writeNodes(node)
 		}
 	}
 	return NotFoundKey
@@ -1584,6 +1648,7 @@ func (t *BPlusTree) mayUpdatedLastParentKey(leaf *Node, idx int) error {
 		var (
 			updateNode *Node
 			node       *Node
+			err        error
 		)
 		//这里重新加载了一次节点，因为改动不想在leaf身上？
 		if node, err = t.newMappingNodeFromPool(leaf.Self); err != nil {
@@ -1603,7 +1668,7 @@ func (t *BPlusTree) mayUpdatedLastParentKey(leaf *Node, idx int) error {
 				}
 			}
 			updateNode.Keys[idx] = key
-			if err = t.flushNodeAndPutNodePool(updateNode); err != nil {
+			if err = t.writeNode(updateNode); err != nil {
 				return err
 			}
 			updateNodeOff = updateNode.Parent
@@ -1613,306 +1678,228 @@ func (t *BPlusTree) mayUpdatedLastParentKey(leaf *Node, idx int) error {
 	return nil
 }
 
-// 因删除 改动索引结点的children指向
-func (t *BPlusTree) deleteKeyFromNode(off OFFTYPE, key uint64) error {
-	if off == INVALID_OFFSET {
-		return nil
+// 读取off处的节点，不使用内存池，删除时同时持有多个节点
+func (t *BPlusTree) loadNode(off OFFTYPE) (*Node, error) {
+	node := &Node{}
+	if err := t.seekNode(node, off); err != nil {
+		return nil, err
 	}
-	var (
-		node      *Node
-		nextNode  *Node
-		prevNode  *Node
-		newRoot   *Node
-		childNode *Node
-		idx       int
-		err       error
-	)
-	if node, err = t.newMappingNodeFromPool(off); err != nil {
-		return err
+	return node, nil
+}
+
+func childIndex(parent *Node, child OFFTYPE) int {
+	for i, v := range parent.Children {
+		if v == child {
+			return i
+		}
 	}
-	idx = getIndex(node.Keys, key)
-	removeKeyFromNode(node, idx)
+	return -1
+}
 
-	// update the last key of parent's if necessary
-	// 先执行更新父节点的lastKey
-	if idx == len(node.Keys) {
-		if err = t.mayUpdatedLastParentKey(node, idx-1); err != nil {
+// n的最大key变小后沿父节点向上更新，n是父节点最后一个孩子时继续向上
+func (t *BPlusTree) updateParentKey(n *Node) error {
+	key := n.Keys[len(n.Keys)-1]
+	child, off := n.Self, n.Parent
+	for off != INVALID_OFFSET {
+		parent, err := t.loadNode(off)
+		if err != nil {
+			return err
+		}
+		idx := childIndex(parent, child)
+		if idx < 0 {
+			return fmt.Errorf("%w: %d is not a child of %d", InvalidDBFormat, child, off)
+		}
+		parent.Keys[idx] = key
+		if err = t.writeNode(parent); err != nil {
 			return err
 		}
+		if idx != len(parent.Children)-1 {
+			return nil
+		}
+		child, off = parent.Self, parent.Parent
 	}
+	return nil
+}
+
+// 把src的第idx项移动到dst的末尾(append)或开头，索引节点需要更新孩子的Parent
+func (t *BPlusTree) moveItem(dst *Node, src *Node, idx int, append_ bool) error {
+	key := src.Keys[idx]
+	if dst.IsLeaf {
+		rec := src.Records[idx]
+		removeKeyFromLeaf(src, idx)
+		if append_ {
+			dst.Keys = append(dst.Keys, key)
+			dst.Records = append(dst.Records, rec)
+		} else {
+			dst.Keys = append([]uint64{key}, dst.Keys...)
+			dst.Records = append([]string{rec}, dst.Records...)
+		}
+		return nil
+	}
+	child := src.Children[idx]
+	removeKeyFromNode(src, idx)
+	if append_ {
+		dst.Keys = append(dst.Keys, key)
+		dst.Children = append(dst.Children, child)
+	} else {
+		dst.Keys = append([]uint64{key}, dst.Keys...)
+		dst.Children = append([]OFFTYPE{child}, dst.Children...)
+	}
+	return t.setParent(child, dst.Self)
+}
 
-	// if statisfied len
-	if len(node.Keys) >= order/2 {
-		return t.flushNodesAndPutNodesPool(node)
+func (t *BPlusTree) setParent(off OFFTYPE, parent OFFTYPE) error {
+	child, err := t.loadNode(off)
+	if err != nil {
+		return err
 	}
+	child.Parent = parent
+	return t.writeNode(child)
+}
 
-	if off == t.rootOff && len(node.Keys) == 1 {
-		if newRoot, err = t.newMappingNodeFromPool(node.Children[0]); err != nil {
+// 把right合并到left，修正同一层的链表并释放right
+func (t *BPlusTree) mergeNodes(left *Node, right *Node) error {
+	for len(right.Keys) > 0 {
+		if err := t.moveItem(left, right, 0, true); err != nil {
 			return err
 		}
-		node.IsActive = false
-		newRoot.Parent = INVALID_OFFSET
-		t.rootOff = newRoot.Self
-		return t.flushNodesAndPutNodesPool(node, newRoot)
 	}
-
-	if node.Next != INVALID_OFFSET {
-		if nextNode, err = t.newMappingNodeFromPool(node.Next); err != nil {
+	left.Next = right.Next
+	if right.Next != INVALID_OFFSET {
+		next, err := t.loadNode(right.Next)
+		if err != nil {
+			return err
+		}
+		next.Prev = left.Self
+		if err = t.writeNode(next); err != nil {
 			return err
 		}
-		// lease from next node
-		if len(nextNode.Keys) > order/2 {
-			key := nextNode.Keys[0]
-			child := nextNode.Children[0]
+	}
+	right.IsActive = false
+	t.putFreeBlocks(right)
+	return nil
+}
 
-			// update child's parent
-			if childNode, err = t.newMappingNodeFromPool(child); err != nil {
-				return err
+// 删除后节点n可能不足order/2，向同一父节点下的兄弟借一项，兄弟也不够时合并，合并可能向上传递
+func (t *BPlusTree) rebalanceAfterDelete(n *Node) error {
+	for {
+		if n.Self == t.rootOff {
+			if n.IsLeaf && len(n.Keys) == 0 {
+				// 删空了整棵树，先落盘为无效页，避免重新打开时被当作根
+				t.rootOff = INVALID_OFFSET
+				n.IsActive = false
+				if err := t.writeNode(n); err != nil {
+					return err
+				}
+				t.putFreeBlocks(n)
+				return nil
 			}
-			childNode.Parent = node.Self
-
-			removeKeyFromNode(nextNode, 0)
-			if idx, err = insertKeyValIntoNode(node, key, child); err != nil {
-				return err
+			if n.IsLeaf || len(n.Children) != 1 {
+				return t.writeNode(n)
 			}
-			// update the last key of parent's if necessy
-			if err = t.mayUpdatedLastParentKey(node, idx); err != nil {
+			// 根只剩一个孩子，孩子成为新的根
+			if err := t.setParent(n.Children[0], INVALID_OFFSET); err != nil {
 				return err
 			}
-			return t.flushNodesAndPutNodesPool(node, nextNode, childNode)
+			t.rootOff = n.Children[0]
+			n.IsActive = false
+			t.putFreeBlocks(n)
+			return nil
 		}
-		// merge nextNode and curNode
-		if node.Prev != INVALID_OFFSET {
-			if prevNode, err = t.newMappingNodeFromPool(node.Prev); err != nil {
-				return err
-			}
-			prevNode.Next = nextNode.Self
-			nextNode.Prev = prevNode.Self
-			if err = t.flushNodesAndPutNodesPool(prevNode); err != nil {
-				return err
-			}
-		} else {
-			nextNode.Prev = INVALID_OFFSET
-		}
-
-		nextNode.Keys = append(node.Keys, nextNode.Keys...)
-		nextNode.Children = append(node.Children, nextNode.Children...)
-
-		// update child's parent
-		for _, v := range node.Children {
-			if childNode, err = t.newMappingNodeFromPool(v); err != nil {
-				return err
-			}
-			childNode.Parent = nextNode.Self
-			if err = t.flushNodesAndPutNodesPool(childNode); err != nil {
-				return err
-			}
+		if len(n.Keys) >= order/2 {
+			return t.writeNode(n)
 		}
 
-		node.IsActive = false
-		t.putFreeBlocks(node)
-
-		if err = t.flushNodesAndPutNodesPool(node, nextNode); err != nil {
+		parent, err := t.loadNode(n.Parent)
+		if err != nil {
 			return err
 		}
-
-		// delete parent's key recursively
-		return t.deleteKeyFromNode(node.Parent, node.Keys[len(node.Keys)-1])
-	}
-
-	// come here because node.Next = INVALID_OFFSET
-	if node.Prev != INVALID_OFFSET {
-		if prevNode, err = t.newMappingNodeFromPool(node.Prev); err != nil {
-			return err
+		idx := childIndex(parent, n.Self)
+		if idx < 0 {
+			return fmt.Errorf("%w: %d is not a child of %d", InvalidDBFormat, n.Self, n.Parent)
 		}
-		// lease from prev leaf
-		if len(prevNode.Keys) > order/2 {
-			key := prevNode.Keys[len(prevNode.Keys)-1]
-			child := prevNode.Children[len(prevNode.Children)-1]
-
-			// update child's parent
-			if childNode, err = t.newMappingNodeFromPool(child); err != nil {
-				return err
-			}
-			childNode.Parent = node.Self
-
-			removeKeyFromNode(prevNode, len(prevNode.Keys)-1)
-			if idx, err = insertKeyValIntoNode(node, key, child); err != nil {
+		var (
+			left, right *Node
+			li          int
+		)
+		if idx+1 < len(parent.Children) {
+			li, left = idx, n
+			if right, err = t.loadNode(parent.Children[idx+1]); err != nil {
 				return err
 			}
-			// update the last key of parent's if necessy
-			if err = t.mayUpdatedLastParentKey(prevNode, len(prevNode.Keys)-1); err != nil {
+		} else if idx > 0 {
+			li, right = idx-1, n
+			if left, err = t.loadNode(parent.Children[idx-1]); err != nil {
 				return err
 			}
-			return t.flushNodesAndPutNodesPool(prevNode, node, childNode)
+		} else {
+			// 非根节点只有一个孩子，不会出现
+			return t.writeNode(n)
 		}
-		// merge prevNode and curNode
-		prevNode.Next = INVALID_OFFSET
-		prevNode.Keys = append(prevNode.Keys, node.Keys...)
-		prevNode.Children = append(prevNode.Children, node.Children...)
 
-		// update child's parent
-		for _, v := range node.Children {
-			if childNode, err = t.newMappingNodeFromPool(v); err != nil {
+		// lease from sibling
+		if left == n && len(right.Keys) > order/2 {
+			err = t.moveItem(left, right, 0, true)
+		} else if right == n && len(left.Keys) > order/2 {
+			err = t.moveItem(right, left, len(left.Keys)-1, false)
+		} else {
+			// merge right into left
+			if err = t.mergeNodes(left, right); err != nil {
 				return err
 			}
-			childNode.Parent = prevNode.Self
-			if err = t.flushNodesAndPutNodesPool(childNode); err != nil {
+			parent.Keys[li] = left.Keys[len(left.Keys)-1]
+			removeKeyFromNode(parent, li+1)
+			if err = t.writeNode(left); err != nil {
 				return err
 			}
+			n = parent
+			continue
 		}
-
-		node.IsActive = false
-		t.putFreeBlocks(node)
-
-		if err = t.flushNodesAndPutNodesPool(node, prevNode); err != nil {
+		if err != nil {
 			return err
 		}
-
-		return t.deleteKeyFromNode(node.Parent, node.Keys[len(node.Keys)-2])
+		parent.Keys[li] = left.Keys[len(left.Keys)-1]
+		return t.writeNodes(left, right, parent)
 	}
-	return nil
 }
 
 // 删除叶子节点的逻辑
 func (t *BPlusTree) deleteKeyFromLeaf(key uint64) error {
-	var (
-		leaf     *Node
-		prevLeaf *Node
-		nextLeaf *Node
-		err      error
-		idx      int
-	)
-	if leaf, err = t.newMappingNodeFromPool(INVALID_OFFSET); err != nil {
-		return err
-	}
-
-	if err = t.findLeaf(leaf, key); err != nil {
+	leaf := &Node{}
+	if err := t.findLeaf(leaf, key); err != nil {
 		return err
 	}
-
-	idx = getIndex(leaf.Keys, key)
+	idx := getIndex(leaf.Keys, key)
 	if idx == len(leaf.Keys) || leaf.Keys[idx] != key {
-		t.putNodePool(leaf)
-		return fmt.Errorf("not found key:%d", key)
-
+		return NotFoundKey
 	}
-	// 删除key
 	removeKeyFromLeaf(leaf, idx)
 
-	// if leaf is root
-	// 如果是叶子节点是根节点直接返回
-	if leaf.Self == t.rootOff {
-		return t.flushNodesAndPutNodesPool(leaf)
-	}
-
-	// update the last key of parent's if necessary
-	// 如果删除的是leaf的最后一个节点，
-	// !BUG-FIX
-	if idx == len(leaf.Keys) {
-		if err = t.mayUpdatedLastParentKey(leaf, idx-1); err != nil {
-			return err
-		}
-	}
-
-	// if satisfied len
-	if len(leaf.Keys) >= order/2 {
-		return t.flushNodesAndPutNodesPool(leaf)
-	}
-
-	if leaf.Next != INVALID_OFFSET {
-		if nextLeaf, err = t.newMappingNodeFromPool(leaf.Next); err != nil {
-			return err
-		}
-		// lease from next leaf
-		// 下一个节点有多余的节点,移动一个到本节点
-		if len(nextLeaf.Keys) > order/2 {
-			key := nextLeaf.Keys[0]
-			rec := nextLeaf.Records[0]
-			removeKeyFromLeaf(nextLeaf, 0)
-			if idx, err = insertKeyValIntoLeaf(leaf, key, rec); err != nil {
-				return err
-			}
-			// update the last key of parent's if necessy
-			if err = t.mayUpdatedLastParentKey(leaf, idx); err != nil {
-				return err
-			}
-			return t.flushNodesAndPutNodesPool(nextLeaf, leaf)
-		}
-		// 如果下一个节点没有多余的节点，将当前节点和下一个节点合并成一个节点
-		// merge nextLeaf and curleaf
-		if leaf.Prev != INVALID_OFFSET {
-			if prevLeaf, err = t.newMappingNodeFromPool(leaf.Prev); err != nil {
-				return err
-			}
-			prevLeaf.Next = nextLeaf.Self
-			nextLeaf.Prev = prevLeaf.Self
-			if err = t.flushNodesAndPutNodesPool(prevLeaf); err != nil {
-				return err
-			}
-		} else {
-			// 当前节点是首节点,将下一个节点选为首结点
-			nextLeaf.Prev = INVALID_OFFSET
-		}
-
-		nextLeaf.Keys = append(leaf.Keys, nextLeaf.Keys...)
-		nextLeaf.Records = append(leaf.Records, nextLeaf.Records...)
-
-		leaf.IsActive = false
-		t.putFreeBlocks(leaf)
-
-		if err = t.flushNodesAndPutNodesPool(leaf, nextLeaf); err != nil {
-			return err
-		}
-
-		return t.deleteKeyFromNode(leaf.Parent, leaf.Keys[len(leaf.Keys)-1])
-	}
-
-	// come here because leaf.Next = INVALID_OFFSET
-	if leaf.Prev != INVALID_OFFSET {
-		if prevLeaf, err = t.newMappingNodeFromPool(leaf.Prev); err != nil {
-			return err
-		}
-		// lease from prev leaf
-		if len(prevLeaf.Keys) > order/2 {
-			key := prevLeaf.Keys[len(prevLeaf.Keys)-1]
-			rec := prevLeaf.Records[len(prevLeaf.Records)-1]
-			removeKeyFromLeaf(prevLeaf, len(prevLeaf.Keys)-1)
-			if idx, err = insertKeyValIntoLeaf(leaf, key, rec); err != nil {
-				return err
-			}
-			// update the last key of parent's if necessy
-			if err = t.mayUpdatedLastParentKey(prevLeaf, len(prevLeaf.Keys)-1); err != nil {
-				return err
-			}
-			return t.flushNodesAndPutNodesPool(prevLeaf, leaf)
-		}
-		// merge prevleaf and curleaf
-		prevLeaf.Next = INVALID_OFFSET
-		prevLeaf.Keys = append(prevLeaf.Keys, leaf.Keys...)
-		prevLeaf.Records = append(prevLeaf.Records, leaf.Records...)
-
-		leaf.IsActive = false
-		t.putFreeBlocks(leaf)
-
-		if err = t.flushNodesAndPutNodesPool(leaf, prevLeaf); err != nil {
+	// 删除的是最后一个key，父节点上记录的最大key需要更新
+	if leaf.Self != t.rootOff && idx == len(leaf.Keys) && len(leaf.Keys) > 0 {
+		if err := t.updateParentKey(leaf); err != nil {
 			return err
 		}
-
-		return t.deleteKeyFromNode(leaf.Parent, leaf.Keys[len(leaf.Keys)-2])
 	}
-
-	return nil
+	return t.rebalanceAfterDelete(leaf)
 }
 
 func (t *BPlusTree) Delete(key uint64) error {
+	t.beginWrite()
+	defer t.endWrite()
 	if t.rootOff == INVALID_OFFSET {
-		return fmt.Errorf("not found key:%d", key)
+		return NotFoundKey
 	}
 	return t.deleteKeyFromLeaf(key)
 }
 
 func (t *BPlusTree) DebugBPlusTreePrint() error {
+	rt := t.beginRead()
+	defer t.endRead(rt)
+	return rt.debugPrint()
+}
+
+func (t *BPlusTree) debugPrint() error {
 	if t.rootOff == INVALID_OFFSET {
 		return fmt.Errorf("root = nil")
 	}
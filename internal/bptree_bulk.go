@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	ErrBulkLoadNotEmpty = errors.New("bulk load into non-empty tree")
+	ErrBulkLoadUnsorted = errors.New("bulk load keys should be strictly increasing")
+)
+
+var (
+	BULK_FILL_FACTOR = 0.75 // 批量构建时每个节点的填充率
+)
+
+// 自底向上批量构建B+树，输入按key严格递增
+// 每层只保留正在填充的节点和上一个节点，上一个节点在下一个节点填满时才写入磁盘，
+// 以便结束时把最后一个节点补足到order/2
+type BulkLoader struct {
+	t      *BPlusTree
+	per    int // 每个节点的key个数
+	levels []*bulkLevel
+	last   uint64
+	count  int
+	err    error
+}
+
+type bulkLevel struct {
+	prev  *Node
+	cur   *Node
+	nodes int
+}
+
+// fill为节点填充率，<=0时使用BULK_FILL_FACTOR，只能用于空树，构建期间不能有其他写入
+func (t *BPlusTree) NewBulkLoader(fill float64) (*BulkLoader, error) {
+	if !t.Empty() {
+		return nil, ErrBulkLoadNotEmpty
+	}
+	if fill <= 0 {
+		fill = BULK_FILL_FACTOR
+	}
+	// 至少order/2+1个，保证最后一个节点可以从上一个节点借到足够的key
+	per := int(float64(order)*fill + 0.5)
+	if per < order/2+1 {
+		per = order/2 + 1
+	}
+	if per > order {
+		per = order
+	}
+	return &BulkLoader{
+		t:   t,
+		per: per,
+	}, nil
+}
+
+func (bl *BulkLoader) Add(key uint64, val string) error {
+	if bl.err != nil {
+		return bl.err
+	}
+	bl.t.beginWrite()
+	defer bl.t.endWrite()
+	if bl.count > 0 && key <= bl.last {
+		return fmt.Errorf("%w: %d after %d", ErrBulkLoadUnsorted, key, bl.last)
+	}
+	bl.last = key
+	bl.count++
+	if _, err := bl.add(0, key, val, INVALID_OFFSET); err != nil {
+		bl.err = err
+		return err
+	}
+	return nil
+}
+
+func (bl *BulkLoader) newNode(level int) (*Node, error) {
+	if level == 0 {
+		return bl.t.newDataNodeFromDisk()
+	}
+	return bl.t.newIndexNodeFromDisk()
+}
+
+// 向第level层追加一项，叶子追加记录，索引节点追加孩子，返回所在节点的偏移
+func (bl *BulkLoader) add(level int, key uint64, val string, child OFFTYPE) (OFFTYPE, error) {
+	if level == len(bl.levels) {
+		bl.levels = append(bl.levels, &bulkLevel{})
+	}
+	lv := bl.levels[level]
+	if lv.cur == nil {
+		node, err := bl.newNode(level)
+		if err != nil {
+			return INVALID_OFFSET, err
+		}
+		lv.cur = node
+		lv.nodes++
+	} else if len(lv.cur.Keys) == bl.per {
+		node, err := bl.newNode(level)
+		if err != nil {
+			return INVALID_OFFSET, err
+		}
+		lv.cur.Next = node.Self
+		node.Prev = lv.cur.Self
+		if lv.prev != nil {
+			if err = bl.emit(level, lv.prev); err != nil {
+				return INVALID_OFFSET, err
+			}
+		}
+		lv.prev = lv.cur
+		lv.cur = node
+		lv.nodes++
+	}
+	lv.cur.Keys = append(lv.cur.Keys, key)
+	if level == 0 {
+		lv.cur.Records = append(lv.cur.Records, val)
+	} else {
+		lv.cur.Children = append(lv.cur.Children, child)
+	}
+	return lv.cur.Self, nil
+}
+
+// 节点已经确定，加入上一层并写入磁盘
+func (bl *BulkLoader) emit(level int, n *Node) error {
+	parent, err := bl.add(level+1, n.Keys[len(n.Keys)-1], "", n.Self)
+	if err != nil {
+		return err
+	}
+	n.Parent = parent
+	return bl.t.writeNode(n)
+}
+
+// 最后一个节点不足order/2时从上一个节点借，索引节点需要更新借来的孩子的Parent
+func (bl *BulkLoader) rebalance(level int, prev *Node, cur *Node) error {
+	total := len(prev.Keys) + len(cur.Keys)
+	if len(cur.Keys) >= order/2 {
+		return nil
+	}
+	split := total - total/2
+	moved := len(prev.Keys) - split
+	cur.Keys = append(append([]uint64{}, prev.Keys[split:]...), cur.Keys...)
+	prev.Keys = prev.Keys[:split]
+	if level == 0 {
+		cur.Records = append(append([]string{}, prev.Records[split:]...), cur.Records...)
+		prev.Records = prev.Records[:split]
+		return nil
+	}
+	cur.Children = append(append([]OFFTYPE{}, prev.Children[split:]...), cur.Children...)
+	prev.Children = prev.Children[:split]
+	for _, v := range cur.Children[:moved] {
+		child, err := bl.t.newMappingNodeFromPool(v)
+		if err != nil {
+			return err
+		}
+		child.Parent = cur.Self
+		if err = bl.t.writeNode(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 写入剩余的节点，确定根节点
+func (bl *BulkLoader) Finish() error {
+	if bl.err != nil {
+		return bl.err
+	}
+	bl.t.beginWrite()
+	defer bl.t.endWrite()
+	for level := 0; level < len(bl.levels); level++ {
+		lv := bl.levels[level]
+		if lv.nodes == 1 {
+			// 只有一个节点的层就是根
+			lv.cur.Parent = INVALID_OFFSET
+			bl.t.rootOff = lv.cur.Self
+			return bl.t.writeNode(lv.cur)
+		}
+		if err := bl.rebalance(level, lv.prev, lv.cur); err != nil {
+			return err
+		}
+		if err := bl.emit(level, lv.prev); err != nil {
+			return err
+		}
+		if err := bl.emit(level, lv.cur); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 批量写入的记录数
+func (bl *BulkLoader) Count() int {
+	return bl.count
+}
+
+// 按key顺序重写整棵树，回收删除留下的空洞并让叶子按顺序排列
+func (t *BPlusTree) Compact() error {
+	t.wlock.Lock()
+	defer t.wlock.Unlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.rewrite(func(add func(uint64, string) error) error {
+		c := t.Cursor()
+		defer c.Close()
+		// 持有写者锁，直接读取磁盘
+		c.r = t
+		for ok := c.edge(false); ok; ok = c.next() {
+			if err := add(c.Key(), c.Value()); err != nil {
+				return err
+			}
+		}
+		return c.Err()
+	})
+}
+
+// 把each按key升序给出的记录批量写入新文件，再替换原文件，调用方持有写者锁与写锁
+func (t *BPlusTree) rewrite(each func(add func(uint64, string) error) error) error {
+	tmp := t.path + ".compact"
+	os.Remove(tmp)
+	nt, err := NewBPlusTree(tmp)
+	if err != nil {
+		return err
+	}
+	bl, err := nt.NewBulkLoader(0)
+	if err != nil {
+		nt.Close()
+		return err
+	}
+	err = each(bl.Add)
+	if err == nil {
+		err = bl.Finish()
+	}
+	if cerr := nt.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	t.close()
+	if err = os.Rename(tmp, t.path); err != nil {
+		return err
+	}
+	if nt, err = NewBPlusTree(t.path); err != nil {
+		return err
+	}
+	t.rootOff, t.file, t.fileSize = nt.rootOff, nt.file, nt.fileSize
+	t.freeBlocks, t.freePageBlocks = nt.freeBlocks, nt.freePageBlocks
+	t.cow.reset(t.rootOff, t.fileSize)
+	return nil
+}
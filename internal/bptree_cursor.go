@@ -0,0 +1,243 @@
+package internal
+
+import "sort"
+
+// 沿磁盘上的叶子链表(Next/Prev)遍历B+树的游标
+// 游标持有当前叶子的副本，每次移动时读取当时已发布的版本；两次移动之间有写入时可能跳过或重复记录，
+// 需要一致的结果时使用Scan/Range，整个遍历都在同一个版本上
+type Cursor struct {
+	t    *BPlusTree
+	r    *BPlusTree // 本次移动读取的视图
+	node *Node      // 当前叶子，nil表示游标无效
+	idx  int        // 当前记录在叶子中的位置
+	err  error
+}
+
+func (t *BPlusTree) Cursor() *Cursor {
+	return &Cursor{
+		t: t,
+	}
+}
+
+func (c *Cursor) release() {
+	if c.node != nil {
+		c.t.putNodePool(c.node)
+		c.node = nil
+	}
+}
+
+// 释放游标持有的节点
+func (c *Cursor) Close() {
+	c.release()
+}
+
+func (c *Cursor) fail(err error) bool {
+	c.err = err
+	c.release()
+	return false
+}
+
+// 沿着第一个(最后一个)孩子下降到最左(最右)的叶子
+func (c *Cursor) edge(last bool) bool {
+	var err error
+	c.release()
+	if c.r.rootOff == INVALID_OFFSET {
+		return false
+	}
+	if c.node, err = c.r.newMappingNodeFromPool(c.r.rootOff); err != nil {
+		return c.fail(err)
+	}
+	for !c.node.IsLeaf {
+		if len(c.node.Children) == 0 {
+			return c.fail(InvalidDBFormat)
+		}
+		child := c.node.Children[0]
+		if last {
+			child = c.node.Children[len(c.node.Children)-1]
+		}
+		if err = c.r.seekNode(c.node, child); err != nil {
+			return c.fail(err)
+		}
+	}
+	if last {
+		c.idx = len(c.node.Keys) - 1
+		return c.backward()
+	}
+	c.idx = 0
+	return c.forward()
+}
+
+// 当前位置越过叶子末尾时移动到下一个非空叶子
+func (c *Cursor) forward() bool {
+	for c.idx >= len(c.node.Keys) {
+		if c.node.Next == INVALID_OFFSET {
+			c.release()
+			return false
+		}
+		if err := c.r.seekNode(c.node, c.node.Next); err != nil {
+			return c.fail(err)
+		}
+		c.idx = 0
+	}
+	return true
+}
+
+// 当前位置越过叶子开头时移动到上一个非空叶子
+func (c *Cursor) backward() bool {
+	for c.idx < 0 {
+		if c.node.Prev == INVALID_OFFSET {
+			c.release()
+			return false
+		}
+		if err := c.r.seekNode(c.node, c.node.Prev); err != nil {
+			return c.fail(err)
+		}
+		c.idx = len(c.node.Keys) - 1
+	}
+	return true
+}
+
+// 在当前已发布的版本上移动一次
+func (c *Cursor) read(f func() bool) bool {
+	c.r = c.t.beginRead()
+	defer func() {
+		c.t.endRead(c.r)
+		c.r = nil
+	}()
+	return f()
+}
+
+// 定位到最小的key
+func (c *Cursor) First() bool {
+	return c.read(func() bool { return c.edge(false) })
+}
+
+// 定位到最大的key
+func (c *Cursor) Last() bool {
+	return c.read(func() bool { return c.edge(true) })
+}
+
+// 定位到第一个大于等于key的位置
+func (c *Cursor) Seek(key uint64) bool {
+	return c.read(func() bool { return c.seek(key) })
+}
+
+func (c *Cursor) seek(key uint64) bool {
+	var err error
+	c.release()
+	if c.r.rootOff == INVALID_OFFSET {
+		return false
+	}
+	if c.node, err = c.r.newMappingNodeFromPool(INVALID_OFFSET); err != nil {
+		return c.fail(err)
+	}
+	if err = c.r.findLeaf(c.node, key); err != nil {
+		return c.fail(err)
+	}
+	c.idx = sort.Search(len(c.node.Keys), func(i int) bool {
+		return c.node.Keys[i] >= key
+	})
+	return c.forward()
+}
+
+// 定位到最后一个小于等于key的位置
+func (c *Cursor) SeekReverse(key uint64) bool {
+	return c.read(func() bool { return c.seekReverse(key) })
+}
+
+func (c *Cursor) seekReverse(key uint64) bool {
+	if !c.seek(key) {
+		if c.err != nil {
+			return false
+		}
+		return c.edge(true)
+	}
+	if c.Key() > key {
+		return c.prev()
+	}
+	return true
+}
+
+func (c *Cursor) Next() bool {
+	return c.read(func() bool { return c.next() })
+}
+
+func (c *Cursor) next() bool {
+	if c.node == nil {
+		return false
+	}
+	c.idx++
+	return c.forward()
+}
+
+func (c *Cursor) Prev() bool {
+	return c.read(func() bool { return c.prev() })
+}
+
+func (c *Cursor) prev() bool {
+	if c.node == nil {
+		return false
+	}
+	c.idx--
+	return c.backward()
+}
+
+// 游标是否指向一条记录
+func (c *Cursor) Valid() bool {
+	return c.node != nil
+}
+
+func (c *Cursor) Key() uint64 {
+	return c.node.Keys[c.idx]
+}
+
+func (c *Cursor) Value() string {
+	return c.node.Records[c.idx]
+}
+
+// 遍历过程中遇到的磁盘错误
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// 按key升序遍历[lo, hi)内的记录，f返回false时停止
+func (t *BPlusTree) Range(lo uint64, hi uint64, f func(uint64, string) bool) error {
+	if lo >= hi {
+		return nil
+	}
+	return t.Scan(lo, hi-1, f)
+}
+
+// 按key降序遍历[lo, hi)内的记录，f返回false时停止
+func (t *BPlusTree) ReverseRange(lo uint64, hi uint64, f func(uint64, string) bool) error {
+	if lo >= hi {
+		return nil
+	}
+	c := t.Cursor()
+	defer c.Close()
+	c.r = t.beginRead()
+	defer t.endRead(c.r)
+	for ok := c.seekReverse(hi - 1); ok && c.Key() >= lo; ok = c.prev() {
+		if !f(c.Key(), c.Value()) {
+			break
+		}
+	}
+	return c.Err()
+}
+
+// 按key升序遍历[lo, hi]内的记录，闭区间可以遍历到最大的key，f返回false时停止
+func (t *BPlusTree) Scan(lo uint64, hi uint64, f func(uint64, string) bool) error {
+	if lo > hi {
+		return nil
+	}
+	c := t.Cursor()
+	defer c.Close()
+	c.r = t.beginRead()
+	defer t.endRead(c.r)
+	for ok := c.seek(lo); ok && c.Key() <= hi; ok = c.next() {
+		if !f(c.Key(), c.Value()) {
+			break
+		}
+	}
+	return c.Err()
+}
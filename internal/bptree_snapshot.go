@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"io"
+	"sync"
+)
+
+// 写者对页面写时复制：一次写操作第一次覆盖某个块之前，先把块原来的内容留一份副本，
+// 写操作结束时把新的根发布成一个新版本
+// 读者开始时取当前已发布的版本，读取页面时如果块在这个版本之后被改写过，就从最早的副本读取，
+// 所以读者看到的始终是同一个版本的树，不需要等待写者的磁盘写入
+// 没有读者还停留在更早的版本时副本就被释放
+
+// 一个已发布的版本
+type treeVersion struct {
+	version  uint64
+	rootOff  OFFTYPE
+	fileSize uint64
+}
+
+// 块被版本version的写操作改写之前的内容
+type shadowBlock struct {
+	version uint64
+	data    []byte
+}
+
+type treeShadows struct {
+	mu      sync.Mutex
+	current treeVersion
+	writing uint64                    // 进行中的写操作的版本，0表示没有
+	blocks  map[OFFTYPE][]shadowBlock // 按版本升序
+	readers map[uint64]int            // 各版本上的读者数
+}
+
+func newTreeShadows() *treeShadows {
+	return &treeShadows{
+		current: treeVersion{rootOff: INVALID_OFFSET},
+		blocks:  make(map[OFFTYPE][]shadowBlock),
+		readers: make(map[uint64]int),
+	}
+}
+
+// 开始一次写操作，调用方持有写者锁
+func (ts *treeShadows) begin() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.writing = ts.current.version + 1
+}
+
+// 写操作结束，发布新版本
+func (ts *treeShadows) commit(root OFFTYPE, fileSize uint64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.writing == 0 {
+		return
+	}
+	ts.current = treeVersion{version: ts.writing, rootOff: root, fileSize: fileSize}
+	ts.writing = 0
+	ts.release()
+}
+
+// 不经过写操作直接替换当前版本，例如重写文件之后，调用方保证没有读者
+func (ts *treeShadows) reset(root OFFTYPE, fileSize uint64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.current = treeVersion{version: ts.current.version + 1, rootOff: root, fileSize: fileSize}
+	ts.blocks = make(map[OFFTYPE][]shadowBlock)
+}
+
+// 在[off, off+length)被覆盖前保存涉及的块，已经保存过的块和读者看不到的新块跳过
+func (ts *treeShadows) preserve(f io.ReaderAt, off int64, length int, bs uint64) error {
+	ts.mu.Lock()
+	version, limit := ts.writing, ts.current.fileSize
+	ts.mu.Unlock()
+	if version == 0 {
+		return nil
+	}
+	for b := uint64(off) / bs * bs; b < uint64(off)+uint64(length) && b < limit; b += bs {
+		ts.mu.Lock()
+		sl := ts.blocks[OFFTYPE(b)]
+		saved := len(sl) > 0 && sl[len(sl)-1].version == version
+		ts.mu.Unlock()
+		if saved {
+			continue
+		}
+		buf := make([]byte, bs)
+		n, err := f.ReadAt(buf, int64(b))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		ts.mu.Lock()
+		ts.blocks[OFFTYPE(b)] = append(ts.blocks[OFFTYPE(b)], shadowBlock{version: version, data: buf[:n]})
+		ts.mu.Unlock()
+	}
+	return nil
+}
+
+// 登记一个读者，返回它看到的版本
+func (ts *treeShadows) acquire() treeVersion {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.readers[ts.current.version]++
+	return ts.current
+}
+
+func (ts *treeShadows) unacquire(version uint64) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.readers[version]--; ts.readers[version] <= 0 {
+		delete(ts.readers, version)
+		ts.release()
+	}
+}
+
+// 释放没有读者需要的副本，读者只需要比自己版本新的副本
+func (ts *treeShadows) release() {
+	if len(ts.blocks) == 0 {
+		return
+	}
+	oldest := ts.current.version
+	for v := range ts.readers {
+		if v < oldest {
+			oldest = v
+		}
+	}
+	for off, sl := range ts.blocks {
+		i := 0
+		for i < len(sl) && sl[i].version <= oldest {
+			i++
+		}
+		if i == len(sl) {
+			delete(ts.blocks, off)
+		} else if i > 0 {
+			ts.blocks[off] = sl[i:]
+		}
+	}
+}
+
+// 按版本version读取，先读磁盘，再用之后被改写的块的副本覆盖
+// 写者保存副本之后才会写块，读完磁盘后还没有副本的块在读取期间没有被改写
+func (ts *treeShadows) readAt(f io.ReaderAt, buf []byte, off int64, version uint64, bs uint64) (int, error) {
+	n, err := f.ReadAt(buf, off)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	end := uint64(off) + uint64(len(buf))
+	for b := uint64(off) / bs * bs; b < end; b += bs {
+		for _, sb := range ts.blocks[OFFTYPE(b)] {
+			if sb.version <= version {
+				continue
+			}
+			// 副本与buf重叠的部分
+			lo, hi := b, b+uint64(len(sb.data))
+			if lo < uint64(off) {
+				lo = uint64(off)
+			}
+			if hi > end {
+				hi = end
+			}
+			if lo < hi {
+				copy(buf[lo-uint64(off):hi-uint64(off)], sb.data[lo-b:hi-b])
+				if int(hi-uint64(off)) > n {
+					n = int(hi - uint64(off))
+				}
+			}
+			break
+		}
+	}
+	if n == len(buf) {
+		err = nil
+	}
+	return n, err
+}
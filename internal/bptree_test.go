@@ -1,8 +1,15 @@
 package internal
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"fts/internal/common"
+	"math"
+	"math/rand"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -88,3 +95,754 @@ func TestBPlusTree(t *testing.T) {
 	// second print
 	BPlusTree.DebugBPlusTreePrint()
 }
+
+// 超过一个数据页的记录写入扩展页，重新打开后仍能读出
+func TestBPlusTreeLargeRecord(t *testing.T) {
+	var (
+		bp   *BPlusTree
+		err  error
+		path = "./large.db"
+		want = make(map[uint64]string)
+		r    = rand.New(rand.NewSource(1))
+	)
+	os.Remove(path)
+	defer os.Remove(path)
+	if bp, err = NewBPlusTree(path); err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 500; i++ {
+			key := uint64(r.Intn(200))
+			val := strings.Repeat(fmt.Sprintf("%c", 'a'+r.Intn(26)), r.Intn(3*DATA_PAGE_DEFAULT_BLOCK_SIZE))
+			if err = bp.InsertOrUpdate(key, val); err != nil {
+				t.Fatal(err)
+			}
+			want[key] = val
+		}
+		for k, v := range want {
+			if val, err := bp.Find(k); err != nil {
+				t.Fatal(err)
+			} else if val != v {
+				t.Fatalf("key %d expect len %d, but get len %d", k, len(v), len(val))
+			}
+		}
+		bp.Close()
+		if bp, err = NewBPlusTree(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bp.Close()
+}
+
+func TestBPlusTreeScan(t *testing.T) {
+	var (
+		bp   *BPlusTree
+		err  error
+		path = "./scan.db"
+	)
+	os.Remove(path)
+	defer os.Remove(path)
+	if bp, err = NewBPlusTree(path); err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+	for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+		if err = bp.Insert(uint64(i*2), fmt.Sprintf("%d", i*2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := []uint64{}
+	if err = bp.Scan(31, 60, func(k uint64, v string) bool {
+		if v != fmt.Sprintf("%d", k) {
+			t.Fatalf("key %d get %s", k, v)
+		}
+		keys = append(keys, k)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[32 34 36 38 40 42 44 46 48 50 52 54 56 58 60]" {
+		t.Fatal(keys)
+	}
+
+	cnt := 0
+	bp.Scan(0, 1000, func(uint64, string) bool {
+		cnt++
+		return cnt < 10
+	})
+	if cnt != 10 {
+		t.Fatal(cnt)
+	}
+}
+
+func TestBPlusTreeCursor(t *testing.T) {
+	var (
+		bp   *BPlusTree
+		err  error
+		path = "./cursor.db"
+	)
+	os.Remove(path)
+	defer os.Remove(path)
+	if bp, err = NewBPlusTree(path); err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+
+	// 空树
+	c := bp.Cursor()
+	if c.First() || c.Last() || c.Seek(1) || c.Valid() {
+		t.Fatal("cursor on empty tree should be invalid")
+	}
+
+	keys := []uint64{}
+	for _, i := range rand.New(rand.NewSource(2)).Perm(200) {
+		if err = bp.Insert(uint64(i*3), fmt.Sprintf("%d", i*3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		keys = append(keys, uint64(i*3))
+	}
+
+	got := []uint64{}
+	for ok := c.First(); ok; ok = c.Next() {
+		if c.Value() != fmt.Sprintf("%d", c.Key()) {
+			t.Fatalf("key %d get %s", c.Key(), c.Value())
+		}
+		got = append(got, c.Key())
+	}
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Fatal(got)
+	}
+
+	got = got[:0]
+	for ok := c.Last(); ok; ok = c.Prev() {
+		got = append(got, c.Key())
+	}
+	for i := range got {
+		if got[i] != keys[len(keys)-1-i] {
+			t.Fatal(got)
+		}
+	}
+
+	// seek
+	if !c.Seek(10) || c.Key() != 12 {
+		t.Fatal("seek 10")
+	}
+	if !c.Prev() || c.Key() != 9 {
+		t.Fatal("prev of 12")
+	}
+	if !c.SeekReverse(10) || c.Key() != 9 {
+		t.Fatal("seek reverse 10")
+	}
+	if !c.SeekReverse(1000) || c.Key() != 597 {
+		t.Fatal("seek reverse 1000")
+	}
+	if c.Seek(598) {
+		t.Fatal("seek beyond last key")
+	}
+	if c.SeekReverse(0) != true || c.Key() != 0 || c.Prev() {
+		t.Fatal("seek reverse 0")
+	}
+	c.Close()
+
+	// [lo, hi)
+	got = got[:0]
+	bp.Range(9, 21, func(k uint64, _ string) bool {
+		got = append(got, k)
+		return true
+	})
+	if fmt.Sprint(got) != "[9 12 15 18]" {
+		t.Fatal(got)
+	}
+	got = got[:0]
+	bp.ReverseRange(9, 21, func(k uint64, _ string) bool {
+		got = append(got, k)
+		return true
+	})
+	if fmt.Sprint(got) != "[18 15 12 9]" {
+		t.Fatal(got)
+	}
+	got = got[:0]
+	bp.ReverseRange(0, 1000, func(k uint64, _ string) bool {
+		got = append(got, k)
+		return len(got) < 2
+	})
+	if fmt.Sprint(got) != "[597 594]" {
+		t.Fatal(got)
+	}
+}
+
+func TestBPlusTreeBulkLoad(t *testing.T) {
+	path := "./bulk.db"
+	defer os.Remove(path)
+	for _, n := range []int{0, 1, 3, 4, 5, 17, 64, 1000} {
+		os.Remove(path)
+		bp, err := NewBPlusTree(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bl, err := bp.NewBulkLoader(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			val := fmt.Sprintf("%d", i*2)
+			if i%97 == 0 {
+				val += strings.Repeat("x", DATA_PAGE_DEFAULT_BLOCK_SIZE)
+			}
+			if err = bl.Add(uint64(i*2), val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n > 0 {
+			if err = bl.Add(0, ""); !errors.Is(err, ErrBulkLoadUnsorted) {
+				t.Fatal(err)
+			}
+		}
+		if err = bl.Finish(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = bp.NewBulkLoader(0); n > 0 && err != ErrBulkLoadNotEmpty {
+			t.Fatal(err)
+		}
+		bp.Close()
+
+		// 重新打开后检查顺序遍历和查找，并能继续插入
+		if bp, err = NewBPlusTree(path); err != nil {
+			t.Fatal(err)
+		}
+		cnt := 0
+		c := bp.Cursor()
+		for ok := c.First(); ok; ok = c.Next() {
+			if c.Key() != uint64(cnt*2) || !strings.HasPrefix(c.Value(), fmt.Sprintf("%d", cnt*2)) {
+				t.Fatalf("n=%d expect key %d, but get %d", n, cnt*2, c.Key())
+			}
+			cnt++
+		}
+		c.Close()
+		if cnt != n {
+			t.Fatalf("n=%d but scan %d", n, cnt)
+		}
+		for i := 0; i < n; i++ {
+			if err = bp.Insert(uint64(i*2+1), "odd"); err != nil {
+				t.Fatal(n, i, err)
+			}
+		}
+		for i := 0; i < 2*n; i++ {
+			if _, err = bp.Find(uint64(i)); err != nil {
+				t.Fatal(n, i, err)
+			}
+		}
+		bp.Close()
+	}
+}
+
+func TestBPlusTreeCompact(t *testing.T) {
+	path := "./compact.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	bp, err := NewBPlusTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range rand.New(rand.NewSource(3)).Perm(300) {
+		if err = bp.Insert(uint64(i), fmt.Sprintf("%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = bp.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+	for i := 0; i < 300; i++ {
+		if val, err := bp.Find(uint64(i)); err != nil || val != fmt.Sprintf("%d", i) {
+			t.Fatal(i, val, err)
+		}
+	}
+}
+
+func TestBPlusTreeDelete(t *testing.T) {
+	path := "./delete.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	bp, err := NewBPlusTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(5))
+	want := make(map[uint64]string)
+	for round := 0; round < 3000; round++ {
+		key := uint64(r.Intn(500))
+		if r.Intn(3) == 0 {
+			_, ok := want[key]
+			err = bp.Delete(key)
+			if ok && err != nil {
+				t.Fatal(round, key, err)
+			}
+			if !ok && err != NotFoundKey {
+				t.Fatal(round, key, err)
+			}
+			delete(want, key)
+			continue
+		}
+		val := fmt.Sprintf("%d-%d", key, round)
+		if err = bp.InsertOrUpdate(key, val); err != nil {
+			t.Fatal(round, key, err)
+		}
+		want[key] = val
+	}
+	check := func() {
+		got := make(map[uint64]string)
+		err := bp.Scan(0, math.MaxUint64, func(key uint64, val string) bool {
+			got[key] = val
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatal(len(got), len(want))
+		}
+		if errs := bp.Verify(false); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Fatal(k, got[k], v)
+			}
+			if val, err := bp.Find(k); err != nil || val != v {
+				t.Fatal(k, val, err)
+			}
+		}
+	}
+	check()
+
+	bp.Close()
+	if bp, err = NewBPlusTree(path); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	for k := range want {
+		if err = bp.Delete(k); err != nil {
+			t.Fatal(k, err)
+		}
+	}
+	if !bp.Empty() {
+		t.Fatal("tree should be empty")
+	}
+	bp.Close()
+	if bp, err = NewBPlusTree(path); err != nil {
+		t.Fatal(err)
+	}
+	if !bp.Empty() {
+		t.Fatal("tree should be empty after reopen")
+	}
+	if err = bp.Insert(1, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if val, err := bp.Find(1); err != nil || val != "1" {
+		t.Fatal(val, err)
+	}
+	bp.Close()
+}
+
+// 配合 go test -race 运行
+func TestBPlusTreeConcurrent(t *testing.T) {
+	path := "./concurrent.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	bp, err := NewBPlusTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+
+	const (
+		writers = 4
+		keys    = 200
+	)
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+		errs = make(chan error, writers*2+2)
+	)
+	// 每个写者负责不相交的key区间，插入全部后删除奇数key
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(base uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < keys; i++ {
+				if err := bp.Insert(base+i, fmt.Sprintf("%d", base+i)); err != nil {
+					errs <- err
+					return
+				}
+			}
+			for i := uint64(1); i < keys; i += 2 {
+				if err := bp.Delete(base + i); err != nil {
+					errs <- fmt.Errorf("delete %d: %w", base+i, err)
+					return
+				}
+			}
+		}(uint64(w * keys))
+	}
+	var readers sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func(seed int64) {
+			defer readers.Done()
+			rd := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := uint64(rd.Intn(writers * keys))
+				// 读者在一个完整的版本上读取，不会读到写了一半的页面
+				if val, err := bp.Find(key); err != nil && err != NotFoundKey {
+					errs <- fmt.Errorf("find %d: %w", key, err)
+					return
+				} else if err == nil && val != fmt.Sprintf("%d", key) {
+					errs <- fmt.Errorf("find %d: %s", key, val)
+					return
+				}
+				prev := int64(-1)
+				err := bp.Scan(key, key+20, func(k uint64, val string) bool {
+					if int64(k) <= prev || val != fmt.Sprintf("%d", k) {
+						errs <- fmt.Errorf("scan %d: %s after %d", k, val, prev)
+						return false
+					}
+					prev = int64(k)
+					return true
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(int64(r))
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for i := uint64(0); i < writers*keys; i++ {
+		val, err := bp.Find(i)
+		if i%2 == 1 {
+			if err != NotFoundKey {
+				t.Fatal(i, val, err)
+			}
+		} else if err != nil || val != fmt.Sprintf("%d", i) {
+			t.Fatal(i, val, err)
+		}
+	}
+	// 读者全部退出后不再保留页面副本
+	if len(bp.cow.blocks) != 0 {
+		t.Fatal("pages preserved after readers finished", len(bp.cow.blocks))
+	}
+}
+
+// 读者停留在开始时的版本上，之后的插入、删除(包括分裂合并与页面复用)对它不可见
+func TestBPlusTreeSnapshot(t *testing.T) {
+	path := "./snapshot.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	bp, err := NewBPlusTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+	for i := uint64(0); i < 100; i++ {
+		if err = bp.Insert(i, fmt.Sprintf("%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rt := bp.beginRead()
+	// 写者不需要等待读者
+	for i := uint64(0); i < 100; i += 2 {
+		if err = bp.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := uint64(100); i < 300; i++ {
+		if err = bp.InsertOrUpdate(i, "new"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = bp.Update(1, "updated"); err != nil {
+		t.Fatal(err)
+	}
+	if len(bp.cow.blocks) == 0 {
+		t.Fatal("no page preserved for the reader")
+	}
+
+	for i := uint64(0); i < 100; i++ {
+		if val, err := rt.find(i); err != nil || val != fmt.Sprintf("%d", i) {
+			t.Fatal(i, val, err)
+		}
+	}
+	if _, err = rt.find(150); err != NotFoundKey {
+		t.Fatal(err)
+	}
+	c := bp.Cursor()
+	c.r = rt
+	n := uint64(0)
+	for ok := c.edge(false); ok; ok = c.next() {
+		if c.Key() != n {
+			t.Fatal(c.Key(), n)
+		}
+		n++
+	}
+	c.Close()
+	if c.Err() != nil || n != 100 {
+		t.Fatal(n, c.Err())
+	}
+	bp.endRead(rt)
+	if len(bp.cow.blocks) != 0 {
+		t.Fatal("pages preserved after the reader finished", len(bp.cow.blocks))
+	}
+
+	// 新的读者看到最新的版本
+	if val, err := bp.Find(1); err != nil || val != "updated" {
+		t.Fatal(val, err)
+	}
+	if _, err = bp.Find(2); err != NotFoundKey {
+		t.Fatal(err)
+	}
+	if val, err := bp.Find(299); err != nil || val != "new" {
+		t.Fatal(val, err)
+	}
+	if errs := bp.Verify(false); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+}
+
+func TestBPlusTreeCorruption(t *testing.T) {
+	path := "./corrupt.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	bp, err := NewBPlusTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err = bp.Insert(uint64(i), fmt.Sprintf("%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bp.Close()
+
+	// 修改第一个页面中的一个字节
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	f.ReadAt(b, 20)
+	b[0] ^= 0xff
+	f.WriteAt(b, 20)
+	f.Close()
+
+	_, err = NewBPlusTree(path)
+	if !errors.Is(err, common.ErrCorrupted) {
+		t.Fatal(err)
+	}
+	var ce *common.CorruptionError
+	if !errors.As(err, &ce) || ce.Offset != 0 || ce.Path != path {
+		t.Fatal(err)
+	}
+}
+
+func TestBPlusTreeVerify(t *testing.T) {
+	path := "./verify.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	bp, err := NewBPlusTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+	r := rand.New(rand.NewSource(9))
+	for _, i := range r.Perm(500) {
+		if err = bp.Insert(uint64(i), strings.Repeat("v", r.Intn(64))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, i := range r.Perm(500)[:200] {
+		if err = bp.Delete(uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errs := bp.Verify(false); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	// 破坏一个叶子的兄弟指针
+	leaf := &Node{}
+	if err = bp.findLeaf(leaf, 250); err != nil {
+		t.Fatal(err)
+	}
+	leaf.Next = leaf.Self
+	if err = bp.writeNode(leaf); err != nil {
+		t.Fatal(err)
+	}
+	errs := bp.Verify(true)
+	if len(errs) == 0 || !errors.Is(errs[0], ErrTreeInvariant) {
+		t.Fatal(errs)
+	}
+	if errs = bp.Verify(false); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	count := 0
+	bp.Scan(0, math.MaxUint64, func(uint64, string) bool {
+		count++
+		return true
+	})
+	if count != 300 {
+		t.Fatal(count)
+	}
+}
+
+// 空闲链表：有序去重，连续的索引页合并为数据页，扩展页优先复用连续的数据页
+func TestBPlusTreeFreeList(t *testing.T) {
+	path := "./freelist.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	bp, err := NewBPlusTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+	var (
+		ip   = OFFTYPE(bp.indexPageSize)
+		dp   = OFFTYPE(bp.dataPageSize)
+		rate = int(bp.getRate())
+	)
+
+	if sl := insertFreeOffsets([]OFFTYPE{2, 8}, 8, 5, 1, 2); fmt.Sprint(sl) != "[1 2 5 8]" {
+		t.Fatal(sl)
+	}
+
+	// 反序返还一个数据页大小的连续索引页，最后一页返还时合并
+	base := 100 * dp
+	bp.freeIndexPage(base + 10*ip)
+	for i := rate - 1; i >= 0; i-- {
+		bp.freeIndexPage(base + OFFTYPE(i)*ip)
+	}
+	if fmt.Sprint(bp.freePageBlocks[INDEX_PAGE]) != fmt.Sprint([]OFFTYPE{base + 10*ip}) {
+		t.Fatal(bp.freePageBlocks[INDEX_PAGE])
+	}
+	if fmt.Sprint(bp.freePageBlocks[DATA_PAGE]) != fmt.Sprint([]OFFTYPE{base}) {
+		t.Fatal(bp.freePageBlocks[DATA_PAGE])
+	}
+
+	// 新申请的块按同样的规则整理
+	bp.freePageBlocks = make([][]OFFTYPE, 4)
+	bp.freeBlocks = []OFFTYPE{base + 20*ip}
+	for i := 0; i < rate; i++ {
+		bp.freeBlocks = append(bp.freeBlocks, base+OFFTYPE(i)*ip)
+	}
+	bp.adjustFreeBlockList()
+	if len(bp.freeBlocks) != 0 ||
+		fmt.Sprint(bp.freePageBlocks[DATA_PAGE]) != fmt.Sprint([]OFFTYPE{base}) ||
+		fmt.Sprint(bp.freePageBlocks[INDEX_PAGE]) != fmt.Sprint([]OFFTYPE{base + 20*ip}) {
+		t.Fatal(bp.freeBlocks, bp.freePageBlocks)
+	}
+
+	// 扩展页取第一段足够长的连续数据页，剩下的保持有序
+	bp.freePageBlocks[DATA_PAGE] = nil
+	bp.freeExtendPage(base+10*dp, 3)
+	bp.freeExtendPage(base, 2)
+	bp.freeDataPage(base + 5*dp)
+	if off := bp.allocExtendPage(3); off != base+10*dp {
+		t.Fatal(off)
+	}
+	if fmt.Sprint(bp.freePageBlocks[DATA_PAGE]) != fmt.Sprint([]OFFTYPE{base, base + dp, base + 5*dp}) {
+		t.Fatal(bp.freePageBlocks[DATA_PAGE])
+	}
+	// 没有足够的连续页时从文件末尾(按索引页对齐)分配
+	bp.fileSize = uint64(base) + 1
+	if off := bp.allocExtendPage(3); off != base+ip || bp.fileSize != uint64(base+ip+3*dp) {
+		t.Fatal(off, bp.fileSize)
+	}
+	if len(bp.freePageBlocks[DATA_PAGE]) != 3 {
+		t.Fatal(bp.freePageBlocks[DATA_PAGE])
+	}
+}
+
+// 删除扩展页后页面在磁盘上标记为未使用，重新打开时回收，再次写入不增长文件
+func TestBPlusTreeReuseFreePages(t *testing.T) {
+	path := "./reuse.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	bp, err := NewBPlusTree(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("x", 3*DATA_PAGE_DEFAULT_BLOCK_SIZE)
+	for i := uint64(0); i < 10; i++ {
+		if err = bp.Insert(i, large); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := uint64(0); i < 10; i++ {
+		if err = bp.Delete(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = bp.Insert(100, "small"); err != nil {
+		t.Fatal(err)
+	}
+	bp.Close()
+
+	if bp, err = NewBPlusTree(path); err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+	size := bp.fileSize
+	free := 0
+	for _, sl := range bp.freePageBlocks {
+		free += len(sl)
+	}
+	if free == 0 {
+		t.Fatal("no free page reclaimed")
+	}
+	for i := uint64(0); i < 3; i++ {
+		if err = bp.Insert(i, large); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bp.fileSize > size {
+		t.Fatal("file grows from", size, "to", bp.fileSize)
+	}
+	for i := uint64(0); i < 3; i++ {
+		if val, err := bp.Find(i); err != nil || val != large {
+			t.Fatal(i, len(val), err)
+		}
+	}
+	if errs := bp.Verify(false); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+}
+
+// 页头记录的长度超过扩展页上限时按格式错误处理，不按长度分配内存
+func TestBPlusTreePageTooLarge(t *testing.T) {
+	path := "./toolarge.db"
+	os.Remove(path)
+	defer os.Remove(path)
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint64(header, MAX_EXTEND_PAGE_SIZE)
+	if err := os.WriteFile(path, header, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBPlusTree(path); !errors.Is(err, InvalidDBFormat) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var ErrTreeInvariant = errors.New("b+tree invariant violated")
+
+// 页面在文件中占用的区间[off, off+span)
+type pageExtent struct {
+	off  OFFTYPE
+	span uint64
+	free bool
+}
+
+// 检查树的结构：key有序、父子指针、同层链表、叶子深度一致、空闲页不与使用中的页重叠
+// 返回发现的问题，repair为true且有问题时从根向下按孩子顺序收集记录重建整棵树，
+// 不依赖可能已损坏的叶子链表，顺序错乱的key被丢弃
+func (t *BPlusTree) Verify(repair bool) []error {
+	errs := t.verify()
+	if len(errs) == 0 || !repair {
+		return errs
+	}
+	if err := t.repair(); err != nil {
+		errs = append(errs, fmt.Errorf("repair %s: %w", t.path, err))
+	}
+	return errs
+}
+
+func (t *BPlusTree) repair() error {
+	t.wlock.Lock()
+	defer t.wlock.Unlock()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.rootOff == INVALID_OFFSET {
+		return t.rewrite(func(func(uint64, string) error) error { return nil })
+	}
+	return t.rewrite(func(add func(uint64, string) error) error {
+		var (
+			last  uint64
+			count int
+			visit func(off OFFTYPE, depth int) error
+		)
+		visit = func(off OFFTYPE, depth int) error {
+			if depth > 64 {
+				return fmt.Errorf("%w: %s: cycle at node %d", ErrTreeInvariant, t.path, off)
+			}
+			n, err := t.loadNode(off)
+			if err != nil {
+				return err
+			}
+			if !n.IsLeaf {
+				for _, child := range n.Children {
+					if err = visit(child, depth+1); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			for i, key := range n.Keys {
+				if i >= len(n.Records) || (count > 0 && key <= last) {
+					continue
+				}
+				if err = add(key, n.Records[i]); err != nil {
+					return err
+				}
+				last = key
+				count++
+			}
+			return nil
+		}
+		return visit(t.rootOff, 0)
+	})
+}
+
+// 需要检查空闲页，与写者互斥
+func (t *BPlusTree) verify() []error {
+	t.wlock.Lock()
+	defer t.wlock.Unlock()
+
+	v := &treeVerifier{t: t}
+	if t.rootOff != INVALID_OFFSET {
+		root, err := t.loadNode(t.rootOff)
+		if err != nil {
+			return []error{err}
+		}
+		if root.Parent != INVALID_OFFSET {
+			v.fail("root %d has parent %d", root.Self, root.Parent)
+		}
+		v.walk(root, 0, false, 0, false, 0)
+		for level, nodes := range v.levels {
+			v.checkChain(level, nodes)
+		}
+	}
+	v.checkFreePages()
+	return v.errs
+}
+
+type treeVerifier struct {
+	t       *BPlusTree
+	errs    []error
+	levels  [][]*Node // 每层从左到右的节点
+	extents []pageExtent
+	depth   int // 叶子所在的层，-1表示还没有遇到叶子
+	leaves  int
+}
+
+func (v *treeVerifier) fail(format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("%w: %s: %s", ErrTreeInvariant, v.t.path, fmt.Sprintf(format, args...)))
+}
+
+// 记录节点自身及扩展页占用的区间
+func (v *treeVerifier) use(off OFFTYPE) error {
+	page := &Node{}
+	if err := v.t.seekNodePage(page, off); err != nil {
+		return err
+	}
+	if !page.IsActive {
+		v.fail("node %d is reachable but inactive", off)
+	}
+	v.extents = append(v.extents, pageExtent{off: off, span: v.t.pageSpan(page)})
+	if page.ExtendPage == INVALID_OFFSET {
+		return nil
+	}
+	extend := &Node{}
+	if err := v.t.seekNodePage(extend, page.ExtendPage); err != nil {
+		return err
+	}
+	v.extents = append(v.extents, pageExtent{off: page.ExtendPage, span: v.t.pageSpan(extend)})
+	return nil
+}
+
+// 子树的key都应该落在(lo, hi]内
+func (v *treeVerifier) walk(n *Node, level int, hasLo bool, lo uint64, hasHi bool, hi uint64) {
+	if err := v.use(n.Self); err != nil {
+		v.errs = append(v.errs, err)
+		return
+	}
+	if level == len(v.levels) {
+		v.levels = append(v.levels, nil)
+	}
+	v.levels[level] = append(v.levels[level], n)
+
+	for i, key := range n.Keys {
+		if i > 0 && key <= n.Keys[i-1] {
+			v.fail("keys of node %d out of order at %d: %d after %d", n.Self, i, key, n.Keys[i-1])
+		}
+		if (hasLo && key <= lo) || (hasHi && key > hi) {
+			v.fail("key %d of node %d out of parent range", key, n.Self)
+		}
+	}
+	if n.Self != v.t.rootOff && len(n.Keys) < order/2 {
+		v.fail("node %d has %d keys, less than %d", n.Self, len(n.Keys), order/2)
+	}
+
+	if n.IsLeaf {
+		if len(n.Records) != len(n.Keys) {
+			v.fail("leaf %d has %d keys but %d records", n.Self, len(n.Keys), len(n.Records))
+		}
+		if v.leaves == 0 {
+			v.depth = level
+		} else if v.depth != level {
+			v.fail("leaf %d at level %d, expected %d", n.Self, level, v.depth)
+		}
+		v.leaves++
+		return
+	}
+
+	if len(n.Children) != len(n.Keys) || len(n.Children) == 0 {
+		v.fail("index node %d has %d keys but %d children", n.Self, len(n.Keys), len(n.Children))
+		return
+	}
+	for i, off := range n.Children {
+		child, err := v.t.loadNode(off)
+		if err != nil {
+			v.errs = append(v.errs, err)
+			continue
+		}
+		if child.Parent != n.Self {
+			v.fail("child %d of node %d points to parent %d", off, n.Self, child.Parent)
+		}
+		clo, chasLo := lo, hasLo
+		if i > 0 {
+			clo, chasLo = n.Keys[i-1], true
+		}
+		v.walk(child, level+1, chasLo, clo, true, n.Keys[i])
+	}
+}
+
+// 同一层的节点按Next/Prev首尾相连
+func (v *treeVerifier) checkChain(level int, nodes []*Node) {
+	for i, n := range nodes {
+		prev, next := OFFTYPE(INVALID_OFFSET), OFFTYPE(INVALID_OFFSET)
+		if i > 0 {
+			prev = nodes[i-1].Self
+		}
+		if i+1 < len(nodes) {
+			next = nodes[i+1].Self
+		}
+		if n.Prev != prev || n.Next != next {
+			v.fail("node %d at level %d links to prev %d next %d, expected %d %d", n.Self, level, n.Prev, n.Next, prev, next)
+		}
+	}
+}
+
+// 空闲列表中的页面在文件内、已标记为未使用，并且互不重叠、不与使用中的页重叠
+func (v *treeVerifier) checkFreePages() {
+	t := v.t
+	add := func(offs []OFFTYPE, size uint64) {
+		for _, off := range offs {
+			v.extents = append(v.extents, pageExtent{off: off, span: size, free: true})
+			if uint64(off)+size > t.fileSize {
+				v.fail("free page %d exceeds file size %d", off, t.fileSize)
+				continue
+			}
+			page := &Node{}
+			if err := t.seekNodePage(page, off); errors.Is(err, io.EOF) {
+				// 预分配的页面还没有写入，文件的实际大小可能更小
+				continue
+			} else if err != nil {
+				v.errs = append(v.errs, err)
+			} else if page.IsActive {
+				v.fail("free page %d is still active", off)
+			}
+		}
+	}
+	add(t.freeBlocks, t.indexPageSize)
+	add(t.freePageBlocks[INDEX_PAGE], t.indexPageSize)
+	add(t.freePageBlocks[DATA_PAGE], t.dataPageSize)
+
+	sort.Slice(v.extents, func(i, j int) bool {
+		return v.extents[i].off < v.extents[j].off
+	})
+	for i := 1; i < len(v.extents); i++ {
+		a, b := v.extents[i-1], v.extents[i]
+		if uint64(a.off)+a.span > uint64(b.off) {
+			v.fail("page %d (free=%v) overlaps page %d (free=%v)", a.off, a.free, b.off, b.free)
+		}
+	}
+}
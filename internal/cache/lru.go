@@ -62,30 +62,42 @@ func (l *LruCache) Clear() {
 			l.onEvited(k, v)
 		}
 	}
-	l.dList = nil
+	l.dList = NewList()
 	l.Maps = make(map[string]*LinkedListNode)
 }
+
+// Get会调整链表顺序，需要持有写锁；未命中时释放锁再回源，避免回源阻塞其他读者
 func (l *LruCache) Get(key string) (interface{}, bool) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+	l.mu.Lock()
 	pv, is := l.Maps[key]
-	if !is {
-		if l.onMissed != nil {
-			dt := l.onMissed(key)
-			if dt == nil {
-				return nil, false
-			}
-			if l.dList.Len() == l.capacity {
-				l.replacePut(key, dt)
-			} else {
-				l.normalPut(key, dt)
-			}
-			return dt, true
-		}
+	if is {
+		l.dList.toHead(pv)
+		l.mu.Unlock()
+		return pv.Value, true
+	}
+	l.mu.Unlock()
+
+	if l.onMissed == nil {
 		return nil, false
 	}
-	l.dList.toHead(pv)
-	return pv.Value, true
+	dt := l.onMissed(key)
+	if dt == nil {
+		return nil, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if pv, is = l.Maps[key]; is {
+		// 回源期间已被其他协程放入
+		l.dList.toHead(pv)
+		return pv.Value, true
+	}
+	if l.dList.Len() == l.capacity {
+		l.replacePut(key, dt)
+	} else {
+		l.normalPut(key, dt)
+	}
+	return dt, true
 }
 
 func (l *LruCache) Put(key string, value interface{}) {
@@ -113,8 +125,9 @@ func (l *LruCache) replacePut(key string, value interface{}) {
 		if v == taiIter.P {
 			if l.onEvited != nil {
 				go l.onEvited(k, v.Value)
-				break
 			}
+			delete(l.Maps, k)
+			break
 		}
 	}
 	taiIter.Delete()
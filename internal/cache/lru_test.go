@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 满了之后淘汰最久没有访问的，被淘汰的键同时从表中删除
+func TestLruEviction(t *testing.T) {
+	evicted := make(chan string, 10)
+	l := NewLruCache(3, nil, func(k string, v interface{}) { evicted <- k })
+	for i := 1; i <= 3; i++ {
+		l.Put(strconv.Itoa(i), i)
+	}
+	// 访问1之后最久没有访问的是2
+	v, ok := l.Get("1")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	l.Put("4", 4)
+	assert.Equal(t, "2", <-evicted)
+	assert.Equal(t, 3, l.Len())
+	_, ok = l.Get("2")
+	assert.False(t, ok)
+	_, ok = l.Maps["2"]
+	assert.False(t, ok)
+
+	for i := 5; i <= 100; i++ {
+		l.Put(strconv.Itoa(i), i)
+	}
+	assert.Equal(t, 3, l.Len())
+	assert.Equal(t, int64(3), l.dList.Len())
+	for i := 98; i <= 100; i++ {
+		v, ok := l.Get(strconv.Itoa(i))
+		assert.True(t, ok)
+		assert.Equal(t, i, v)
+	}
+}
+
+// 未命中时回源的结果放入缓存，回源期间不持有锁
+func TestLruMissed(t *testing.T) {
+	var (
+		calls   int64
+		release = make(chan struct{})
+		l       *LruCache
+	)
+	l = NewLruCache(2, func(k string) interface{} {
+		atomic.AddInt64(&calls, 1)
+		if k == "slow" {
+			<-release
+		}
+		if k == "none" {
+			return nil
+		}
+		return "v" + k
+	}, nil)
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, ok := l.Get("slow")
+		assert.True(t, ok)
+		assert.Equal(t, "vslow", v)
+	}()
+	// 慢的回源不阻塞其他键
+	done := make(chan struct{})
+	go func() {
+		l.Put("a", "x")
+		_, ok := l.Get("a")
+		assert.True(t, ok)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Get blocked by a slow miss callback")
+	}
+	close(release)
+	wg.Wait()
+
+	_, ok := l.Get("none")
+	assert.False(t, ok)
+	assert.Equal(t, 2, l.Len())
+	v, ok := l.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, "vb", v)
+	assert.Equal(t, 2, l.Len())
+	assert.Equal(t, int64(2), l.dList.Len())
+	_, ok = l.Maps["a"]
+	assert.False(t, ok)
+}
@@ -0,0 +1,84 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"fts/internal/types"
+	"strings"
+)
+
+var (
+	_ types.DiskCodec = (*NoneDiskCodec)(nil)
+	_ types.DiskCodec = (*FlateDiskCodec)(nil)
+	_ types.DiskCodec = (*GzipDiskCodec)(nil)
+	_ types.DiskCodec = (*HuffmanDiskCodec)(nil)
+)
+
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// 写入块头的编码类型，数值不能改变
+type CodecType uint8
+
+const (
+	CODEC_NONE CodecType = iota
+	CODEC_FLATE
+	CODEC_GZIP
+	CODEC_HUFFMAN
+)
+
+var codecNames = []string{"none", "flate", "gzip", "huffman"}
+
+func (ct CodecType) String() string {
+	if int(ct) < len(codecNames) {
+		return codecNames[ct]
+	}
+	return fmt.Sprintf("codec(%d)", uint8(ct))
+}
+
+// none/flate/gzip/huffman，不区分大小写
+func ParseCodec(name string) (CodecType, error) {
+	for i, v := range codecNames {
+		if strings.EqualFold(v, name) {
+			return CodecType(i), nil
+		}
+	}
+	return CODEC_NONE, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+}
+
+func New(ct CodecType) (types.DiskCodec, error) {
+	switch ct {
+	case CODEC_NONE:
+		return NewNoneCodec(), nil
+	case CODEC_FLATE:
+		return NewFlateCodec(flate.DefaultCompression), nil
+	case CODEC_GZIP:
+		return NewGzipCodec(), nil
+	case CODEC_HUFFMAN:
+		return NewHuffmanCodec(), nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnknownCodec, ct)
+}
+
+func Compress(ct CodecType, b []byte) ([]byte, error) {
+	c, err := New(ct)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	c.BindW(buf)
+	if _, err = c.Encode(b); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func Decompress(ct CodecType, b []byte) ([]byte, error) {
+	c, err := New(ct)
+	if err != nil {
+		return nil, err
+	}
+	c.BindR(bytes.NewReader(b))
+	return c.Decode()
+}
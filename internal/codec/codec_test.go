@@ -0,0 +1,60 @@
+package codec
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 4096)
+	r.Read(random)
+	skewed := make([]byte, 100000)
+	for i := range skewed {
+		// 指数分布，码长差异较大
+		skewed[i] = byte(r.ExpFloat64() * 3)
+	}
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		bytes.Repeat([]byte("x"), 1000),
+		[]byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 200)),
+		random,
+		skewed,
+	}
+	for _, ct := range []CodecType{CODEC_NONE, CODEC_FLATE, CODEC_GZIP, CODEC_HUFFMAN} {
+		for i, in := range inputs {
+			b, err := Compress(ct, in)
+			assert.Nil(t, err, ct.String())
+			out, err := Decompress(ct, b)
+			assert.Nil(t, err, ct.String())
+			assert.Equal(t, len(in), len(out), "%v input %d", ct, i)
+			assert.True(t, bytes.Equal(in, out), "%v input %d", ct, i)
+		}
+	}
+
+	// 限制码长后仍然可以还原
+	HUFFMAN_MAX_CODE_LEN = 8
+	b, err := Compress(CODEC_HUFFMAN, skewed)
+	HUFFMAN_MAX_CODE_LEN = 32
+	assert.Nil(t, err)
+	out, err := Decompress(CODEC_HUFFMAN, b)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(skewed, out))
+
+	text := inputs[3]
+	b, _ = Compress(CODEC_HUFFMAN, text)
+	assert.Less(t, len(b), len(text)*3/4)
+}
+
+func TestParseCodec(t *testing.T) {
+	ct, err := ParseCodec("Huffman")
+	assert.Nil(t, err)
+	assert.Equal(t, CODEC_HUFFMAN, ct)
+	_, err = ParseCodec("zstd")
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+}
@@ -0,0 +1,68 @@
+package codec
+
+import (
+	"compress/flate"
+	"io"
+)
+
+type FlateDiskCodec struct {
+	r     io.Reader
+	w     io.Writer
+	level int
+}
+
+func NewFlateCodec(level int) *FlateDiskCodec {
+	return &FlateDiskCodec{
+		level: level,
+	}
+}
+
+func (fdc *FlateDiskCodec) BindR(r io.Reader) {
+	fdc.r = r
+}
+func (fdc *FlateDiskCodec) BindW(w io.Writer) {
+	fdc.w = w
+}
+func (fdc *FlateDiskCodec) Encode(b []byte) (int64, error) {
+	cw := NewCountWriter(fdc.w)
+	w, err := flate.NewWriter(cw, fdc.level)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.Write(b); err != nil {
+		w.Close()
+		return cw.count, err
+	}
+	err = w.Close()
+	return cw.count, err
+}
+
+func (fdc *FlateDiskCodec) Decode() ([]byte, error) {
+	r := flate.NewReader(fdc.r)
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// 不压缩，原样写入
+type NoneDiskCodec struct {
+	r io.Reader
+	w io.Writer
+}
+
+func NewNoneCodec() *NoneDiskCodec {
+	return &NoneDiskCodec{}
+}
+
+func (ndc *NoneDiskCodec) BindR(r io.Reader) {
+	ndc.r = r
+}
+func (ndc *NoneDiskCodec) BindW(w io.Writer) {
+	ndc.w = w
+}
+func (ndc *NoneDiskCodec) Encode(b []byte) (int64, error) {
+	n, err := ndc.w.Write(b)
+	return int64(n), err
+}
+func (ndc *NoneDiskCodec) Decode() ([]byte, error) {
+	return io.ReadAll(ndc.r)
+}
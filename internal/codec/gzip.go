@@ -25,8 +25,12 @@ func (gdc *GzipDiskCodec) Encode(b []byte) (int64, error) {
 	//buf := new(bytes.Buffer)
 	cw := NewCountWriter(gdc.w)
 	w := gzip.NewWriter(cw)
-	defer w.Close()
-	_, err := w.Write(b)
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return cw.count, err
+	}
+	// Close之后才写完尾部，计数才完整
+	err := w.Close()
 	return cw.count, err
 }
 
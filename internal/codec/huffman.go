@@ -1,19 +1,31 @@
 package codec
 
 import (
-	"bytes"
-	"encoding/gob"
+	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"fts/internal/common"
 	"io"
+	"sort"
 )
 
+var ErrHuffmanFormat = errors.New("invalid huffman data")
+
+var (
+	HUFFMAN_MAX_CODE_LEN = 32 // 码长上限，超过时把频率减半后重建，不能小于8
+)
+
+// 范式哈夫曼编码
+// 格式: 原始长度(uvarint) | 256个字节的码长 | 按位(高位在前)写入的编码
 type HuffmanDiskCodec struct {
 	r io.Reader
 	w io.Writer
 }
 
+func NewHuffmanCodec() *HuffmanDiskCodec {
+	return &HuffmanDiskCodec{}
+}
+
 func (h *HuffmanDiskCodec) BindR(r io.Reader) {
 	h.r = r
 }
@@ -22,316 +34,206 @@ func (h *HuffmanDiskCodec) BindW(w io.Writer) {
 }
 
 func (h *HuffmanDiskCodec) Encode(b []byte) (int64, error) {
-	m := countBytes(b)
-	hf := huffmanTree{}
-	mm, w := split(m)
-	err := hf.build(len(m), mm, w)
-	if err != nil {
-		return -1, err
+	var freq [256]int
+	for _, v := range b {
+		freq[v]++
+	}
+	lens := huffmanLengths(freq)
+	codes := canonicalCodes(lens)
+
+	cw := NewCountWriter(h.w)
+	bw := bufio.NewWriter(cw)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tmp, uint64(len(b)))
+	bw.Write(tmp[:n])
+	bw.Write(lens[:])
+
+	var (
+		acc  uint64 // 待写出的位，低nacc位有效
+		nacc uint
+	)
+	for _, v := range b {
+		acc = acc<<lens[v] | uint64(codes[v])
+		nacc += uint(lens[v])
+		for nacc >= 8 {
+			nacc -= 8
+			bw.WriteByte(byte(acc >> nacc))
+		}
 	}
-	hf.coding(m)
-
-	bs := hf.encodeHeader()
-	xs, err := hf.encodeBody(b)
-	if err != nil {
-		return -1, err
+	if nacc > 0 {
+		bw.WriteByte(byte(acc << (8 - nacc)))
 	}
-	bs = append(bs, xs...)
-
-	i64, err := h.w.Write(bs)
-
-	return int64(i64), err
+	if err := bw.Flush(); err != nil {
+		return cw.count, err
+	}
+	return cw.count, nil
 }
 
 func (h *HuffmanDiskCodec) Decode() ([]byte, error) {
-	b, err := io.ReadAll(h.r)
-	if err != nil {
-		return nil, err
-	}
-	hf := huffmanTree{}
-	idx, header, err := hf.decodeHeader(b)
+	br := bufio.NewReader(h.r)
+	size, err := binary.ReadUvarint(br)
 	if err != nil {
-		return nil, err
-	}
-	return hf.decodeBody(header, b[idx:])
-}
-
-type huffmanNode struct {
-	weight                int
-	parent, lchild, rchid int
-}
-
-type huffmanTree struct {
-	root     []*huffmanNode
-	maps     map[int]byte
-	reflects map[byte]string
-	lens     int
-}
-
-type huffmanHeader struct {
-	checkSum int
-	root     []*huffmanNode //哈夫曼树
-	reflects map[byte]byte  //key 待编码，value 编码结果
-	bytes    map[byte]uint8 // value 编码结果位数
-}
-
-func countBytes(b []byte) map[byte]int {
-	s := make(map[byte]int)
-	for i := 0; i < len(b); i++ {
-		_, ok := s[b[i]]
-		if !ok {
-			s[b[i]] = 1
+		return nil, fmt.Errorf("%w: %v", ErrHuffmanFormat, err)
+	}
+	var lens [256]uint8
+	if _, err = io.ReadFull(br, lens[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHuffmanFormat, err)
+	}
+
+	// 每种码长的个数、第一个码字以及对应的符号在syms中的起点
+	var (
+		count [64]int
+		first [64]int
+		start [64]int
+		syms  []byte
+	)
+	for i := 0; i < 256; i++ {
+		if int(lens[i]) >= len(count) {
+			return nil, fmt.Errorf("%w: code length %d", ErrHuffmanFormat, lens[i])
 		}
-		s[b[i]]++
-	}
-	return s
-}
-func split(s map[byte]int) (b []byte, w []int) {
-	for k, v := range s {
-		b = append(b, k)
-		w = append(w, v)
-	}
-	return
-}
-func (h *huffmanTree) build(n int, m []byte, w []int) error {
-	if n <= 1 {
-		return errors.New("n <= 1")
-	}
-	lens := 2*n - 1
-	h.root = make([]*huffmanNode, lens+1)
-
-	for i := 1; i <= lens; i++ {
-		h.root[i].lchild = 0
-		h.root[i].parent = 0
-		h.root[i].rchid = 0
-	}
-
-	for i := 1; i <= n; i++ {
-		h.root[i].weight = w[i-1]
-		h.maps[i] = m[i-1]
-	}
-
-	for i := n + 1; i <= lens; i++ {
-		s1, s2 := h.choose(i - 1)
-		h.root[i].lchild = s1
-		h.root[i].rchid = s2
-		h.root[i].weight = h.root[s1].weight + h.root[s2].weight
-		h.root[s1].parent = i
-		h.root[s2].parent = i
-	}
-	h.lens = lens + 1
-	return nil
-}
-
-func (h *huffmanTree) choose(n int) (int, int) {
-	var min1, min2 int
-	var idx1, idx2 int
-	for i := 1; i <= n; i++ {
-		if h.root[i].parent == 0 {
-			continue
-		}
-		t := h.root[i].weight
-
-		if t < min2 {
-			if t > min1 {
-				min2 = t
-				idx2 = i
-			} else {
-				min1 = t
-				min2 = t
-				idx1 = i
-				idx2 = i
-			}
+		if lens[i] > 0 {
+			count[lens[i]]++
+			syms = append(syms, byte(i))
 		}
 	}
-
-	return idx1, idx2
-}
-
-// 'a' -> 0b110
-func (h *huffmanTree) coding(s map[byte]int) {
-	m := make(map[byte]string, 0)
-	n := len(s)
-	for i := 1; i <= n; i++ {
-		f := h.root[i].parent
-		c := i
-		var b string
-		dep := 0
-		for f != 0 {
-			if h.root[i].lchild == c {
-				// 左子树编1
-				b += "1" //encode(b, true, dep)
-			} else {
-				//右子树编0
-				b = "0" //encode(b, false, dep)
+	sort.SliceStable(syms, func(i, j int) bool { return lens[syms[i]] < lens[syms[j]] })
+	code, idx := 0, 0
+	for l := 1; l < len(count); l++ {
+		code = (code + count[l-1]) << 1
+		first[l], start[l] = code, idx
+		idx += count[l]
+	}
+	if size > 0 && len(syms) == 0 {
+		return nil, fmt.Errorf("%w: no symbols", ErrHuffmanFormat)
+	}
+
+	res := make([]byte, 0, size)
+	var (
+		cur  byte
+		left uint
+	)
+	for uint64(len(res)) < size {
+		code, l := 0, 0
+		for {
+			if left == 0 {
+				if cur, err = br.ReadByte(); err != nil {
+					return nil, fmt.Errorf("%w: %v", ErrHuffmanFormat, err)
+				}
+				left = 8
+			}
+			left--
+			code = code<<1 | int(cur>>left&1)
+			l++
+			if l >= len(count) {
+				return nil, fmt.Errorf("%w: bad code", ErrHuffmanFormat)
+			}
+			if d := code - first[l]; d >= 0 && d < count[l] {
+				res = append(res, syms[start[l]+d])
+				break
 			}
-			dep++
-			f = h.root[f].parent
 		}
-		m[byte(h.maps[i])] = b
 	}
-	h.reflects = m
+	return res, nil
 }
-func (h *huffmanTree) encodeBody(b []byte) ([]byte, error) {
-	bbs := make([]byte, 1)
-	pos := int64(0)
-	for _, v := range b {
-		bs, ok := h.reflects[v]
-		if !ok {
-			return nil, fmt.Errorf("not found meta data of %v", v)
+
+// 由字节频率计算码长，超过HUFFMAN_MAX_CODE_LEN时频率减半重建
+func huffmanLengths(freq [256]int) [256]uint8 {
+	for {
+		lens, max := buildLengths(freq)
+		if max <= HUFFMAN_MAX_CODE_LEN {
+			return lens
 		}
-		if len(bbs)+1 == cap(bbs) {
-			bbs = append(bbs, 0)[:len(bbs)] //扩容
+		for i := range freq {
+			if freq[i] > 0 {
+				freq[i] = (freq[i] + 1) / 2
+			}
 		}
-		pos = encodePos(bbs, sbyte(bs), pos, slen(bs))
 	}
-
-	return bbs, nil
 }
 
-func (h *huffmanTree) header() huffmanHeader {
-	hh := huffmanHeader{
-		root: h.root,
-	}
-	for k, v := range h.reflects {
-		hh.bytes[k] = slen(v)
-		hh.reflects[k] = sbyte(v)
+func buildLengths(freq [256]int) ([256]uint8, int) {
+	type node struct {
+		weight int
+		parent int
 	}
-	return hh
-}
-func (h *huffmanTree) decodeHeader(b []byte) (int64, *huffmanHeader, error) {
-	creader := NewCountReader(bytes.NewReader(b))
-	d := gob.NewDecoder(creader)
-	hh := huffmanHeader{}
-	d.Decode(&hh.reflects)
-	d.Decode(&hh.bytes)
-	d.Decode(&hh.root)
-	sl := creader.count
-	crc32 := common.GetCrc32(b[:sl])
-	d.Decode(&hh.checkSum)
-	if hh.checkSum != int(crc32) {
-		return -1, nil, fmt.Errorf("data broken,crc32 not equal")
+	var (
+		lens  [256]uint8
+		nodes []node
+		leafs []int // 叶子对应的符号
+		queue []int // 按权重排序的待合并节点
+	)
+	for i, v := range freq {
+		if v > 0 {
+			nodes = append(nodes, node{weight: v, parent: -1})
+			leafs = append(leafs, i)
+		}
 	}
-	return creader.count, &hh, nil
-}
-func (h *huffmanTree) encodeHeader() []byte {
-	buf := new(bytes.Buffer)
-
-	header := h.header()
-	d := gob.NewEncoder(buf)
-	d.Encode(&header.reflects)
-	d.Encode(&header.bytes)
-	d.Encode(&header.root)
-	header.checkSum = int(common.GetCrc32(buf.Bytes()))
-	d.Encode(&header.checkSum)
-	return buf.Bytes()
-}
-
-func (h *huffmanTree) decodeBody(hh *huffmanHeader, b []byte) ([]byte, error) {
-	pos := 0
-	bbs := make([]byte, 1)
-	decodelen := 0
-	var ok bool
-	for pos < 8*len(b) {
-		isleaf := false
-		child := len(hh.root)
-		lens := 0
-		var bs byte
-		for !isleaf {
-			start := pos / 8
-			offset := pos % 8
-			bit := getPos(b[start], uint8(offset))
-			if bit {
-				child = hh.root[child].lchild
-			} else {
-				child = hh.root[child].rchid
-			}
-			bs = encode(bs, bit, lens)
-			lens++
-			if hh.root[child].lchild == 0 || hh.root[child].rchid == 0 {
-				//isleaf = true
-				break
-			}
-			pos++
+	switch len(leafs) {
+	case 0:
+		return lens, 0
+	case 1:
+		// 只有一种字节时也需要1位
+		lens[leafs[0]] = 1
+		return lens, 1
+	}
+	for i := range nodes {
+		queue = append(queue, i)
+	}
+	sort.Slice(queue, func(i, j int) bool { return nodes[queue[i]].weight < nodes[queue[j]].weight })
+	// 叶子队列与合并出的内部节点队列都有序，每次取两个队首中较小的
+	merged := []int{}
+	pop := func() int {
+		if len(merged) == 0 || (len(queue) > 0 && nodes[queue[0]].weight <= nodes[merged[0]].weight) {
+			v := queue[0]
+			queue = queue[1:]
+			return v
 		}
-
-		if len(bbs) == cap(bbs) {
-			bbs = append(bbs, 0)[:len(bbs)]
+		v := merged[0]
+		merged = merged[1:]
+		return v
+	}
+	for len(queue)+len(merged) > 1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, parent: -1})
+		nodes[a].parent, nodes[b].parent = len(nodes)-1, len(nodes)-1
+		merged = append(merged, len(nodes)-1)
+	}
+	max := 0
+	for i, sym := range leafs {
+		depth := 0
+		for p := nodes[i].parent; p != -1; p = nodes[p].parent {
+			depth++
 		}
-		bbs[decodelen], ok = decode(hh, bs, uint8(lens))
-		if !ok {
-			return nil, fmt.Errorf("decoding body error")
+		if depth > max {
+			max = depth
 		}
-		decodelen++
-	}
-
-	return bbs, nil
-}
-
-func encode(b byte, i bool, dep int) byte {
-	maps := map[int]byte{
-		0: 0xFE, 1: 0xFD, 2: 0xFB, 3: 0xF7, 4: 0xEF, 5: 0xDF, 6: 0xBF, 7: 0x7F,
-	}
-	if i {
-		return b | 0xff - maps[dep]
-	} else {
-		return b & maps[dep]
-	}
-}
-
-func decode(hf *huffmanHeader, b byte, len uint8) (byte, bool) {
-	bs := make(map[uint8]byte)
-	for k, v := range hf.reflects {
-		if v == b {
-			bs[hf.bytes[k]] = k
+		if depth <= 255 {
+			lens[sym] = uint8(depth)
 		}
 	}
-	bx, ok := bs[len]
-	return bx, ok
+	return lens, max
 }
 
-func encodePos(b []byte, r byte, pos int64, len uint8) int64 {
-	start := pos / 8
-	off := uint8(pos % 8)
-	//left := 8 - off
-	bs := b[start]
-	var s byte
-	rea := getLow(r, len)
-	rea = rea << off
-	s = bs & rea
-	b[start] = s
-	if off+len > 8 {
-		right := off + len - 8
-		rea = getHight(r, right)
-		b[start+1] = rea
-	}
-	return pos + int64(len)
-}
-
-func getLow(b byte, len uint8) byte {
-	return b & ((1 << len) - 1)
-}
-func getHight(b byte, len uint8) byte {
-	return b >> (8 - len)
-}
-
-// 0<=pos<8 true ==> 1
-func getPos(b byte, pos uint8) bool {
-	return (b>>pos)&1 == 1
-}
-func slen(s string) (z uint8) {
-	for range s {
-		z++
+// 范式编码：按(码长, 符号)顺序依次分配码字
+func canonicalCodes(lens [256]uint8) [256]uint32 {
+	var (
+		codes [256]uint32
+		syms  []int
+	)
+	for i, l := range lens {
+		if l > 0 {
+			syms = append(syms, i)
+		}
 	}
-	return
-}
-func sbyte(s string) (b byte) {
-	for idx, r := range []byte(s) {
-		if r == 0x01 {
-			b = encode(b, true, idx)
-		} else {
-			b = encode(b, false, idx)
+	sort.SliceStable(syms, func(i, j int) bool { return lens[syms[i]] < lens[syms[j]] })
+	code, prev := uint32(0), uint8(0)
+	for i, sym := range syms {
+		if i > 0 {
+			code++
 		}
+		code <<= lens[sym] - prev
+		prev = lens[sym]
+		codes[sym] = code
 	}
-	return
+	return codes
 }
@@ -0,0 +1,432 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"fts/internal/types"
+	"sort"
+)
+
+var (
+	ErrPostingsFormat   = errors.New("invalid postings data")
+	ErrPostingsUnsorted = errors.New("postings ids should be strictly increasing")
+	ErrIndexVersion     = errors.New("unsupported index format version")
+)
+
+var (
+	POSTINGS_BLOCK_SIZE = 128 // 每块的文档个数
+)
+
+// 块的编码方式
+type PostingsFormat uint8
+
+const (
+	POSTINGS_AUTO   PostingsFormat = iota // 每块选择较小的一种
+	POSTINGS_VARINT                       // 差值与词频按varint写入
+	POSTINGS_PACKED                       // 减去块内最小值后按固定位宽打包(frame of reference)
+)
+
+// 块的跳表项，Last为块内最后一个文档，Off为块在数据区内的偏移
+type PostingsSkip struct {
+	Last int64
+	Off  int
+	Size int
+}
+
+// 倒排列表的头部与跳表
+type PostingsHeader struct {
+	Count     int
+	BlockSize int
+	First     int64
+	Skips     []PostingsSkip
+}
+
+// 倒排列表的编码
+// 格式: 文档数(uvarint) | 每块文档数(uvarint) | 第一个文档ID(varint) | 块数(uvarint)
+//
+//	| 每块的跳表项: 与上一块Last的差值(uvarint), 块的字节数(uvarint)
+//	| 各块的数据
+//
+// 块内: 编码方式(1) | 文档ID差值 | 词频，第一块的第一个差值相对于第一个文档ID，之后相对于上一块的Last
+func EncodePostings(ids []int64, freqs []int16) ([]byte, error) {
+	return EncodePostingsWith(POSTINGS_AUTO, ids, freqs)
+}
+
+func EncodePostingsWith(format PostingsFormat, ids []int64, freqs []int16) ([]byte, error) {
+	if len(ids) != len(freqs) {
+		return nil, fmt.Errorf("%w: %d ids but %d freqs", ErrPostingsFormat, len(ids), len(freqs))
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			return nil, fmt.Errorf("%w: %d after %d", ErrPostingsUnsorted, ids[i], ids[i-1])
+		}
+	}
+	size := POSTINGS_BLOCK_SIZE
+	if size <= 0 {
+		size = 128
+	}
+
+	res := binary.AppendUvarint(nil, uint64(len(ids)))
+	res = binary.AppendUvarint(res, uint64(size))
+	if len(ids) == 0 {
+		return res, nil
+	}
+	res = binary.AppendVarint(res, ids[0])
+	nblocks := (len(ids) + size - 1) / size
+	res = binary.AppendUvarint(res, uint64(nblocks))
+
+	var (
+		data   []byte
+		skips  []byte
+		prev   = ids[0]
+		deltas = make([]uint64, 0, size)
+		tfs    = make([]uint64, 0, size)
+	)
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		deltas, tfs = deltas[:0], tfs[:0]
+		for i := start; i < end; i++ {
+			deltas = append(deltas, uint64(ids[i]-prev))
+			tfs = append(tfs, uint64(uint16(freqs[i])))
+			prev = ids[i]
+		}
+		block := encodePostingsBlock(format, deltas, tfs)
+		skips = binary.AppendUvarint(skips, uint64(ids[end-1]-ids[maxInt(start-1, 0)]))
+		skips = binary.AppendUvarint(skips, uint64(len(block)))
+		data = append(data, block...)
+	}
+	res = append(res, skips...)
+	return append(res, data...), nil
+}
+
+// 按文档ID排序后编码，词频取自Info
+func EncodeQueryResult(res types.IndexQueryResult) ([]byte, error) {
+	ids := res.Ids
+	if len(ids) != len(res.Info) {
+		ids = make([]int64, 0, len(res.Info))
+		for id := range res.Info {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	freqs := make([]int16, len(ids))
+	for i, id := range ids {
+		freqs[i] = res.Info[id]
+	}
+	return EncodePostings(ids, freqs)
+}
+
+func DecodeQueryResult(b []byte) (types.IndexQueryResult, error) {
+	ids, freqs, err := DecodePostings(b)
+	if err != nil {
+		return types.IndexQueryResult{}, err
+	}
+	info := make(map[int64]int16, len(ids))
+	for i, id := range ids {
+		info[id] = freqs[i]
+	}
+	return types.IndexQueryResult{Ids: ids, Info: info}, nil
+}
+
+// 索引记录的格式标记，与旧版本的gob数据区分
+var indexMagic = []byte("FPI")
+
+const INDEX_VERSION = 1
+
+// 索引记录: magic(3) | 版本(1) | 词项长度(uvarint) | 词项 | 倒排列表(EncodePostings的结果)
+func EncodeIndex(token string, postings []byte) []byte {
+	res := make([]byte, 0, len(indexMagic)+1+binary.MaxVarintLen64+len(token)+len(postings))
+	res = append(res, indexMagic...)
+	res = append(res, INDEX_VERSION)
+	res = binary.AppendUvarint(res, uint64(len(token)))
+	res = append(res, token...)
+	return append(res, postings...)
+}
+
+// 是否为EncodeIndex写入的记录，不是时按旧格式读取
+func IsIndexFormat(b []byte) bool {
+	return len(b) > len(indexMagic) && string(b[:len(indexMagic)]) == string(indexMagic)
+}
+
+// 返回词项与未解码的倒排列表
+func DecodeIndex(b []byte) (string, []byte, error) {
+	if !IsIndexFormat(b) {
+		return "", nil, fmt.Errorf("%w: missing index magic", ErrPostingsFormat)
+	}
+	b = b[len(indexMagic):]
+	if b[0] != INDEX_VERSION {
+		return "", nil, fmt.Errorf("%w: %d", ErrIndexVersion, b[0])
+	}
+	b = b[1:]
+	n, m := binary.Uvarint(b)
+	if m <= 0 || uint64(len(b)-m) < n {
+		return "", nil, fmt.Errorf("%w: bad token length", ErrPostingsFormat)
+	}
+	return string(b[m : m+int(n)]), b[m+int(n):], nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func encodePostingsBlock(format PostingsFormat, deltas, tfs []uint64) []byte {
+	switch format {
+	case POSTINGS_VARINT:
+		return appendVarintBlock([]byte{byte(POSTINGS_VARINT)}, deltas, tfs)
+	case POSTINGS_PACKED:
+		return appendPackedBlock([]byte{byte(POSTINGS_PACKED)}, deltas, tfs)
+	}
+	v := appendVarintBlock([]byte{byte(POSTINGS_VARINT)}, deltas, tfs)
+	p := appendPackedBlock([]byte{byte(POSTINGS_PACKED)}, deltas, tfs)
+	if len(p) < len(v) {
+		return p
+	}
+	return v
+}
+
+func appendVarintBlock(dst []byte, deltas, tfs []uint64) []byte {
+	for _, v := range deltas {
+		dst = binary.AppendUvarint(dst, v)
+	}
+	for _, v := range tfs {
+		dst = binary.AppendUvarint(dst, v)
+	}
+	return dst
+}
+
+func appendPackedBlock(dst []byte, deltas, tfs []uint64) []byte {
+	dst = appendFrame(dst, deltas)
+	return appendFrame(dst, tfs)
+}
+
+// 最小值(uvarint) | 位宽(1) | 减去最小值后按位宽打包，低位在前
+func appendFrame(dst []byte, vals []uint64) []byte {
+	min, max := vals[0], vals[0]
+	for _, v := range vals {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	width := bitsLen(max - min)
+	dst = binary.AppendUvarint(dst, min)
+	dst = append(dst, byte(width))
+	start := len(dst)
+	dst = append(dst, make([]byte, (int(width)*len(vals)+7)/8)...)
+	packed := dst[start:]
+	bit := uint(0)
+	for _, v := range vals {
+		v -= min
+		for left := width; left > 0; {
+			idx, shift := bit/8, bit%8
+			take := minUint(8-shift, left)
+			packed[idx] |= byte(v&(1<<take-1)) << shift
+			v >>= take
+			left -= take
+			bit += take
+		}
+	}
+	return dst
+}
+
+func minUint(a, b uint) uint {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func bitsLen(v uint64) uint {
+	n := uint(0)
+	for ; v > 0; v >>= 1 {
+		n++
+	}
+	return n
+}
+
+// 解析头部与跳表，返回头部与数据区
+func ReadPostingsHeader(b []byte) (*PostingsHeader, []byte, error) {
+	bad := func(what string) (*PostingsHeader, []byte, error) {
+		return nil, nil, fmt.Errorf("%w: bad %s", ErrPostingsFormat, what)
+	}
+	c, n := binary.Uvarint(b)
+	if n <= 0 {
+		return bad("count")
+	}
+	b = b[n:]
+	size, n := binary.Uvarint(b)
+	if n <= 0 || size == 0 || size > 1<<20 {
+		return bad("block size")
+	}
+	b = b[n:]
+	ph := &PostingsHeader{Count: int(c), BlockSize: int(size)}
+	if c == 0 {
+		return ph, b, nil
+	}
+	if ph.First, n = binary.Varint(b); n <= 0 {
+		return bad("first id")
+	}
+	b = b[n:]
+	nblocks, n := binary.Uvarint(b)
+	if n <= 0 || nblocks != (c+size-1)/size {
+		return bad("block count")
+	}
+	b = b[n:]
+	ph.Skips = make([]PostingsSkip, nblocks)
+	last, off := ph.First, 0
+	for i := range ph.Skips {
+		d, n1 := binary.Uvarint(b)
+		if n1 <= 0 {
+			return bad("skip")
+		}
+		size, n2 := binary.Uvarint(b[n1:])
+		if n2 <= 0 || size == 0 {
+			return bad("skip")
+		}
+		b = b[n1+n2:]
+		last += int64(d)
+		ph.Skips[i] = PostingsSkip{Last: last, Off: off, Size: int(size)}
+		off += int(size)
+	}
+	if off > len(b) {
+		return nil, nil, fmt.Errorf("%w: %d bytes of blocks but %d left", ErrPostingsFormat, off, len(b))
+	}
+	return ph, b, nil
+}
+
+func DecodePostings(b []byte) ([]int64, []int16, error) {
+	ph, data, err := ReadPostingsHeader(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 损坏的头部可能给出很大的文档数，预分配不超过数据区字节数
+	capacity := ph.Count
+	if capacity > len(data) {
+		capacity = len(data)
+	}
+	ids := make([]int64, 0, capacity)
+	freqs := make([]int16, 0, capacity)
+	for i := range ph.Skips {
+		if ids, freqs, err = ph.DecodeBlock(i, data, ids, freqs); err != nil {
+			return nil, nil, err
+		}
+	}
+	return ids, freqs, nil
+}
+
+// 解码第i块追加到ids与freqs
+func (ph *PostingsHeader) DecodeBlock(i int, data []byte, ids []int64, freqs []int16) ([]int64, []int16, error) {
+	n := ph.Count - i*ph.BlockSize
+	if n > ph.BlockSize {
+		n = ph.BlockSize
+	}
+	skip := ph.Skips[i]
+	if skip.Off+skip.Size > len(data) {
+		return ids, freqs, fmt.Errorf("%w: bad block %d", ErrPostingsFormat, i)
+	}
+	prev := ph.First
+	if i > 0 {
+		prev = ph.Skips[i-1].Last
+	}
+	block := data[skip.Off : skip.Off+skip.Size]
+	var (
+		deltas, tfs []uint64
+		err         error
+	)
+	switch PostingsFormat(block[0]) {
+	case POSTINGS_VARINT:
+		deltas, tfs, err = readVarintBlock(block[1:], n)
+	case POSTINGS_PACKED:
+		deltas, tfs, err = readPackedBlock(block[1:], n)
+	default:
+		err = fmt.Errorf("%w: block %d format %d", ErrPostingsFormat, i, block[0])
+	}
+	if err != nil {
+		return ids, freqs, err
+	}
+	for j := 0; j < n; j++ {
+		prev += int64(deltas[j])
+		ids = append(ids, prev)
+		freqs = append(freqs, int16(uint16(tfs[j])))
+	}
+	if prev != skip.Last {
+		return ids, freqs, fmt.Errorf("%w: block %d ends at %d, skip says %d", ErrPostingsFormat, i, prev, skip.Last)
+	}
+	return ids, freqs, nil
+}
+
+func readVarintBlock(b []byte, n int) ([]uint64, []uint64, error) {
+	vals := make([]uint64, 2*n)
+	for i := range vals {
+		v, m := binary.Uvarint(b)
+		if m <= 0 {
+			return nil, nil, fmt.Errorf("%w: bad varint", ErrPostingsFormat)
+		}
+		vals[i] = v
+		b = b[m:]
+	}
+	return vals[:n], vals[n:], nil
+}
+
+func readPackedBlock(b []byte, n int) ([]uint64, []uint64, error) {
+	deltas, m, err := readFrame(b, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	tfs, _, err := readFrame(b[m:], n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return deltas, tfs, nil
+}
+
+// 返回n个值与读取的字节数
+func readFrame(b []byte, n int) ([]uint64, int, error) {
+	min, m := binary.Uvarint(b)
+	if m <= 0 || m >= len(b) {
+		return nil, 0, fmt.Errorf("%w: bad frame", ErrPostingsFormat)
+	}
+	width := uint(b[m])
+	if width > 64 {
+		return nil, 0, fmt.Errorf("%w: bit width %d", ErrPostingsFormat, width)
+	}
+	b = b[m+1:]
+	nbytes := (int(width)*n + 7) / 8
+	if nbytes > len(b) {
+		return nil, 0, fmt.Errorf("%w: frame needs %d bytes but %d left", ErrPostingsFormat, nbytes, len(b))
+	}
+	vals := make([]uint64, n)
+	mask := uint64(1)<<width - 1
+	if width == 64 {
+		mask = ^uint64(0)
+	}
+	bit := uint(0)
+	for i := range vals {
+		idx, shift := bit/8, bit%8
+		if width <= 56 && int(idx)+8 <= len(b) {
+			// 一次取8个字节
+			vals[i] = binary.LittleEndian.Uint64(b[idx:])>>shift&mask + min
+			bit += width
+			continue
+		}
+		var v uint64
+		for got := uint(0); got < width; {
+			idx, shift = bit/8, bit%8
+			take := minUint(8-shift, width-got)
+			v |= uint64(b[idx]>>shift&(1<<take-1)) << got
+			got += take
+			bit += take
+		}
+		vals[i] = v + min
+	}
+	return vals, m + 1 + nbytes, nil
+}
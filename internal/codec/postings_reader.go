@@ -0,0 +1,107 @@
+package codec
+
+import (
+	"fts/internal/types"
+	"sort"
+)
+
+var _ types.PostingsIterator = (*PostingsReader)(nil)
+
+// 按块惰性解码的倒排列表，Advance先在跳表中找到目标所在的块，只解码这一块
+type PostingsReader struct {
+	ph      *PostingsHeader
+	data    []byte
+	block   int // 当前解码的块，-1表示还没有开始，len(Skips)表示结束
+	pos     int // 当前文档在块内的位置
+	ids     []int64
+	freqs   []int16
+	decoded int
+	err     error
+}
+
+func NewPostingsReader(b []byte) (*PostingsReader, error) {
+	ph, data, err := ReadPostingsHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	return &PostingsReader{
+		ph:    ph,
+		data:  data,
+		block: -1,
+	}, nil
+}
+
+func (pr *PostingsReader) Doc() int64 {
+	return pr.ids[pr.pos]
+}
+
+func (pr *PostingsReader) Freq() int16 {
+	return pr.freqs[pr.pos]
+}
+
+func (pr *PostingsReader) Cost() int64 {
+	return int64(pr.ph.Count)
+}
+
+// 解码过的块数
+func (pr *PostingsReader) Decoded() int {
+	return pr.decoded
+}
+
+// 解码失败时遍历提前结束，由Err返回原因
+func (pr *PostingsReader) Err() error {
+	return pr.err
+}
+
+func (pr *PostingsReader) exhausted() bool {
+	return pr.block >= len(pr.ph.Skips)
+}
+
+func (pr *PostingsReader) load(block int) bool {
+	pr.block, pr.pos = block, 0
+	if pr.exhausted() {
+		return false
+	}
+	pr.ids, pr.freqs, pr.err = pr.ph.DecodeBlock(block, pr.data, pr.ids[:0], pr.freqs[:0])
+	pr.decoded++
+	if pr.err != nil {
+		pr.block = len(pr.ph.Skips)
+		return false
+	}
+	return true
+}
+
+func (pr *PostingsReader) Next() bool {
+	if pr.exhausted() {
+		return false
+	}
+	if pr.block >= 0 && pr.pos+1 < len(pr.ids) {
+		pr.pos++
+		return true
+	}
+	return pr.load(pr.block + 1)
+}
+
+func (pr *PostingsReader) Advance(target int64) bool {
+	if pr.exhausted() {
+		return false
+	}
+	if pr.block >= 0 && pr.ids[pr.pos] >= target {
+		return true
+	}
+	skips := pr.ph.Skips
+	if pr.block < 0 || skips[pr.block].Last < target {
+		// 当前块之后第一个Last不小于target的块
+		from := pr.block + 1
+		i := from + sort.Search(len(skips)-from, func(i int) bool {
+			return skips[from+i].Last >= target
+		})
+		if !pr.load(i) {
+			return false
+		}
+	}
+	pr.pos += sort.Search(len(pr.ids)-pr.pos, func(i int) bool {
+		return pr.ids[pr.pos+i] >= target
+	})
+	return true
+}
@@ -0,0 +1,251 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fts/internal/types"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 生成n个递增的文档ID，gap为平均间隔
+func genPostings(r *rand.Rand, n int, gap int64) ([]int64, []int16) {
+	ids := make([]int64, n)
+	freqs := make([]int16, n)
+	cur := r.Int63n(1000) - 500
+	for i := range ids {
+		cur += 1 + r.Int63n(2*gap)
+		ids[i] = cur
+		freqs[i] = int16(1 + r.ExpFloat64()*3)
+	}
+	return ids, freqs
+}
+
+func TestPostingsRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	hashed := make(map[int64]bool)
+	for len(hashed) < 1000 {
+		hashed[r.Int63()-r.Int63()] = true
+	}
+	hashIds := make([]int64, 0, len(hashed))
+	for id := range hashed {
+		hashIds = append(hashIds, id)
+	}
+	sort.Slice(hashIds, func(i, j int) bool { return hashIds[i] < hashIds[j] })
+
+	type input struct {
+		ids   []int64
+		freqs []int16
+	}
+	inputs := []input{
+		{nil, nil},
+		{[]int64{42}, []int16{3}},
+		{[]int64{math.MinInt64, -1, 0, math.MaxInt64}, []int16{1, -1, math.MaxInt16, math.MinInt16}},
+		{hashIds, make([]int16, len(hashIds))},
+	}
+	for _, n := range []int{127, 128, 129, 1000, 10000} {
+		ids, freqs := genPostings(r, n, 5)
+		inputs = append(inputs, input{ids, freqs})
+	}
+	for _, format := range []PostingsFormat{POSTINGS_AUTO, POSTINGS_VARINT, POSTINGS_PACKED} {
+		for i, in := range inputs {
+			b, err := EncodePostingsWith(format, in.ids, in.freqs)
+			assert.Nil(t, err)
+			ids, freqs, err := DecodePostings(b)
+			assert.Nil(t, err, "format %d input %d", format, i)
+			assert.Equal(t, len(in.ids), len(ids), "format %d input %d", format, i)
+			for j := range in.ids {
+				if ids[j] != in.ids[j] || freqs[j] != in.freqs[j] {
+					t.Fatalf("format %d input %d at %d: get (%d, %d), expect (%d, %d)", format, i, j, ids[j], freqs[j], in.ids[j], in.freqs[j])
+				}
+			}
+
+			// 跳表项与块的最后一个文档一致
+			ph, _, err := ReadPostingsHeader(b)
+			assert.Nil(t, err)
+			for k, skip := range ph.Skips {
+				end := (k+1)*ph.BlockSize - 1
+				if end >= len(in.ids) {
+					end = len(in.ids) - 1
+				}
+				assert.Equal(t, in.ids[end], skip.Last)
+			}
+		}
+	}
+
+	_, err := EncodePostings([]int64{2, 1}, []int16{1, 1})
+	assert.True(t, errors.Is(err, ErrPostingsUnsorted))
+	_, err = EncodePostings([]int64{1}, nil)
+	assert.True(t, errors.Is(err, ErrPostingsFormat))
+}
+
+func TestPostingsQueryResult(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	ids, freqs := genPostings(r, 500, 100)
+	info := make(map[int64]int16)
+	for i, id := range ids {
+		info[id] = freqs[i]
+	}
+	// Ids为空时由Info排序
+	b, err := EncodeQueryResult(types.IndexQueryResult{Info: info})
+	assert.Nil(t, err)
+	res, err := DecodeQueryResult(b)
+	assert.Nil(t, err)
+	assert.Equal(t, ids, res.Ids)
+	assert.Equal(t, info, res.Info)
+}
+
+func TestIndexFormat(t *testing.T) {
+	postings, err := EncodePostings([]int64{1, 5, 9}, []int16{1, 2, 3})
+	assert.Nil(t, err)
+	b := EncodeIndex("北京", postings)
+	assert.True(t, IsIndexFormat(b))
+	token, raw, err := DecodeIndex(b)
+	assert.Nil(t, err)
+	assert.Equal(t, "北京", token)
+	assert.Equal(t, postings, raw)
+
+	// 旧版本的gob数据
+	assert.False(t, IsIndexFormat(gobPostings([]int64{1}, []int16{1})))
+	_, _, err = DecodeIndex(b[:5])
+	assert.True(t, errors.Is(err, ErrPostingsFormat))
+	b[3] = INDEX_VERSION + 1
+	_, _, err = DecodeIndex(b)
+	assert.True(t, errors.Is(err, ErrIndexVersion))
+}
+
+func TestPostingsCorrupted(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	ids, freqs := genPostings(r, 1000, 10)
+	b, err := EncodePostings(ids, freqs)
+	assert.Nil(t, err)
+	for i := 0; i < len(b); i += 7 {
+		// 截断与改写都不能panic
+		DecodePostings(b[:i])
+		c := append([]byte{}, b...)
+		c[i] ^= 0x5a
+		DecodePostings(c)
+	}
+}
+
+func postingsBenchData() ([]int64, []int16) {
+	return genPostings(rand.New(rand.NewSource(4)), 100000, 20)
+}
+
+func gobPostings(ids []int64, freqs []int16) []byte {
+	m := make(map[int64]int16, len(ids))
+	for i, id := range ids {
+		m[id] = freqs[i]
+	}
+	buf := new(bytes.Buffer)
+	gob.NewEncoder(buf).Encode(m)
+	return buf.Bytes()
+}
+
+func BenchmarkPostingsEncode(b *testing.B) {
+	ids, freqs := postingsBenchData()
+	b.Run("gob", func(b *testing.B) {
+		var size int
+		for i := 0; i < b.N; i++ {
+			size = len(gobPostings(ids, freqs))
+		}
+		b.ReportMetric(float64(size)/float64(len(ids)), "bytes/doc")
+	})
+	for _, bc := range []struct {
+		name   string
+		format PostingsFormat
+	}{{"varint", POSTINGS_VARINT}, {"packed", POSTINGS_PACKED}, {"auto", POSTINGS_AUTO}} {
+		b.Run(bc.name, func(b *testing.B) {
+			var size int
+			for i := 0; i < b.N; i++ {
+				p, _ := EncodePostingsWith(bc.format, ids, freqs)
+				size = len(p)
+			}
+			b.ReportMetric(float64(size)/float64(len(ids)), "bytes/doc")
+		})
+	}
+}
+
+func BenchmarkPostingsDecode(b *testing.B) {
+	ids, freqs := postingsBenchData()
+	b.Run("gob", func(b *testing.B) {
+		data := gobPostings(ids, freqs)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m := make(map[int64]int16)
+			gob.NewDecoder(bytes.NewReader(data)).Decode(&m)
+		}
+		b.ReportMetric(float64(len(data))/float64(len(ids)), "bytes/doc")
+	})
+	for _, bc := range []struct {
+		name   string
+		format PostingsFormat
+	}{{"varint", POSTINGS_VARINT}, {"packed", POSTINGS_PACKED}, {"auto", POSTINGS_AUTO}} {
+		b.Run(bc.name, func(b *testing.B) {
+			data, _ := EncodePostingsWith(bc.format, ids, freqs)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				DecodePostings(data)
+			}
+			b.ReportMetric(float64(len(data))/float64(len(ids)), "bytes/doc")
+		})
+	}
+}
+
+func TestPostingsReader(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	ids, freqs := genPostings(r, 5000, 10)
+	b, err := EncodePostings(ids, freqs)
+	assert.Nil(t, err)
+
+	pr, err := NewPostingsReader(b)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(ids)), pr.Cost())
+	for i := range ids {
+		assert.True(t, pr.Next())
+		if pr.Doc() != ids[i] || pr.Freq() != freqs[i] {
+			t.Fatalf("at %d: get (%d, %d), expect (%d, %d)", i, pr.Doc(), pr.Freq(), ids[i], freqs[i])
+		}
+	}
+	assert.False(t, pr.Next())
+	assert.False(t, pr.Advance(0))
+
+	// 随机递增的目标与二分查找的结果一致
+	pr, _ = NewPostingsReader(b)
+	target := ids[0] - 5
+	for {
+		target += r.Int63n(300)
+		expect := sort.Search(len(ids), func(i int) bool { return ids[i] >= target })
+		ok := pr.Advance(target)
+		if expect == len(ids) {
+			assert.False(t, ok)
+			break
+		}
+		assert.True(t, ok)
+		assert.Equal(t, ids[expect], pr.Doc())
+		if pr.Doc() > target {
+			// 已经越过目标时不移动
+			assert.True(t, pr.Advance(target))
+			assert.Equal(t, ids[expect], pr.Doc())
+		}
+	}
+	assert.Nil(t, pr.Err())
+
+	// 稀疏的跳跃只解码用到的块
+	pr, _ = NewPostingsReader(b)
+	for _, i := range []int{10, 2000, 4990} {
+		assert.True(t, pr.Advance(ids[i]))
+	}
+	assert.Equal(t, 3, pr.Decoded())
+
+	empty, _ := EncodePostings(nil, nil)
+	pr, err = NewPostingsReader(empty)
+	assert.Nil(t, err)
+	assert.False(t, pr.Next())
+	assert.False(t, pr.Advance(1))
+}
@@ -1,7 +1,40 @@
 package common
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrDuplicateload = errors.New("file has already load")
+	ErrCorrupted     = errors.New("data corrupted")
 )
+
+// 校验和不一致，Path与Offset指出损坏的页面或记录，可以用errors.Is(err, ErrCorrupted)判断
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Expect uint32
+	Actual uint32
+}
+
+func (ce *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: %s at %d, crc32 expect %08x but get %08x", ErrCorrupted, ce.Path, ce.Offset, ce.Expect, ce.Actual)
+}
+
+func (ce *CorruptionError) Unwrap() error {
+	return ErrCorrupted
+}
+
+// 校验data的crc32，不一致时返回*CorruptionError
+func VerifyCrc32(path string, offset int64, data []byte, expect uint32) error {
+	if actual := GetCrc32(data); actual != expect {
+		return &CorruptionError{
+			Path:   path,
+			Offset: offset,
+			Expect: expect,
+			Actual: actual,
+		}
+	}
+	return nil
+}
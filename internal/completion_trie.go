@@ -0,0 +1,273 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"sync"
+)
+
+// 自动补全用的字典树，每个节点缓存子树中权重最高的k个补全
+// 更新时沿路径自底向上重算缓存，查询前缀时n<=k直接返回缓存
+type CompletionTrie struct {
+	sync.RWMutex
+	root *completionNode
+	k    int
+	lens int
+}
+
+type Completion struct {
+	Key    string // 树中的key，一般是归一化(小写)后的文本
+	Text   string // 展示的原始文本
+	Weight int64
+}
+
+type completionNode struct {
+	ch     rune
+	childs []*completionNode
+	end    bool
+	key    string
+	text   string
+	weight int64
+	top    []Completion
+}
+
+type completionSerialNode struct {
+	Ch     rune
+	Childs []int
+	End    bool
+	Key    string
+	Text   string
+	Weight int64
+}
+
+func NewCompletionTrie(k int) *CompletionTrie {
+	if k <= 0 {
+		k = 1
+	}
+	return &CompletionTrie{
+		root: &completionNode{},
+		k:    k,
+	}
+}
+
+func (cn *completionNode) child(r rune) *completionNode {
+	for _, v := range cn.childs {
+		if v.ch == r {
+			return v
+		}
+	}
+	return nil
+}
+
+func lessCompletion(a, b Completion) bool {
+	if a.Weight != b.Weight {
+		return a.Weight > b.Weight
+	}
+	return a.Key < b.Key
+}
+
+// 由自身和子节点的缓存重算top-k
+func (cn *completionNode) refresh(k int) {
+	top := []Completion{}
+	if cn.end {
+		top = append(top, Completion{
+			Key:    cn.key,
+			Text:   cn.text,
+			Weight: cn.weight,
+		})
+	}
+	for _, v := range cn.childs {
+		top = append(top, v.top...)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return lessCompletion(top[i], top[j])
+	})
+	if len(top) > k {
+		top = top[:k]
+	}
+	cn.top = top
+}
+
+func (ct *CompletionTrie) update(key string, text string, f func(int64) int64) {
+	ct.Lock()
+	defer ct.Unlock()
+	path := []*completionNode{ct.root}
+	p := ct.root
+	for _, r := range key {
+		n := p.child(r)
+		if n == nil {
+			n = &completionNode{ch: r}
+			p.childs = append(p.childs, n)
+		}
+		p = n
+		path = append(path, p)
+	}
+
+	wasEnd := p.end
+	p.weight = f(p.weight)
+	p.end = p.weight > 0
+	p.key = key
+	if text != "" {
+		p.text = text
+	} else if p.text == "" {
+		p.text = key
+	}
+	if !p.end {
+		p.weight = 0
+	}
+	if wasEnd && !p.end {
+		ct.lens--
+	} else if !wasEnd && p.end {
+		ct.lens++
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		path[i].refresh(ct.k)
+	}
+}
+
+// 权重累加delta，例如词项每出现在一篇文档中加一；权重<=0时移除
+func (ct *CompletionTrie) Add(key string, text string, delta int64) {
+	ct.update(key, text, func(w int64) int64 {
+		return w + delta
+	})
+}
+
+// 直接设置权重，例如外部存储的热度；权重<=0时移除
+func (ct *CompletionTrie) Set(key string, text string, weight int64) {
+	ct.update(key, text, func(int64) int64 {
+		return weight
+	})
+}
+
+func (ct *CompletionTrie) Weight(key string) int64 {
+	ct.RLock()
+	defer ct.RUnlock()
+	p := ct.root
+	for _, r := range key {
+		if p = p.child(r); p == nil {
+			return 0
+		}
+	}
+	return p.weight
+}
+
+// 以prefix开头、权重最高的n个补全
+func (ct *CompletionTrie) TopK(prefix string, n int) []Completion {
+	ct.RLock()
+	defer ct.RUnlock()
+	p := ct.root
+	for _, r := range prefix {
+		if p = p.child(r); p == nil {
+			return nil
+		}
+	}
+	if n <= ct.k {
+		if n > len(p.top) {
+			n = len(p.top)
+		}
+		res := make([]Completion, n)
+		copy(res, p.top[:n])
+		return res
+	}
+
+	// 超过缓存大小，遍历子树
+	res := []Completion{}
+	var dfs func(*completionNode)
+	dfs = func(cn *completionNode) {
+		if cn.end {
+			res = append(res, Completion{
+				Key:    cn.key,
+				Text:   cn.text,
+				Weight: cn.weight,
+			})
+		}
+		for _, v := range cn.childs {
+			dfs(v)
+		}
+	}
+	dfs(p)
+	sort.Slice(res, func(i, j int) bool {
+		return lessCompletion(res[i], res[j])
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+func (ct *CompletionTrie) Len() int {
+	ct.RLock()
+	defer ct.RUnlock()
+	return ct.lens
+}
+
+func (cn *completionNode) serialNode(s *[]completionSerialNode) int {
+	idx := len(*s)
+	*s = append(*s, completionSerialNode{
+		Ch:     cn.ch,
+		End:    cn.end,
+		Key:    cn.key,
+		Text:   cn.text,
+		Weight: cn.weight,
+	})
+	childs := make([]int, 0, len(cn.childs))
+	for _, v := range cn.childs {
+		childs = append(childs, v.serialNode(s))
+	}
+	(*s)[idx].Childs = childs
+	return idx
+}
+
+// top-k缓存不参与序列化，Dump时重建
+func (cn *completionNode) dumpNode(s []completionSerialNode, idx int, k int) int {
+	cn.ch = s[idx].Ch
+	cn.end = s[idx].End
+	cn.key = s[idx].Key
+	cn.text = s[idx].Text
+	cn.weight = s[idx].Weight
+	lens := 0
+	if cn.end {
+		lens++
+	}
+	for _, v := range s[idx].Childs {
+		node := &completionNode{}
+		lens += node.dumpNode(s, v, k)
+		cn.childs = append(cn.childs, node)
+	}
+	cn.refresh(k)
+	return lens
+}
+
+func (ct *CompletionTrie) Serial() []byte {
+	ct.RLock()
+	defer ct.RUnlock()
+	sl := make([]completionSerialNode, 0, ct.lens)
+	ct.root.serialNode(&sl)
+
+	buf := new(bytes.Buffer)
+	e := gob.NewEncoder(buf)
+	e.Encode(ct.k)
+	e.Encode(sl)
+	return buf.Bytes()
+}
+
+func (ct *CompletionTrie) Dump(b []byte) {
+	var (
+		k  int
+		sl []completionSerialNode
+	)
+	d := gob.NewDecoder(bytes.NewReader(b))
+	if d.Decode(&k) != nil || d.Decode(&sl) != nil || len(sl) == 0 {
+		return
+	}
+	root := &completionNode{}
+	lens := root.dumpNode(sl, 0, k)
+
+	ct.Lock()
+	ct.k = k
+	ct.root = root
+	ct.lens = lens
+	ct.Unlock()
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func keysOf(cs []Completion) []string {
+	res := []string{}
+	for _, v := range cs {
+		res = append(res, v.Key)
+	}
+	return res
+}
+
+func TestCompletionTrie(t *testing.T) {
+	ct := NewCompletionTrie(2)
+	ct.Add("beijing", "Beijing", 5)
+	ct.Add("beihai", "", 3)
+	ct.Add("bei", "", 1)
+	ct.Add("tibet", "", 4)
+
+	assert.Equal(t, 4, ct.Len())
+	assert.Equal(t, []string{"beijing", "beihai"}, keysOf(ct.TopK("be", 2)))
+	assert.Equal(t, "Beijing", ct.TopK("b", 1)[0].Text)
+	assert.Equal(t, "beihai", ct.TopK("beih", 1)[0].Text)
+	assert.Equal(t, []string{"beijing", "tibet"}, keysOf(ct.TopK("", 2)))
+	assert.Empty(t, ct.TopK("x", 2))
+
+	// 权重变化后缓存跟着更新
+	ct.Add("bei", "", 9)
+	assert.Equal(t, []string{"bei", "beijing"}, keysOf(ct.TopK("be", 2)))
+	ct.Set("bei", "", 0)
+	assert.Equal(t, 3, ct.Len())
+	assert.Equal(t, []string{"beijing", "beihai"}, keysOf(ct.TopK("be", 5)))
+	assert.Equal(t, int64(0), ct.Weight("bei"))
+
+	// 超过缓存大小时遍历子树
+	assert.Equal(t, []string{"beijing", "tibet", "beihai"}, keysOf(ct.TopK("", 5)))
+
+	nt := NewCompletionTrie(1)
+	nt.Dump(ct.Serial())
+	assert.Equal(t, 3, nt.Len())
+	assert.Equal(t, []string{"beijing", "beihai"}, keysOf(nt.TopK("bei", 2)))
+	assert.Equal(t, "Beijing", nt.TopK("beij", 1)[0].Text)
+	assert.Equal(t, int64(4), nt.Weight("tibet"))
+}
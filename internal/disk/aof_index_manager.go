@@ -1,12 +1,15 @@
 package disk
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"fts/internal/cache"
 	"fts/internal/common"
 	"fts/internal/types"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -16,6 +19,10 @@ var (
 	maxElem = 65535 //cache token
 )
 
+// 记录头8字节，低32位为内容长度，高32位为内容的crc32，与B+树的页面头相同
+// 校验和随记录写入段文件，重启、压缩之后仍然可以校验
+const AOF_RECORD_HEADER = 8
+
 type chunkInfo struct {
 	sync.RWMutex
 	offset map[int64]int64
@@ -42,6 +49,27 @@ func (ici *chunkInfo) AofPadding(path string, off int64, id int64, sl []byte) {
 	ici.offset[id] = off
 	ff.Write(sl)
 }
+
+// 加上记录头
+func encodeRecord(b []byte) []byte {
+	rec := make([]byte, AOF_RECORD_HEADER+len(b))
+	binary.LittleEndian.PutUint32(rec, uint32(len(b)))
+	binary.LittleEndian.PutUint32(rec[4:], common.GetCrc32(b))
+	copy(rec[AOF_RECORD_HEADER:], b)
+	return rec
+}
+
+// 校验并去掉记录头，长度与记录头不一致的是没有记录头的旧记录，原样返回
+func decodeRecord(path string, off int64, rec []byte) ([]byte, error) {
+	if len(rec) < AOF_RECORD_HEADER || int(binary.LittleEndian.Uint32(rec)) != len(rec)-AOF_RECORD_HEADER {
+		return rec, nil
+	}
+	b := rec[AOF_RECORD_HEADER:]
+	if err := common.VerifyCrc32(path, off, b, binary.LittleEndian.Uint32(rec[4:])); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
 func (ici *chunkInfo) add(id int64, offset int64, lens int64) {
 	ici.links[id] = []int64{id}
 	ici.lens[id] = lens
@@ -103,6 +131,14 @@ func (ici *chunkInfo) compactTo(path string, newPath string) []int64 {
 	return ids
 }
 
+// 新建类型为t的空索引，t可以是指针类型
+func newIndex(t reflect.Type) types.Index {
+	if t.Kind() == reflect.Ptr {
+		return reflect.New(t.Elem()).Interface().(types.Index)
+	}
+	return reflect.New(t).Interface().(types.Index)
+}
+
 type AofIndexDiskManager struct {
 	sync.RWMutex
 	root       string
@@ -119,6 +155,7 @@ func NewAofIndexDiskManager(root string) *AofIndexDiskManager {
 		root:     root,
 		segments: make(map[string][]int64),
 		chunks:   make(map[string]*chunkInfo),
+		locks:    make(map[string]*sync.Mutex),
 		fields:   make(map[string]reflect.Type),
 	}
 
@@ -166,7 +203,12 @@ func (ridm *AofIndexDiskManager) getFromDisk(id int64) []byte {
 	if !ok {
 		return nil
 	}
-	return ridm.fetchBytes(id, path)
+	b, err := ridm.fetchBytes(id, path)
+	if err != nil {
+		common.DFAIL("fetch index %v %v", id, err)
+		return nil
+	}
+	return b
 }
 
 func (ridm *AofIndexDiskManager) loadMeta() {
@@ -202,34 +244,51 @@ func (ridm *AofIndexDiskManager) persite() {
 	e.Encode(&ridm.fields)
 }
 
-func (ridm *AofIndexDiskManager) fetchBytes(id int64, file string) []byte {
+// 读取记录，按记录头校验
+func (ridm *AofIndexDiskManager) fetchBytes(id int64, file string) ([]byte, error) {
 	ridm.RLock()
 	defer ridm.RUnlock()
 
-	f, _ := os.Open(file)
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 	ck := ridm.chunks[file]
+	ck.RLock()
+	off, lens := ck.offset[id], ck.lens[id]
+	ck.RUnlock()
 
-	b := make([]byte, ck.lens[id])
+	b := make([]byte, lens)
 
-	f.ReadAt(b, ck.offset[id])
-	return b
+	if _, err = f.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	return decodeRecord(file, off, b)
 }
 
 // 如果
 func (ridm *AofIndexDiskManager) fflushBytes(id int64, file string, b []byte) {
-	ridm.RLock()
-	defer ridm.RUnlock()
+	ridm.Lock()
 	ck := ridm.chunks[file]
-	offset, lens, _ := ck.find(id)
 	if _, ok := ridm.locks[file]; !ok {
 		ridm.locks[file] = &sync.Mutex{}
 	}
-
 	mu := ridm.locks[file]
+	ridm.Unlock()
+	ridm.RLock()
+	defer ridm.RUnlock()
+	offset, lens, _ := ck.find(id)
+
 	mu.Lock()
 	defer mu.Unlock()
-	f, _ := os.Open(file)
+	f, err := os.OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		common.DFAIL("flush index %v %v", id, err)
+		return
+	}
 	defer f.Close()
+	b = encodeRecord(b)
 	//这种覆盖式写入是一种极为低效的方式
 	//改为增量复制，AOF
 	size := common.GetFileSize(f)
@@ -238,7 +297,10 @@ func (ridm *AofIndexDiskManager) fflushBytes(id int64, file string, b []byte) {
 	if oldlens == 0 {
 		copy(by, b)
 		f.WriteAt(by, offset)
-		lens = int64(len(b))
+		// 合并之后记录的长度可能变化
+		ck.Lock()
+		ck.lens[id] = int64(len(b))
+		ck.Unlock()
 	} else {
 		f.ReadAt(by, offset)
 		s1 := common.GetSha256(by[:len(b)])
@@ -341,12 +403,17 @@ func (ridm *AofIndexDiskManager) getIndex(key string, fields string) types.Index
 	if !ok {
 		return nil
 	}
+	b, _ := in.([]byte)
+	if b == nil {
+		// 不存在或者数据损坏
+		return nil
+	}
 	tyzm, ok := ridm.fields[fields]
 	if !ok {
 		return nil
 	}
-	index := reflect.New(tyzm).Interface().(types.Index)
-	index.Dump(in.([]byte))
+	index := newIndex(tyzm)
+	index.Dump(b)
 	return index
 }
 
@@ -378,7 +445,7 @@ func (ridm *AofIndexDiskManager) addIndex(index types.Index) {
 		defer f.Close()
 		off := common.GetFileSize(f)
 		ck.offset[id] = off
-		ck.lens[id] = int64(len(bytes))
+		ck.lens[id] = int64(AOF_RECORD_HEADER + len(bytes))
 		ridm.addFileID(path, id)
 		ridm.blockcache.Put(strconv.FormatInt(id, 10), bytes)
 	} else {
@@ -390,7 +457,7 @@ func (ridm *AofIndexDiskManager) addIndex(index types.Index) {
 				id: 0,
 			},
 			lens: map[int64]int64{
-				id: int64(len(bytes)),
+				id: int64(AOF_RECORD_HEADER + len(bytes)),
 			},
 			links: map[int64][]int64{
 				id: make([]int64, 0),
@@ -405,7 +472,7 @@ func (ridm *AofIndexDiskManager) mergeIndex(path string, id int64, index types.I
 	//go ridm.fflushBytes(id, path, index.Bytes())
 	xid := strconv.FormatInt(id, 10)
 
-	in := reflect.New(reflect.TypeOf(index)).Interface().(types.Index)
+	in := newIndex(reflect.TypeOf(index))
 	b, _ := ridm.blockcache.Get(xid)
 	in.Dump(b.([]byte))
 	if !index.Merge(in) {
@@ -416,6 +483,79 @@ func (ridm *AofIndexDiskManager) mergeIndex(path string, id int64, index types.I
 func (ridm *AofIndexDiskManager) checkSha256(sha256 string) bool {
 	return true
 }
+
+// 检查每个段文件中记录的偏移与长度不超过文件大小，记录头中的crc32与内容一致，
+// segments与chunkInfo中的id一致；repair时由chunkInfo重建segments
+func (ridm *AofIndexDiskManager) Verify(repair bool) []error {
+	ridm.Lock()
+	defer ridm.Unlock()
+	errs := []error{}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrChunkInvariant, fmt.Sprintf(format, args...)))
+	}
+	rebuild := false
+	for path, ck := range ridm.chunks {
+		st, err := os.Stat(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ck.RLock()
+		for id, off := range ck.offset {
+			lens := ck.lens[id]
+			if off < 0 || lens < 0 || off+lens > st.Size() {
+				fail("%s record %d at [%d, %d) out of file size %d", path, id, off, off+lens, st.Size())
+				continue
+			}
+			b := make([]byte, lens)
+			if f, err := os.Open(path); err != nil {
+				errs = append(errs, err)
+			} else {
+				_, err = f.ReadAt(b, off)
+				f.Close()
+				if err == nil {
+					_, err = decodeRecord(path, off, b)
+				}
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		ids := ridm.segments[path]
+		for i, id := range ids {
+			if i > 0 && id <= ids[i-1] {
+				fail("segment %s out of order at %d", path, i)
+				rebuild = true
+				break
+			}
+			if _, ok := ck.offset[id]; !ok {
+				fail("segment %s lists %d without offset", path, id)
+				rebuild = true
+			}
+		}
+		ck.RUnlock()
+	}
+	for path := range ridm.segments {
+		if _, ok := ridm.chunks[path]; !ok {
+			fail("segment %s has no chunk info", path)
+			rebuild = true
+		}
+	}
+	if repair && rebuild {
+		segments := make(map[string][]int64)
+		for path, ck := range ridm.chunks {
+			ids := make([]int64, 0, len(ck.offset))
+			for id := range ck.offset {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			segments[path] = ids
+		}
+		ridm.segments = segments
+	}
+	return errs
+}
+
 func (ridm *AofIndexDiskManager) SaveMeta() {
 	ridm.persite()
 }
@@ -0,0 +1,66 @@
+package disk
+
+import (
+	"errors"
+	"fts/internal/common"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 校验和写在记录头里，只恢复偏移与长度(重启之后)也能发现损坏
+func TestAofRecordChecksum(t *testing.T) {
+	root, _ := os.MkdirTemp("", "aof")
+	defer os.RemoveAll(root)
+	path := root + "/0.idx"
+	f, _ := os.Create(path)
+	f.Close()
+
+	chunk := func() *chunkInfo {
+		return &chunkInfo{
+			offset: map[int64]int64{1: 0},
+			lens:   map[int64]int64{1: AOF_RECORD_HEADER + 5},
+			links:  map[int64][]int64{1: {}},
+		}
+	}
+	ridm := NewAofIndexDiskManager(root)
+	ridm.chunks[path] = chunk()
+	ridm.addFileID(path, 1)
+	// 合并后变长的记录
+	ridm.fflushBytes(1, path, []byte("hello world"))
+	b, err := ridm.fetchBytes(1, path)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(b))
+
+	reopen := NewAofIndexDiskManager(root)
+	reopen.chunks[path] = chunk()
+	reopen.chunks[path].lens[1] = AOF_RECORD_HEADER + 11
+	reopen.addFileID(path, 1)
+	b, err = reopen.fetchBytes(1, path)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(b))
+	assert.Empty(t, reopen.Verify(false))
+
+	f, _ = os.OpenFile(path, os.O_RDWR, 0644)
+	f.WriteAt([]byte("j"), AOF_RECORD_HEADER)
+	f.Close()
+	_, err = reopen.fetchBytes(1, path)
+	assert.True(t, errors.Is(err, common.ErrCorrupted))
+	var ce *common.CorruptionError
+	assert.True(t, errors.As(err, &ce))
+	assert.Equal(t, path, ce.Path)
+	assert.Nil(t, reopen.getFromDisk(1))
+	errs := reopen.Verify(false)
+	assert.Equal(t, 1, len(errs))
+	assert.True(t, errors.Is(errs[0], common.ErrCorrupted))
+
+	// 没有记录头的旧记录原样读出
+	f, _ = os.OpenFile(path, os.O_RDWR|os.O_TRUNC, 0644)
+	f.Write([]byte("legacy"))
+	f.Close()
+	reopen.chunks[path].lens[1] = 6
+	b, err = reopen.fetchBytes(1, path)
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", string(b))
+}
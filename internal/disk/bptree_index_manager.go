@@ -45,7 +45,7 @@ func (bpi *BPIndexDiskManager) init() {
 			} else {
 				index := in.(types.Index)
 				// new a index
-				v := reflect.New(reflect.TypeOf(index)).Interface().(types.Index)
+				v := newIndex(reflect.TypeOf(index))
 				v.Dump([]byte(s))
 				index.Merge(v)
 				return string(index.Serial())
@@ -105,7 +105,7 @@ func (bpi *BPIndexDiskManager) getIndex(id int64, field string) types.Index {
 	if bp == nil || typ == nil {
 		return nil
 	}
-	index := reflect.New(typ).Interface().(types.Index)
+	index := newIndex(typ)
 	b, ok := bp.Find(uint64(id))
 	if ok != nil {
 		return nil
@@ -146,3 +146,14 @@ func (bpi *BPIndexDiskManager) EnumFields() (s []string) {
 func (bpi *BPIndexDiskManager) Close() {
 	bpi.zc.Clear()
 }
+
+// 检查每个字段的B+树，repair时重建有问题的树
+func (bpi *BPIndexDiskManager) Verify(repair bool) []error {
+	errs := []error{}
+	for _, bp := range bpi.fileds {
+		if bp != nil {
+			errs = append(errs, bp.Verify(repair)...)
+		}
+	}
+	return errs
+}
@@ -2,13 +2,21 @@ package disk
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"fts/internal/cache"
+	"fts/internal/codec"
 	"fts/internal/common"
 	"fts/internal/types"
+	"hash/fnv"
+	"io"
 	"os"
 	"path"
 	"reflect"
+	"sort"
 	"strconv"
 	"sync"
 )
@@ -17,10 +25,82 @@ var muti = 1024
 var meta = "ddm.meta"
 var max = 1024 * 1024 * 128 //128MB
 
+var (
+	DOC_BLOCK_SIZE    = 64 * 1024         // 块解压后的目标大小，写满后压缩写入
+	DOC_BLOCK_CACHE   = 64                // 缓存的解压后的块个数
+	DEFAULT_DOC_CODEC = codec.CODEC_FLATE // 新块默认使用的编码
+)
+
+// 块头: 编码(1) | 解压后长度(4) | 压缩后长度(4) | 压缩数据的crc32(4)
+const docBlockHeaderSize = 13
+
+var (
+	ErrChunkInvariant = errors.New("chunk invariant violated")
+	ErrDocBlock       = errors.New("invalid doc block")
+	ErrUUIDCollision  = errors.New("document uuid collision")
+	ErrDocType        = errors.New("unknown document type")
+)
+
+// 文档UUID已被Identity不同的文档占用时的处理方式
+type CollisionPolicy int
+
+const (
+	COLLISION_OVERWRITE CollisionPolicy = iota // 新文档覆盖旧文档
+	COLLISION_REJECT                           // 拒绝新文档
+	COLLISION_RENAME                           // 对Identity加盐重新哈希得到新ID
+	COLLISION_SECONDARY                        // 由原ID派生次级ID，两者都保留并记录原ID到次级ID的映射
+)
+
+var COLLISION_MAX_PROBE = 16 // 改名或派生次级ID时最多尝试的候选ID个数
+
+// 发现的UUID冲突次数，Seen为各项之和
+type CollisionStats struct {
+	Seen        int64
+	Overwritten int64
+	Rejected    int64
+	Renamed     int64
+	Secondary   int64
+}
+
+// 元数据只记录类型名，重新加载时按名字找回写入过或注册过的文档类型
+var docTypes = struct {
+	sync.RWMutex
+	m map[string]reflect.Type
+}{m: make(map[string]reflect.Type)}
+
+// 注册文档类型，使重新打开的DocDiskManager在写入新文档之前也能读出这种类型的文档
+func RegisterDocType(doc types.Document) {
+	t := reflect.TypeOf(doc)
+	docTypes.Lock()
+	docTypes.m[common.ExtractMetaTypeName(t)] = t
+	docTypes.Unlock()
+}
+
+func registeredDocType(name string) reflect.Type {
+	docTypes.RLock()
+	defer docTypes.RUnlock()
+	return docTypes.m[name]
+}
+
+func identityHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
 type docchunkInfo struct {
-	Mapping map[int64]int64 // ID对应文档在文件的偏移值
-	Lengths map[int64]int   //ID对应的文档对象大小，允许变长编码
-	Lens    int64
+	Mapping    map[int64]int64  // ID对应文档在文件的偏移值，按块存储时为所在块的偏移
+	Lengths    map[int64]int    //ID对应的文档对象大小，允许变长编码
+	Checksums  map[int64]uint32 // ID对应文档的crc32，旧的元数据没有这一项时不校验
+	Inner      map[int64]int    // 按块存储时ID对应文档在解压后的块内的偏移
+	Blocked    bool             // 按块压缩存储，旧的chunk为false，只读不再追加
+	Identities map[int64]uint64 // ID对应文档Identity的FNV哈希，文档没有Identity或旧的元数据没有这一项时为空
+	Lens       int64
+}
+
+// 正在填充的块
+type docBlock struct {
+	buf []byte
 }
 
 func (ci *docchunkInfo) Len() int64 {
@@ -31,10 +111,11 @@ func (ci *docchunkInfo) Len() int64 {
 type WriteHandle struct {
 	offset int64
 	b      []byte
+	done   func() // 写入文件后调用，可以为nil
 }
 type SequenceHandle struct {
 	f      *os.File
-	fflush chan struct{}
+	fflush chan chan struct{}
 	stop   chan struct{}
 	ch     chan WriteHandle
 }
@@ -42,7 +123,7 @@ type SequenceHandle struct {
 func NewSequenceHandle(f *os.File) *SequenceHandle {
 	s := &SequenceHandle{
 		f:      f,
-		fflush: make(chan struct{}),
+		fflush: make(chan chan struct{}),
 		stop:   make(chan struct{}),
 		ch:     make(chan WriteHandle, 16),
 	}
@@ -54,22 +135,48 @@ func NewSequenceHandle(f *os.File) *SequenceHandle {
 func sequenceWriteFile(
 	f *os.File,
 	ch chan WriteHandle,
-	fflush chan struct{},
+	fflush chan chan struct{},
 	stop chan struct{},
 ) {
 	var (
 		batch        = make([]byte, 0, 1024*1024*32)
 		offset int64 = -1
+		dones        = make([]func(), 0)
 		//apply        = make([]int64, 0)
 	)
+	// 批量写入之后通知写入已经完成
+	ack := func() {
+		for _, done := range dones {
+			done()
+		}
+		dones = dones[:0]
+	}
 	for {
 		select {
-		case <-fflush:
+		case done := <-fflush:
+			// 先取完已经提交的写入
+			for drain := true; drain; {
+				select {
+				case b := <-ch:
+					if offset == -1 {
+						offset = b.offset
+					}
+					batch = append(batch, b.b...)
+					if b.done != nil {
+						dones = append(dones, b.done)
+					}
+				default:
+					drain = false
+				}
+			}
 			if offset != -1 {
 				f.WriteAt(batch, offset)
 			}
+			ack()
 			f.Sync()
 			offset = -1
+			batch = batch[0:0]
+			close(done)
 		case <-stop:
 			return
 		case b, ok := <-ch:
@@ -82,8 +189,12 @@ func sequenceWriteFile(
 				//apply = append(apply, offset)
 			}
 			batch = append(batch, b.b...)
+			if b.done != nil {
+				dones = append(dones, b.done)
+			}
 			if len(batch) >= 1024*1024*32 {
 				f.WriteAt(batch, offset)
+				ack()
 				common.DINFO("Writing Into %v 32MB", f.Name())
 				offset = -1
 				batch = batch[0:0] //将切片清零，但是保留容量
@@ -92,9 +203,15 @@ func sequenceWriteFile(
 	}
 }
 func (seq *SequenceHandle) Go(offset int64, b []byte) {
+	seq.GoNotify(offset, b, nil)
+}
+
+// 同Go，写入文件之后在写入协程中调用done
+func (seq *SequenceHandle) GoNotify(offset int64, b []byte, done func()) {
 	seq.ch <- WriteHandle{
 		offset: offset,
 		b:      b,
+		done:   done,
 	}
 }
 
@@ -102,36 +219,82 @@ func (seq *SequenceHandle) Close() {
 	seq.stop <- struct{}{}
 }
 
+// 写入之前提交的数据并等待落盘
 func (seq *SequenceHandle) Flush() {
-	seq.fflush <- struct{}{}
+	done := make(chan struct{})
+	seq.fflush <- done
+	<-done
 }
 
 type DocDiskManager struct {
-	mu       sync.RWMutex
-	loadmaps map[string][]string //记录某次load的reflects文档对应生成的磁盘文件，key是文档名
-	ids      map[string][]int64  //记录某个磁盘文件对应有多少个id对应,倒排索引
-	chunks   map[string]*docchunkInfo
-	reflects map[string]reflect.Type //无法序列化reflect.Type
-	sequence map[string]*SequenceHandle
-	last     *SequenceHandle
-	root     string
-	max      int64
+	mu        sync.RWMutex
+	loadmaps  map[string][]string //记录某次load的reflects文档对应生成的磁盘文件，key是文档名
+	ids       map[string][]int64  //记录某个磁盘文件对应有多少个id对应,倒排索引
+	chunks    map[string]*docchunkInfo
+	reflects  map[string]reflect.Type //无法序列化reflect.Type
+	sequence  map[string]*SequenceHandle
+	last      *SequenceHandle
+	root      string
+	max       int64
+	codec     codec.CodecType
+	pending   map[string]*docBlock // 每个chunk正在填充的块
+	blocks    *cache.LruCache      // 解压后的块，key为chunk路径与块偏移
+	smu       sync.Mutex
+	sealed    map[string][]byte // 已经提交但还没有写入文件的块，写入后才从这里移除，key同blocks
+	policy    CollisionPolicy
+	stats     CollisionStats
+	secondary map[int64][]int64 // 原ID -> 冲突时派生的次级ID
 }
 
 func NewDocDiskManager(root string) *DocDiskManager {
 	ddm := &DocDiskManager{
-		loadmaps: make(map[string][]string),
-		ids:      make(map[string][]int64),
-		chunks:   make(map[string]*docchunkInfo),
-		reflects: make(map[string]reflect.Type),
-		sequence: make(map[string]*SequenceHandle),
-		root:     root,
-		last:     nil,
-		max:      int64(max),
+		loadmaps:  make(map[string][]string),
+		ids:       make(map[string][]int64),
+		chunks:    make(map[string]*docchunkInfo),
+		reflects:  make(map[string]reflect.Type),
+		sequence:  make(map[string]*SequenceHandle),
+		root:      root,
+		last:      nil,
+		max:       int64(max),
+		codec:     DEFAULT_DOC_CODEC,
+		pending:   make(map[string]*docBlock),
+		blocks:    cache.Default(int64(DOC_BLOCK_CACHE)),
+		sealed:    make(map[string][]byte),
+		secondary: make(map[int64][]int64),
 	}
 	ddm.loadMeta()
 	return ddm
 }
+
+// 之后写入的块使用的编码，已写入的块按块头中的编码读取
+func (ddm *DocDiskManager) SetCodec(ct codec.CodecType) error {
+	if _, err := codec.New(ct); err != nil {
+		return err
+	}
+	ddm.mu.Lock()
+	defer ddm.mu.Unlock()
+	ddm.codec = ct
+	return nil
+}
+
+func (ddm *DocDiskManager) SetCollisionPolicy(p CollisionPolicy) {
+	ddm.mu.Lock()
+	defer ddm.mu.Unlock()
+	ddm.policy = p
+}
+
+func (ddm *DocDiskManager) Stats() CollisionStats {
+	ddm.mu.RLock()
+	defer ddm.mu.RUnlock()
+	return ddm.stats
+}
+
+// 原ID冲突时派生的次级ID，按派生顺序
+func (ddm *DocDiskManager) Secondaries(id int64) []int64 {
+	ddm.mu.RLock()
+	defer ddm.mu.RUnlock()
+	return append([]int64{}, ddm.secondary[id]...)
+}
 func (ddm *DocDiskManager) meta() string {
 	return "hash_doc.meta"
 }
@@ -148,22 +311,46 @@ func (ddm *DocDiskManager) loadMeta() {
 		dec.Decode(&ddm.loadmaps)
 		dec.Decode(&ddm.ids)
 		dec.Decode(&ddm.chunks)
-		err = dec.Decode(&ddm.reflects)
+		// 类型以名字保存，找不到的类型在读取时再查注册表
+		refl := make(map[string][]byte)
+		err = dec.Decode(&refl)
 		if err != nil {
 			panic(err)
 		}
+		for k := range refl {
+			if t := registeredDocType(k); t != nil {
+				ddm.reflects[k] = t
+			}
+		}
+		// 旧的元数据没有次级ID
+		if err = dec.Decode(&ddm.secondary); err != nil && err != io.EOF {
+			panic(err)
+		}
+		if ddm.secondary == nil {
+			ddm.secondary = make(map[int64][]int64)
+		}
 	}
 }
+
+// 元数据中的偏移要落在文件已有的数据内，先封存正在填充的块并等待写入完成
 func (ddm *DocDiskManager) persite() {
-	ddm.mu.RLock()
-	defer ddm.mu.RUnlock()
-	var file *os.File
+	ddm.mu.Lock()
+	defer ddm.mu.Unlock()
+	for name := range ddm.pending {
+		if err := ddm.sealBlock(name); err != nil {
+			common.DFAIL("write block %v %v", name, err)
+		}
+	}
+	for _, v := range ddm.sequence {
+		v.Flush()
+	}
 	path := ddm.root + "/" + ddm.meta()
-	if !common.IsExist(path) {
-		file, _ = os.Create(path)
-	} else {
-		file, _ = os.Open(path)
+	file, err := os.Create(path)
+	if err != nil {
+		common.DFAIL("persite %v %v", path, err)
+		return
 	}
+	defer file.Close()
 
 	enc := gob.NewEncoder(file)
 
@@ -176,7 +363,13 @@ func (ddm *DocDiskManager) persite() {
 		jsc, _ := json.Marshal(v)
 		refl[k] = jsc
 	}
+	for k := range ddm.loadmaps {
+		if _, ok := refl[k]; !ok {
+			refl[k] = nil
+		}
+	}
 	enc.Encode(refl)
+	enc.Encode(&ddm.secondary)
 }
 func (ddm *DocDiskManager) SaveMeta() {
 	ddm.persite()
@@ -199,28 +392,34 @@ func (ddm *DocDiskManager) getNextChunkName(sha256 string) string {
 	return ddm.root + "/" + sha256 + "-" + strconv.Itoa(len(ddm.chunks)) + ".xck"
 }
 
-// add file <-> id ,binary insert
+// add file <-> id ,binary insert，已存在时不重复添加
 func (ddm *DocDiskManager) addID(path string, id int64) {
-
 	ids := ddm.ids[path]
-
-	idx := len(ids) - 1
-	for ; idx >= 0; idx-- {
-		if ids[idx] < id {
-			break
-		}
+	idx := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	if idx < len(ids) && ids[idx] == id {
+		return
 	}
+	ids = append(ids, 0)
+	copy(ids[idx+1:], ids[idx:])
+	ids[idx] = id
+	ddm.ids[path] = ids
+}
 
-	if idx == len(ids)-1 {
-		ids = append(ids, id)
-	} else if idx == -1 {
-		ids = append([]int64{id}, ids...)
-	} else {
-		ids = append(ids[:idx], append([]int64{id}, ids[idx+1:]...)...)
+// 从chunk中去掉ID，文档原来的字节留在chunk中不再引用
+func (ddm *DocDiskManager) dropID(path string, id int64) {
+	ids := ddm.ids[path]
+	idx := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+	if idx < len(ids) && ids[idx] == id {
+		ddm.ids[path] = append(ids[:idx], ids[idx+1:]...)
 	}
-
-	ddm.ids[path] = ids
+	ckc := ddm.chunks[path]
+	delete(ckc.Mapping, id)
+	delete(ckc.Lengths, id)
+	delete(ckc.Checksums, id)
+	delete(ckc.Inner, id)
+	delete(ckc.Identities, id)
 }
+
 func (ddm *DocDiskManager) goLookID(id int64) (string, bool) {
 	var (
 		proc = 4
@@ -280,13 +479,106 @@ func (ddm *DocDiskManager) lookID(id int64) (string, bool) {
 	}
 	return "", false
 }
-func (ddm *DocDiskManager) addDoc(doc types.Document) {
+
+// 写入文档并返回实际使用的ID，ID已被Identity不同的文档占用时按冲突策略处理
+// 没有实现types.IdentityDocument的文档无法识别冲突，总是覆盖
+func (ddm *DocDiskManager) Insert(doc types.Document) (int64, error) {
 	ddm.mu.Lock()
 	defer ddm.mu.Unlock()
+	id := doc.UUID()
+	idoc, ok := doc.(types.IdentityDocument)
+	if !ok {
+		return id, ddm.addDoc(doc, id, nil)
+	}
+	ident := identityHash(idoc.Identity())
+	if path, ok := ddm.lookID(id); !ok || ddm.sameIdentity(path, id, ident) {
+		return id, ddm.addDoc(doc, id, &ident)
+	}
+	ddm.stats.Seen++
+	switch ddm.policy {
+	case COLLISION_REJECT:
+		ddm.stats.Rejected++
+		return id, fmt.Errorf("%w: %d", ErrUUIDCollision, id)
+	case COLLISION_RENAME, COLLISION_SECONDARY:
+		nid, err := ddm.probe(idoc, id, ident)
+		if err != nil {
+			ddm.stats.Rejected++
+			return id, err
+		}
+		if ddm.policy == COLLISION_RENAME {
+			ddm.stats.Renamed++
+		} else {
+			ddm.stats.Secondary++
+			ddm.addSecondary(id, nid)
+		}
+		return nid, ddm.addDoc(doc, nid, &ident)
+	}
+	ddm.stats.Overwritten++
+	return id, ddm.addDoc(doc, id, &ident)
+}
+
+func (ddm *DocDiskManager) addSecondary(id, nid int64) {
+	for _, v := range ddm.secondary[id] {
+		if v == nid {
+			return
+		}
+	}
+	ddm.secondary[id] = append(ddm.secondary[id], nid)
+}
+
+// 已保存的文档与ident是否是同一文档，无法判断时视为同一文档
+func (ddm *DocDiskManager) sameIdentity(path string, id int64, ident uint64) bool {
+	if h, ok := ddm.chunks[path].Identities[id]; ok {
+		return h == ident
+	}
+	// 旧数据没有记录Identity，读出文档比较
+	ty := ddm.getDocTypeInfo(path)
+	if ty == nil {
+		return true
+	}
+	old, ok := newDoc(ty).(types.IdentityDocument)
+	if !ok {
+		return true
+	}
+	buf, err := ddm.readChunk(path, id)
+	if err != nil {
+		return true
+	}
+	old.Dump(buf)
+	return identityHash(old.Identity()) == ident
+}
+
+// 依次尝试候选ID，返回第一个空闲或者已经属于同一文档的ID，并把文档改为使用这个ID
+func (ddm *DocDiskManager) probe(doc types.IdentityDocument, id int64, ident uint64) (int64, error) {
+	rd, ok := doc.(types.RenamableDocument)
+	if !ok {
+		return id, fmt.Errorf("%w: %d, %T can not be renamed", ErrUUIDCollision, id, doc)
+	}
+	for k := 1; k <= COLLISION_MAX_PROBE; k++ {
+		var nid int64
+		if ddm.policy == COLLISION_RENAME {
+			nid = common.StringHashToInt64(doc.Identity() + "#" + strconv.Itoa(k))
+		} else {
+			nid = common.StringHashToInt64(strconv.FormatInt(id, 10) + "/" + strconv.Itoa(k))
+		}
+		if path, ok := ddm.lookID(nid); !ok || ddm.sameIdentity(path, nid, ident) {
+			rd.SetUUID(nid)
+			return nid, nil
+		}
+	}
+	return id, fmt.Errorf("%w: %d, no free id in %d probes", ErrUUIDCollision, id, COLLISION_MAX_PROBE)
+}
+
+// 以ID写入文档，ID已存在时先从原来的chunk去掉，调用方持有写锁
+func (ddm *DocDiskManager) addDoc(doc types.Document, ID int64, ident *uint64) error {
 	t := reflect.TypeOf(doc)
 	s := common.ExtractMetaTypeName(t)
 	if _, ok := ddm.reflects[s]; !ok {
 		ddm.reflects[s] = t
+		RegisterDocType(doc)
+	}
+	if old, ok := ddm.lookID(ID); ok {
+		ddm.dropID(old, ID)
 	}
 
 	var (
@@ -300,61 +592,181 @@ func (ddm *DocDiskManager) addDoc(doc types.Document) {
 	} else {
 		meta = p
 	}
-	for n, ck := range ddm.chunks {
-		if ck.Len() < ddm.max {
+	// 只向同类型的块存储chunk追加
+	for _, n := range ddm.loadmaps[meta] {
+		if ck := ddm.chunks[n]; ck.Blocked && ck.Len() < ddm.max {
 			name = n
 			ckc = ck
 			break
 		}
 	}
-	if name != "" {
-		offset := ckc.Len()
-		ID := doc.UUID()
-		bytes := doc.Serial()
-
-		seq := ddm.sequence[name]
-		seq.Go(offset, bytes)
-		ckc.Lengths[ID] = len(bytes)
-		ckc.Lens += int64(len(bytes))
-		ckc.Mapping[ID] = offset
-		//ddm.ids[name] = append(ddm.ids[name], ID)
-		ddm.addID(name, ID)
-		return
+	if name == "" {
+		name = ddm.getNextChunkName(meta)
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		if ddm.last != nil {
+			ddm.last.Flush()
+		}
+		seq := NewSequenceHandle(f)
+		ddm.sequence[name] = seq
+		ddm.last = seq
+		ckc = &docchunkInfo{
+			Mapping:    make(map[int64]int64),
+			Lengths:    make(map[int64]int),
+			Checksums:  make(map[int64]uint32),
+			Inner:      make(map[int64]int),
+			Blocked:    true,
+			Identities: make(map[int64]uint64),
+		}
+		ddm.chunks[name] = ckc
+		ddm.loadmaps[meta] = append(ddm.loadmaps[meta], name)
 	}
-	name = ddm.getNextChunkName(meta)
-	ID := doc.UUID()
+
 	bytes := doc.Serial()
-	ddm.chunks[name] = &docchunkInfo{
-		Mapping: map[int64]int64{
-			ID: 0,
-		},
-		Lengths: map[int64]int{
-			ID: len(bytes),
-		},
-		Lens: int64(len(bytes)),
-	}
-	ddm.loadmaps[meta] = append(ddm.loadmaps[meta], name)
+	blk, ok := ddm.pending[name]
+	if !ok {
+		blk = &docBlock{}
+		ddm.pending[name] = blk
+	}
+	// 块在写入时位于chunk的末尾
+	ckc.Mapping[ID] = ckc.Lens
+	ckc.Inner[ID] = len(blk.buf)
+	ckc.Lengths[ID] = len(bytes)
+	ckc.Checksums[ID] = common.GetCrc32(bytes)
+	if ident != nil {
+		if ckc.Identities == nil {
+			ckc.Identities = make(map[int64]uint64)
+		}
+		ckc.Identities[ID] = *ident
+	}
+	blk.buf = append(blk.buf, bytes...)
 	//ddm.ids[name] = append(ddm.ids[name], ID)
 	ddm.addID(name, ID)
+	if len(blk.buf) >= DOC_BLOCK_SIZE {
+		return ddm.sealBlock(name)
+	}
+	return nil
+}
+
+// 取chunk的顺序写入句柄，重新加载后还没有打开时打开文件
+func (ddm *DocDiskManager) seq(name string) (*SequenceHandle, error) {
+	if seq, ok := ddm.sequence[name]; ok {
+		return seq, nil
+	}
 	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
-		common.DFAIL("Create %v Error %v", name, err)
-		return
-	}
-	if ddm.last != nil {
-		ddm.last.Flush()
+		return nil, err
 	}
 	seq := NewSequenceHandle(f)
 	ddm.sequence[name] = seq
-	seq.Go(0, bytes)
+	return seq, nil
+}
+
+// 压缩chunk正在填充的块，追加到chunk末尾，调用方持有写锁
+func (ddm *DocDiskManager) sealBlock(name string) error {
+	blk, ok := ddm.pending[name]
+	if !ok || len(blk.buf) == 0 {
+		return nil
+	}
+	seq, err := ddm.seq(name)
+	if err != nil {
+		return err
+	}
+	ckc := ddm.chunks[name]
+	data := encodeDocBlock(ddm.codec, blk.buf)
+	off := ckc.Lens
+	key := blockKey(name, off)
+	// 顺序写入是异步的，写入文件之前块不能只放在会被淘汰的缓存里
+	ddm.smu.Lock()
+	ddm.sealed[key] = blk.buf
+	ddm.smu.Unlock()
+	seq.GoNotify(off, data, func() {
+		ddm.smu.Lock()
+		delete(ddm.sealed, key)
+		ddm.smu.Unlock()
+	})
+	ckc.Lens += int64(len(data))
+	delete(ddm.pending, name)
+	ddm.blocks.Put(key, blk.buf)
+	return nil
+}
 
-	ddm.last = seq
+func blockKey(path string, off int64) string {
+	return path + "@" + strconv.FormatInt(off, 10)
+}
+
+// 压缩失败或者没有变小时不压缩
+func encodeDocBlock(ct codec.CodecType, raw []byte) []byte {
+	payload, err := codec.Compress(ct, raw)
+	if err != nil || (ct != codec.CODEC_NONE && len(payload) >= len(raw)) {
+		ct, payload = codec.CODEC_NONE, raw
+	}
+	data := make([]byte, docBlockHeaderSize, docBlockHeaderSize+len(payload))
+	data[0] = byte(ct)
+	binary.LittleEndian.PutUint32(data[1:5], uint32(len(raw)))
+	binary.LittleEndian.PutUint32(data[5:9], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(data[9:13], common.GetCrc32(payload))
+	return append(data, payload...)
+}
+
+// 读取并解压off处的块，先查正在填充的块、还没有写入文件的块和缓存
+func (ddm *DocDiskManager) readBlock(path string, off int64) ([]byte, error) {
+	if blk, ok := ddm.pending[path]; ok && off == ddm.chunks[path].Lens {
+		return blk.buf, nil
+	}
+	key := blockKey(path, off)
+	ddm.smu.Lock()
+	buf, ok := ddm.sealed[key]
+	ddm.smu.Unlock()
+	if ok {
+		return buf, nil
+	}
+	if v, ok := ddm.blocks.Get(key); ok {
+		return v.([]byte), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, docBlockHeaderSize)
+	if _, err = f.ReadAt(header, off); err != nil {
+		return nil, err
+	}
+	ct := codec.CodecType(header[0])
+	rawLen := binary.LittleEndian.Uint32(header[1:5])
+	dataLen := binary.LittleEndian.Uint32(header[5:9])
+	if int64(off)+docBlockHeaderSize+int64(dataLen) > ddm.chunks[path].Lens {
+		return nil, fmt.Errorf("%w: %s at %d, length %d out of chunk", ErrDocBlock, path, off, dataLen)
+	}
+	payload := make([]byte, dataLen)
+	if _, err = f.ReadAt(payload, off+docBlockHeaderSize); err != nil {
+		return nil, err
+	}
+	if err = common.VerifyCrc32(path, off, payload, binary.LittleEndian.Uint32(header[9:13])); err != nil {
+		return nil, err
+	}
+	raw, err := codec.Decompress(ct, payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s at %d: %v", ErrDocBlock, path, off, err)
+	}
+	if len(raw) != int(rawLen) {
+		return nil, fmt.Errorf("%w: %s at %d, expect %d bytes but get %d", ErrDocBlock, path, off, rawLen, len(raw))
+	}
+	ddm.blocks.Put(key, raw)
+	return raw, nil
 }
 func (ddm *DocDiskManager) getDocTypeInfo(path string) reflect.Type {
 	for k, v := range ddm.loadmaps {
 		for _, vv := range v {
 			if vv == path {
-				return ddm.reflects[k]
+				if t, ok := ddm.reflects[k]; ok {
+					return t
+				}
+				return registeredDocType(k)
 			}
 		}
 	}
@@ -402,20 +814,56 @@ func (ddm *DocDiskManager) goGetDoc(nums int, key int64) types.Document {
 		}
 	}
 l:
-	ckc := ddm.chunks[path]
-	offset := ckc.Mapping[key]
-	length := ckc.Lengths[key]
-	f, _ := os.Open(path)
-	buf := make([]byte, length)
-	f.ReadAt(buf, offset)
+	buf, err := ddm.readChunk(path, key)
+	if err != nil {
+		common.DFAIL("read doc %v %v", key, err)
+		return nil
+	}
 
 	ty := ddm.getDocTypeInfo(path)
-	doc := reflect.New(ty).Interface().(types.Document)
+	doc := newDoc(ty)
 	doc.Dump(buf)
 	return doc
 }
 
-func (ddm *DocDiskManager) getDoc(key int64) types.Document {
+// 读取文档在chunk中的字节并校验crc32
+func (ddm *DocDiskManager) readChunk(path string, key int64) ([]byte, error) {
+	ckc := ddm.chunks[path]
+	off := ckc.Mapping[key]
+	lens := ckc.Lengths[key]
+
+	var buf []byte
+	if ckc.Blocked {
+		block, err := ddm.readBlock(path, off)
+		if err != nil {
+			return nil, err
+		}
+		inner := ckc.Inner[key]
+		if inner < 0 || inner+lens > len(block) {
+			return nil, fmt.Errorf("%w: %s doc %d at [%d, %d) out of block length %d", ErrDocBlock, path, key, inner, inner+lens, len(block))
+		}
+		buf = block[inner : inner+lens]
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		buf = make([]byte, lens)
+		if _, err = f.ReadAt(buf, off); err != nil {
+			return nil, err
+		}
+	}
+	if crc, ok := ckc.Checksums[key]; ok {
+		if err := common.VerifyCrc32(path, off, buf, crc); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func (ddm *DocDiskManager) getDoc(key int64) (types.Document, error) {
 	ddm.mu.RLock()
 	defer ddm.mu.RUnlock()
 	//var path string
@@ -438,30 +886,42 @@ func (ddm *DocDiskManager) getDoc(key int64) types.Document {
 	path, ok = ddm.lookID(key)
 
 	if path == "" || !ok {
-		return nil
+		return nil, nil
 	}
 
-	ckc := ddm.chunks[path]
-	off := ckc.Mapping[key]
-	lens := ckc.Lengths[key]
-
-	f, _ := os.Open(path)
-
-	buf := make([]byte, lens)
+	buf, err := ddm.readChunk(path, key)
+	if err != nil {
+		return nil, err
+	}
 	ty := ddm.getDocTypeInfo(path)
+	if ty == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDocType, path)
+	}
 	//doc := reflect.New(ddm.reflects[])
-	f.ReadAt(buf, off)
-	doc := reflect.New(ty).Interface().(types.Document)
+	doc := newDoc(ty)
 	doc.Dump(buf)
-	return doc
+	return doc, nil
 }
 
 func (ddm *DocDiskManager) GetDoc(uuid int64) types.Document {
 	//xid := strconv.FormatInt(uuid, 10)
+	doc, err := ddm.getDoc(uuid)
+	if err != nil {
+		common.DFAIL("get doc %v %v", uuid, err)
+		return nil
+	}
+	return doc
+}
+
+// 与GetDoc相同，但返回读取错误，数据损坏时为*common.CorruptionError，文档不存在时两者都为nil
+func (ddm *DocDiskManager) ReadDoc(uuid int64) (types.Document, error) {
 	return ddm.getDoc(uuid)
 }
-func (ddm *DocDiskManager) AddDoc(doc types.Document) {
-	ddm.addDoc(doc)
+
+// 按冲突策略拒绝时返回ErrUUIDCollision
+func (ddm *DocDiskManager) AddDoc(doc types.Document) error {
+	_, err := ddm.Insert(doc)
+	return err
 }
 
 func (ddm *DocDiskManager) Docs(doc types.Document) int64 {
@@ -487,15 +947,109 @@ func (ddm *DocDiskManager) EnumDocsID(doc types.Document, size int) chan int64 {
 	return ch
 }
 
+// 记录的类型是指针时创建指向的对象
+func newDoc(ty reflect.Type) types.Document {
+	if ty.Kind() == reflect.Ptr {
+		return reflect.New(ty.Elem()).Interface().(types.Document)
+	}
+	return reflect.New(ty).Interface().(types.Document)
+}
+
 func (ddm *DocDiskManager) EnumDocTypes() []types.Document {
 	tys := []types.Document{}
-	for _, v := range ddm.reflects {
-		tys = append(tys, reflect.New(v).Interface().(types.Document))
+	for k := range ddm.loadmaps {
+		t, ok := ddm.reflects[k]
+		if !ok {
+			t = registeredDocType(k)
+		}
+		if t != nil {
+			tys = append(tys, newDoc(t))
+		}
 	}
 	return tys
 }
 
+// 检查每个chunk文件存在且不短于记录的长度，文档的偏移与长度落在chunk内，
+// 块的crc32与解压后的长度正确，记录了crc32的文档内容一致，ids与Mapping一致；repair时由Mapping重建ids并保存元数据
+func (ddm *DocDiskManager) Verify(repair bool) []error {
+	ddm.mu.Lock()
+	errs := []error{}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrChunkInvariant, fmt.Sprintf(format, args...)))
+	}
+	rebuild := false
+	for path, ckc := range ddm.chunks {
+		st, err := os.Stat(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if st.Size() < ckc.Len() {
+			fail("%s has %d bytes, less than %d", path, st.Size(), ckc.Len())
+		}
+		for id, off := range ckc.Mapping {
+			lens, ok := ckc.Lengths[id]
+			if !ok {
+				fail("%s doc %d has offset but no length", path, id)
+				continue
+			}
+			if ckc.Blocked {
+				// 块的范围与文档在块内的位置在读取时检查
+				if off < 0 || off > ckc.Len() {
+					fail("%s doc %d in block %d out of chunk length %d", path, id, off, ckc.Len())
+					continue
+				}
+			} else if off < 0 || off+int64(lens) > ckc.Len() {
+				fail("%s doc %d at [%d, %d) out of chunk length %d", path, id, off, off+int64(lens), ckc.Len())
+				continue
+			}
+			if _, err = ddm.readChunk(path, id); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		ids := ddm.ids[path]
+		for i, id := range ids {
+			if i > 0 && id <= ids[i-1] {
+				fail("ids of %s out of order at %d", path, i)
+				rebuild = true
+				break
+			}
+			if _, ok := ckc.Mapping[id]; !ok {
+				fail("%s lists doc %d without offset", path, id)
+				rebuild = true
+			}
+		}
+		if len(ids) != len(ckc.Mapping) {
+			fail("%s lists %d ids but maps %d docs", path, len(ids), len(ckc.Mapping))
+			rebuild = true
+		}
+	}
+	if repair && rebuild {
+		for path, ckc := range ddm.chunks {
+			ids := make([]int64, 0, len(ckc.Mapping))
+			for id := range ckc.Mapping {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			ddm.ids[path] = ids
+		}
+	}
+	ddm.mu.Unlock()
+	if repair && rebuild {
+		ddm.persite()
+	}
+	return errs
+}
+
+// 写入所有正在填充的块再落盘
 func (ddm *DocDiskManager) Flush() {
+	ddm.mu.Lock()
+	for name := range ddm.pending {
+		if err := ddm.sealBlock(name); err != nil {
+			common.DFAIL("write block %v %v", name, err)
+		}
+	}
+	ddm.mu.Unlock()
 	for _, v := range ddm.sequence {
 		v.Flush()
 	}
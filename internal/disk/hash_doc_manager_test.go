@@ -0,0 +1,244 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"fts/internal/cache"
+	"fts/internal/codec"
+	"fts/internal/common"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type blockDoc struct {
+	ID   int64
+	Text string
+}
+
+func (d *blockDoc) Serial() []byte           { return []byte(d.Text) }
+func (d *blockDoc) Dump(b []byte)            { d.Text = string(b) }
+func (d *blockDoc) UUID() int64              { return d.ID }
+func (d *blockDoc) FieldExist(f string) bool { return f == "Text" }
+func (d *blockDoc) FieldLen(f string) int64  { return int64(len(d.Text)) }
+func (d *blockDoc) FetchField(f string) []byte {
+	return []byte(d.Text)
+}
+
+func TestDocBlocks(t *testing.T) {
+	old := DOC_BLOCK_SIZE
+	DOC_BLOCK_SIZE = 1024
+	defer func() { DOC_BLOCK_SIZE = old }()
+
+	text := func(i int) string {
+		return strings.Repeat(fmt.Sprintf("doc %d says hello ", i), i%7+1)
+	}
+	for _, ct := range []codec.CodecType{codec.CODEC_NONE, codec.CODEC_FLATE, codec.CODEC_GZIP, codec.CODEC_HUFFMAN} {
+		ddm := NewDocDiskManager(t.TempDir())
+		assert.Nil(t, ddm.SetCodec(ct))
+		for i := 1; i <= 300; i++ {
+			ddm.AddDoc(&blockDoc{ID: int64(i), Text: text(i)})
+		}
+		// 未写入的块从内存读取
+		doc, err := ddm.ReadDoc(300)
+		assert.Nil(t, err, ct.String())
+		assert.Equal(t, text(300), doc.(*blockDoc).Text)
+
+		ddm.Flush()
+		ddm.blocks = cache.Default(int64(DOC_BLOCK_CACHE))
+		for i := 1; i <= 300; i++ {
+			doc, err := ddm.ReadDoc(int64(i))
+			assert.Nil(t, err, ct.String())
+			assert.Equal(t, text(i), doc.(*blockDoc).Text)
+		}
+		assert.Empty(t, ddm.Verify(false), ct.String())
+
+		var total int64
+		for _, ckc := range ddm.chunks {
+			total += ckc.Len()
+		}
+		if ct != codec.CODEC_NONE {
+			raw := int64(0)
+			for i := 1; i <= 300; i++ {
+				raw += int64(len(text(i)))
+			}
+			assert.Less(t, total, raw, ct.String())
+		}
+	}
+}
+
+// 封存的块在异步写入完成之前被缓存淘汰，仍然可以读取
+func TestDocBlocksSealedBeforeWrite(t *testing.T) {
+	old := DOC_BLOCK_SIZE
+	DOC_BLOCK_SIZE = 1024
+	defer func() { DOC_BLOCK_SIZE = old }()
+
+	ddm := NewDocDiskManager(t.TempDir())
+	text := func(i int) string {
+		return strings.Repeat(fmt.Sprintf("doc %d ", i), 100)
+	}
+	n := 2 * (DOC_BLOCK_CACHE + 10)
+	for i := 1; i <= n; i++ {
+		ddm.AddDoc(&blockDoc{ID: int64(i), Text: text(i)})
+	}
+	// 顺序写入攒够32MB之前不会写文件
+	assert.Greater(t, len(ddm.sealed), DOC_BLOCK_CACHE)
+	for _, i := range []int{1, 2, n / 2, n} {
+		doc, err := ddm.ReadDoc(int64(i))
+		assert.Nil(t, err)
+		assert.Equal(t, text(i), doc.(*blockDoc).Text)
+	}
+
+	ddm.Flush()
+	assert.Empty(t, ddm.sealed)
+	ddm.blocks = cache.Default(int64(DOC_BLOCK_CACHE))
+	doc, err := ddm.ReadDoc(1)
+	assert.Nil(t, err)
+	assert.Equal(t, text(1), doc.(*blockDoc).Text)
+}
+
+// 保存元数据时封存正在填充的块，没有Flush也能从磁盘重新打开
+func TestSaveMetaSealsBlocks(t *testing.T) {
+	root := t.TempDir()
+	ddm := NewDocDiskManager(root)
+	for i := 1; i <= 10; i++ {
+		ddm.AddDoc(&blockDoc{ID: int64(i), Text: fmt.Sprintf("doc %d", i)})
+	}
+	assert.NotEmpty(t, ddm.pending)
+	ddm.SaveMeta()
+	assert.Empty(t, ddm.pending)
+	assert.Empty(t, ddm.sealed)
+
+	ddm = NewDocDiskManager(root)
+	for i := 1; i <= 10; i++ {
+		doc, err := ddm.ReadDoc(int64(i))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("doc %d", i), doc.(*blockDoc).Text)
+	}
+	assert.Empty(t, ddm.Verify(false))
+}
+
+func TestDocBlockCorruption(t *testing.T) {
+	ddm := NewDocDiskManager(t.TempDir())
+	for i := 1; i <= 10; i++ {
+		ddm.AddDoc(&blockDoc{ID: int64(i), Text: strings.Repeat("corrupt me ", i)})
+	}
+	ddm.Flush()
+
+	for path := range ddm.chunks {
+		f, err := os.OpenFile(path, os.O_RDWR, 0666)
+		assert.Nil(t, err)
+		f.WriteAt([]byte{0xff, 0xff}, docBlockHeaderSize+4)
+		f.Close()
+	}
+	ddm.blocks = cache.Default(int64(DOC_BLOCK_CACHE))
+	_, err := ddm.ReadDoc(1)
+	assert.True(t, errors.Is(err, common.ErrCorrupted), err)
+	assert.NotEmpty(t, ddm.Verify(false))
+}
+
+// 所有文档的UUID相同，Identity不同
+type collideDoc struct {
+	Name  string
+	Alias int64
+}
+
+func (d *collideDoc) Serial() []byte {
+	return []byte(fmt.Sprintf("%s|%d", d.Name, d.Alias))
+}
+func (d *collideDoc) Dump(b []byte) {
+	fmt.Sscanf(strings.Replace(string(b), "|", " ", 1), "%s %d", &d.Name, &d.Alias)
+}
+func (d *collideDoc) UUID() int64 {
+	if d.Alias != 0 {
+		return d.Alias
+	}
+	return 7
+}
+func (d *collideDoc) Identity() string           { return d.Name }
+func (d *collideDoc) SetUUID(id int64)           { d.Alias = id }
+func (d *collideDoc) FieldExist(f string) bool   { return false }
+func (d *collideDoc) FieldLen(f string) int64    { return 0 }
+func (d *collideDoc) FetchField(f string) []byte { return nil }
+
+func TestUUIDCollision(t *testing.T) {
+	for _, p := range []CollisionPolicy{COLLISION_OVERWRITE, COLLISION_REJECT, COLLISION_RENAME, COLLISION_SECONDARY} {
+		root := t.TempDir()
+		ddm := NewDocDiskManager(root)
+		ddm.SetCollisionPolicy(p)
+		id, err := ddm.Insert(&collideDoc{Name: "a"})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(7), id)
+		// 同一文档再次写入不算冲突
+		_, err = ddm.Insert(&collideDoc{Name: "a"})
+		assert.Nil(t, err)
+		assert.Equal(t, CollisionStats{}, ddm.Stats())
+
+		b := &collideDoc{Name: "b"}
+		id, err = ddm.Insert(b)
+		stats := ddm.Stats()
+		assert.Equal(t, int64(1), stats.Seen)
+		switch p {
+		case COLLISION_OVERWRITE:
+			assert.Nil(t, err)
+			assert.Equal(t, int64(1), stats.Overwritten)
+			assert.Equal(t, "b", ddm.GetDoc(7).(*collideDoc).Name)
+		case COLLISION_REJECT:
+			assert.True(t, errors.Is(err, ErrUUIDCollision))
+			assert.True(t, errors.Is(ddm.AddDoc(&collideDoc{Name: "b"}), ErrUUIDCollision))
+			assert.Equal(t, int64(2), ddm.Stats().Rejected)
+			assert.Equal(t, int64(1), stats.Rejected)
+			assert.Equal(t, "a", ddm.GetDoc(7).(*collideDoc).Name)
+		default:
+			assert.Nil(t, err)
+			assert.NotEqual(t, int64(7), id)
+			assert.Equal(t, id, b.UUID())
+			assert.Equal(t, "a", ddm.GetDoc(7).(*collideDoc).Name)
+			assert.Equal(t, "b", ddm.GetDoc(id).(*collideDoc).Name)
+			// 重新导入时落到同一个ID
+			again, err := ddm.Insert(&collideDoc{Name: "b"})
+			assert.Nil(t, err)
+			assert.Equal(t, id, again)
+		}
+		if p == COLLISION_SECONDARY {
+			assert.Equal(t, []int64{id}, ddm.Secondaries(7))
+		}
+		var n int
+		for range ddm.EnumDocsID(&collideDoc{}, 4) {
+			n++
+		}
+		if p == COLLISION_OVERWRITE || p == COLLISION_REJECT {
+			assert.Equal(t, 1, n)
+		} else {
+			assert.Equal(t, 2, n)
+		}
+		assert.Empty(t, ddm.Verify(false))
+
+		ddm.Flush()
+		ddm.SaveMeta()
+		ddm = NewDocDiskManager(root)
+		ddm.SetCollisionPolicy(p)
+		assert.Equal(t, len(ddm.Secondaries(7)), int(stats.Secondary))
+		_, err = ddm.Insert(&collideDoc{Name: "c"})
+		if p == COLLISION_REJECT {
+			assert.True(t, errors.Is(err, ErrUUIDCollision))
+		} else {
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, int64(1), ddm.Stats().Seen)
+	}
+}
+
+func TestUUIDCollisionNotRenamable(t *testing.T) {
+	ddm := NewDocDiskManager(t.TempDir())
+	ddm.SetCollisionPolicy(COLLISION_RENAME)
+	assert.Nil(t, ddm.AddDoc(&blockDoc{ID: 1, Text: "a"}))
+	// 没有Identity的文档总是覆盖
+	_, err := ddm.Insert(&blockDoc{ID: 1, Text: "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, CollisionStats{}, ddm.Stats())
+	assert.Equal(t, "b", ddm.GetDoc(1).(*blockDoc).Text)
+	assert.Empty(t, ddm.Verify(false))
+}
@@ -0,0 +1,299 @@
+package document
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"fts/internal/bitmap"
+	"fts/internal/common"
+	"fts/internal/types"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrDocNumberFull      = errors.New("internal doc numbers exhausted")
+	ErrDocNumberNotFound  = errors.New("doc number not found")
+	ErrDocNumberInvariant = errors.New("doc number invariant violated")
+)
+
+var docnumMeta = "docnum.meta"
+
+// 索引目录(段)内的文档编号：按加入顺序为外部ID分配从0开始连续递增的内部编号，
+// 倒排、字段长度、DocValues、过滤器等按内部编号存储以便压缩和使用位图，对外仍然使用外部ID，
+// 两者之间的转换都经过这里
+// 编号不复用，删除的文档只在删除位图中标记
+type DocNumbers struct {
+	mu      sync.RWMutex
+	root    string           // 为空时只在内存中编号，不写回
+	ids     []int64          // 内部编号 -> 外部ID
+	nums    map[int64]uint32 // 外部ID -> 内部编号
+	deleted *bitmap.Bitmap
+	version uint64 // 编号或删除标记每次变化加一
+}
+
+type docNumbersMeta struct {
+	IDs     []int64
+	Deleted []byte
+}
+
+// 读取root下的编号表，文件损坏时返回错误
+func NewDocNumbers(root string) (*DocNumbers, error) {
+	dn := NewMemDocNumbers()
+	dn.root = root
+	if err := dn.load(); err != nil {
+		return nil, err
+	}
+	return dn, nil
+}
+
+// 只在内存中的编号表，Persite不写文件
+func NewMemDocNumbers() *DocNumbers {
+	return &DocNumbers{
+		nums:    make(map[int64]uint32),
+		deleted: bitmap.New(),
+	}
+}
+
+func (dn *DocNumbers) path() string {
+	return dn.root + "/" + docnumMeta
+}
+
+func (dn *DocNumbers) load() error {
+	path := dn.path()
+	if !common.IsExist(path) {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	meta := docNumbersMeta{}
+	if err = gob.NewDecoder(bytes.NewReader(b)).Decode(&meta); err != nil {
+		return fmt.Errorf("load %v: %w", path, err)
+	}
+	if err = dn.deleted.UnmarshalBinary(meta.Deleted); err != nil {
+		return fmt.Errorf("load %v: %w", path, err)
+	}
+	dn.ids = meta.IDs
+	for i, id := range dn.ids {
+		if _, ok := dn.nums[id]; !ok {
+			dn.nums[id] = uint32(i)
+		}
+	}
+	return nil
+}
+
+func (dn *DocNumbers) Persite() error {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	if dn.root == "" {
+		return nil
+	}
+	deleted, err := dn.deleted.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	if err = gob.NewEncoder(buf).Encode(&docNumbersMeta{IDs: dn.ids, Deleted: deleted}); err != nil {
+		return err
+	}
+	return os.WriteFile(dn.path(), buf.Bytes(), 0666)
+}
+
+// 返回id的内部编号，没有时分配下一个，已删除的文档重新加入时恢复原来的编号
+func (dn *DocNumbers) Assign(id int64) (uint32, error) {
+	dn.mu.Lock()
+	defer dn.mu.Unlock()
+	if num, ok := dn.nums[id]; ok {
+		if dn.deleted.Contains(num) {
+			dn.deleted.Remove(num)
+			dn.version++
+		}
+		return num, nil
+	}
+	if len(dn.ids) > math.MaxUint32 {
+		return 0, ErrDocNumberFull
+	}
+	num := uint32(len(dn.ids))
+	dn.ids = append(dn.ids, id)
+	dn.nums[id] = num
+	dn.version++
+	return num, nil
+}
+
+func (dn *DocNumbers) Num(id int64) (uint32, bool) {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	num, ok := dn.nums[id]
+	return num, ok
+}
+
+// 没有删除的文档的外部ID，查询结果转换为外部ID时使用
+func (dn *DocNumbers) LiveID(num uint32) (int64, bool) {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	if int(num) >= len(dn.ids) || dn.deleted.Contains(num) {
+		return 0, false
+	}
+	return dn.ids[num], true
+}
+
+func (dn *DocNumbers) ID(num uint32) (int64, bool) {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	if int(num) >= len(dn.ids) {
+		return 0, false
+	}
+	return dn.ids[num], true
+}
+
+// 已分配的编号个数，包括删除的文档
+func (dn *DocNumbers) Len() int {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	return len(dn.ids)
+}
+
+func (dn *DocNumbers) Delete(id int64) error {
+	dn.mu.Lock()
+	defer dn.mu.Unlock()
+	num, ok := dn.nums[id]
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrDocNumberNotFound, id)
+	}
+	if !dn.deleted.Contains(num) {
+		dn.deleted.Add(num)
+		dn.version++
+	}
+	return nil
+}
+
+// 编号表的版本，分配编号、删除或恢复文档后增加，按编号缓存的结果用它判断是否过期
+func (dn *DocNumbers) Version() uint64 {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	return dn.version
+}
+
+func (dn *DocNumbers) IsDeleted(id int64) bool {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	num, ok := dn.nums[id]
+	return ok && dn.deleted.Contains(num)
+}
+
+// 删除位图的副本
+func (dn *DocNumbers) Deleted() *bitmap.Bitmap {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	return dn.deleted.Clone()
+}
+
+// 未删除的文档
+func (dn *DocNumbers) Live() *bitmap.Bitmap {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	all := bitmap.New()
+	for i := range dn.ids {
+		all.Add(uint32(i))
+	}
+	res := all.AndNot(dn.deleted)
+	res.RunOptimize()
+	return res
+}
+
+// 外部ID转换为内部编号的位图，没有编号或已删除的文档被忽略
+func (dn *DocNumbers) Bitmap(ids []int64) *bitmap.Bitmap {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	res := bitmap.New()
+	for _, id := range ids {
+		if num, ok := dn.nums[id]; ok && !dn.deleted.Contains(num) {
+			res.Add(num)
+		}
+	}
+	return res
+}
+
+// 位图中的内部编号转换为升序的外部ID
+func (dn *DocNumbers) IDs(b *bitmap.Bitmap) []int64 {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	res := make([]int64, 0, b.Cardinality())
+	b.ForEach(func(num uint32) bool {
+		if int(num) < len(dn.ids) {
+			res = append(res, dn.ids[num])
+		}
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// 把按外部ID记录的倒排(例如编号之前构建的)转换为按内部编号升序排列，可以直接交给codec.EncodePostings
+// 没有编号或已删除的文档被忽略
+func (dn *DocNumbers) Postings(result types.IndexQueryResult) ([]int64, []int16) {
+	dn.mu.RLock()
+	defer dn.mu.RUnlock()
+	nums := make([]int64, 0, len(result.Info))
+	for id := range result.Info {
+		if num, ok := dn.nums[id]; ok && !dn.deleted.Contains(num) {
+			nums = append(nums, int64(num))
+		}
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	freqs := make([]int16, len(nums))
+	for i, num := range nums {
+		freqs[i] = result.Info[dn.ids[num]]
+	}
+	return nums, freqs
+}
+
+// 编号表与外部ID一一对应，删除位图只包含已分配的编号
+// repair时按编号表重建反向映射，重复出现的ID保留第一个编号，去掉超出范围的删除标记
+func (dn *DocNumbers) Verify(repair bool) []error {
+	dn.mu.Lock()
+	errs := []error{}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%w: %s", ErrDocNumberInvariant, fmt.Sprintf(format, args...)))
+	}
+	seen := make(map[int64]uint32, len(dn.ids))
+	for i, id := range dn.ids {
+		if prev, ok := seen[id]; ok {
+			fail("doc %d numbered %d and %d", id, prev, i)
+			continue
+		}
+		seen[id] = uint32(i)
+		if num, ok := dn.nums[id]; !ok || num != uint32(i) {
+			fail("doc %d should map to %d", id, i)
+		}
+	}
+	if len(dn.nums) != len(seen) {
+		fail("%d ids map to numbers but %d numbered", len(dn.nums), len(seen))
+	}
+	valid := bitmap.New()
+	dn.deleted.ForEach(func(num uint32) bool {
+		if int(num) < len(dn.ids) {
+			valid.Add(num)
+		} else {
+			fail("deleted number %d exceeds %d", num, len(dn.ids))
+		}
+		return true
+	})
+	if repair && len(errs) > 0 {
+		dn.nums = seen
+		dn.deleted = valid
+		dn.version++
+	}
+	dn.mu.Unlock()
+	if repair && len(errs) > 0 {
+		if err := dn.Persite(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,256 @@
+package document
+
+import (
+	"errors"
+	"fts/internal/codec"
+	"fts/internal/common"
+	"fts/internal/types"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type numDoc struct {
+	ID int64
+}
+
+func (d *numDoc) Serial() []byte           { return nil }
+func (d *numDoc) Dump([]byte)              {}
+func (d *numDoc) UUID() int64              { return d.ID }
+func (d *numDoc) FieldExist(string) bool   { return false }
+func (d *numDoc) FieldLen(string) int64    { return 0 }
+func (d *numDoc) FetchField(string) []byte { return nil }
+
+// 只记录文档ID的磁盘管理器
+type numDisk struct {
+	ids    []int64
+	reject map[int64]error // 拒绝写入的文档
+}
+
+func (nd *numDisk) GetDoc(id int64) types.Document           { return &numDoc{ID: id} }
+func (nd *numDisk) ReadDoc(id int64) (types.Document, error) { return &numDoc{ID: id}, nil }
+func (nd *numDisk) AddDoc(doc types.Document) error {
+	if err := nd.reject[doc.UUID()]; err != nil {
+		return err
+	}
+	nd.ids = append(nd.ids, doc.UUID())
+	return nil
+}
+func (nd *numDisk) EnumDocTypes() []types.Document { return []types.Document{&numDoc{}} }
+func (nd *numDisk) Docs(types.Document) int64      { return int64(len(nd.ids)) }
+func (nd *numDisk) Flush()                         {}
+func (nd *numDisk) SaveMeta()                      {}
+func (nd *numDisk) EnumDocsID(doc types.Document, n int) chan int64 {
+	ch := make(chan int64, n)
+	go func() {
+		for _, v := range nd.ids {
+			ch <- v
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func hashedIDs(n int) []int64 {
+	ids := make([]int64, n)
+	for i := range ids {
+		ids[i] = common.StringHashToInt64("doc-" + strconv.Itoa(i))
+	}
+	return ids
+}
+
+func TestDocNumbers(t *testing.T) {
+	root := t.TempDir()
+	ids := hashedIDs(1000)
+	dn, err := NewDocNumbers(root)
+	assert.Nil(t, err)
+	for i, id := range ids {
+		num, err := dn.Assign(id)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(i), num)
+	}
+	// 重复分配返回原来的编号
+	num, _ := dn.Assign(ids[10])
+	assert.Equal(t, uint32(10), num)
+
+	assert.Nil(t, dn.Delete(ids[3]))
+	assert.True(t, errors.Is(dn.Delete(12345), ErrDocNumberNotFound))
+	assert.True(t, dn.IsDeleted(ids[3]))
+	assert.Equal(t, uint64(999), dn.Live().Cardinality())
+	assert.Nil(t, dn.Persite())
+
+	dn, err = NewDocNumbers(root)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, dn.Len())
+	assert.True(t, dn.IsDeleted(ids[3]))
+	id, ok := dn.ID(500)
+	assert.True(t, ok)
+	assert.Equal(t, ids[500], id)
+	_, ok = dn.ID(1000)
+	assert.False(t, ok)
+	assert.Empty(t, dn.Verify(false))
+
+	// 外部ID与位图互相转换，已删除的文档被忽略
+	b := dn.Bitmap([]int64{ids[1], ids[3], ids[7], 42})
+	assert.Equal(t, []uint32{1, 7}, b.ToArray())
+	expect := []int64{ids[1], ids[7]}
+	sort.Slice(expect, func(i, j int) bool { return expect[i] < expect[j] })
+	assert.Equal(t, expect, dn.IDs(b))
+
+	// 重新加入恢复原来的编号
+	num, _ = dn.Assign(ids[3])
+	assert.Equal(t, uint32(3), num)
+	assert.False(t, dn.IsDeleted(ids[3]))
+
+	// 损坏或不完整的编号表返回错误
+	b2, _ := os.ReadFile(dn.path())
+	os.WriteFile(dn.path(), b2[:len(b2)/2], 0666)
+	_, err = NewDocNumbers(root)
+	assert.NotNil(t, err)
+}
+
+func TestDocNumbersPostings(t *testing.T) {
+	ids := hashedIDs(2000)
+	dn := NewMemDocNumbers()
+	for _, id := range ids {
+		dn.Assign(id)
+	}
+	dn.Delete(ids[8])
+	r := rand.New(rand.NewSource(1))
+	info := map[int64]int16{12345: 1}
+	for _, id := range ids {
+		if r.Intn(4) == 0 {
+			info[id] = int16(1 + r.Intn(3))
+		}
+	}
+	info[ids[8]] = 1
+	nums, freqs := dn.Postings(types.IndexQueryResult{Info: info})
+	// 没有编号与删除的文档被忽略
+	assert.Equal(t, len(info)-2, len(nums))
+	assert.True(t, sort.SliceIsSorted(nums, func(i, j int) bool { return nums[i] < nums[j] }))
+	for i, num := range nums {
+		id, _ := dn.ID(uint32(num))
+		assert.Equal(t, info[id], freqs[i])
+	}
+}
+
+// 每个词项随机命中1/4的文档，返回按哈希ID与按内部编号编码的倒排
+func postingsSizes(dn *DocNumbers, ids []int64, r *rand.Rand) ([]byte, []byte, int, error) {
+	info := make(map[int64]int16)
+	for _, id := range ids {
+		if r.Intn(4) == 0 {
+			info[id] = int16(1 + r.Intn(3))
+		}
+	}
+	res := types.IndexQueryResult{Info: info}
+	sparse, err := codec.EncodeQueryResult(res)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	dense, err := codec.EncodePostings(dn.Postings(res))
+	return sparse, dense, len(info), err
+}
+
+// 按内部编号编码的倒排远小于按哈希ID编码的
+func TestDocNumbersCompression(t *testing.T) {
+	ids := hashedIDs(20000)
+	dn := NewMemDocNumbers()
+	for _, id := range ids {
+		dn.Assign(id)
+	}
+	sparse, dense, n, err := postingsSizes(dn, ids, rand.New(rand.NewSource(1)))
+	assert.Nil(t, err)
+	t.Logf("%d docs, hashed %d bytes, dense %d bytes, ratio %.2f", n, len(sparse), len(dense), float64(len(sparse))/float64(len(dense)))
+	assert.Less(t, 4*len(dense), len(sparse))
+}
+
+func BenchmarkDocNumbersPostings(b *testing.B) {
+	ids := hashedIDs(100000)
+	dn := NewMemDocNumbers()
+	for _, id := range ids {
+		dn.Assign(id)
+	}
+	var sparse, dense, n int
+	for i := 0; i < b.N; i++ {
+		s, d, docs, _ := postingsSizes(dn, ids, rand.New(rand.NewSource(int64(i))))
+		sparse, dense, n = len(s), len(d), docs
+	}
+	b.ReportMetric(float64(sparse)/float64(n), "hashed-bytes/doc")
+	b.ReportMetric(float64(dense)/float64(n), "dense-bytes/doc")
+	b.ReportMetric(float64(sparse)/float64(dense), "ratio")
+}
+
+func TestUseNumbers(t *testing.T) {
+	disk := &numDisk{ids: hashedIDs(10)}
+	root := t.TempDir()
+	dm := NewDocumentManager(16, disk)
+	dn, err := NewDocNumbers(root)
+	assert.Nil(t, err)
+	dn.Assign(disk.ids[5])
+	dn.Delete(disk.ids[5])
+
+	assert.Nil(t, dm.UseNumbers(dn))
+	assert.Equal(t, 10, dn.Len())
+	// 已有编号的文档保持删除
+	assert.True(t, dn.IsDeleted(disk.ids[5]))
+	assert.Nil(t, dm.GetDocument(disk.ids[5]))
+	assert.NotNil(t, dm.GetDocument(disk.ids[6]))
+	dn, err = NewDocNumbers(root)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, dn.Len())
+}
+
+type numLoader struct {
+	ids  []int64
+	err  error
+	exit error
+}
+
+func (nl *numLoader) Load(ch chan types.Document, errch chan error) {
+	for _, id := range nl.ids {
+		ch <- &numDoc{ID: id}
+	}
+	if nl.err != nil {
+		errch <- nl.err
+		return
+	}
+	ch <- nil
+}
+func (nl *numLoader) ErrExit(err error) { nl.exit = err }
+
+// 加载出错时返回错误并通知loader，已经加载的文档保留编号
+func TestLoadDocumentError(t *testing.T) {
+	disk := &numDisk{}
+	dm := NewDocumentManager(16, disk)
+	dn := NewMemDocNumbers()
+	assert.Nil(t, dm.UseNumbers(dn))
+
+	ids := hashedIDs(5)
+	assert.Nil(t, dm.LoadDocument(&numLoader{ids: ids[:2]}))
+	assert.Equal(t, 2, dn.Len())
+
+	fail := errors.New("broken source")
+	nl := &numLoader{ids: ids[2:], err: fail}
+	assert.Equal(t, fail, dm.LoadDocument(nl))
+	assert.Equal(t, fail, nl.exit)
+	// 每个写入磁盘的文档都有编号
+	assert.Equal(t, len(disk.ids), dn.Len())
+
+	// 被磁盘拒绝的文档跳过，其余文档照常加载
+	collision := errors.New("uuid collision")
+	more := hashedIDs(10)[5:]
+	disk.reject = map[int64]error{more[1]: collision}
+	nl = &numLoader{ids: more}
+	err := dm.LoadDocument(nl)
+	assert.True(t, errors.Is(err, collision))
+	assert.Nil(t, nl.exit)
+	_, ok := dn.Num(more[1])
+	assert.False(t, ok)
+	_, ok = dn.Num(more[4])
+	assert.True(t, ok)
+	assert.Equal(t, len(disk.ids), dn.Len())
+}
@@ -1,8 +1,10 @@
 package document
 
 import (
+	"errors"
 	"fmt"
 	"fts/internal/cache"
+	"fts/internal/common"
 	"fts/internal/types"
 	"strconv"
 )
@@ -17,6 +19,7 @@ type DocumentWrapper struct {
 type DocumentManager struct {
 	cache types.Cache
 	disk  types.DocDiskManager
+	nums  *DocNumbers // 内部文档编号，为nil时不分配
 }
 
 func NewDocumentManager(cap int64, disk types.DocDiskManager) *DocumentManager {
@@ -36,33 +39,83 @@ func (dm *DocumentManager) init(cap int64) {
 	})
 }
 
-func (dm *DocumentManager) LoadDocument(loader types.DocumentLoader) {
+// 加载loader给出的全部文档，出错时通知loader并返回错误，已经加载的文档仍然写入磁盘
+// 磁盘拒绝的文档(例如ID冲突)跳过并继续加载，结束后一起返回，可以用errors.Is判断原因
+func (dm *DocumentManager) LoadDocument(loader types.DocumentLoader) error {
 	ch := make(chan types.Document, maxloads)
 	Errch := make(chan error)
 	//go LoadAbstractDocumentGzip(path, ty, ch, Errch)
 	go loader.Load(ch, Errch)
 	count := 0
-	for {
+	var (
+		err      error
+		rejected []error
+	)
+	for err == nil {
 		select {
-		case err := <-Errch:
-			if err != nil {
-				loader.ErrExit(err)
-				panic(err)
-			}
+		case err = <-Errch:
 		case doc := <-ch:
 			if doc == nil {
 				goto e
 			}
+			if aerr := dm.disk.AddDoc(doc); aerr != nil {
+				// 没有写入的文档不编号
+				rejected = append(rejected, aerr)
+				continue
+			}
 			count++
-			dm.disk.AddDoc(doc)
+			if dm.nums != nil {
+				_, err = dm.nums.Assign(doc.UUID())
+			}
 		}
 	}
+	loader.ErrExit(err)
 e:
 	dm.FlushAllBuildCache()
 	dm.disk.SaveMeta()
+	if dm.nums != nil {
+		if perr := dm.nums.Persite(); perr != nil {
+			common.DFAIL("persite doc numbers %v", perr)
+		}
+	}
+	if err != nil {
+		return err
+	}
 	fmt.Printf("success loaded %v documents", count)
+	if len(rejected) > 0 {
+		return fmt.Errorf("%d documents rejected: %w", len(rejected), errors.Join(rejected...))
+	}
+	return nil
+}
+
+// 使用内部文档编号，为已经加载但还没有编号的文档补充编号
+func (dm *DocumentManager) UseNumbers(nums *DocNumbers) error {
+	dm.nums = nums
+	count := nums.Len()
+	for _, id := range dm.DumpAllDocsID() {
+		if _, ok := nums.Num(id); ok {
+			// 已有编号，不改变删除标记
+			continue
+		}
+		if _, err := nums.Assign(id); err != nil {
+			return err
+		}
+	}
+	if nums.Len() == count {
+		return nil
+	}
+	return nums.Persite()
+}
+
+func (dm *DocumentManager) Numbers() *DocNumbers {
+	return dm.nums
 }
+
+// 删除的文档返回nil
 func (dm *DocumentManager) GetDocument(ID int64) types.Document {
+	if dm.nums != nil && dm.nums.IsDeleted(ID) {
+		return nil
+	}
 	var doc interface{}
 	var ok bool
 	xid := strconv.FormatInt(ID, 10)
@@ -72,6 +125,11 @@ func (dm *DocumentManager) GetDocument(ID int64) types.Document {
 	}
 	return doc.(types.Document)
 }
+
+// 绕过缓存直接从磁盘读取，返回数据损坏等错误
+func (dm *DocumentManager) ReadDocument(ID int64) (types.Document, error) {
+	return dm.disk.ReadDoc(ID)
+}
 func (dm *DocumentManager) fetchDisk(ID string) interface{} {
 	doc, ok := dm.Miss(ID)
 	if !ok {
@@ -121,6 +179,14 @@ func (dm *DocumentManager) DumpAllDocsID() []int64 {
 	return sl
 }
 
+// 检查磁盘上的文档，磁盘管理器不支持自检时返回nil
+func (dm *DocumentManager) Verify(repair bool) []error {
+	if v, ok := dm.disk.(types.Verifier); ok {
+		return v.Verify(repair)
+	}
+	return nil
+}
+
 func (dm *DocumentManager) FlushAllBuildCache() {
 	dm.disk.Flush()
 }
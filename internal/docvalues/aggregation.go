@@ -0,0 +1,151 @@
+package docvalues
+
+import (
+	"fts/internal/bitmap"
+	"sort"
+	"time"
+)
+
+type TermBucket struct {
+	Term  string
+	Count int64
+}
+
+// 词项聚合的结果，Other为排在前n个之外的取值的文档数，Missing为没有值的文档数
+type TermsResult struct {
+	Buckets []TermBucket
+	Other   int64
+	Missing int64
+}
+
+// 统计hits(文档编号)中每个取值的文档数，返回文档数最多的n个取值，文档数相同时按取值升序
+// n<=0时返回全部取值
+func Terms(col *KeywordColumn, hits *bitmap.Bitmap, n int) *TermsResult {
+	res := &TermsResult{}
+	counts := make([]int64, col.Cardinality())
+	hits.ForEach(func(num uint32) bool {
+		if ord, ok := col.Ord(num); ok {
+			counts[ord]++
+		} else {
+			res.Missing++
+		}
+		return true
+	})
+	for ord, c := range counts {
+		if c > 0 {
+			res.Buckets = append(res.Buckets, TermBucket{Term: col.Terms[ord], Count: c})
+		}
+	}
+	// 取值已经升序，稳定排序保持文档数相同的取值的顺序
+	sort.SliceStable(res.Buckets, func(i, j int) bool {
+		return res.Buckets[i].Count > res.Buckets[j].Count
+	})
+	if n > 0 && len(res.Buckets) > n {
+		for _, b := range res.Buckets[n:] {
+			res.Other += b.Count
+		}
+		res.Buckets = res.Buckets[:n]
+	}
+	return res
+}
+
+// 数值字段的统计，Count为有值的文档数，Count为0时其它项无意义
+type StatsResult struct {
+	Count   int64
+	Missing int64
+	Min     int64
+	Max     int64
+	Sum     int64
+	Avg     float64
+}
+
+func Stats(col *NumericColumn, hits *bitmap.Bitmap) *StatsResult {
+	res := &StatsResult{}
+	hits.ForEach(func(num uint32) bool {
+		v, ok := col.Value(num)
+		if !ok {
+			res.Missing++
+			return true
+		}
+		if res.Count == 0 || v < res.Min {
+			res.Min = v
+		}
+		if res.Count == 0 || v > res.Max {
+			res.Max = v
+		}
+		res.Count++
+		res.Sum += v
+		return true
+	})
+	if res.Count > 0 {
+		res.Avg = float64(res.Sum) / float64(res.Count)
+	}
+	return res
+}
+
+// 直方图的一个区间，Key为区间的起点
+type Bucket struct {
+	Key   int64
+	Count int64
+}
+
+// 向下取整的除法
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// 固定宽度的直方图，区间为[offset+k*interval, offset+(k+1)*interval)，按Key升序，不返回空区间
+func Histogram(col *NumericColumn, hits *bitmap.Bitmap, interval int64, offset int64) []Bucket {
+	if interval <= 0 {
+		return nil
+	}
+	return buckets(col, hits, func(v int64) int64 {
+		return floorDiv(v-offset, interval)*interval + offset
+	})
+}
+
+type DateInterval int
+
+const (
+	DATE_DAY DateInterval = iota
+	DATE_MONTH
+	DATE_YEAR
+)
+
+var DATE_LOCATION = time.Local // 日期直方图按该时区划分日、月
+
+// 日期直方图，值为unix时间戳(秒)，Key为所在日、月或年在DATE_LOCATION的起始时间戳
+func DateHistogram(col *NumericColumn, hits *bitmap.Bitmap, unit DateInterval) []Bucket {
+	return buckets(col, hits, func(v int64) int64 {
+		t := time.Unix(v, 0).In(DATE_LOCATION)
+		switch unit {
+		case DATE_MONTH:
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, DATE_LOCATION)
+		case DATE_YEAR:
+			t = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, DATE_LOCATION)
+		default:
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, DATE_LOCATION)
+		}
+		return t.Unix()
+	})
+}
+
+func buckets(col *NumericColumn, hits *bitmap.Bitmap, key func(int64) int64) []Bucket {
+	counts := make(map[int64]int64)
+	hits.ForEach(func(num uint32) bool {
+		if v, ok := col.Value(num); ok {
+			counts[key(v)]++
+		}
+		return true
+	})
+	res := make([]Bucket, 0, len(counts))
+	for k, c := range counts {
+		res = append(res, Bucket{Key: k, Count: c})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
@@ -0,0 +1,70 @@
+package docvalues
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// 二进制列：每个文档记录任意字节，定长值为字节在文件末尾数据区的偏移(8)与长度(4)
+type BinaryColumn struct {
+	*Column
+}
+
+func writeBinary(path string, values map[uint32][]byte) error {
+	count, missing := layout(func(f func(uint32)) {
+		for num := range values {
+			f(num)
+		}
+	})
+	blob := []byte{}
+	offs := make(map[uint32]int, len(values))
+	for num := uint32(0); num < count; num++ {
+		if v, ok := values[num]; ok {
+			offs[num] = len(blob)
+			blob = append(blob, v...)
+		}
+	}
+	return writeColumn(path, KIND_BINARY, 12, count, missing, func(num uint32, b []byte) {
+		binary.LittleEndian.PutUint64(b, uint64(offs[num]))
+		binary.LittleEndian.PutUint32(b[8:], uint32(len(values[num])))
+	}, nil, blob)
+}
+
+func openBinary(path string) (*BinaryColumn, error) {
+	c, err := openKind(path, KIND_BINARY, 12)
+	if err != nil {
+		return nil, err
+	}
+	return &BinaryColumn{Column: c}, nil
+}
+
+// 二进制值在数据区的偏移与长度
+func (c *Column) span(num uint32) (int64, int64, error) {
+	b, ok := c.entry(num)
+	if !ok {
+		return 0, -1, c.Err()
+	}
+	off, n := int64(binary.LittleEndian.Uint64(b)), int64(binary.LittleEndian.Uint32(b[8:]))
+	if off < 0 || off+n > c.blobLen {
+		return 0, -1, fmt.Errorf("%w: %s doc %d at [%d, %d) out of %d bytes", ErrColumnFormat, c.path, num, off, off+n, c.blobLen)
+	}
+	return off, n, nil
+}
+
+// 文档的值，没有值或读取失败时返回false
+func (bc *BinaryColumn) Value(num uint32) ([]byte, bool) {
+	off, n, err := bc.span(num)
+	if err != nil {
+		bc.fail(err)
+		return nil, false
+	}
+	if n < 0 {
+		return nil, false
+	}
+	b := make([]byte, n)
+	if _, err := bc.f.ReadAt(b, bc.blobOff+off); err != nil {
+		bc.fail(err)
+		return nil, false
+	}
+	return b, true
+}
@@ -0,0 +1,328 @@
+package docvalues
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"fts/internal/bitmap"
+	"fts/internal/cache"
+	"fts/internal/common"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	DOCVALUES_BLOCK = 4096 // 每块的文档个数，写入时记录在文件头，读取时按文件头
+	DOCVALUES_CACHE = 256  // 所有列共享的块缓存个数
+)
+
+var ErrColumnFormat = errors.New("invalid doc values column")
+
+const (
+	columnMagic      = 0x31435644 // "DVC1"
+	columnHeaderSize = 24
+
+	KIND_NUMERIC byte = 1
+	KIND_KEYWORD byte = 2
+	KIND_BINARY  byte = 3
+)
+
+var (
+	blockCache = cache.Default(int64(DOCVALUES_CACHE))
+	openSeq    int64 // 每次打开列的编号，区分重建前后同一文件的缓存块
+)
+
+// 列文件:
+// 文件头: magic(4) | 类型(1) | 每个值的字节数(1) | 保留(2) | 文档数(4) | 每块文档数(4) | 尾部偏移(8)，little endian
+// 值区: 按文档编号排列的定长值，每DOCVALUES_BLOCK个值为一块
+// 尾部: 每块的crc32(4*块数) | 无值文档位图长度(4) | 位图 | 附加数据长度(4) | 附加数据 | 二进制列的值
+// 按编号定位到块与块内偏移，读取一个值最多读一块
+type Column struct {
+	*columnFile
+	mu  sync.Mutex
+	err error // 这个读者读取值时遇到的第一个错误
+}
+
+// 打开的列文件，多个读者共用，最后一个读者释放时关闭
+type columnFile struct {
+	path      string
+	f         *os.File
+	kind      byte
+	width     int
+	count     uint32
+	blockSize uint32
+	crcs      []uint32
+	missing   *bitmap.Bitmap
+	extra     []byte
+	blobOff   int64
+	blobLen   int64
+	key       string
+	refs      int32
+}
+
+// 写入列文件，entry把编号num的值编码到b(width字节)，missing中的编号不调用entry
+// 先写临时文件再改名，重建时正在读取的旧列不受影响
+func writeColumn(path string, kind byte, width int, count uint32, missing *bitmap.Bitmap, entry func(num uint32, b []byte), extra []byte, blob []byte) error {
+	bs := uint32(DOCVALUES_BLOCK)
+	blocks := (count + bs - 1) / bs
+	data := make([]byte, int(count)*width)
+	for num := uint32(0); num < count; num++ {
+		if !missing.Contains(num) {
+			entry(num, data[int(num)*width:int(num+1)*width])
+		}
+	}
+	mb, err := missing.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, columnHeaderSize, columnHeaderSize+len(data)+4*int(blocks)+8+len(mb)+len(extra)+len(blob))
+	binary.LittleEndian.PutUint32(buf[0:], columnMagic)
+	buf[4] = kind
+	buf[5] = byte(width)
+	binary.LittleEndian.PutUint32(buf[8:], count)
+	binary.LittleEndian.PutUint32(buf[12:], bs)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(columnHeaderSize+len(data)))
+	buf = append(buf, data...)
+	for i := uint32(0); i < blocks; i++ {
+		start, end := int(i*bs)*width, int((i+1)*bs)*width
+		if end > len(data) {
+			end = len(data)
+		}
+		buf = binary.LittleEndian.AppendUint32(buf, common.GetCrc32(data[start:end]))
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(mb)))
+	buf = append(buf, mb...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(extra)))
+	buf = append(buf, extra...)
+	buf = append(buf, blob...)
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, buf, 0666); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 由有值的编号计算文档数(最大编号+1)与没有值的编号
+func layout(each func(func(uint32))) (uint32, *bitmap.Bitmap) {
+	present := bitmap.New()
+	count := uint32(0)
+	each(func(num uint32) {
+		present.Add(num)
+		if num+1 > count {
+			count = num + 1
+		}
+	})
+	missing := bitmap.New()
+	for num := uint32(0); num < count; num++ {
+		if !present.Contains(num) {
+			missing.Add(num)
+		}
+	}
+	missing.RunOptimize()
+	return count, missing
+}
+
+// 打开列文件，读入文件头与尾部，值区按块读取
+func Open(path string) (*Column, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := readColumn(path, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func readColumn(path string, f *os.File) (*Column, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	bad := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s %s", ErrColumnFormat, path, fmt.Sprintf(format, args...))
+	}
+	head := make([]byte, columnHeaderSize)
+	if _, err = f.ReadAt(head, 0); err != nil {
+		return nil, bad("header: %v", err)
+	}
+	if binary.LittleEndian.Uint32(head) != columnMagic {
+		return nil, bad("magic %x", head[:4])
+	}
+	c := &columnFile{
+		path:      path,
+		f:         f,
+		kind:      head[4],
+		width:     int(head[5]),
+		count:     binary.LittleEndian.Uint32(head[8:]),
+		blockSize: binary.LittleEndian.Uint32(head[12:]),
+		key:       path + "#" + strconv.FormatInt(atomic.AddInt64(&openSeq, 1), 10) + "#",
+		refs:      1,
+	}
+	tailOff := int64(binary.LittleEndian.Uint64(head[16:]))
+	if c.width == 0 || c.blockSize == 0 || tailOff != columnHeaderSize+int64(c.count)*int64(c.width) || tailOff > st.Size() {
+		return nil, bad("width %d, block %d, tail at %d of %d", c.width, c.blockSize, tailOff, st.Size())
+	}
+	tail := make([]byte, st.Size()-tailOff)
+	if _, err = f.ReadAt(tail, tailOff); err != nil && err != io.EOF {
+		return nil, err
+	}
+	blocks := int((c.count + c.blockSize - 1) / c.blockSize)
+	if len(tail) < 4*blocks+4 {
+		return nil, bad("truncated checksums")
+	}
+	c.crcs = make([]uint32, blocks)
+	for i := range c.crcs {
+		c.crcs[i] = binary.LittleEndian.Uint32(tail[4*i:])
+	}
+	tail = tail[4*blocks:]
+	section := func() ([]byte, error) {
+		if len(tail) < 4 {
+			return nil, bad("truncated tail")
+		}
+		n := int(binary.LittleEndian.Uint32(tail))
+		if len(tail) < 4+n {
+			return nil, bad("section of %d bytes exceeds tail", n)
+		}
+		b := tail[4 : 4+n]
+		tail = tail[4+n:]
+		return b, nil
+	}
+	mb, err := section()
+	if err != nil {
+		return nil, err
+	}
+	c.missing = bitmap.New()
+	if err = c.missing.UnmarshalBinary(mb); err != nil {
+		return nil, bad("missing: %v", err)
+	}
+	if c.extra, err = section(); err != nil {
+		return nil, err
+	}
+	c.blobOff = st.Size() - int64(len(tail))
+	c.blobLen = int64(len(tail))
+	return &Column{columnFile: c}, nil
+}
+
+// 打开列并检查类型与值的宽度
+func openKind(path string, kind byte, width int) (*Column, error) {
+	c, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.kind != kind || c.width != width {
+		c.Close()
+		return nil, fmt.Errorf("%w: %s has kind %d width %d, want %d width %d", ErrColumnFormat, path, c.kind, c.width, kind, width)
+	}
+	return c, nil
+}
+
+// 文档数，编号不小于Len的文档没有值
+func (c *Column) Len() uint32 {
+	return c.count
+}
+
+// 第i块的值，经过crc32校验后放入缓存
+func (c *Column) block(i uint32) ([]byte, error) {
+	key := c.key + strconv.FormatUint(uint64(i), 10)
+	if v, ok := blockCache.Get(key); ok {
+		return v.([]byte), nil
+	}
+	b, err := c.readBlock(i)
+	if err != nil {
+		return nil, err
+	}
+	blockCache.Put(key, b)
+	return b, nil
+}
+
+func (c *Column) readBlock(i uint32) ([]byte, error) {
+	n := c.blockSize
+	if rest := c.count - i*c.blockSize; rest < n {
+		n = rest
+	}
+	off := columnHeaderSize + int64(i)*int64(c.blockSize)*int64(c.width)
+	b := make([]byte, int(n)*c.width)
+	if _, err := c.f.ReadAt(b, off); err != nil {
+		return nil, err
+	}
+	if err := common.VerifyCrc32(c.path, off, b, c.crcs[i]); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// 编号num的定长值，没有值或读取失败时返回false，失败原因见Err
+func (c *Column) entry(num uint32) ([]byte, bool) {
+	if num >= c.count || c.missing.Contains(num) {
+		return nil, false
+	}
+	b, err := c.block(num / c.blockSize)
+	if err != nil {
+		c.fail(err)
+		return nil, false
+	}
+	i := int(num%c.blockSize) * c.width
+	return b[i : i+c.width], true
+}
+
+func (c *Column) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
+
+// 这个读者读取值时遇到的第一个错误，读取失败的值按没有值处理
+// 错误不影响同一列的其他读者，重新取列后从nil开始
+func (c *Column) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// 共用同一个列文件的新读者，用完后调用Release
+func (c *Column) acquire() *Column {
+	atomic.AddInt32(&c.refs, 1)
+	return &Column{columnFile: c.columnFile}
+}
+
+// 释放读者，所有读者都释放后关闭列文件
+func (c *Column) Release() error {
+	if atomic.AddInt32(&c.refs, -1) == 0 {
+		return c.f.Close()
+	}
+	return nil
+}
+
+func (c *Column) Close() error {
+	return c.Release()
+}
+
+// 校验每块的crc32，二进制列还检查每个值落在数据区内；列由文档重建，repair时不做修改
+func (c *Column) Verify(repair bool) []error {
+	errs := []error{}
+	for i := range c.crcs {
+		if _, err := c.readBlock(uint32(i)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 || c.kind != KIND_BINARY {
+		return errs
+	}
+	for num := uint32(0); num < c.count; num++ {
+		if _, _, err := c.span(num); err != nil {
+			return append(errs, err)
+		}
+	}
+	return errs
+}
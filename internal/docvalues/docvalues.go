@@ -0,0 +1,205 @@
+package docvalues
+
+import (
+	"errors"
+	"fmt"
+	"fts/internal/common"
+	"path/filepath"
+	"sync"
+)
+
+var ErrFieldNotFound = errors.New("doc values field not found")
+
+// 按内部文档编号存储的列式字段值，聚合与排序时不需要打开文档
+// 每个字段一列，保存在root下，按编号O(1)读取，读过的块放在共享的缓存中
+// 取得的列是一个读者，用完后调用Release，列被重建或关闭后最后一个读者释放时关闭文件
+type DocValues struct {
+	mu       sync.Mutex
+	root     string
+	keywords map[string]*KeywordColumn
+	numerics map[string]*NumericColumn
+	binaries map[string]*BinaryColumn
+}
+
+var (
+	keywordSuffix = "_kw.dv"
+	numericSuffix = "_num.dv"
+	binarySuffix  = "_bin.dv"
+)
+
+func NewDocValues(root string) *DocValues {
+	return &DocValues{
+		root:     root,
+		keywords: make(map[string]*KeywordColumn),
+		numerics: make(map[string]*NumericColumn),
+		binaries: make(map[string]*BinaryColumn),
+	}
+}
+
+func (dv *DocValues) path(field string, suffix string) string {
+	return dv.root + "/" + field + suffix
+}
+
+// 打开字段的列，不存在时返回ErrFieldNotFound
+func (dv *DocValues) open(field string, suffix string, open func(string) error) error {
+	path := dv.path(field, suffix)
+	if !common.IsExist(path) {
+		return fmt.Errorf("%w: %s", ErrFieldNotFound, field)
+	}
+	return open(path)
+}
+
+// 用文档编号到字段值的映射重建关键词列并保存，值作为整体不分词
+// 重建前取得的旧列仍然可以读取，旧列的读者都释放后关闭文件
+func (dv *DocValues) SetKeyword(field string, values map[uint32]string) error {
+	path := dv.path(field, keywordSuffix)
+	if err := writeKeyword(path, values); err != nil {
+		return err
+	}
+	col, err := openKeyword(path)
+	if err != nil {
+		return err
+	}
+	dv.mu.Lock()
+	old := dv.keywords[field]
+	dv.keywords[field] = col
+	dv.mu.Unlock()
+	if old != nil {
+		old.Release()
+	}
+	return nil
+}
+
+// 字段的关键词列，第一次使用时打开，用完后Release
+func (dv *DocValues) Keyword(field string) (*KeywordColumn, error) {
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	if col, ok := dv.keywords[field]; ok {
+		return &KeywordColumn{Column: col.acquire(), Terms: col.Terms}, nil
+	}
+	err := dv.open(field, keywordSuffix, func(path string) (err error) {
+		dv.keywords[field], err = openKeyword(path)
+		return
+	})
+	if err != nil {
+		delete(dv.keywords, field)
+		return nil, err
+	}
+	col := dv.keywords[field]
+	return &KeywordColumn{Column: col.acquire(), Terms: col.Terms}, nil
+}
+
+// 用文档编号到字段值的映射重建数值列并保存
+func (dv *DocValues) SetNumeric(field string, values map[uint32]int64) error {
+	path := dv.path(field, numericSuffix)
+	if err := writeNumeric(path, values); err != nil {
+		return err
+	}
+	col, err := openNumeric(path)
+	if err != nil {
+		return err
+	}
+	dv.mu.Lock()
+	old := dv.numerics[field]
+	dv.numerics[field] = col
+	dv.mu.Unlock()
+	if old != nil {
+		old.Release()
+	}
+	return nil
+}
+
+// 字段的数值列，第一次使用时打开，用完后Release
+func (dv *DocValues) Numeric(field string) (*NumericColumn, error) {
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	if col, ok := dv.numerics[field]; ok {
+		return &NumericColumn{Column: col.acquire()}, nil
+	}
+	err := dv.open(field, numericSuffix, func(path string) (err error) {
+		dv.numerics[field], err = openNumeric(path)
+		return
+	})
+	if err != nil {
+		delete(dv.numerics, field)
+		return nil, err
+	}
+	col := dv.numerics[field]
+	return &NumericColumn{Column: col.acquire()}, nil
+}
+
+// 用文档编号到字段值的映射重建二进制列并保存
+func (dv *DocValues) SetBinary(field string, values map[uint32][]byte) error {
+	path := dv.path(field, binarySuffix)
+	if err := writeBinary(path, values); err != nil {
+		return err
+	}
+	col, err := openBinary(path)
+	if err != nil {
+		return err
+	}
+	dv.mu.Lock()
+	old := dv.binaries[field]
+	dv.binaries[field] = col
+	dv.mu.Unlock()
+	if old != nil {
+		old.Release()
+	}
+	return nil
+}
+
+// 字段的二进制列，第一次使用时打开，用完后Release
+func (dv *DocValues) Binary(field string) (*BinaryColumn, error) {
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	if col, ok := dv.binaries[field]; ok {
+		return &BinaryColumn{Column: col.acquire()}, nil
+	}
+	err := dv.open(field, binarySuffix, func(path string) (err error) {
+		dv.binaries[field], err = openBinary(path)
+		return
+	})
+	if err != nil {
+		delete(dv.binaries, field)
+		return nil, err
+	}
+	col := dv.binaries[field]
+	return &BinaryColumn{Column: col.acquire()}, nil
+}
+
+// 检查root下所有列文件，列由文档重建，repair时不做修改
+func (dv *DocValues) Verify(repair bool) []error {
+	errs := []error{}
+	matches, err := filepath.Glob(filepath.Join(dv.root, "*.dv"))
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, m := range matches {
+		col, err := Open(m)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, col.Verify(repair)...)
+		col.Close()
+	}
+	return errs
+}
+
+func (dv *DocValues) Close() {
+	dv.mu.Lock()
+	defer dv.mu.Unlock()
+	// 正在使用的列在读者释放后关闭
+	for _, v := range dv.keywords {
+		v.Release()
+	}
+	for _, v := range dv.numerics {
+		v.Release()
+	}
+	for _, v := range dv.binaries {
+		v.Release()
+	}
+	dv.keywords = make(map[string]*KeywordColumn)
+	dv.numerics = make(map[string]*NumericColumn)
+	dv.binaries = make(map[string]*BinaryColumn)
+}
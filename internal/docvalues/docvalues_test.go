@@ -0,0 +1,280 @@
+package docvalues
+
+import (
+	"errors"
+	"fts/internal/bitmap"
+	"fts/internal/common"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var categories = []string{"体育", "娱乐", "财经", "体育", "科技", "体育", "娱乐"}
+
+func TestKeywordColumn(t *testing.T) {
+	root := t.TempDir()
+	values := make(map[uint32]string)
+	for i, v := range categories {
+		values[uint32(i)] = v
+	}
+	// 编号7没有值
+	values[8] = "财经"
+
+	dv := NewDocValues(root)
+	assert.Nil(t, dv.SetKeyword("Catgory", values))
+	_, err := dv.Keyword("Title")
+	assert.True(t, errors.Is(err, ErrFieldNotFound))
+
+	col, err := NewDocValues(root).Keyword("Catgory")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, col.Cardinality())
+	v, ok := col.Value(4)
+	assert.True(t, ok)
+	assert.Equal(t, "科技", v)
+	_, ok = col.Value(7)
+	assert.False(t, ok)
+	_, ok = col.Value(100)
+	assert.False(t, ok)
+	// 序号与取值同序
+	a, _ := col.Ord(0)
+	b, _ := col.Ord(2)
+	assert.Equal(t, "体育" < "财经", a < b)
+}
+
+func TestTermsAggregation(t *testing.T) {
+	values := make(map[uint32]string)
+	for i, v := range categories {
+		values[uint32(i)] = v
+	}
+	dv := NewDocValues(t.TempDir())
+	assert.Nil(t, dv.SetKeyword("Catgory", values))
+	col, _ := dv.Keyword("Catgory")
+
+	res := Terms(col, bitmap.Of(0, 1, 2, 3, 5, 6, 7, 20), 2)
+	assert.Equal(t, []TermBucket{{"体育", 3}, {"娱乐", 2}}, res.Buckets)
+	assert.Equal(t, int64(1), res.Other)
+	assert.Equal(t, int64(2), res.Missing)
+
+	res = Terms(col, bitmap.Of(1, 2, 4), 0)
+	assert.Equal(t, []TermBucket{{"娱乐", 1}, {"科技", 1}, {"财经", 1}}, res.Buckets)
+	assert.Empty(t, Terms(col, bitmap.New(), 10).Buckets)
+}
+
+func TestNumericAggregation(t *testing.T) {
+	root := t.TempDir()
+	values := map[uint32]int64{0: -7, 1: 3, 2: 10, 3: 15, 5: 24}
+	assert.Nil(t, NewDocValues(root).SetNumeric("Score", values))
+	col, err := NewDocValues(root).Numeric("Score")
+	assert.Nil(t, err)
+
+	hits := bitmap.Of(0, 1, 2, 3, 4, 5)
+	st := Stats(col, hits)
+	assert.Equal(t, StatsResult{Count: 5, Missing: 1, Min: -7, Max: 24, Sum: 45, Avg: 9}, *st)
+	assert.Equal(t, int64(0), Stats(col, bitmap.Of(4)).Count)
+
+	assert.Equal(t, []Bucket{{-10, 1}, {0, 1}, {10, 2}, {20, 1}}, Histogram(col, hits, 10, 0))
+	assert.Equal(t, []Bucket{{-15, 1}, {-5, 1}, {5, 1}, {15, 2}}, Histogram(col, hits, 10, 5))
+	assert.Nil(t, Histogram(col, hits, 0, 0))
+}
+
+func TestDateHistogram(t *testing.T) {
+	old := DATE_LOCATION
+	DATE_LOCATION = time.FixedZone("CST", 8*3600)
+	defer func() { DATE_LOCATION = old }()
+
+	at := func(s string) int64 {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, DATE_LOCATION)
+		assert.Nil(t, err)
+		return tm.Unix()
+	}
+	// 23:30与次日00:10在UTC下是同一天，在东八区是两天
+	values := map[uint32]int64{
+		0: at("2015-03-01 23:30"),
+		1: at("2015-03-02 00:10"),
+		2: at("2015-03-31 12:00"),
+		3: at("2015-04-01 08:00"),
+	}
+	dv := NewDocValues(t.TempDir())
+	assert.Nil(t, dv.SetNumeric("PublishTime", values))
+	col, _ := dv.Numeric("PublishTime")
+	hits := bitmap.Of(0, 1, 2, 3)
+	assert.Equal(t, []Bucket{
+		{at("2015-03-01 00:00"), 1},
+		{at("2015-03-02 00:00"), 1},
+		{at("2015-03-31 00:00"), 1},
+		{at("2015-04-01 00:00"), 1},
+	}, DateHistogram(col, hits, DATE_DAY))
+	assert.Equal(t, []Bucket{{at("2015-03-01 00:00"), 3}, {at("2015-04-01 00:00"), 1}}, DateHistogram(col, hits, DATE_MONTH))
+	assert.Equal(t, []Bucket{{at("2015-01-01 00:00"), 4}}, DateHistogram(col, hits, DATE_YEAR))
+}
+
+func TestColumnBlocks(t *testing.T) {
+	old := DOCVALUES_BLOCK
+	DOCVALUES_BLOCK = 100
+	defer func() { DOCVALUES_BLOCK = old }()
+
+	root := t.TempDir()
+	r := rand.New(rand.NewSource(1))
+	nums := make(map[uint32]int64)
+	bins := make(map[uint32][]byte)
+	for i := 0; i < 1000; i++ {
+		num := uint32(r.Intn(5000))
+		nums[num] = r.Int63() - r.Int63()
+		bins[num] = []byte(strings.Repeat("x", r.Intn(20)))
+	}
+	dv := NewDocValues(root)
+	assert.Nil(t, dv.SetNumeric("Value", nums))
+	assert.Nil(t, dv.SetBinary("Raw", bins))
+
+	// 块大小记录在文件中，读取时不受当前设置影响
+	DOCVALUES_BLOCK = 7
+	dv = NewDocValues(root)
+	nc, err := dv.Numeric("Value")
+	assert.Nil(t, err)
+	bc, err := dv.Binary("Raw")
+	assert.Nil(t, err)
+	for num := uint32(0); num < 5100; num++ {
+		v, ok := nc.Value(num)
+		expect, exist := nums[num]
+		assert.Equal(t, exist, ok)
+		assert.Equal(t, expect, v)
+		b, ok := bc.Value(num)
+		assert.Equal(t, exist, ok)
+		if exist {
+			assert.Equal(t, bins[num], b)
+		}
+	}
+	assert.Nil(t, nc.Err())
+	assert.Nil(t, bc.Err())
+	assert.Empty(t, dv.Verify(false))
+	_, err = dv.Keyword("Value")
+	assert.True(t, errors.Is(err, ErrFieldNotFound))
+
+	// 重建后读到新的值
+	assert.Nil(t, dv.SetNumeric("Value", map[uint32]int64{3: 42}))
+	nc, _ = dv.Numeric("Value")
+	v, ok := nc.Value(3)
+	assert.True(t, ok)
+	assert.Equal(t, int64(42), v)
+	assert.Equal(t, uint32(4), nc.Len())
+	dv.Close()
+}
+
+func TestColumnCorruption(t *testing.T) {
+	root := t.TempDir()
+	values := make(map[uint32]int64)
+	for i := 0; i < 100; i++ {
+		values[uint32(i)] = int64(i)
+	}
+	assert.Nil(t, NewDocValues(root).SetNumeric("Value", values))
+	path := root + "/Value" + numericSuffix
+
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[columnHeaderSize+8*10] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, b, 0666))
+	dv := NewDocValues(root)
+	errs := dv.Verify(false)
+	assert.Len(t, errs, 1)
+	var ce *common.CorruptionError
+	assert.True(t, errors.As(errs[0], &ce))
+
+	col, err := dv.Numeric("Value")
+	assert.Nil(t, err)
+	_, ok := col.Value(10)
+	assert.False(t, ok)
+	assert.True(t, errors.As(col.Err(), &ce))
+
+	// 错误只记录在遇到它的读者上，修复后新的读者可以读到值
+	b[columnHeaderSize+8*10] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, b, 0666))
+	again, err := dv.Numeric("Value")
+	assert.Nil(t, err)
+	assert.Nil(t, again.Err())
+	v, ok := again.Value(10)
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), v)
+	assert.Nil(t, again.Err())
+	assert.NotNil(t, col.Err())
+	col.Release()
+	again.Release()
+	dv.Close()
+	b[columnHeaderSize+8*10] ^= 0xff
+
+	// 截断的文件无法打开
+	assert.Nil(t, os.WriteFile(path, b[:columnHeaderSize+5], 0666))
+	_, err = NewDocValues(root).Numeric("Value")
+	assert.True(t, errors.Is(err, ErrColumnFormat))
+	assert.Nil(t, os.WriteFile(path, []byte("not a column"), 0666))
+	_, err = Open(path)
+	assert.True(t, errors.Is(err, ErrColumnFormat))
+}
+
+func TestSort(t *testing.T) {
+	dv := NewDocValues(t.TempDir())
+	assert.Nil(t, dv.SetNumeric("PublishTime", map[uint32]int64{0: 30, 1: 10, 2: 30, 4: 20}))
+	assert.Nil(t, dv.SetKeyword("Catgory", map[uint32]string{0: "财经", 1: "体育", 2: "体育", 3: "娱乐"}))
+
+	nums := []uint32{0, 1, 2, 3, 4}
+	scores := []float64{1, 5, 2, 4, 3}
+	sorted := func(expr string) []uint32 {
+		fields, err := ParseSort(expr)
+		assert.Nil(t, err)
+		order, err := dv.Sort(nums, scores, fields)
+		assert.Nil(t, err)
+		res := make([]uint32, len(order))
+		for i, o := range order {
+			res[i] = nums[o]
+		}
+		return res
+	}
+	// 发布时间降序，相同时按得分降序，没有时间的排在最后
+	assert.Equal(t, []uint32{2, 0, 4, 1, 3}, sorted("PublishTime:desc,_score"))
+	assert.Equal(t, []uint32{1, 4, 2, 0, 3}, sorted("PublishTime,_score"))
+	assert.Equal(t, []uint32{3, 1, 4, 0, 2}, sorted("PublishTime:asc:first"))
+	assert.Equal(t, []uint32{1, 3, 4, 2, 0}, sorted("_score"))
+	// 关键词按取值排序，没有值的4排在最后
+	assert.Equal(t, []uint32{1, 2, 3, 0, 4}, sorted("Catgory"))
+	assert.Equal(t, []uint32{0, 3, 1, 2, 4}, sorted("Catgory:desc,_score:desc"))
+
+	_, err := dv.Sort(nums, scores, []SortField{{Field: "Title"}})
+	assert.True(t, errors.Is(err, ErrFieldNotFound))
+	for _, expr := range []string{"", "PublishTime:up", "a,,b"} {
+		_, err = ParseSort(expr)
+		assert.True(t, errors.Is(err, ErrSortField), expr)
+	}
+}
+
+// 重建后旧列的读者释放时关闭旧文件，正在使用的列在Close后仍可读取
+func TestColumnRelease(t *testing.T) {
+	dv := NewDocValues(t.TempDir())
+	assert.Nil(t, dv.SetNumeric("Value", map[uint32]int64{1: 1}))
+	old, err := dv.Numeric("Value")
+	assert.Nil(t, err)
+	assert.Nil(t, dv.SetNumeric("Value", map[uint32]int64{1: 2}))
+
+	_, err = old.f.Stat()
+	assert.Nil(t, err)
+	v, ok := old.Value(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), v)
+	old.Release()
+	_, err = old.f.Stat()
+	assert.ErrorIs(t, err, os.ErrClosed)
+
+	cur, err := dv.Numeric("Value")
+	assert.Nil(t, err)
+	dv.Close()
+	v, ok = cur.Value(1)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), v)
+	_, err = cur.f.Stat()
+	assert.Nil(t, err)
+	cur.Release()
+	_, err = cur.f.Stat()
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
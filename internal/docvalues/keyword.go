@@ -0,0 +1,98 @@
+package docvalues
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// 没有值的文档的序号
+const MISSING_ORD = ^uint32(0)
+
+// 关键词列：字段的不同取值排序后编号(序号)，每个文档记录取值的序号
+// 按序号比较与按取值比较的结果相同，聚合时按序号计数
+// 取值词典保存在附加数据中，打开时读入内存
+type KeywordColumn struct {
+	*Column
+	Terms []string // 序号 -> 取值，升序
+}
+
+func writeKeyword(path string, values map[uint32]string) error {
+	terms := []string{}
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			terms = append(terms, v)
+		}
+	}
+	sort.Strings(terms)
+	ords := make(map[string]uint32, len(terms))
+	extra := binary.AppendUvarint(nil, uint64(len(terms)))
+	for i, v := range terms {
+		ords[v] = uint32(i)
+		extra = binary.AppendUvarint(extra, uint64(len(v)))
+		extra = append(extra, v...)
+	}
+	count, missing := layout(func(f func(uint32)) {
+		for num := range values {
+			f(num)
+		}
+	})
+	return writeColumn(path, KIND_KEYWORD, 4, count, missing, func(num uint32, b []byte) {
+		binary.LittleEndian.PutUint32(b, ords[values[num]])
+	}, extra, nil)
+}
+
+func openKeyword(path string) (*KeywordColumn, error) {
+	c, err := openKind(path, KIND_KEYWORD, 4)
+	if err != nil {
+		return nil, err
+	}
+	kc := &KeywordColumn{Column: c}
+	b := c.extra
+	n, k := binary.Uvarint(b)
+	if k <= 0 || n > uint64(len(b)) {
+		c.Close()
+		return nil, fmt.Errorf("%w: %s terms", ErrColumnFormat, path)
+	}
+	b = b[k:]
+	kc.Terms = make([]string, 0, n)
+	for i := uint64(0); i < n; i++ {
+		l, k := binary.Uvarint(b)
+		if k <= 0 || l > uint64(len(b)-k) {
+			c.Close()
+			return nil, fmt.Errorf("%w: %s term %d", ErrColumnFormat, path, i)
+		}
+		kc.Terms = append(kc.Terms, string(b[k:k+int(l)]))
+		b = b[k+int(l):]
+	}
+	return kc, nil
+}
+
+// 文档的取值序号，没有值时返回false
+func (kc *KeywordColumn) Ord(num uint32) (uint32, bool) {
+	b, ok := kc.entry(num)
+	if !ok {
+		return MISSING_ORD, false
+	}
+	ord := binary.LittleEndian.Uint32(b)
+	if int(ord) >= len(kc.Terms) {
+		kc.fail(fmt.Errorf("%w: %s doc %d ord %d of %d terms", ErrColumnFormat, kc.path, num, ord, len(kc.Terms)))
+		return MISSING_ORD, false
+	}
+	return ord, true
+}
+
+func (kc *KeywordColumn) Value(num uint32) (string, bool) {
+	ord, ok := kc.Ord(num)
+	if !ok {
+		return "", false
+	}
+	return kc.Terms[ord], true
+}
+
+// 不同取值的个数
+func (kc *KeywordColumn) Cardinality() int {
+	return len(kc.Terms)
+}
@@ -0,0 +1,36 @@
+package docvalues
+
+import "encoding/binary"
+
+// 数值列：每个文档记录一个int64，日期统一为unix时间戳(秒)
+type NumericColumn struct {
+	*Column
+}
+
+func writeNumeric(path string, values map[uint32]int64) error {
+	count, missing := layout(func(f func(uint32)) {
+		for num := range values {
+			f(num)
+		}
+	})
+	return writeColumn(path, KIND_NUMERIC, 8, count, missing, func(num uint32, b []byte) {
+		binary.LittleEndian.PutUint64(b, uint64(values[num]))
+	}, nil, nil)
+}
+
+func openNumeric(path string) (*NumericColumn, error) {
+	c, err := openKind(path, KIND_NUMERIC, 8)
+	if err != nil {
+		return nil, err
+	}
+	return &NumericColumn{Column: c}, nil
+}
+
+// 文档的值，没有值时返回false
+func (nc *NumericColumn) Value(num uint32) (int64, bool) {
+	b, ok := nc.entry(num)
+	if !ok {
+		return 0, false
+	}
+	return int64(binary.LittleEndian.Uint64(b)), true
+}
@@ -0,0 +1,149 @@
+package docvalues
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrSortField = errors.New("invalid sort field")
+
+// 按得分排序的字段名
+const SORT_SCORE = "_score"
+
+// 排序字段，数值字段按值比较，关键词字段按取值比较
+// 没有值的文档默认排在最后，与升降序无关
+type SortField struct {
+	Field        string
+	Desc         bool
+	MissingFirst bool
+}
+
+// 解析排序表达式，例如 "PublishTime:desc,_score"，每个字段可以带asc/desc与first/last(没有值的文档的位置)
+// 只写_score时默认降序
+func ParseSort(expr string) ([]SortField, error) {
+	res := []SortField{}
+	for _, part := range strings.Split(expr, ",") {
+		opts := strings.Split(strings.TrimSpace(part), ":")
+		sf := SortField{Field: strings.TrimSpace(opts[0])}
+		if sf.Field == "" {
+			return nil, fmt.Errorf("%w: %q", ErrSortField, expr)
+		}
+		sf.Desc = sf.Field == SORT_SCORE
+		for _, o := range opts[1:] {
+			switch strings.ToLower(strings.TrimSpace(o)) {
+			case "asc":
+				sf.Desc = false
+			case "desc":
+				sf.Desc = true
+			case "first":
+				sf.MissingFirst = true
+			case "last":
+				sf.MissingFirst = false
+			default:
+				return nil, fmt.Errorf("%w: %q in %q", ErrSortField, o, part)
+			}
+		}
+		res = append(res, sf)
+	}
+	return res, nil
+}
+
+// 一个排序字段在每个命中文档上的值，预先取出后排序时不再读列
+type sortKeys struct {
+	field  SortField
+	ints   []int64
+	floats []float64
+	has    []bool
+}
+
+func (sk *sortKeys) compare(i, j int) int {
+	if sk.has[i] != sk.has[j] {
+		// 没有值的文档的位置不受升降序影响
+		if sk.has[i] == sk.field.MissingFirst {
+			return 1
+		}
+		return -1
+	}
+	if !sk.has[i] {
+		return 0
+	}
+	c := 0
+	if sk.floats != nil {
+		if sk.floats[i] < sk.floats[j] {
+			c = -1
+		} else if sk.floats[i] > sk.floats[j] {
+			c = 1
+		}
+	} else if sk.ints[i] < sk.ints[j] {
+		c = -1
+	} else if sk.ints[i] > sk.ints[j] {
+		c = 1
+	}
+	if sk.field.Desc {
+		c = -c
+	}
+	return c
+}
+
+// 取出字段在nums上的值，数值字段优先，其次是关键词字段(按序号)
+func (dv *DocValues) sortKeys(sf SortField, nums []uint32, scores []float64) (*sortKeys, error) {
+	sk := &sortKeys{field: sf, has: make([]bool, len(nums))}
+	if sf.Field == SORT_SCORE {
+		sk.floats = make([]float64, len(nums))
+		for i := range nums {
+			if i < len(scores) {
+				sk.floats[i], sk.has[i] = scores[i], true
+			}
+		}
+		return sk, nil
+	}
+	sk.ints = make([]int64, len(nums))
+	if nc, err := dv.Numeric(sf.Field); err == nil {
+		defer nc.Release()
+		for i, num := range nums {
+			sk.ints[i], sk.has[i] = nc.Value(num)
+		}
+		return sk, nc.Err()
+	} else if !errors.Is(err, ErrFieldNotFound) {
+		return nil, err
+	}
+	kc, err := dv.Keyword(sf.Field)
+	if err != nil {
+		return nil, err
+	}
+	defer kc.Release()
+	for i, num := range nums {
+		var ord uint32
+		ord, sk.has[i] = kc.Ord(num)
+		sk.ints[i] = int64(ord)
+	}
+	return sk, kc.Err()
+}
+
+// 按fields对文档编号排序，返回排序后的下标，scores与nums一一对应，不按得分排序时可以为nil
+// 所有字段都相同的文档保持原来的顺序
+func (dv *DocValues) Sort(nums []uint32, scores []float64, fields []SortField) ([]int, error) {
+	keys := make([]*sortKeys, 0, len(fields))
+	for _, f := range fields {
+		sk, err := dv.sortKeys(f, nums, scores)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, sk)
+	}
+	order := make([]int, len(nums))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		for _, sk := range keys {
+			if c := sk.compare(order[a], order[b]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return order, nil
+}
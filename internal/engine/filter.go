@@ -0,0 +1,237 @@
+package engine
+
+import (
+	"fmt"
+	"fts/internal/bitmap"
+	"fts/internal/query"
+	"fts/internal/types"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var FILTER_CACHE = 128 // 缓存的过滤条件个数
+
+// 过滤条件：只限制命中的文档，不参与打分
+// Key是条件的规范表示，相同的条件Key相同，用作缓存的key；Bitmap返回满足条件的文档内部编号
+type Filter interface {
+	Key() string
+	Bitmap(e *Engine) (*bitmap.Bitmap, error)
+}
+
+type termFilter struct {
+	field  string
+	values []string
+}
+
+// 关键词字段等于value的文档，需要先BuildKeyword
+func TermFilter(field string, value string) Filter {
+	return TermsFilter(field, value)
+}
+
+// 关键词字段等于values之一的文档
+func TermsFilter(field string, values ...string) Filter {
+	vs := append([]string{}, values...)
+	sort.Strings(vs)
+	return &termFilter{field: field, values: vs}
+}
+
+func (tf *termFilter) Key() string {
+	return fmt.Sprintf("terms(%s=%q)", tf.field, tf.values)
+}
+
+func (tf *termFilter) Bitmap(e *Engine) (*bitmap.Bitmap, error) {
+	col, err := e.values.Keyword(tf.field)
+	if err != nil {
+		return nil, err
+	}
+	defer col.Release()
+	ords := make(map[uint32]bool)
+	for _, v := range tf.values {
+		if i := sort.SearchStrings(col.Terms, v); i < len(col.Terms) && col.Terms[i] == v {
+			ords[uint32(i)] = true
+		}
+	}
+	res := bitmap.New()
+	if len(ords) > 0 {
+		for num := uint32(0); num < col.Len(); num++ {
+			if ord, ok := col.Ord(num); ok && ords[ord] {
+				res.Add(num)
+			}
+		}
+	}
+	return res, col.Err()
+}
+
+type numericFilter struct {
+	field string
+	nr    types.NumericRange
+	err   error
+}
+
+// 数值/日期字段在范围内的文档，例如 "[2015-01-01 TO 2015-12-31]"，需要先BuildNumeric
+func NumericFilter(field string, expr string) Filter {
+	nr, err := query.ParseRange(expr)
+	return &numericFilter{field: field, nr: nr, err: err}
+}
+
+func (nf *numericFilter) Key() string {
+	return fmt.Sprintf("range(%s=[%d,%d])", nf.field, nf.nr.Min, nf.nr.Max)
+}
+
+func (nf *numericFilter) Bitmap(e *Engine) (*bitmap.Bitmap, error) {
+	if nf.err != nil {
+		return nil, nf.err
+	}
+	ids, err := e.numeric.Range(nf.field, nf.nr)
+	if err != nil {
+		return nil, err
+	}
+	return e.nums.Bitmap(ids), nil
+}
+
+type idsFilter struct {
+	ids []int64
+	key string
+}
+
+// 文档id在ids中的文档
+func IDsFilter(ids ...int64) Filter {
+	sorted := append([]int64{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// id列表可能很长，key使用哈希
+	h := fnv.New64a()
+	for _, id := range sorted {
+		h.Write([]byte(strconv.FormatInt(id, 10) + ","))
+	}
+	return &idsFilter{ids: sorted, key: fmt.Sprintf("ids(%d:%x)", len(sorted), h.Sum64())}
+}
+
+func (idf *idsFilter) Key() string {
+	return idf.key
+}
+
+func (idf *idsFilter) Bitmap(e *Engine) (*bitmap.Bitmap, error) {
+	return e.nums.Bitmap(idf.ids), nil
+}
+
+// 组合条件
+type boolFilter struct {
+	op      string
+	filters []Filter
+}
+
+// 同时满足所有条件的文档
+func AndFilter(filters ...Filter) Filter {
+	return &boolFilter{op: "and", filters: filters}
+}
+
+// 满足任一条件的文档
+func OrFilter(filters ...Filter) Filter {
+	return &boolFilter{op: "or", filters: filters}
+}
+
+// 不满足条件的文档
+func NotFilter(filter Filter) Filter {
+	return &boolFilter{op: "not", filters: []Filter{filter}}
+}
+
+func (bf *boolFilter) Key() string {
+	keys := make([]string, 0, len(bf.filters))
+	for _, f := range bf.filters {
+		keys = append(keys, f.Key())
+	}
+	// 与、或的子条件与顺序无关
+	sort.Strings(keys)
+	return bf.op + "(" + strings.Join(keys, ",") + ")"
+}
+
+func (bf *boolFilter) Bitmap(e *Engine) (*bitmap.Bitmap, error) {
+	var res *bitmap.Bitmap
+	if bf.op == "not" {
+		res = e.nums.Live()
+	}
+	for i, f := range bf.filters {
+		b, err := e.filter(f)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case bf.op == "not":
+			res = res.AndNot(b)
+		case i == 0:
+			res = b.Clone()
+		case bf.op == "and":
+			res = res.And(b)
+		default:
+			res = res.Or(b)
+		}
+	}
+	if res == nil {
+		res = bitmap.New()
+	}
+	return res, nil
+}
+
+// 过滤条件的位图，按Key与编号表的版本缓存，包括已删除的文档，返回的位图不能修改
+// 加载、删除文档后编号表的版本变化，NotFilter、IDsFilter等按编号得到的旧位图不再命中
+func (e *Engine) filter(f Filter) (*bitmap.Bitmap, error) {
+	key := fmt.Sprintf("%s@%d", f.Key(), e.nums.Version())
+	if v, ok := e.filters.Get(key); ok {
+		return v.(*bitmap.Bitmap), nil
+	}
+	b, err := f.Bitmap(e)
+	if err != nil {
+		return nil, err
+	}
+	b.RunOptimize()
+	e.filters.Put(key, b)
+	return b, nil
+}
+
+// 满足过滤条件且没有删除的文档的内部编号
+func (e *Engine) Filter(f Filter) (*bitmap.Bitmap, error) {
+	b, err := e.filter(f)
+	if err != nil {
+		return nil, err
+	}
+	return b.AndNot(e.nums.Deleted()), nil
+}
+
+// 重建列或数值索引后清空过滤条件的缓存
+func (e *Engine) ClearFilterCache() {
+	e.filters.Clear()
+}
+
+// 带过滤条件的查询，过滤条件只限制命中的文档，不参与打分
+// 查询器实现types.FilteredQueryer时在遍历倒排时过滤(各级别的做法见query.QueryBuilder.QueryFilter)，
+// 否则在打开文档之后过滤
+func (e *Engine) QueryFilter(text string, field string, level types.QueryLevel, f Filter, args ...any) ([]QueryResult, error) {
+	b, err := e.Filter(f)
+	if err != nil {
+		return nil, err
+	}
+	fq, ok := e.queryer.(types.FilteredQueryer)
+	if !ok {
+		result, loadmaps, ids, prefix, _ := e.queryer.Query(text, level, args...)
+		if len(result) == 0 {
+			return nil, ErrNotFound
+		}
+		return e.FilterBitmap(e.rank(field, result, loadmaps, ids, prefix), b), nil
+	}
+	result, loadmaps, ids, prefix, _ := fq.QueryFilter(text, level, b, args...)
+	if len(result) == 0 {
+		return nil, ErrNotFound
+	}
+	return e.rank(field, result, loadmaps, ids, prefix), nil
+}
+
+// 后置过滤：只限制返回的结果，先在完整的结果上做聚合再过滤时使用
+func (e *Engine) PostFilter(qr []QueryResult, f Filter) ([]QueryResult, error) {
+	b, err := e.Filter(f)
+	if err != nil {
+		return nil, err
+	}
+	return e.FilterBitmap(qr, b), nil
+}
@@ -2,14 +2,29 @@ package engine
 
 import (
 	"errors"
+	"fmt"
+	"fts/internal"
+	"fts/internal/bitmap"
+	"fts/internal/cache"
 	"fts/internal/common"
 	"fts/internal/document"
+	"fts/internal/docvalues"
+	"fts/internal/fsck"
+	"fts/internal/index"
 	"fts/internal/indexer"
+	"fts/internal/query"
 	"fts/internal/types"
+	"math"
+	"sort"
 )
 
 var (
-	ErrNotFound = errors.New("not found keys")
+	ErrNotFound   = errors.New("not found keys")
+	ErrNotSupport = errors.New("not support by index manager")
+)
+
+var (
+	SUGGEST_MIN_HITS = 3 // 命中的文档少于该值时才给出拼写建议
 )
 
 type Engine struct {
@@ -17,8 +32,13 @@ type Engine struct {
 	docm    *document.DocumentManager //文档管理器
 	indexm  types.IndexManager        //索引管理器
 	queryer types.Queryer             //查询器
-	indexer indexer.IndexerManager    //索引构建器
+	indexer *indexer.IndexerManager   //索引构建器
 	ranker  types.Ranker
+	suggest *index.Suggester           //自动补全
+	numeric *index.NumericIndexManager //数值/日期字段
+	nums    *document.DocNumbers       //内部文档编号
+	values  *docvalues.DocValues       //按编号存储的列式字段值
+	filters *cache.LruCache            //过滤条件的位图
 }
 
 type QueryResult struct {
@@ -26,12 +46,13 @@ type QueryResult struct {
 	Prefix   string
 	Token    string
 	Field    string
+	Score    float64 // 排序器给出的得分，同一结果中的文档得分相同
 }
 
 func NewFTSEngine(
 	root string,
 	doc types.DocDiskManager,
-	index types.IndexManager,
+	indexm types.IndexManager,
 	queryer types.Queryer,
 	ranker types.Ranker,
 	builder types.IndexBuilder,
@@ -39,10 +60,24 @@ func NewFTSEngine(
 	eig := &Engine{
 		docm:    document.NewDocumentManager(64, doc),
 		root:    root,
-		indexm:  index,
+		indexm:  indexm,
 		queryer: queryer,
-		indexer: *indexer.NewIndexerManager(root, builder),
+		indexer: indexer.NewIndexerManager(root, builder),
 		ranker:  ranker,
+		suggest: index.NewSuggester(root),
+		numeric: index.NewNumericIndexManager(root),
+		values:  docvalues.NewDocValues(root),
+		filters: cache.Default(int64(FILTER_CACHE)),
+	}
+	nums, err := document.NewDocNumbers(root)
+	if err != nil {
+		// 不覆盖损坏的编号表，用fsck检查修复后重新打开
+		common.DFAIL("load doc numbers %v", err)
+		nums = document.NewMemDocNumbers()
+	}
+	eig.nums = nums
+	if err := eig.docm.UseNumbers(eig.nums); err != nil {
+		common.DFAIL("number documents %v", err)
 	}
 	//eig.queryer.Use(ranker)
 	eig.queryer.SetIndexManager(eig.indexm)
@@ -65,6 +100,7 @@ func NewFTSEngine(
 // 查询所有token的并集
 func (e *Engine) QueryOr(text string, field string) ([]QueryResult, error) {
 	result, loadmaps, ids, prefix, _ := e.queryer.Query(text, types.AT_OR)
+	result, loadmaps, ids = e.external(result, loadmaps, ids)
 
 	if len(result) == 0 {
 		return nil, ErrNotFound
@@ -102,6 +138,7 @@ func (e *Engine) QueryOr(text string, field string) ([]QueryResult, error) {
 				FileRune: sl,
 				Prefix:   prefix,
 				Token:    v.Token,
+				Score:    v.Scores,
 				Field:    field,
 			})
 		} else {
@@ -111,6 +148,7 @@ func (e *Engine) QueryOr(text string, field string) ([]QueryResult, error) {
 					FileRune: sl,
 					Prefix:   prefix,
 					Token:    v.Token,
+					Score:    v.Scores,
 					Field:    field,
 				},
 			}, qr[idx+1:]...)...)
@@ -123,6 +161,7 @@ func (e *Engine) QueryOr(text string, field string) ([]QueryResult, error) {
 // 查询所有token的交集
 func (e *Engine) QueryAnd(text string, field string) ([]QueryResult, error) {
 	result, loadmaps, ids, prefix, _ := e.queryer.Query(text, types.AT_AND)
+	result, loadmaps, ids = e.external(result, loadmaps, ids)
 
 	docs := make(map[int64]types.Document)
 
@@ -157,6 +196,7 @@ func (e *Engine) QueryAnd(text string, field string) ([]QueryResult, error) {
 				FileRune: sl,
 				Prefix:   prefix,
 				Token:    v.Token,
+				Score:    v.Scores,
 				Field:    field,
 			})
 		} else {
@@ -166,6 +206,7 @@ func (e *Engine) QueryAnd(text string, field string) ([]QueryResult, error) {
 					FileRune: sl,
 					Prefix:   prefix,
 					Token:    v.Token,
+					Score:    v.Scores,
 					Field:    field,
 				},
 			}, qr[idx+1:]...)...)
@@ -182,6 +223,7 @@ func (e *Engine) QueryAndK(text string, field string, k float64) ([]QueryResult,
 	}
 
 	result, loadmaps, ids, prefix, _ := e.queryer.Query(text, types.AT_LEAST, false, false, k)
+	result, loadmaps, ids = e.external(result, loadmaps, ids)
 
 	docs := make(map[int64]types.Document)
 
@@ -216,6 +258,7 @@ func (e *Engine) QueryAndK(text string, field string, k float64) ([]QueryResult,
 				FileRune: sl,
 				Prefix:   prefix,
 				Token:    v.Token,
+				Score:    v.Scores,
 				Field:    field,
 			})
 		} else {
@@ -225,6 +268,7 @@ func (e *Engine) QueryAndK(text string, field string, k float64) ([]QueryResult,
 					FileRune: sl,
 					Prefix:   prefix,
 					Token:    v.Token,
+					Score:    v.Scores,
 					Field:    field,
 				},
 			}, qr[idx+1:]...)...)
@@ -241,6 +285,7 @@ func (e *Engine) QueryAndKLeast(text string, field string, k float64) ([]QueryRe
 		return e.QueryOr(text, field)
 	}
 	result, loadmaps, ids, prefix, _ := e.queryer.Query(text, types.AT_LEAST, true, false, k)
+	result, loadmaps, ids = e.external(result, loadmaps, ids)
 
 	docs := make(map[int64]types.Document)
 
@@ -275,6 +320,7 @@ func (e *Engine) QueryAndKLeast(text string, field string, k float64) ([]QueryRe
 				FileRune: sl,
 				Prefix:   prefix,
 				Token:    v.Token,
+				Score:    v.Scores,
 				Field:    field,
 			})
 		} else {
@@ -284,6 +330,7 @@ func (e *Engine) QueryAndKLeast(text string, field string, k float64) ([]QueryRe
 					FileRune: sl,
 					Prefix:   prefix,
 					Token:    v.Token,
+					Score:    v.Scores,
 					Field:    field,
 				},
 			}, qr[idx+1:]...)...)
@@ -300,6 +347,7 @@ func (e *Engine) QueryOrK(text string, field string, k float64) ([]QueryResult,
 		return e.QueryOr(text, field)
 	}
 	result, loadmaps, ids, prefix, _ := e.queryer.Query(text, types.AT_LEAST, false, true, k)
+	result, loadmaps, ids = e.external(result, loadmaps, ids)
 
 	docs := make(map[int64]types.Document)
 
@@ -334,6 +382,7 @@ func (e *Engine) QueryOrK(text string, field string, k float64) ([]QueryResult,
 				FileRune: sl,
 				Prefix:   prefix,
 				Token:    v.Token,
+				Score:    v.Scores,
 				Field:    field,
 			})
 		} else {
@@ -343,6 +392,7 @@ func (e *Engine) QueryOrK(text string, field string, k float64) ([]QueryResult,
 					FileRune: sl,
 					Prefix:   prefix,
 					Token:    v.Token,
+					Score:    v.Scores,
 					Field:    field,
 				},
 			}, qr[idx+1:]...)...)
@@ -358,6 +408,7 @@ func (e *Engine) QueryOrKLeast(text string, field string, k float64) ([]QueryRes
 		return e.QueryOr(text, field)
 	}
 	result, loadmaps, ids, prefix, _ := e.queryer.Query(text, types.AT_LEAST, false, true, k)
+	result, loadmaps, ids = e.external(result, loadmaps, ids)
 
 	docs := make(map[int64]types.Document)
 
@@ -392,6 +443,7 @@ func (e *Engine) QueryOrKLeast(text string, field string, k float64) ([]QueryRes
 				FileRune: sl,
 				Prefix:   prefix,
 				Token:    v.Token,
+				Score:    v.Scores,
 				Field:    field,
 			})
 		} else {
@@ -401,6 +453,7 @@ func (e *Engine) QueryOrKLeast(text string, field string, k float64) ([]QueryRes
 					FileRune: sl,
 					Prefix:   prefix,
 					Token:    v.Token,
+					Score:    v.Scores,
 					Field:    field,
 				},
 			}, qr[idx+1:]...)...)
@@ -413,11 +466,875 @@ func (e *Engine) QueryOrKLeast(text string, field string, k float64) ([]QueryRes
 // *** load ***
 
 // load document
-func (e *Engine) Load(loader types.DocumentLoader) {
-	e.docm.LoadDocument(loader)
+func (e *Engine) Load(loader types.DocumentLoader) error {
+	return e.docm.LoadDocument(loader)
 }
 
 // *** build ***
 func (e *Engine) Build(typ types.Document, field string) error {
-	return e.indexer.BuildIndex(typ, field, e.docm, e.indexm)
+	return e.BuildFields(typ, field)
+}
+
+// 一次遍历构建多个字段，同时保存各字段的长度供Explain使用
+func (e *Engine) BuildFields(typ types.Document, fields ...string) error {
+	// 出错时也可能已经提交了部分批次
+	defer e.clearQueryCache()
+	if err := e.indexer.BuildFields(typ, fields, e.docm, e.indexm); err != nil {
+		return err
+	}
+	return e.buildFieldLens(typ, fields...)
+}
+
+// 字段长度的列名
+func lenColumn(field string) string {
+	return "_len." + field
+}
+
+// 重建字段长度的列，打分的统计量从这里读取，不需要打开文档
+func (e *Engine) buildFieldLens(typ types.Document, fields ...string) error {
+	values := make(map[string]map[uint32]int64)
+	for _, f := range fields {
+		values[f] = make(map[uint32]int64)
+	}
+	for id := range e.docm.ChanDocsID(typ) {
+		num, ok := e.nums.Num(id)
+		if !ok {
+			continue
+		}
+		doc := e.docm.GetDocument(id)
+		if doc == nil {
+			continue
+		}
+		for _, f := range fields {
+			values[f][num] = doc.FieldLen(f)
+		}
+	}
+	for _, f := range fields {
+		if err := e.values.SetNumeric(lenColumn(f), values[f]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 命中文档(内部编号)中字段的统计量，与Rank打开这些文档后得到的相同，Lens按内部编号
+// 长度从字段长度的列读取，列中没有的文档(例如构建之后加载的)才打开
+func (e *Engine) fieldStats(field string, nums []int64) types.FieldStats {
+	stats := types.FieldStats{Lens: make(map[int64]int64, len(nums))}
+	col, err := e.values.Numeric(lenColumn(field))
+	if err == nil {
+		defer col.Release()
+	} else if !errors.Is(err, docvalues.ErrFieldNotFound) {
+		common.DWARN("field %v length %v", field, err)
+	}
+	total := 0.0
+	for _, num := range nums {
+		// 删除的文档不参与打分
+		id, live := e.liveID(num)
+		if !live {
+			continue
+		}
+		var (
+			n  int64
+			ok bool
+		)
+		if col != nil {
+			n, ok = col.Value(uint32(num))
+		}
+		if !ok {
+			// 无法读取的文档也不参与打分
+			doc := e.docm.GetDocument(id)
+			if doc == nil {
+				continue
+			}
+			n = doc.FieldLen(field)
+		}
+		stats.Lens[num] = n
+		total += float64(n)
+	}
+	if col != nil && col.Err() != nil {
+		common.DWARN("field %v length %v", field, col.Err())
+	}
+	stats.Docs = len(stats.Lens)
+	if stats.Docs > 0 {
+		stats.AvgLen = total / float64(stats.Docs)
+	}
+	return stats
+}
+
+// 索引变化后清空查询器缓存的索引信息
+func (e *Engine) clearQueryCache() {
+	if cq, ok := e.queryer.(types.CachedQueryer); ok {
+		cq.ClearCache()
+	}
+}
+
+// 为字段指定单独的分词器
+func (e *Engine) UseFieldBuilder(field string, builder types.IndexBuilder) {
+	e.indexer.UseFieldBuilder(field, builder)
+}
+
+// 打开命中的文档并排序，result、loadmaps、ids为查询器按内部编号给出的结果
+func (e *Engine) rank(
+	field string,
+	result []types.QueryReuslt,
+	loadmaps map[string]types.Pair,
+	ids []int64,
+	prefix string,
+) []QueryResult {
+	result, loadmaps, ids = e.external(result, loadmaps, ids)
+	docs, rxoc := e.open(result, ids)
+	res := e.ranker.Rank(field, rxoc, loadmaps, docs, prefix)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Scores > res[j].Scores
+	})
+	qr := make([]QueryResult, 0, len(res))
+	for _, v := range res {
+		sl := []types.Document{}
+		sl = append(sl, v.Doc...)
+		qr = append(qr, QueryResult{
+			FileRune: sl,
+			Prefix:   prefix,
+			Token:    v.Token,
+			Score:    v.Scores,
+			Field:    field,
+		})
+	}
+	return qr
+}
+
+// 倒排按内部编号记录，查询结果交给ranker之前转换为外部ID，没有编号的文档被去掉
+// 删除的文档保留，打开时跳过，词项的文档数与转换前相同
+func (e *Engine) external(
+	result []types.QueryReuslt,
+	loadmaps map[string]types.Pair,
+	nums []int64,
+) ([]types.QueryReuslt, map[string]types.Pair, []int64) {
+	res := make([]types.QueryReuslt, 0, len(result))
+	for _, v := range result {
+		res = append(res, types.QueryReuslt{Docs: e.externalIDs(v.Docs), Tokens: v.Tokens})
+	}
+	maps := make(map[string]types.Pair, len(loadmaps))
+	for k, v := range loadmaps {
+		m := make(map[int64]int16, len(v.Maps))
+		for num, freq := range v.Maps {
+			if id, ok := e.externalID(num); ok {
+				m[id] = freq
+			}
+		}
+		v.Maps = m
+		maps[k] = v
+	}
+	return res, maps, e.externalIDs(nums)
+}
+
+func (e *Engine) externalIDs(nums []int64) []int64 {
+	ids := make([]int64, 0, len(nums))
+	for _, num := range nums {
+		if id, ok := e.externalID(num); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (e *Engine) externalID(num int64) (int64, bool) {
+	if num < 0 || num > math.MaxUint32 {
+		return 0, false
+	}
+	return e.nums.ID(uint32(num))
+}
+
+// 没有删除的文档的外部ID
+func (e *Engine) liveID(num int64) (int64, bool) {
+	if num < 0 || num > math.MaxUint32 {
+		return 0, false
+	}
+	return e.nums.LiveID(uint32(num))
+}
+
+// 打开查询结果中的文档，返回id到文档以及token组合到文档的映射
+func (e *Engine) open(result []types.QueryReuslt, ids []int64) (map[int64]types.Document, map[string][]types.Document) {
+	docs := make(map[int64]types.Document)
+	for _, v := range ids {
+		// 删除或无法读取的文档不参与排序
+		if doc := e.docm.GetDocument(v); doc != nil {
+			docs[v] = doc
+		}
+	}
+	rxoc := make(map[string][]types.Document)
+	for _, v := range result {
+		dd := make([]types.Document, 0, len(v.Docs))
+		for _, vv := range v.Docs {
+			if doc, ok := docs[vv]; ok {
+				dd = append(dd, doc)
+			}
+		}
+		if len(dd) > 0 {
+			rxoc[v.Tokens] = dd
+		}
+	}
+	return docs, rxoc
+}
+
+// 解释文档docID在查询中的得分，参数level、args与Query*相同
+// 每个字段分别查询，总分为各字段得分之和；文档在字段中的得分是包含它的token组合的得分中的最大值，
+// 组合的得分是组合中各文档得分的中位数
+// 词频来自查询结果，字段长度来自构建时保存的列，都按内部编号读取，不打开命中的文档
+// 查询器不支持按字段查询(types.FieldQueryer)时各字段使用同一个查询结果
+// 文档不在字段的结果中时该字段得分为0；ranker不支持解释时返回ErrNotSupport
+func (e *Engine) Explain(text string, fields []string, level types.QueryLevel, docID int64, args ...any) (*types.Explanation, error) {
+	ex, ok := e.ranker.(types.Explainer)
+	if !ok {
+		return nil, ErrNotSupport
+	}
+	res := &types.Explanation{Description: fmt.Sprintf("doc %d, sum of fields:", docID)}
+	// 没有编号的文档不会命中
+	num := int64(-1)
+	if n, ok := e.nums.Num(docID); ok {
+		num = int64(n)
+	}
+	found := false
+	for _, field := range fields {
+		result, loadmaps, ids, _, _ := e.queryField(field, text, level, args...)
+		if len(result) == 0 {
+			continue
+		}
+		found = true
+		fe := e.explainField(ex, field, result, loadmaps, e.fieldStats(field, ids), docID, num)
+		res.Value += fe.Value
+		res.Details = append(res.Details, fe)
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+// 在field上查询，查询器不支持时使用它自己的字段
+func (e *Engine) queryField(field string, text string, level types.QueryLevel, args ...any) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	if fq, ok := e.queryer.(types.FieldQueryer); ok {
+		return fq.QueryField(field, text, level, args...)
+	}
+	return e.queryer.Query(text, level, args...)
+}
+
+// 文档在一个字段中的得分，组合的中位数按统计量计算，与Rank相同，num为docID的内部编号
+func (e *Engine) explainField(
+	ex types.Explainer,
+	field string,
+	result []types.QueryReuslt,
+	loadmaps map[string]types.Pair,
+	stats types.FieldStats,
+	docID int64,
+	num int64,
+) *types.Explanation {
+	res := &types.Explanation{Description: fmt.Sprintf("field %s, max of token groups containing it:", field)}
+	if _, ok := stats.Lens[num]; !ok {
+		res.Description = fmt.Sprintf("field %s, doc %d does not match", field, docID)
+		return res
+	}
+	for _, v := range result {
+		var (
+			scores = []float64{}
+			hit    = false
+		)
+		for _, id := range v.Docs {
+			if _, ok := stats.Lens[id]; !ok {
+				continue
+			}
+			hit = hit || id == num
+			scores = append(scores, ex.Explain(field, v.Tokens, loadmaps, stats, id).Value)
+		}
+		if !hit {
+			continue
+		}
+		sort.Sort(sort.Reverse(sort.Float64Slice(scores)))
+		median := scores[len(scores)/2]
+		// 得分按内部编号计算，标出对应的外部ID
+		doc := ex.Explain(field, v.Tokens, loadmaps, stats, num)
+		res.Details = append(res.Details, &types.Explanation{
+			Value:       median,
+			Description: fmt.Sprintf("group %q, median of %d docs, this doc:", v.Tokens, len(scores)),
+			Details: []*types.Explanation{{
+				Value:       doc.Value,
+				Description: fmt.Sprintf("doc %d, internal number %d:", docID, num),
+				Details:     []*types.Explanation{doc},
+			}},
+		})
+		if len(res.Details) == 1 || median > res.Value {
+			res.Value = median
+		}
+	}
+	return res
+}
+
+// 前缀/通配符查询，pattern中'*'匹配任意个字符，'?'匹配单个字符
+func (e *Engine) QueryWildcard(pattern string, field string) ([]QueryResult, error) {
+	result, loadmaps, ids, prefix, _ := e.queryer.Query(pattern, types.AT_WILDCARD)
+	if len(result) == 0 {
+		return nil, ErrNotFound
+	}
+	return e.rank(field, result, loadmaps, ids, prefix), nil
+}
+
+// 模糊查询，distance为最大编辑距离(1~2)，prefix为需要精确匹配的前缀长度
+func (e *Engine) QueryFuzzy(term string, field string, distance int, prefix int) ([]QueryResult, error) {
+	result, loadmaps, ids, tag, _ := e.queryer.Query(term, types.AT_FUZZY, distance, prefix)
+	if len(result) == 0 {
+		return nil, ErrNotFound
+	}
+	return e.rank(field, result, loadmaps, ids, tag), nil
+}
+
+// 查询命中的文档数少于SUGGEST_MIN_HITS时，根据索引词典给出至多n条纠正后的查询
+func (e *Engine) DidYouMean(text string, hits int, n int) []types.Suggestion {
+	if hits >= SUGGEST_MIN_HITS {
+		return nil
+	}
+	sp, ok := e.queryer.(types.Speller)
+	if !ok {
+		return nil
+	}
+	return sp.Suggest(text, n)
+}
+
+// *** completion ***
+
+// 由索引词典重建字段的词项补全，权重为文档频率
+func (e *Engine) BuildTermCompletion(field string) error {
+	td, ok := e.indexm.(types.TermDictionary)
+	if !ok {
+		return ErrNotSupport
+	}
+	e.suggest.Reset(field, index.COMPLETE_TERM)
+	terms, _ := td.Terms(field, query.NewPrefixAutomaton(""), 0)
+	for _, v := range terms {
+		idx := e.indexm.GetIndex(v, field)
+		if idx == nil {
+			continue
+		}
+		e.suggest.AddTerm(field, v, int64(len(idx.QueryAllDoc().Info)))
+	}
+	e.suggest.Persite()
+	return nil
+}
+
+// 由文档重建字段的整段文本补全(例如标题)，文档实现PopularDocument时按热度加权，否则按出现次数
+func (e *Engine) BuildTextCompletion(typ types.Document, field string) error {
+	e.suggest.Reset(field, index.COMPLETE_TEXT)
+	for id := range e.docm.ChanDocsID(typ) {
+		doc := e.docm.GetDocument(id)
+		if doc == nil {
+			continue
+		}
+		text := doc.FetchField(field)
+		if text == nil {
+			continue
+		}
+		weight := int64(1)
+		if pd, ok := doc.(types.PopularDocument); ok {
+			weight = pd.Popularity()
+		}
+		e.suggest.AddText(field, string(text), weight)
+	}
+	e.suggest.Persite()
+	return nil
+}
+
+// 补全输入，返回权重最高的n个结果
+func (e *Engine) Complete(prefix string, field string, mode index.CompletionMode, n int) []internal.Completion {
+	return e.suggest.Complete(field, mode, prefix, n)
+}
+
+// 正则查询，例如 "/colou?r/"，词项需要完整匹配
+func (e *Engine) QueryRegexp(pattern string, field string) ([]QueryResult, error) {
+	// 先校验模式串，把错误返回给调用者
+	if _, err := query.NewRegexpAutomaton(pattern); err != nil {
+		return nil, err
+	}
+	result, loadmaps, ids, tag, _ := e.queryer.Query(pattern, types.AT_REGEXP)
+	if len(result) == 0 {
+		return nil, ErrNotFound
+	}
+	return e.rank(field, result, loadmaps, ids, tag), nil
+}
+
+// *** numeric ***
+
+// 重建数值/日期字段的索引与列，文档需要实现NumericDocument，没有该字段的文档跳过
+func (e *Engine) BuildNumeric(typ types.Document, fields ...string) error {
+	values := make(map[string]map[int64][]int64)
+	columns := make(map[string]map[uint32]int64)
+	for _, f := range fields {
+		values[f] = make(map[int64][]int64)
+		columns[f] = make(map[uint32]int64)
+	}
+	for id := range e.docm.ChanDocsID(typ) {
+		doc, ok := e.docm.GetDocument(id).(types.NumericDocument)
+		if !ok {
+			continue
+		}
+		num, numbered := e.nums.Num(doc.UUID())
+		for _, f := range fields {
+			if v, ok := doc.NumericField(f); ok {
+				values[f][v] = append(values[f][v], doc.UUID())
+				if numbered {
+					columns[f][num] = v
+				}
+			}
+		}
+	}
+	for _, f := range fields {
+		if err := e.numeric.Reset(f); err != nil {
+			return err
+		}
+		if err := e.numeric.AddBatch(f, values[f]); err != nil {
+			return err
+		}
+		if err := e.values.SetNumeric(f, columns[f]); err != nil {
+			return err
+		}
+	}
+	e.ClearFilterCache()
+	return nil
+}
+
+// 范围查询，例如 "[2015-01-01 TO 2015-12-31]"、"{100 TO *]"，返回升序的文档id，可以用FilterDocs过滤文本查询的结果
+func (e *Engine) QueryRange(field string, expr string) ([]int64, error) {
+	nr, err := query.ParseRange(expr)
+	if err != nil {
+		return nil, err
+	}
+	return e.numeric.Range(field, nr)
+}
+
+// 只保留id在ids(升序)中的文档，没有剩余文档的结果被去掉
+func FilterDocs(qr []QueryResult, ids []int64) []QueryResult {
+	res := make([]QueryResult, 0, len(qr))
+	for _, v := range qr {
+		docs := []types.Document{}
+		for _, doc := range v.FileRune {
+			if doc == nil {
+				continue
+			}
+			id := doc.UUID()
+			idx := sort.Search(len(ids), func(i int) bool { return ids[i] >= id })
+			if idx < len(ids) && ids[idx] == id {
+				docs = append(docs, doc)
+			}
+		}
+		if len(docs) == 0 {
+			continue
+		}
+		v.FileRune = docs
+		res = append(res, v)
+	}
+	return res
+}
+
+// *** doc numbers ***
+
+// 内部文档编号，倒排、列与过滤器都按编号存储
+func (e *Engine) Numbers() *document.DocNumbers {
+	return e.nums
+}
+
+// 标记删除文档，之后的查询不再返回该文档，重新加载时恢复
+func (e *Engine) Delete(id int64) error {
+	if err := e.nums.Delete(id); err != nil {
+		return err
+	}
+	return e.nums.Persite()
+}
+
+// 范围查询的结果转换为内部编号的位图，可以与其它过滤条件做集合运算后用FilterBitmap过滤
+func (e *Engine) RangeFilter(field string, expr string) (*bitmap.Bitmap, error) {
+	ids, err := e.QueryRange(field, expr)
+	if err != nil {
+		return nil, err
+	}
+	return e.nums.Bitmap(ids), nil
+}
+
+// 只保留内部编号在b中的文档，没有剩余文档的结果被去掉
+func (e *Engine) FilterBitmap(qr []QueryResult, b *bitmap.Bitmap) []QueryResult {
+	res := make([]QueryResult, 0, len(qr))
+	for _, v := range qr {
+		docs := []types.Document{}
+		for _, doc := range v.FileRune {
+			if doc == nil {
+				continue
+			}
+			if num, ok := e.nums.Num(doc.UUID()); ok && b.Contains(num) {
+				docs = append(docs, doc)
+			}
+		}
+		if len(docs) == 0 {
+			continue
+		}
+		v.FileRune = docs
+		res = append(res, v)
+	}
+	return res
+}
+
+// 查询结果中文档的内部编号
+func (e *Engine) Hits(qr []QueryResult) *bitmap.Bitmap {
+	ids := []int64{}
+	for _, v := range qr {
+		for _, doc := range v.FileRune {
+			if doc != nil {
+				ids = append(ids, doc.UUID())
+			}
+		}
+	}
+	return e.nums.Bitmap(ids)
+}
+
+// *** doc values ***
+
+// 重建关键词字段的列，字段值作为整体不分词，没有该字段或值为空的文档跳过
+func (e *Engine) BuildKeyword(typ types.Document, fields ...string) error {
+	values := make(map[string]map[uint32]string)
+	for _, f := range fields {
+		values[f] = make(map[uint32]string)
+	}
+	for id := range e.docm.ChanDocsID(typ) {
+		num, ok := e.nums.Num(id)
+		if !ok {
+			continue
+		}
+		doc := e.docm.GetDocument(id)
+		if doc == nil {
+			continue
+		}
+		for _, f := range fields {
+			if v := doc.FetchField(f); len(v) > 0 {
+				values[f][num] = string(v)
+			}
+		}
+	}
+	for _, f := range fields {
+		if err := e.values.SetKeyword(f, values[f]); err != nil {
+			return err
+		}
+	}
+	e.ClearFilterCache()
+	return nil
+}
+
+// 重建二进制字段的列，保存字段的原始字节，没有该字段的文档跳过
+func (e *Engine) BuildBinary(typ types.Document, fields ...string) error {
+	values := make(map[string]map[uint32][]byte)
+	for _, f := range fields {
+		values[f] = make(map[uint32][]byte)
+	}
+	for id := range e.docm.ChanDocsID(typ) {
+		num, ok := e.nums.Num(id)
+		if !ok {
+			continue
+		}
+		doc := e.docm.GetDocument(id)
+		if doc == nil {
+			continue
+		}
+		for _, f := range fields {
+			if doc.FieldExist(f) {
+				values[f][num] = doc.FetchField(f)
+			}
+		}
+	}
+	for _, f := range fields {
+		if err := e.values.SetBinary(f, values[f]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 列式字段值，按内部编号读取
+func (e *Engine) DocValues() *docvalues.DocValues {
+	return e.values
+}
+
+// 查询结果按关键词字段的取值计数，返回文档数最多的n个取值
+func (e *Engine) TermsAggregation(qr []QueryResult, field string, n int) (*docvalues.TermsResult, error) {
+	col, err := e.values.Keyword(field)
+	if err != nil {
+		return nil, err
+	}
+	defer col.Release()
+	res := docvalues.Terms(col, e.Hits(qr), n)
+	if err = col.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 查询结果中数值字段的最小、最大、平均值与总和
+func (e *Engine) StatsAggregation(qr []QueryResult, field string) (*docvalues.StatsResult, error) {
+	col, err := e.values.Numeric(field)
+	if err != nil {
+		return nil, err
+	}
+	defer col.Release()
+	res := docvalues.Stats(col, e.Hits(qr))
+	if err = col.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 查询结果按数值字段的固定宽度区间计数
+func (e *Engine) HistogramAggregation(qr []QueryResult, field string, interval int64, offset int64) ([]docvalues.Bucket, error) {
+	col, err := e.values.Numeric(field)
+	if err != nil {
+		return nil, err
+	}
+	defer col.Release()
+	res := docvalues.Histogram(col, e.Hits(qr), interval, offset)
+	if err = col.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 查询结果按日期字段的日、月或年计数
+func (e *Engine) DateHistogramAggregation(qr []QueryResult, field string, unit docvalues.DateInterval) ([]docvalues.Bucket, error) {
+	col, err := e.values.Numeric(field)
+	if err != nil {
+		return nil, err
+	}
+	defer col.Release()
+	res := docvalues.DateHistogram(col, e.Hits(qr), unit)
+	if err = col.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 排序后的一个命中文档
+type Hit struct {
+	ID    int64
+	Doc   types.Document
+	Score float64
+}
+
+// 把查询结果展开为命中文档，按fields排序，例如 docvalues.ParseSort("PublishTime:desc,_score")
+// 文档出现在多个结果中时取最高的得分，字段值从列中读取，使用结果中已经打开的文档
+func (e *Engine) Sort(qr []QueryResult, fields ...docvalues.SortField) ([]Hit, error) {
+	nums, scores, docs := e.flatten(qr)
+	return e.sortPage(nums, scores, 0, 0, fields, func(num uint32) types.Document {
+		return docs[num]
+	})
+}
+
+// 按fields排序查询命中的文档，返回from开始的size个(size<=0时到末尾)，参数level、args与Explain相同
+// 先按列排序，只打开这一页的文档；_score与Sort(rank的结果)相同，由词频与字段长度的列计算，
+// ranker需要实现types.Explainer，否则返回ErrNotSupport
+func (e *Engine) QuerySort(text string, field string, level types.QueryLevel, from int, size int, fields []docvalues.SortField, args ...any) ([]Hit, error) {
+	result, loadmaps, ids, _, _ := e.queryer.Query(text, level, args...)
+	if len(result) == 0 {
+		return nil, ErrNotFound
+	}
+	if !sortByScore(fields) {
+		nums := make([]uint32, 0, len(ids))
+		for _, num := range ids {
+			if num >= 0 && num <= math.MaxUint32 {
+				nums = append(nums, uint32(num))
+			}
+		}
+		return e.sortPage(nums, nil, from, size, fields, e.openNum)
+	}
+	ex, ok := e.ranker.(types.Explainer)
+	if !ok {
+		return nil, ErrNotSupport
+	}
+	nums, scores := e.scores(ex, field, result, loadmaps, e.fieldStats(field, ids))
+	return e.sortPage(nums, scores, from, size, fields, e.openNum)
+}
+
+// 按统计量计算命中文档的得分，组合的得分是组合中各文档得分的中位数，文档取包含它的组合的最高得分，与rank后flatten相同
+func (e *Engine) scores(
+	ex types.Explainer,
+	field string,
+	result []types.QueryReuslt,
+	loadmaps map[string]types.Pair,
+	stats types.FieldStats,
+) ([]uint32, []float64) {
+	var (
+		nums   = []uint32{}
+		scores = []float64{}
+		seen   = make(map[int64]int)
+	)
+	for _, v := range result {
+		group := make([]float64, 0, len(v.Docs))
+		for _, num := range v.Docs {
+			// 删除或无法读取的文档不参与打分
+			if _, ok := stats.Lens[num]; ok {
+				group = append(group, ex.Score(field, v.Tokens, loadmaps, stats, num))
+			}
+		}
+		if len(group) == 0 {
+			continue
+		}
+		sort.Sort(sort.Reverse(sort.Float64Slice(group)))
+		median := group[len(group)/2]
+		for _, num := range v.Docs {
+			if _, ok := stats.Lens[num]; !ok {
+				continue
+			}
+			if i, ok := seen[num]; ok {
+				if median > scores[i] {
+					scores[i] = median
+				}
+				continue
+			}
+			seen[num] = len(nums)
+			nums = append(nums, uint32(num))
+			scores = append(scores, median)
+		}
+	}
+	return nums, scores
+}
+
+// 按fields对位图中的文档排序，返回前n个文档id(n<=0时返回全部)，只读取列不打开文档
+// 位图没有得分，_score不影响顺序
+func (e *Engine) SortBitmap(b *bitmap.Bitmap, n int, fields ...docvalues.SortField) ([]int64, error) {
+	nums := b.ToArray()
+	order, err := e.sortNums(nums, nil, 0, n, fields)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int64, 0, len(order))
+	for _, o := range order {
+		if id, ok := e.nums.LiveID(nums[o]); ok {
+			res = append(res, id)
+		}
+	}
+	return res, nil
+}
+
+func sortByScore(fields []docvalues.SortField) bool {
+	for _, f := range fields {
+		if f.Field == docvalues.SORT_SCORE {
+			return true
+		}
+	}
+	return false
+}
+
+// 查询结果中文档的内部编号、得分与文档，文档出现在多个结果中时取最高的得分，没有编号的文档被去掉
+func (e *Engine) flatten(qr []QueryResult) ([]uint32, []float64, map[uint32]types.Document) {
+	nums := []uint32{}
+	scores := []float64{}
+	docs := make(map[uint32]types.Document)
+	seen := make(map[uint32]int)
+	for _, v := range qr {
+		for _, doc := range v.FileRune {
+			if doc == nil {
+				continue
+			}
+			num, ok := e.nums.Num(doc.UUID())
+			if !ok {
+				continue
+			}
+			if i, ok := seen[num]; ok {
+				if v.Score > scores[i] {
+					scores[i] = v.Score
+				}
+				continue
+			}
+			seen[num] = len(nums)
+			nums = append(nums, num)
+			scores = append(scores, v.Score)
+			docs[num] = doc
+		}
+	}
+	return nums, scores, docs
+}
+
+// 按内部编号打开文档，删除的文档返回nil
+func (e *Engine) openNum(num uint32) types.Document {
+	id, ok := e.nums.LiveID(num)
+	if !ok {
+		return nil
+	}
+	return e.docm.GetDocument(id)
+}
+
+// 排序后打开from开始的size个文档，open返回nil的文档跳过
+func (e *Engine) sortPage(
+	nums []uint32,
+	scores []float64,
+	from int,
+	size int,
+	fields []docvalues.SortField,
+	open func(uint32) types.Document,
+) ([]Hit, error) {
+	order, err := e.sortNums(nums, scores, from, size, fields)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Hit, 0, len(order))
+	for _, o := range order {
+		doc := open(nums[o])
+		if doc == nil {
+			continue
+		}
+		h := Hit{ID: doc.UUID(), Doc: doc}
+		if scores != nil {
+			h.Score = scores[o]
+		}
+		res = append(res, h)
+	}
+	return res, nil
+}
+
+// 按fields对内部编号排序，返回from开始的size个文档在nums中的下标，scores与nums对应，可以为nil
+func (e *Engine) sortNums(nums []uint32, scores []float64, from int, size int, fields []docvalues.SortField) ([]int, error) {
+	live := make([]uint32, 0, len(nums))
+	idx := make([]int, 0, len(nums))
+	var kept []float64
+	for i, num := range nums {
+		// 删除的文档不再返回
+		if _, ok := e.nums.LiveID(num); !ok {
+			continue
+		}
+		live = append(live, num)
+		idx = append(idx, i)
+		if scores != nil {
+			kept = append(kept, scores[i])
+		}
+	}
+	order, err := e.values.Sort(live, kept, fields)
+	if err != nil {
+		return nil, err
+	}
+	if from > len(order) {
+		from = len(order)
+	}
+	order = order[from:]
+	if size > 0 && len(order) > size {
+		order = order[:size]
+	}
+	for i, o := range order {
+		order[i] = idx[o]
+	}
+	return order, nil
+}
+
+// 在线检查引擎使用中的各个结构：文档chunk、词典与倒排、数值字段的B+树
+// repair为true时重建可以推导出的结构，离线检查目录见fsck.Check
+func (e *Engine) Verify(repair bool) *fsck.Report {
+	r := fsck.NewReport(e.root, repair)
+	r.Verify("documents", e.docm)
+	if v, ok := e.indexm.(types.Verifier); ok {
+		r.Verify("index", v)
+	}
+	r.Verify("numeric", e.numeric)
+	r.Verify("numbers", e.nums)
+	r.Verify("docvalues", e.values)
+	return r
 }
@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"fmt"
+	"fts/internal/document"
+	"fts/internal/docvalues"
+	"fts/internal/query"
+	"fts/internal/types"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testDoc struct {
+	ID    int64
+	Year  int64
+	Title string
+	Text  string
+}
+
+func (d *testDoc) Serial() []byte           { return []byte(d.Text) }
+func (d *testDoc) Dump(b []byte)            { d.Text = string(b) }
+func (d *testDoc) UUID() int64              { return d.ID }
+func (d *testDoc) FieldExist(f string) bool { return f == "Text" || f == "Title" }
+func (d *testDoc) FieldLen(f string) int64 {
+	return int64(len(strings.Fields(string(d.FetchField(f)))))
+}
+func (d *testDoc) FetchField(f string) []byte {
+	switch f {
+	case "Text":
+		return []byte(d.Text)
+	case "Title":
+		return []byte(d.Title)
+	}
+	return nil
+}
+func (d *testDoc) NumericField(f string) (int64, bool) { return d.Year, f == "Year" }
+
+// 记录从磁盘读取的文档数
+type testDocDisk struct {
+	sync.Mutex
+	docs  map[int64]types.Document
+	ids   []int64
+	reads int
+}
+
+func (td *testDocDisk) GetDoc(id int64) types.Document {
+	td.Lock()
+	defer td.Unlock()
+	td.reads++
+	return td.docs[id]
+}
+func (td *testDocDisk) ReadDoc(id int64) (types.Document, error) { return td.GetDoc(id), nil }
+func (td *testDocDisk) AddDoc(doc types.Document) error {
+	td.Lock()
+	defer td.Unlock()
+	td.docs[doc.UUID()] = doc
+	td.ids = append(td.ids, doc.UUID())
+	return nil
+}
+func (td *testDocDisk) EnumDocTypes() []types.Document { return []types.Document{&testDoc{}} }
+func (td *testDocDisk) EnumDocsID(doc types.Document, size int) chan int64 {
+	ch := make(chan int64, size)
+	go func() {
+		for _, v := range td.ids {
+			ch <- v
+		}
+		close(ch)
+	}()
+	return ch
+}
+func (td *testDocDisk) Docs(types.Document) int64 { return int64(len(td.ids)) }
+func (td *testDocDisk) Flush()                    {}
+func (td *testDocDisk) SaveMeta()                 {}
+
+func (td *testDocDisk) resetReads() {
+	td.Lock()
+	defer td.Unlock()
+	td.reads = 0
+}
+
+type testIndexManager struct{}
+
+func (tim *testIndexManager) GetIndex(string, string) types.Index { return nil }
+func (tim *testIndexManager) AddIndex(string, types.Index)        {}
+
+// 按空格分词，返回字段包含任一词项的文档(内部编号)，默认查询Text
+type testQueryer struct {
+	disk *testDocDisk
+	nums *document.DocNumbers
+}
+
+func (tq *testQueryer) SetIndexManager(types.IndexManager) {}
+func (tq *testQueryer) Query(text string, level types.QueryLevel, args ...any) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	return tq.QueryField("Text", text, level, args...)
+}
+func (tq *testQueryer) QueryField(field string, text string, level types.QueryLevel, args ...any) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	var (
+		result   []types.QueryReuslt
+		loadmaps = make(map[string]types.Pair)
+		ids      []int64
+		seen     = make(map[int64]bool)
+	)
+	for _, token := range strings.Fields(text) {
+		maps := make(map[int64]int16)
+		docs := []int64{}
+		for _, v := range tq.disk.ids {
+			n, _ := tq.nums.Num(v)
+			id := int64(n)
+			for _, w := range strings.Fields(string(tq.disk.docs[v].FetchField(field))) {
+				if w == token {
+					maps[id]++
+				}
+			}
+			if maps[id] > 0 {
+				docs = append(docs, id)
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+		if len(docs) > 0 {
+			result = append(result, types.QueryReuslt{Docs: docs, Tokens: token})
+			loadmaps[token] = types.Pair{Maps: maps}
+		}
+	}
+	return result, loadmaps, ids, "|", nil
+}
+
+// n个文档，第i个文档Year为2000+i，包含beijing，偶数文档还包含i%7+1个tibet，
+// 标题为i%3+1个词，其中3的倍数包含tibet
+func newTestEngine(t *testing.T, n int) (*Engine, *testDocDisk) {
+	disk := &testDocDisk{docs: make(map[int64]types.Document)}
+	for i := 1; i <= n; i++ {
+		text := "beijing"
+		if i%2 == 0 {
+			text += strings.Repeat(" tibet", i%7+1)
+		}
+		title := strings.Repeat("dabie ", i%3) + "mountains"
+		if i%3 == 0 {
+			title = "tibet"
+		}
+		disk.AddDoc(&testDoc{ID: int64(i), Year: int64(2000 + i), Title: title, Text: text})
+	}
+	tq := &testQueryer{disk: disk}
+	e := NewFTSEngine(t.TempDir(), disk, &testIndexManager{}, tq, query.NewBM25Ranker(1.2, 0, 0.75), nil)
+	tq.nums = e.nums
+	assert.Nil(t, e.BuildNumeric(&testDoc{}, "Year"))
+	return e, disk
+}
+
+func TestQuerySort(t *testing.T) {
+	e, disk := newTestEngine(t, 200)
+	assert.Nil(t, e.Delete(3))
+
+	// 按列排序后只打开一页的文档
+	byYear, _ := docvalues.ParseSort("Year")
+	disk.resetReads()
+	hits, err := e.QuerySort("beijing", "Text", types.AT_OR, 5, 10, byYear)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, disk.reads, 10)
+	ids := []int64{}
+	for _, h := range hits {
+		assert.NotNil(t, h.Doc)
+		ids = append(ids, h.ID)
+	}
+	// 删除的3不占位置
+	assert.Equal(t, []int64{7, 8, 9, 10, 11, 12, 13, 14, 15, 16}, ids)
+
+	// 按得分排序由长度列计算，只打开一页，与打开全部文档后Sort的结果相同
+	assert.Nil(t, e.buildFieldLens(&testDoc{}, "Text"))
+	byScore, _ := docvalues.ParseSort("_score,Year:desc")
+	disk.resetReads()
+	page, err := e.QuerySort("tibet", "Text", types.AT_OR, 10, 20, byScore)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, disk.reads, 20)
+	result, loadmaps, qids, prefix, _ := e.queryer.Query("tibet", types.AT_OR)
+	all, err := e.Sort(e.rank("Text", result, loadmaps, qids, prefix), byScore...)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(all))
+	assert.Equal(t, all[10:30], page)
+	for i := 1; i < len(all); i++ {
+		assert.GreaterOrEqual(t, all[i-1].Score, all[i].Score)
+	}
+
+	_, err = e.QuerySort("dabie", "Text", types.AT_OR, 0, 10, byYear)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// 位图与查询走同一个排序
+	desc, _ := docvalues.ParseSort("Year:desc")
+	top, err := e.SortBitmap(e.nums.Bitmap([]int64{1, 2, 3, 4, 5}), 2, desc...)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{5, 4}, top)
+}
+
+type testLoader struct {
+	docs []types.Document
+}
+
+func (tl *testLoader) Load(ch chan types.Document, errch chan error) {
+	for _, d := range tl.docs {
+		ch <- d
+	}
+	ch <- nil
+}
+func (tl *testLoader) ErrExit(error) {}
+
+// 编号表变化后按编号得到的过滤位图不再从缓存读取
+func TestFilterCacheInvalidation(t *testing.T) {
+	e, _ := newTestEngine(t, 10)
+	not := NotFilter(IDsFilter(1, 2))
+	ids := IDsFilter(11)
+	b, err := e.filter(not)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(8), b.Cardinality())
+	b, _ = e.filter(ids)
+	assert.Equal(t, uint64(0), b.Cardinality())
+
+	assert.Nil(t, e.Load(&testLoader{docs: []types.Document{&testDoc{ID: 11, Year: 2011, Text: "beijing"}}}))
+	b, _ = e.filter(not)
+	assert.Equal(t, uint64(9), b.Cardinality())
+	b, _ = e.filter(ids)
+	assert.Equal(t, uint64(1), b.Cardinality())
+
+	assert.Nil(t, e.Delete(3))
+	b, _ = e.filter(not)
+	assert.Equal(t, uint64(8), b.Cardinality())
+	b, _ = e.Filter(ids)
+	assert.Equal(t, uint64(1), b.Cardinality())
+}
+
+// 按字段解释得分，统计量从长度列读取，不打开命中的文档
+func TestExplain(t *testing.T) {
+	e, disk := newTestEngine(t, 30)
+	assert.Nil(t, e.buildFieldLens(&testDoc{}, "Text", "Title"))
+	assert.Nil(t, e.Load(&testLoader{docs: []types.Document{&testDoc{ID: 31, Title: "tibet", Text: "tibet tibet beijing"}}}))
+
+	// 与打开全部文档排序得到的得分相同
+	scores := func(field string) map[int64]float64 {
+		result, loadmaps, ids, prefix, _ := e.queryField(field, "tibet", types.AT_OR)
+		res := make(map[int64]float64)
+		for _, v := range e.rank(field, result, loadmaps, ids, prefix) {
+			for _, d := range v.FileRune {
+				res[d.UUID()] = v.Score
+			}
+		}
+		return res
+	}
+	text, title := scores("Text"), scores("Title")
+
+	for _, id := range []int64{6, 4, 3, 31} {
+		disk.resetReads()
+		exp, err := e.Explain("tibet", []string{"Text", "Title"}, types.AT_OR, id)
+		assert.Nil(t, err)
+		// 构建之后加载的31不在长度列中，只打开它(可能已在缓存中)
+		if id == 31 {
+			assert.LessOrEqual(t, disk.reads, 1)
+		} else {
+			assert.Equal(t, 0, disk.reads)
+		}
+		assert.Equal(t, 2, len(exp.Details))
+		assert.InDelta(t, text[id], exp.Details[0].Value, 1e-9, "%d", id)
+		assert.InDelta(t, title[id], exp.Details[1].Value, 1e-9, "%d", id)
+		assert.InDelta(t, exp.Value, exp.Details[0].Value+exp.Details[1].Value, 1e-9)
+		assert.True(t, strings.Contains(exp.String(), "weight(Title:tibet)") == (title[id] > 0))
+		num, _ := e.nums.Num(id)
+		assert.True(t, strings.Contains(exp.String(), fmt.Sprintf("doc %d, internal number %d", id, num)))
+	}
+
+	// 删除的文档不再命中
+	assert.Nil(t, e.Delete(6))
+	exp, err := e.Explain("tibet", []string{"Text", "Title"}, types.AT_OR, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, exp.Value)
+	assert.True(t, strings.Contains(exp.Details[0].Description, "does not match"))
+
+	_, err = e.Explain("dabie", []string{"Text"}, types.AT_OR, 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
@@ -0,0 +1,168 @@
+package fsck
+
+import (
+	"errors"
+	"fmt"
+	"fts/internal"
+	"fts/internal/disk"
+	"fts/internal/document"
+	"fts/internal/docvalues"
+	"fts/internal/types"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrLoad = errors.New("load failed")
+
+// 一个检查对象上发现的问题
+type Issue struct {
+	Target string
+	Err    error
+}
+
+func (i Issue) String() string {
+	return i.Target + ": " + i.Err.Error()
+}
+
+// 检查报告，Issues为检查时发现的问题，Remains为修复后再次检查仍然存在的问题
+type Report struct {
+	Root    string
+	Repair  bool
+	Checked []string
+	Issues  []Issue
+	Remains []Issue
+}
+
+func NewReport(root string, repair bool) *Report {
+	return &Report{
+		Root:   root,
+		Repair: repair,
+	}
+}
+
+func (r *Report) add(target string, errs []error) []Issue {
+	res := []Issue{}
+	for _, err := range errs {
+		res = append(res, Issue{Target: target, Err: err})
+	}
+	return res
+}
+
+// 检查target，修复模式下发现问题时修复并再检查一次
+func (r *Report) Verify(target string, v types.Verifier) {
+	r.Checked = append(r.Checked, target)
+	issues := r.add(target, v.Verify(r.Repair))
+	r.Issues = append(r.Issues, issues...)
+	if r.Repair && len(issues) > 0 {
+		r.Remains = append(r.Remains, r.add(target, v.Verify(false))...)
+	}
+}
+
+// 记录无法打开的对象
+func (r *Report) Fail(target string, err error) {
+	r.Checked = append(r.Checked, target)
+	r.Issues = append(r.Issues, Issue{Target: target, Err: err})
+	if r.Repair {
+		r.Remains = append(r.Remains, Issue{Target: target, Err: err})
+	}
+}
+
+// 没有发现任何问题
+func (r *Report) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// 没有问题，或者问题都已修复
+func (r *Report) Healthy() bool {
+	if r.Repair {
+		return len(r.Remains) == 0
+	}
+	return r.OK()
+}
+
+func (r *Report) String() string {
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "fsck %s: checked %d, issues %d", r.Root, len(r.Checked), len(r.Issues))
+	if r.Repair {
+		fmt.Fprintf(&sb, ", remains %d", len(r.Remains))
+	}
+	sb.WriteByte('\n')
+	for _, v := range r.Issues {
+		sb.WriteString("  " + v.String() + "\n")
+	}
+	if len(r.Remains) > 0 {
+		sb.WriteString("remains:\n")
+		for _, v := range r.Remains {
+			sb.WriteString("  " + v.String() + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// 离线检查root目录：数值字段与倒排的B+树文件(*_num.idx, *_bp.idx)、文档chunk(hash_doc.meta)、
+// 文档编号(docnum.meta)、列式字段值(*.dv)以及后缀表(.sst)，repair为true时重建可以推导出的结构
+// 词典与倒排的对应关系需要打开对应的IndexManager，见Engine.Verify
+func Check(root string, repair bool) (*Report, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	r := NewReport(root, repair)
+	for _, v := range entries {
+		name := v.Name()
+		path := filepath.Join(root, name)
+		switch {
+		case v.IsDir():
+		case strings.HasSuffix(name, "_num.idx"), strings.HasSuffix(name, "_bp.idx"):
+			bp, err := internal.NewBPlusTree(path)
+			if err != nil {
+				r.Fail(path, err)
+				continue
+			}
+			r.Verify(path, bp)
+			bp.Close()
+		case name == "hash_doc.meta":
+			var ddm *disk.DocDiskManager
+			if err = load(func() { ddm = disk.NewDocDiskManager(root) }); err != nil {
+				r.Fail(path, err)
+				continue
+			}
+			r.Verify(path, ddm)
+		case name == ".sst":
+			var sm *internal.SstManager
+			if err = load(func() { sm = internal.NewSSTM(root) }); err != nil {
+				r.Fail(path, err)
+				continue
+			}
+			r.Verify(path, sm)
+		case name == "docnum.meta":
+			dn, err := document.NewDocNumbers(root)
+			if err != nil {
+				r.Fail(path, err)
+				continue
+			}
+			r.Verify(path, dn)
+		case strings.HasSuffix(name, ".dv"):
+			col, err := docvalues.Open(path)
+			if err != nil {
+				r.Fail(path, err)
+				continue
+			}
+			r.Verify(path, col)
+			col.Close()
+		}
+	}
+	return r, nil
+}
+
+// 各管理器加载元数据失败时直接panic，这里转为错误
+func load(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrLoad, r)
+		}
+	}()
+	f()
+	return nil
+}
@@ -0,0 +1,45 @@
+package fsck
+
+import (
+	"errors"
+	"fmt"
+	"fts/internal"
+	"fts/internal/common"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"Links_num.idx", "title_bp.idx"} {
+		bp, err := internal.NewBPlusTree(filepath.Join(root, name))
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, bp.Insert(uint64(i), fmt.Sprintf("%d", i)))
+		}
+		bp.Close()
+	}
+
+	r, err := Check(root, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(r.Checked))
+	assert.True(t, r.OK(), r.String())
+
+	// 破坏第一个页面
+	path := filepath.Join(root, "Links_num.idx")
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	f.WriteAt([]byte{0xff, 0xff}, 16)
+	f.Close()
+
+	r, err = Check(root, true)
+	assert.Nil(t, err)
+	assert.False(t, r.OK())
+	assert.False(t, r.Healthy())
+	assert.Equal(t, 1, len(r.Issues))
+	assert.Equal(t, path, r.Issues[0].Target)
+	assert.True(t, errors.Is(r.Issues[0].Err, common.ErrCorrupted))
+}
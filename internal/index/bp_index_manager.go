@@ -136,3 +136,31 @@ func (bpm *BpIndexManager) GetIndex(token string, field string) types.Index {
 	}
 	return bpm.disk.GetIndex(xid.(int64), field)
 }
+
+func (bpm *BpIndexManager) Terms(field string, a types.Automaton, max int) ([]string, bool) {
+	rix, ok := bpm.radix[field]
+	if !ok {
+		return nil, false
+	}
+	pairs, truncated := rix.Intersect(a, max)
+	terms := make([]string, 0, len(pairs))
+	for _, v := range pairs {
+		terms = append(terms, v.Key())
+	}
+	return terms, truncated
+}
+
+// 检查词典中的词项都能取到倒排记录以及各字段的B+树，repair时删除悬空的词项
+func (bpm *BpIndexManager) Verify(repair bool) []error {
+	fields := make([]string, 0, len(bpm.radix))
+	for k := range bpm.radix {
+		fields = append(fields, k)
+	}
+	errs := verifyTerms(bpm, bpm, fields, repair, func(field string, term string) {
+		bpm.radix[field].Delete(term)
+	})
+	if repair && len(errs) > 0 {
+		bpm.persite()
+	}
+	return append(errs, verifyDisk(bpm.disk, repair)...)
+}
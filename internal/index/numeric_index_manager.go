@@ -0,0 +1,262 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"fts/internal"
+	"fts/internal/common"
+	"fts/internal/types"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrNumericFieldNotFound = errors.New("numeric field not found")
+
+// 数值/日期字段的索引，每个字段一棵以数值为key的B+树，记录为该数值下的有序文档id
+// 读锁只保护字段到树的映射，查询在树的快照上进行，不等待写者；写者之间由wmu串行
+type NumericIndexManager struct {
+	sync.RWMutex
+	wmu    sync.Mutex
+	root   string
+	fields map[string]*internal.BPlusTree
+}
+
+func NewNumericIndexManager(root string) *NumericIndexManager {
+	return &NumericIndexManager{
+		root:   root,
+		fields: make(map[string]*internal.BPlusTree),
+	}
+}
+
+func (nm *NumericIndexManager) path(field string) string {
+	return nm.root + "/" + field + "_num.idx"
+}
+
+// 有符号数映射到无符号数并保持顺序，负数排在正数前面
+func numericKey(v int64) uint64 {
+	return uint64(v) ^ (1 << 63)
+}
+
+// 有序文档id，差值按varint编码
+func encodeDocIDs(ids []int64) string {
+	buf := make([]byte, 0, len(ids)*binary.MaxVarintLen64/2)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	prev := int64(0)
+	for _, v := range ids {
+		n := binary.PutUvarint(tmp, uint64(v-prev))
+		buf = append(buf, tmp[:n]...)
+		prev = v
+	}
+	return string(buf)
+}
+
+func decodeDocIDs(s string) []int64 {
+	b := []byte(s)
+	ids := []int64{}
+	prev := int64(0)
+	for len(b) > 0 {
+		delta, n := binary.Uvarint(b)
+		if n <= 0 {
+			break
+		}
+		prev += int64(delta)
+		ids = append(ids, prev)
+		b = b[n:]
+	}
+	return ids
+}
+
+// 合并两个有序id数组并去重
+func mergeDocIDs(a []int64, b []int64) []int64 {
+	res := make([]int64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		var v int64
+		if j == len(b) || (i < len(a) && a[i] <= b[j]) {
+			v = a[i]
+			i++
+		} else {
+			v = b[j]
+			j++
+		}
+		if len(res) == 0 || res[len(res)-1] != v {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// 字段的B+树，只在查找和打开时加锁，调用方不持有锁
+func (nm *NumericIndexManager) lookup(field string, create bool) (*internal.BPlusTree, error) {
+	nm.RLock()
+	bp, ok := nm.fields[field]
+	nm.RUnlock()
+	if ok {
+		return bp, nil
+	}
+	nm.Lock()
+	defer nm.Unlock()
+	return nm.tree(field, create)
+}
+
+// 调用方持有写锁
+func (nm *NumericIndexManager) tree(field string, create bool) (*internal.BPlusTree, error) {
+	if bp, ok := nm.fields[field]; ok {
+		return bp, nil
+	}
+	path := nm.path(field)
+	if !create && !common.IsExist(path) {
+		return nil, ErrNumericFieldNotFound
+	}
+	bp, err := internal.NewBPlusTree(path)
+	if err != nil {
+		return nil, err
+	}
+	nm.fields[field] = bp
+	return bp, nil
+}
+
+func (nm *NumericIndexManager) Add(field string, value int64, id int64) error {
+	return nm.AddBatch(field, map[int64][]int64{value: {id}})
+}
+
+// 批量添加，values为 数值 -> 文档id，按数值升序写入
+func (nm *NumericIndexManager) AddBatch(field string, values map[int64][]int64) error {
+	nm.wmu.Lock()
+	defer nm.wmu.Unlock()
+	bp, err := nm.lookup(field, true)
+	if err != nil {
+		return err
+	}
+	keys := make([]int64, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if bp.Empty() {
+		// 重建时是空树，直接批量构建
+		return nm.bulkLoad(bp, keys, values)
+	}
+	for _, k := range keys {
+		ids := append([]int64{}, values[k]...)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		err = bp.InsertOrUpdateWhat(numericKey(k), func(isNew bool, old string) string {
+			if isNew {
+				return encodeDocIDs(mergeDocIDs(nil, ids))
+			}
+			return encodeDocIDs(mergeDocIDs(decodeDocIDs(old), ids))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nm *NumericIndexManager) bulkLoad(bp *internal.BPlusTree, keys []int64, values map[int64][]int64) error {
+	bl, err := bp.NewBulkLoader(0)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		ids := append([]int64{}, values[k]...)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if err = bl.Add(numericKey(k), encodeDocIDs(mergeDocIDs(nil, ids))); err != nil {
+			return err
+		}
+	}
+	return bl.Finish()
+}
+
+// 数值落在nr内的文档id，升序且去重
+func (nm *NumericIndexManager) Range(field string, nr types.NumericRange) ([]int64, error) {
+	bp, err := nm.lookup(field, false)
+	if err != nil {
+		return nil, err
+	}
+	if nr.Min > nr.Max {
+		return []int64{}, nil
+	}
+	res := []int64{}
+	err = bp.Scan(numericKey(nr.Min), numericKey(nr.Max), func(_ uint64, rec string) bool {
+		res = append(res, decodeDocIDs(rec)...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return mergeDocIDs(res, nil), nil
+}
+
+// 检查root下所有数值字段的B+树，以及每个数值下的文档id有序且不重复
+// repair时重建结构有问题的树
+func (nm *NumericIndexManager) Verify(repair bool) []error {
+	nm.wmu.Lock()
+	defer nm.wmu.Unlock()
+	nm.Lock()
+	defer nm.Unlock()
+	errs := []error{}
+	entries, err := os.ReadDir(nm.root)
+	if err != nil {
+		return []error{err}
+	}
+	for _, v := range entries {
+		if v.IsDir() || !strings.HasSuffix(v.Name(), "_num.idx") {
+			continue
+		}
+		field := strings.TrimSuffix(v.Name(), "_num.idx")
+		bp, err := nm.tree(field, false)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		errs = append(errs, bp.Verify(repair)...)
+		err = bp.Scan(0, math.MaxUint64, func(key uint64, rec string) bool {
+			ids := decodeDocIDs(rec)
+			for i := 1; i < len(ids); i++ {
+				if ids[i] <= ids[i-1] {
+					errs = append(errs, fmt.Errorf("%w: %s value %d doc ids out of order", internal.ErrTreeInvariant, field, int64(key^(1<<63))))
+					break
+				}
+			}
+			return true
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// 删除字段的索引文件，用于重建
+func (nm *NumericIndexManager) Reset(field string) error {
+	nm.wmu.Lock()
+	defer nm.wmu.Unlock()
+	nm.Lock()
+	defer nm.Unlock()
+	if bp, ok := nm.fields[field]; ok {
+		bp.Close()
+		delete(nm.fields, field)
+	}
+	path := nm.path(field)
+	if !common.IsExist(path) {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func (nm *NumericIndexManager) Close() {
+	nm.wmu.Lock()
+	defer nm.wmu.Unlock()
+	nm.Lock()
+	defer nm.Unlock()
+	for k, v := range nm.fields {
+		v.Close()
+		delete(nm.fields, k)
+	}
+}
@@ -0,0 +1,97 @@
+package index
+
+import (
+	"fts/internal/types"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNumericRange(t *testing.T) {
+	root, _ := os.MkdirTemp("", "numeric")
+	defer os.RemoveAll(root)
+
+	nm := NewNumericIndexManager(root)
+	assert.Nil(t, nm.AddBatch("Links", map[int64][]int64{
+		-3: {7, 1},
+		0:  {2},
+		5:  {3, 4},
+		9:  {-8},
+	}))
+	assert.Nil(t, nm.Add("Links", 5, 1))
+	assert.Nil(t, nm.Add("Links", 5, 3))
+
+	ids, err := nm.Range("Links", types.NumericRange{Min: -3, Max: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2, 3, 4, 7}, ids)
+
+	ids, _ = nm.Range("Links", types.NumericRange{Min: 1, Max: math.MaxInt64})
+	assert.Equal(t, []int64{-8, 1, 3, 4}, ids)
+
+	ids, _ = nm.Range("Links", types.NumericRange{Min: 6, Max: 8})
+	assert.Empty(t, ids)
+
+	_, err = nm.Range("Title", types.NumericRange{Min: 0, Max: 1})
+	assert.ErrorIs(t, err, ErrNumericFieldNotFound)
+
+	// 重新打开
+	nm.Close()
+	nm = NewNumericIndexManager(root)
+	ids, _ = nm.Range("Links", types.NumericRange{Min: math.MinInt64, Max: 0})
+	assert.Equal(t, []int64{1, 2, 7}, ids)
+
+	assert.Nil(t, nm.Reset("Links"))
+	_, err = nm.Range("Links", types.NumericRange{Min: 0, Max: 1})
+	assert.ErrorIs(t, err, ErrNumericFieldNotFound)
+	nm.Close()
+}
+
+// 范围查询不等待写者，多个查询与写入可以同时进行
+func TestNumericRangeConcurrent(t *testing.T) {
+	root, _ := os.MkdirTemp("", "numeric")
+	defer os.RemoveAll(root)
+
+	nm := NewNumericIndexManager(root)
+	defer nm.Close()
+	values := map[int64][]int64{}
+	for i := int64(0); i < 1000; i++ {
+		values[i] = []int64{i}
+	}
+	assert.Nil(t, nm.AddBatch("Links", values))
+
+	// 写者进行中时查询仍然返回
+	nm.wmu.Lock()
+	done := make(chan []int64)
+	go func() {
+		ids, _ := nm.Range("Links", types.NumericRange{Min: 10, Max: 19})
+		done <- ids
+	}()
+	select {
+	case ids := <-done:
+		assert.Equal(t, 10, len(ids))
+	case <-time.After(5 * time.Second):
+		t.Fatal("range waits for the writer")
+	}
+	nm.wmu.Unlock()
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				ids, err := nm.Range("Links", types.NumericRange{Min: 100, Max: 199})
+				assert.Nil(t, err)
+				assert.Equal(t, 100, len(ids))
+			}
+		}()
+	}
+	for i := int64(0); i < 50; i++ {
+		assert.Nil(t, nm.Add("Links", 2000+i, i))
+	}
+	wg.Wait()
+}
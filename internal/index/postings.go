@@ -0,0 +1,152 @@
+package index
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fts/internal/codec"
+	"fts/internal/common"
+	"fts/internal/types"
+	"sort"
+)
+
+// 词项的倒排列表，索引类型内嵌后只需实现Field与UUID，例如
+//
+//	type TitleIndex struct{ index.BlockPostings }
+//	&TitleIndex{index.NewBlockPostings(token, map[int64]int16{num: 1})}
+//
+// 文档为段内的内部编号(document.DocNumbers)，编号连续，差值比哈希得到的外部ID小得多
+// 存储格式为codec.EncodeIndex，Dump兼容旧的gob格式({Token, Maps或Docs})
+// 新建与合并时以文档->词频的map为准；Dump只保留块编码，Postings按块解码，
+// 用到全部文档(QueryDoc、QueryAllDoc、Merge)时才解码成map
+type BlockPostings struct {
+	token string
+	docs  map[int64]int16
+	raw   []byte // 块编码的倒排列表，docs为nil时有效
+}
+
+func NewBlockPostings(token string, docs map[int64]int16) BlockPostings {
+	if docs == nil {
+		docs = make(map[int64]int16)
+	}
+	return BlockPostings{token: token, docs: docs}
+}
+
+func (bp *BlockPostings) Token() string {
+	return bp.token
+}
+
+// 旧版本的存储格式，不同的索引类型文档字段名不同
+type legacyPostings struct {
+	Token string
+	Maps  map[int64]int16
+	Docs  map[int64]int16
+}
+
+func (bp *BlockPostings) Dump(b []byte) {
+	if codec.IsIndexFormat(b) {
+		token, raw, err := codec.DecodeIndex(b)
+		if err != nil {
+			common.DFAIL("dump postings %v", err)
+			*bp = NewBlockPostings("", nil)
+			return
+		}
+		bp.token, bp.docs, bp.raw = token, nil, raw
+		return
+	}
+	var lp legacyPostings
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&lp); err != nil {
+		common.DFAIL("dump legacy postings %v", err)
+	}
+	if lp.Maps == nil {
+		lp.Maps = lp.Docs
+	}
+	*bp = NewBlockPostings(lp.Token, lp.Maps)
+}
+
+func (bp *BlockPostings) Serial() []byte {
+	raw := bp.raw
+	if bp.docs != nil {
+		var err error
+		if raw, err = codec.EncodeQueryResult(types.IndexQueryResult{Info: bp.docs}); err != nil {
+			common.DFAIL("serial postings %v %v", bp.token, err)
+			return nil
+		}
+	}
+	return codec.EncodeIndex(bp.token, raw)
+}
+
+// 解码全部文档，数据损坏时按空列表处理
+func (bp *BlockPostings) decode() map[int64]int16 {
+	if bp.docs != nil {
+		return bp.docs
+	}
+	bp.docs = make(map[int64]int16)
+	if bp.raw != nil {
+		res, err := codec.DecodeQueryResult(bp.raw)
+		if err != nil {
+			common.DFAIL("decode postings %v %v", bp.token, err)
+		} else {
+			bp.docs = res.Info
+		}
+	}
+	bp.raw = nil
+	return bp.docs
+}
+
+func (bp *BlockPostings) blockPostings() *BlockPostings {
+	return bp
+}
+
+// 合并同一词项的倒排，同一文档的词频相加
+func (bp *BlockPostings) Merge(i interface{}) bool {
+	in, ok := i.(interface{ blockPostings() *BlockPostings })
+	if !ok {
+		return false
+	}
+	other := in.blockPostings()
+	if other.token != bp.token {
+		return false
+	}
+	docs := bp.decode()
+	for id, v := range other.decode() {
+		docs[id] += v
+	}
+	return true
+}
+
+func (bp *BlockPostings) QueryDoc(id int64) int16 {
+	return bp.decode()[id]
+}
+
+func (bp *BlockPostings) QueryAllDoc() types.IndexQueryResult {
+	docs := bp.decode()
+	ids := make([]int64, 0, len(docs))
+	for k := range docs {
+		ids = append(ids, k)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return types.IndexQueryResult{Ids: ids, Info: docs}
+}
+
+// 按块遍历倒排，Advance借助跳表只解码目标所在的块
+func (bp *BlockPostings) Postings() types.PostingsIterator {
+	raw := bp.raw
+	if bp.docs != nil {
+		raw, _ = codec.EncodeQueryResult(types.IndexQueryResult{Info: bp.docs})
+	}
+	pr, err := codec.NewPostingsReader(raw)
+	if err != nil {
+		common.DFAIL("read postings %v %v", bp.token, err)
+		empty, _ := codec.EncodePostings(nil, nil)
+		pr, _ = codec.NewPostingsReader(empty)
+	}
+	return pr
+}
+
+// 文档数，只读取头部
+func (bp *BlockPostings) DocFreq() int64 {
+	if bp.docs != nil {
+		return int64(len(bp.docs))
+	}
+	return bp.Postings().Cost()
+}
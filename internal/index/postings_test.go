@@ -0,0 +1,133 @@
+package index
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fts/internal/codec"
+	"fts/internal/common"
+	"fts/internal/disk"
+	"fts/internal/query"
+	"fts/internal/types"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testTermIndex struct {
+	BlockPostings
+}
+
+// 每个词项打开的块读取器，用于统计解码的块数
+var termReaders = make(map[string][]*codec.PostingsReader)
+
+func (ti *testTermIndex) Field() string { return "Text" }
+func (ti *testTermIndex) UUID() int64   { return common.StringHashToInt64(ti.Token()) }
+func (ti *testTermIndex) Postings() types.PostingsIterator {
+	it := ti.BlockPostings.Postings()
+	termReaders[ti.Token()] = append(termReaders[ti.Token()], it.(*codec.PostingsReader))
+	return it
+}
+
+var _ types.PostingsIndex = (*testTermIndex)(nil)
+
+// 词项到磁盘索引的映射
+type testDiskIndexManager struct {
+	disk types.IndexDiskManager
+}
+
+func (tm *testDiskIndexManager) GetIndex(token string, field string) types.Index {
+	return tm.disk.GetIndex(common.StringHashToInt64(token), field)
+}
+func (tm *testDiskIndexManager) AddIndex(token string, index types.Index) {
+	tm.disk.AddIndex(index)
+}
+
+type testTokenizer struct{}
+
+func (tt *testTokenizer) UseSegmentor(types.Segmentor) {}
+func (tt *testTokenizer) UseFilter(types.Filter)       {}
+func (tt *testTokenizer) Analyze(text string) (res []types.TokenMeta) {
+	for _, v := range strings.Fields(text) {
+		res = append(res, &testToken{token: v})
+	}
+	return
+}
+
+type testToken struct{ token string }
+
+func (t *testToken) Token() string                    { return t.token }
+func (t *testToken) SetToken(s string)                { t.token = s }
+func (t *testToken) GetMeta(interface{}) interface{}  { return nil }
+func (t *testToken) SetMeta(interface{}, interface{}) {}
+func (t *testToken) Copy() types.TokenMeta            { return &testToken{token: t.token} }
+
+func TestBlockPostings(t *testing.T) {
+	ti := &testTermIndex{NewBlockPostings("beijing", map[int64]int16{9: 1, 2: 3})}
+	ti.Merge(&testTermIndex{NewBlockPostings("beijing", map[int64]int16{2: 1, 5: 1})})
+	assert.False(t, ti.Merge(&testTermIndex{NewBlockPostings("tibet", nil)}))
+	assert.Equal(t, []int64{2, 5, 9}, ti.QueryAllDoc().Ids)
+	assert.Equal(t, int16(4), ti.QueryDoc(2))
+
+	b := ti.Serial()
+	assert.True(t, codec.IsIndexFormat(b))
+	dumped := &testTermIndex{}
+	dumped.Dump(b)
+	assert.Equal(t, "beijing", dumped.Token())
+	assert.Equal(t, int64(3), dumped.DocFreq())
+	// 未解码时原样写回
+	assert.Equal(t, b, dumped.Serial())
+	it := dumped.Postings()
+	assert.True(t, it.Advance(5))
+	assert.Equal(t, int64(5), it.Doc())
+	assert.Equal(t, ti.QueryAllDoc(), dumped.QueryAllDoc())
+
+	// 旧版本的gob格式仍然可以读取
+	for _, legacy := range []interface{}{
+		struct {
+			Maps  map[int64]int16
+			Token string
+		}{map[int64]int16{1: 2, 3: 1}, "tibet"},
+		struct {
+			Docs  map[int64]int16
+			Token string
+		}{map[int64]int16{1: 2, 3: 1}, "tibet"},
+	} {
+		buf := new(bytes.Buffer)
+		gob.NewEncoder(buf).Encode(legacy)
+		old := &testTermIndex{}
+		old.Dump(buf.Bytes())
+		assert.Equal(t, "tibet", old.Token())
+		assert.Equal(t, []int64{1, 3}, old.QueryAllDoc().Ids)
+		assert.Equal(t, int16(2), old.QueryDoc(1))
+		assert.True(t, codec.IsIndexFormat(old.Serial()))
+	}
+}
+
+// 从磁盘读出的索引按块遍历，rare AND common只解码common的一小部分块
+func TestBlockPostingsConjunction(t *testing.T) {
+	root, _ := os.MkdirTemp("", "postings")
+	defer os.RemoveAll(root)
+
+	im := &testDiskIndexManager{disk: disk.NewAofIndexDiskManager(root)}
+	all := make(map[int64]int16)
+	for i := int64(0); i < 100000; i++ {
+		all[i] = 1
+	}
+	im.AddIndex("common", &testTermIndex{NewBlockPostings("common", all)})
+	im.AddIndex("rare", &testTermIndex{NewBlockPostings("rare", map[int64]int16{100: 2, 50000: 1, 99000: 1})})
+
+	qb := query.NewQueryBuilder(&testTokenizer{}, "Text")
+	qb.SetIndexManager(im)
+	_, infos, docs, _, _ := qb.Query("rare common", types.AT_AND)
+	assert.Equal(t, []int64{100, 50000, 99000}, docs)
+	assert.Equal(t, int64(100000), infos["common"].DocFreq)
+	assert.Equal(t, int16(2), infos["rare"].Maps[100])
+
+	readers := termReaders["common"]
+	assert.Equal(t, 1, len(readers))
+	blocks := (100000 + codec.POSTINGS_BLOCK_SIZE - 1) / codec.POSTINGS_BLOCK_SIZE
+	assert.LessOrEqual(t, readers[0].Decoded(), 3)
+	t.Logf("decoded %d of %d blocks", readers[0].Decoded(), blocks)
+}
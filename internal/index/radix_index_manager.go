@@ -141,5 +141,40 @@ func (rim *RadixIndexManager) GetIndex(token string, fields string) types.Index
 	}
 	key := common.MergeI64AndString(id.(int64), fields)
 	i, _ := rim.cache.Get(key)
-	return i.(types.Index)
+	index, _ := i.(types.Index)
+	return index
+}
+
+func (rim *RadixIndexManager) Terms(field string, a types.Automaton, max int) ([]string, bool) {
+	rim.RLock()
+	defer rim.RUnlock()
+	rix, ok := rim.radix[field]
+	if !ok {
+		return nil, false
+	}
+	pairs, truncated := rix.Intersect(a, max)
+	terms := make([]string, 0, len(pairs))
+	for _, v := range pairs {
+		terms = append(terms, v.Key())
+	}
+	return terms, truncated
+}
+
+// 检查词典中的词项都能取到倒排记录以及磁盘上的段文件，repair时删除悬空的词项
+func (rim *RadixIndexManager) Verify(repair bool) []error {
+	rim.RLock()
+	fields := make([]string, 0, len(rim.radix))
+	for k := range rim.radix {
+		fields = append(fields, k)
+	}
+	rim.RUnlock()
+	errs := verifyTerms(rim, rim, fields, repair, func(field string, term string) {
+		rim.Lock()
+		defer rim.Unlock()
+		rim.radix[field].Delete(term)
+	})
+	if repair && len(errs) > 0 {
+		rim.persite()
+	}
+	return append(errs, verifyDisk(rim.disk, repair)...)
 }
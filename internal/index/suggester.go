@@ -0,0 +1,165 @@
+package index
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fts/internal"
+	"fts/internal/common"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 补全的粒度
+type CompletionMode uint8
+
+const (
+	COMPLETE_TERM CompletionMode = iota // 词项级补全，权重为文档频率
+	COMPLETE_TEXT                       // 整个字段(例如标题)补全，权重为文档热度
+)
+
+var (
+	DEFAULT_COMPLETION_TOPK = 10 // 每个节点缓存的补全个数
+)
+
+type completionKey struct {
+	Field string
+	Mode  CompletionMode
+}
+
+// 管理各字段的补全字典树
+type Suggester struct {
+	sync.RWMutex
+	root  string
+	k     int
+	tries map[completionKey]*internal.CompletionTrie
+}
+
+func NewSuggester(root string) *Suggester {
+	s := &Suggester{
+		root:  root,
+		k:     DEFAULT_COMPLETION_TOPK,
+		tries: make(map[completionKey]*internal.CompletionTrie),
+	}
+	s.load()
+	return s
+}
+
+func (s *Suggester) meta() string {
+	return "suggest.meta"
+}
+
+// 小写并合并连续空白，输入与建树使用同一规则
+func NormalizeCompletion(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+func (s *Suggester) trie(field string, mode CompletionMode) *internal.CompletionTrie {
+	key := completionKey{field, mode}
+	s.RLock()
+	t, ok := s.tries[key]
+	s.RUnlock()
+	if ok {
+		return t
+	}
+	s.Lock()
+	defer s.Unlock()
+	if t, ok = s.tries[key]; !ok {
+		t = internal.NewCompletionTrie(s.k)
+		s.tries[key] = t
+	}
+	return t
+}
+
+// 词项权重累加weight
+func (s *Suggester) AddTerm(field string, term string, weight int64) {
+	s.trie(field, COMPLETE_TERM).Add(term, "", weight)
+}
+
+// 整段文本权重累加weight，相同的文本(归一化后)合并
+func (s *Suggester) AddText(field string, text string, weight int64) {
+	key := NormalizeCompletion(text)
+	if key == "" {
+		return
+	}
+	s.trie(field, COMPLETE_TEXT).Add(key, strings.TrimSpace(text), weight)
+}
+
+// 直接设置权重，例如外部存储的热度，weight<=0时移除
+func (s *Suggester) SetWeight(field string, mode CompletionMode, text string, weight int64) {
+	key := text
+	if mode == COMPLETE_TEXT {
+		key = NormalizeCompletion(text)
+	}
+	s.trie(field, mode).Set(key, strings.TrimSpace(text), weight)
+}
+
+// 清空字段的补全数据，用于重建
+func (s *Suggester) Reset(field string, mode CompletionMode) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.tries, completionKey{field, mode})
+}
+
+// 以prefix开头的前n个补全
+func (s *Suggester) Complete(field string, mode CompletionMode, prefix string, n int) []internal.Completion {
+	s.RLock()
+	t, ok := s.tries[completionKey{field, mode}]
+	s.RUnlock()
+	if !ok {
+		return nil
+	}
+	if mode == COMPLETE_TEXT {
+		// 保留末尾的空格，"new " 只补全以"new"为完整单词开头的文本
+		trail := strings.HasSuffix(prefix, " ")
+		prefix = NormalizeCompletion(prefix)
+		if trail && prefix != "" {
+			prefix += " "
+		}
+	}
+	return t.TopK(prefix, n)
+}
+
+func (s *Suggester) Persite() {
+	s.RLock()
+	maps := make(map[completionKey][]byte)
+	for k, v := range s.tries {
+		maps[k] = v.Serial()
+	}
+	s.RUnlock()
+
+	buf := new(bytes.Buffer)
+	e := gob.NewEncoder(buf)
+	e.Encode(maps)
+
+	f, err := os.Create(s.root + "/" + s.meta())
+	if err != nil {
+		common.DFAIL("persite suggester %v", err)
+		return
+	}
+	defer f.Close()
+	f.Write(buf.Bytes())
+}
+
+func (s *Suggester) load() {
+	path := s.root + "/" + s.meta()
+	if !common.IsExist(path) {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	maps := make(map[completionKey][]byte)
+	if gob.NewDecoder(f).Decode(&maps) != nil {
+		common.DFAIL("load suggester meta failed")
+		return
+	}
+	for k, v := range maps {
+		t := internal.NewCompletionTrie(s.k)
+		t.Dump(v)
+		s.tries[k] = t
+	}
+}
@@ -146,3 +146,31 @@ func (tim *TrieIndexManager) GetIndex(token, field string) types.Index {
 	}
 	return tim.disk.GetIndex(xid.(int64), field)
 }
+
+func (tim *TrieIndexManager) Terms(field string, a types.Automaton, max int) ([]string, bool) {
+	rix, ok := tim.fields[field]
+	if !ok {
+		return nil, false
+	}
+	tuples, truncated := rix.Intersect(a, max)
+	terms := make([]string, 0, len(tuples))
+	for _, v := range tuples {
+		terms = append(terms, v.Key())
+	}
+	return terms, truncated
+}
+
+// 检查词典中的词项都能取到倒排记录以及磁盘上的段文件，repair时删除悬空的词项
+func (tim *TrieIndexManager) Verify(repair bool) []error {
+	fields := make([]string, 0, len(tim.fields))
+	for k := range tim.fields {
+		fields = append(fields, k)
+	}
+	errs := verifyTerms(tim, tim, fields, repair, func(field string, term string) {
+		tim.fields[field].Delete(term)
+	})
+	if repair && len(errs) > 0 {
+		tim.persite()
+	}
+	return append(errs, verifyDisk(tim.disk, repair)...)
+}
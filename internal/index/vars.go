@@ -1,8 +1,17 @@
 package index
 
-import "time"
+import (
+	"fts/internal/types"
+	"time"
+)
 
 var (
 	SAVE_DISK_INTERVAL = 1 * time.Hour
 	PERSITE_INTERVAL   = 2 * time.Second
 )
+
+var (
+	_ types.TermDictionary = (*BpIndexManager)(nil)
+	_ types.TermDictionary = (*RadixIndexManager)(nil)
+	_ types.TermDictionary = (*TrieIndexManager)(nil)
+)
@@ -0,0 +1,49 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"fts/internal/types"
+)
+
+var ErrDanglingTerm = errors.New("term points to missing postings")
+
+var (
+	_ types.Verifier = (*BpIndexManager)(nil)
+	_ types.Verifier = (*RadixIndexManager)(nil)
+	_ types.Verifier = (*TrieIndexManager)(nil)
+	_ types.Verifier = (*NumericIndexManager)(nil)
+)
+
+// 接受任意词项的自动机，用于枚举整个词典
+type anyTerm struct{}
+
+func (anyTerm) Start() int             { return 0 }
+func (anyTerm) Step(s int, _ rune) int { return s }
+func (anyTerm) Accept(int) bool        { return true }
+
+// 检查词典中的每个词项都能取到倒排记录，repair时调用remove把词项从词典中删除
+func verifyTerms(td types.TermDictionary, im types.IndexManager, fields []string, repair bool, remove func(string, string)) []error {
+	errs := []error{}
+	for _, field := range fields {
+		terms, _ := td.Terms(field, anyTerm{}, 0)
+		for _, term := range terms {
+			if im.GetIndex(term, field) != nil {
+				continue
+			}
+			errs = append(errs, fmt.Errorf("%w: %s:%s", ErrDanglingTerm, field, term))
+			if repair {
+				remove(field, term)
+			}
+		}
+	}
+	return errs
+}
+
+// 词典之后检查存放倒排记录的磁盘结构
+func verifyDisk(disk types.IndexDiskManager, repair bool) []error {
+	if v, ok := disk.(types.Verifier); ok {
+		return v.Verify(repair)
+	}
+	return nil
+}
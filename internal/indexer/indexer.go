@@ -23,13 +23,25 @@ func NewIndexer(tzr types.IndexBuilder) *Indexer {
 }
 
 func (idr *Indexer) Build(doc types.Document, fields string) ([]types.IndexMeta, error) {
+	tokens, err := idr.Analyze(doc, fields)
+	if err != nil {
+		return nil, err
+	}
+	return idr.Invert(doc, tokens), nil
+}
+
+// 对文档的字段分词
+func (idr *Indexer) Analyze(doc types.Document, fields string) ([]types.TokenMeta, error) {
 	text := doc.FetchField(fields)
 	if text == nil {
 		return nil, fmt.Errorf("no fields %v", fields)
 	}
+	return idr.builder.Analyze(string(text)), nil
+}
 
-	tokens := idr.builder.Analyze(string(text))
-	return idr.builder.Build(doc, tokens), nil
+// 由分词结果生成倒排索引
+func (idr *Indexer) Invert(doc types.Document, tokens []types.TokenMeta) []types.IndexMeta {
+	return idr.builder.Build(doc, tokens)
 }
 
 func (idr *Indexer) BatchBuild(
@@ -43,7 +55,7 @@ func (idr *Indexer) BatchBuild(
 	for i := 0; i < cores; i++ {
 		go func(seq int) {
 			for j := seq; j < len(docs); j += cores {
-				indexes, err := idr.Build(docs[seq], field)
+				indexes, err := idr.Build(docs[j], field)
 
 				br := buildResult{
 					idx:     j,
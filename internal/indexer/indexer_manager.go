@@ -2,6 +2,7 @@ package indexer
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"fmt"
@@ -11,7 +12,8 @@ import (
 	"log"
 	"os"
 	"reflect"
-	"time"
+	"sort"
+	"sync"
 )
 
 type BuildInfo struct {
@@ -23,16 +25,28 @@ var (
 	meta = "irm.meta"
 )
 
+// 元数据文件: magic | 记录...，每提交一批追加一条记录
+// 记录: 长度(4) | crc32(4) | gob(metaRecord)，little endian
+const metaMagic = "IRM1"
+
+type metaRecord struct {
+	Batch  map[string][]BuildInfo // 这条记录新增的构建信息
+	Fields map[string][]string    // 写入记录时全部的字段
+}
+
 type IndexerManager struct {
 	root    string
 	fields  map[string][]string    // doc-type -> fields
 	batch   map[string][]BuildInfo // fields -> buildinfe
-	lens    map[string]int64
 	indexer *Indexer
+	fidx    map[string]*Indexer // field -> indexer，未指定的字段使用indexer
+
+	pipeline PipelineConfig
+	f        func([]BuildInfo, error) error
 
-	batchSize int
-	f         func([]BuildInfo, error) error
-	s         chan struct{}
+	mu      sync.Mutex
+	running *Pipeline
+	metrics []StageMetrics
 }
 
 type buildResult struct {
@@ -48,7 +62,9 @@ func NewIndexerManager(root string, builder types.IndexBuilder) *IndexerManager
 		indexer: NewIndexer(builder),
 		fields:  make(map[string][]string),
 		batch:   make(map[string][]BuildInfo),
-		lens:    make(map[string]int64),
+		fidx:    make(map[string]*Indexer),
+
+		pipeline: DefaultPipelineConfig(),
 	}
 	im.init()
 	return im
@@ -58,174 +74,208 @@ func (im *IndexerManager) init() {
 	im.load()
 }
 
-func (im *IndexerManager) persite() {
-	buf := new(bytes.Buffer)
-
-	e := gob.NewEncoder(buf)
-
-	e.Encode(&im.batch)
-	e.Encode(&im.fields)
-
-	f, _ := os.Open(im.root + "/" + meta)
+// 追加一次提交的构建信息，与之前的记录一起回放得到完整的元数据
+func (im *IndexerManager) persite(batch map[string][]BuildInfo) error {
+	im.mu.Lock()
+	rec, err := encodeMetaRecord(&metaRecord{Batch: batch, Fields: im.fields})
+	im.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	path := im.root + "/" + meta
+	if !common.IsExist(path) {
+		// 第一次提交，全部元数据已经包含这一批
+		return im.compact()
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
-
-	f.Write(buf.Bytes())
+	_, err = f.Write(rec)
+	return err
 }
 
-func (im *IndexerManager) load() {
+// 把当前的全部元数据写成一条记录，先写临时文件再改名
+func (im *IndexerManager) compact() error {
+	im.mu.Lock()
+	rec, err := encodeMetaRecord(&metaRecord{Batch: im.batch, Fields: im.fields})
+	im.mu.Unlock()
+	if err != nil {
+		return err
+	}
 	path := im.root + "/" + meta
-	if common.IsExist(path) {
-		f, _ := os.Open(path)
-		defer f.Close()
-		d := gob.NewDecoder(f)
-
-		if d.Decode(&im.batch) != nil || d.Decode(&im.fields) != nil {
-			panic("indexer-manager decode meta file error")
-		}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, append([]byte(metaMagic), rec...), 0666); err != nil {
+		os.Remove(tmp)
+		return err
 	}
-}
-func (im *IndexerManager) SetBatchSize(b int) {
-	im.batchSize = b
-}
-func (im *IndexerManager) OnBuild(on func([]BuildInfo, error) error) {
-	im.f = on
+	return os.Rename(tmp, path)
 }
 
-func (im *IndexerManager) waitBatch(
-	batches []types.Document,
-	field string,
-	in types.IndexManager,
-	cores int,
-) error {
-	resCh := make(chan buildResult, 256)
-	compelete := make(chan struct{}, cores)
-	im.indexer.BatchBuild(cores, batches, field, resCh, compelete)
-	indexes := make(map[string]types.Index)
-	//dealine := time.Now().Add(3 * time.Second)
-	info := make([]BuildInfo, len(batches))
-
-	for i, v := range batches {
-		info[i] = BuildInfo{
-			DocID: v.UUID(),
-		}
+func encodeMetaRecord(rec *metaRecord) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(rec); err != nil {
+		return nil, err
 	}
+	b := make([]byte, 8, 8+buf.Len())
+	binary.LittleEndian.PutUint32(b, uint32(buf.Len()))
+	binary.LittleEndian.PutUint32(b[4:], common.GetCrc32(buf.Bytes()))
+	return append(b, buf.Bytes()...), nil
+}
 
-	total := 0
-	var err error
-	for {
-		select {
-		case res := <-resCh:
-			if res.err != nil {
-				err = res.err
-				goto l
+// 回放元数据的记录，写了一半的尾部记录(写入时崩溃)被丢弃，之后压缩为一条记录
+func (im *IndexerManager) load() {
+	path := im.root + "/" + meta
+	if !common.IsExist(path) {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		panic(err)
+	}
+	if !bytes.HasPrefix(b, []byte(metaMagic)) {
+		// 旧的元数据是整个映射表
+		d := gob.NewDecoder(bytes.NewReader(b))
+		if d.Decode(&im.batch) != nil || d.Decode(&im.fields) != nil {
+			panic("indexer-manager decode meta file error")
+		}
+	} else {
+		for b = b[len(metaMagic):]; len(b) > 0; {
+			if len(b) < 8 || len(b)-8 < int(binary.LittleEndian.Uint32(b)) {
+				common.DWARN("indexer meta %v: drop truncated record of %d bytes", path, len(b))
+				break
 			}
-			for _, v := range res.indexes {
-				info[res.idx].IndexIDS = append(info[res.idx].IndexIDS, v.UUID())
+			n := int(binary.LittleEndian.Uint32(b))
+			payload := b[8 : 8+n]
+			if common.GetCrc32(payload) != binary.LittleEndian.Uint32(b[4:]) {
+				common.DWARN("indexer meta %v: drop corrupted record of %d bytes", path, len(b))
+				break
 			}
-			for k, v := range res.indexes {
-				s, ok := indexes[k]
-				if ok {
-					MergeTwoIndex(s, v)
-				} else {
-					indexes[k] = v
-				}
+			rec := metaRecord{}
+			if err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+				panic(fmt.Sprintf("indexer-manager decode meta record error: %v", err))
 			}
-		case <-compelete:
-			total++
-			if total == cores {
-				goto l
+			for field, bi := range rec.Batch {
+				im.AddBuildInfo(field, bi)
 			}
-		case <-time.After(5 * time.Second):
-			return errors.New("fetch build result timeout")
+			if rec.Fields != nil {
+				im.fields = rec.Fields
+			}
+			b = b[8+n:]
 		}
 	}
-l:
-	if im.f != nil {
-		err = im.f(info, err)
-	}
-	if err != nil {
-		return err
+	if err = im.compact(); err != nil {
+		panic(err)
 	}
-	//im.batch[field] = append(im.batch[field], info...)
-	im.AddBuildInfo(field, info)
-	for k, v := range indexes {
-		in.AddIndex(k, v)
+}
+func (im *IndexerManager) SetBatchSize(b int) {
+	im.pipeline.BatchSize = b
+}
+
+func (im *IndexerManager) SetPipeline(cfg PipelineConfig) {
+	cfg.normalize()
+	im.pipeline = cfg
+}
+
+// 返回正在运行的构建的各阶段统计，没有运行中的构建则返回上一次构建的统计
+func (im *IndexerManager) Metrics() []StageMetrics {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.running != nil {
+		return im.running.Metrics()
 	}
-	return nil
-	// success += im.batchSize
+	return im.metrics
+}
 
-	// batches = []types.Document{}
+// 为字段指定单独的IndexBuilder(分词器)
+func (im *IndexerManager) UseFieldBuilder(field string, builder types.IndexBuilder) {
+	im.fidx[field] = NewIndexer(builder)
 }
 
-func (im *IndexerManager) freshFieldBuild(
-	typ types.Document,
-	field string,
-	doc *document.DocumentManager,
-	in types.IndexManager,
-) error {
-	ch := doc.ChanDocsID(typ)
-
-	batches := []types.Document{}
-	for {
-		var i64 int64
-		var ok bool
-		select {
-		case i64, ok = <-ch:
-			if !ok {
-				return nil
+// 设置构建回调：每批构建结果提交前以(info,nil)调用，返回错误时终止构建
+// 任意阶段出错时以(nil,err)调用一次，返回非nil时替换返回给Build调用者的错误
+func (im *IndexerManager) OnBuild(on func([]BuildInfo, error) error) {
+	im.f = on
+}
+
+// 回调自身返回的错误，不再通知回调
+type callbackError struct {
+	err error
+}
+
+func (ce *callbackError) Error() string { return ce.err.Error() }
+func (ce *callbackError) Unwrap() error { return ce.err }
+
+// 提交一批构建结果
+func (im *IndexerManager) commitBatch(in types.IndexManager) func(map[string]*FieldBatch) error {
+	return func(batches map[string]*FieldBatch) error {
+		for _, fb := range batches {
+			if im.f != nil {
+				if err := im.f(fb.Info, nil); err != nil {
+					return &callbackError{err}
+				}
 			}
-		case <-time.After(100 * time.Millisecond): //单次取值不得超过100毫秒
-			return fmt.Errorf("read doc-id channel timeout")
 		}
-		dc := doc.GetDocument(i64)
-		batches = append(batches, dc)
-		if len(batches) == im.batchSize {
-			can := im.waitBatch(batches, field, in, 8)
-			if can != nil {
-				return can
+		info := make(map[string][]BuildInfo, len(batches))
+		for field, fb := range batches {
+			im.AddBuildInfo(field, fb.Info)
+			info[field] = fb.Info
+			for k, v := range fb.Indexes {
+				in.AddIndex(k, v)
 			}
-			im.lens[field] += int64(im.batchSize)
-			batches = []types.Document{}
 		}
-
-		im.persite()
+		return im.persite(info)
 	}
 }
 
-func (im *IndexerManager) checkBuild(
-	typ types.Document,
-	field string,
+func (im *IndexerManager) runPipeline(
+	ids <-chan int64,
+	fields []string,
 	doc *document.DocumentManager,
 	in types.IndexManager,
 ) error {
-
-	ch := doc.ChanDocsID(typ)
-	build := []types.Document{}
-	for {
-		var i64 int64
-		var ok bool
-		select {
-		case i64, ok = <-ch:
-			if !ok {
-				return nil
-			}
+	p := NewPipeline(im.pipeline, im.indexer, fields...)
+	for f, idr := range im.fidx {
+		p.UseIndexer(f, idr)
+	}
+	// 跳过已经构建过的文档
+	p.Skip(func(id int64, field string) bool {
+		return im.LookupBuildInfo(field, id) != nil
+	})
+	im.mu.Lock()
+	im.running = p
+	im.mu.Unlock()
+
+	err := p.Run(ids, doc, im.commitBatch(in))
+	// 出错提前退出时，排空ID通道让上游的枚举协程能够退出
+	go func() {
+		for range ids {
 		}
+	}()
 
-		inf := im.LookupBuildInfo(field, i64)
-		if inf == nil {
-			build = append(build, doc.GetDocument(i64))
-		}
+	im.mu.Lock()
+	im.metrics = p.Metrics()
+	im.running = nil
+	im.mu.Unlock()
 
-		if len(build) == im.batchSize {
-			err := im.waitBatch(build, field, in, 8)
-			if err != nil {
-				return nil
-			}
+	var ce *callbackError
+	if errors.As(err, &ce) {
+		return ce.err
+	}
+	if err != nil && im.f != nil {
+		if ferr := im.f(nil, err); ferr != nil {
+			return ferr
 		}
-
-		im.lens[field] += int64(im.batchSize)
-		im.persite()
 	}
+	return err
+}
+
+// 字段已经构建的文档数
+func (im *IndexerManager) built(field string) int64 {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return int64(len(im.batch[field]))
 }
 
 func (im *IndexerManager) BuildIndex(
@@ -234,31 +284,41 @@ func (im *IndexerManager) BuildIndex(
 	doc *document.DocumentManager,
 	in types.IndexManager,
 ) error {
+	return im.BuildFields(typ, []string{field}, doc, in)
+}
 
+// 一次遍历构建多个字段，每篇文档只读取一次，已经构建过的(文档,字段)会被跳过
+func (im *IndexerManager) BuildFields(
+	typ types.Document,
+	fields []string,
+	doc *document.DocumentManager,
+	in types.IndexManager,
+) error {
 	name := common.ExtractMetaTypeName(reflect.TypeOf(typ))
-	dc, ok := im.fields[name]
-	if !ok {
-		im.fields[name] = []string{field}
-		im.lens[field] = 0
-
-		return im.freshFieldBuild(typ, field, doc, in)
-	} else {
-		total := doc.Docs(typ)
-
-		for _, v := range dc {
-			if v == field && total > im.lens[v] {
-				return im.checkBuild(typ, field, doc, in)
+	total := doc.Docs(typ)
+	todo := make([]string, 0, len(fields))
+	for _, field := range fields {
+		exist := false
+		for _, v := range im.fields[name] {
+			if v == field {
+				exist = true
+				break
 			}
 		}
-
-		if im.lens[field] == 0 {
-			im.freshFieldBuild(typ, field, doc, in)
-		} else {
-			log.Println("already build")
+		if !exist {
+			im.fields[name] = append(im.fields[name], field)
+		}
+		if total > 0 && im.built(field) >= total {
+			log.Printf("field %v already build", field)
+			continue
 		}
+		todo = append(todo, field)
+	}
+	if len(todo) == 0 {
+		return nil
 	}
 
-	return nil
+	return im.runPipeline(doc.ChanDocsID(typ), todo, doc, in)
 }
 
 func MergeTwoIndex(i1 types.Index, i2 types.Index) {
@@ -266,28 +326,31 @@ func MergeTwoIndex(i1 types.Index, i2 types.Index) {
 }
 
 func (im *IndexerManager) AddBuildInfo(field string, bi []BuildInfo) {
-	arr, ok := im.batch[field]
-	if !ok {
-		arr = make([]BuildInfo, 0)
-		im.batch[field] = arr
-	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	arr := im.batch[field]
 	for _, v := range bi {
-		idx := len(arr) - 1
-		for ; idx >= 0; idx-- {
-			if arr[idx].DocID < v.DocID {
-				break
-			}
+		// 按DocID有序插入，LookupBuildInfo依赖有序性
+		idx := sort.Search(len(arr), func(i int) bool {
+			return arr[i].DocID >= v.DocID
+		})
+		if idx < len(arr) && arr[idx].DocID == v.DocID {
+			arr[idx].IndexIDS = v.IndexIDS
+			continue
+		}
+		arr = append(arr, BuildInfo{})
+		copy(arr[idx+1:], arr[idx:])
+		arr[idx] = BuildInfo{
+			DocID:    v.DocID,
+			IndexIDS: v.IndexIDS,
 		}
-		arr = append(arr[idx:], append([]BuildInfo{
-			{
-				DocID:    v.DocID,
-				IndexIDS: v.IndexIDS,
-			},
-		}, arr[idx+1:]...)...)
 	}
+	im.batch[field] = arr
 }
 
 func (im *IndexerManager) LookupBuildInfo(field string, docID int64) *BuildInfo {
+	im.mu.Lock()
+	defer im.mu.Unlock()
 	arr := im.batch[field]
 	low, high := 0, len(arr)-1
 	for low <= high {
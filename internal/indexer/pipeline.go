@@ -0,0 +1,414 @@
+package indexer
+
+import (
+	"errors"
+	"fmt"
+	"fts/internal/document"
+	"fts/internal/types"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 流水线式构建索引: fetch(读取文档) -> analyze(分词) -> invert(倒排) -> merge(合并进索引管理器)
+// 阶段之间使用有界通道连接，下游处理不过来时上游阻塞（背压），内存占用只和通道容量有关。
+// 任意阶段出错会关闭done，所有阶段尽快退出，第一个错误作为构建结果返回。
+// 一条流水线可以同时构建多个字段，每篇文档只读取一次，各字段使用各自的Indexer分词。
+// 文档管理器分配了内部编号时倒排按编号记录，构建信息仍然使用外部ID。
+
+type PipelineConfig struct {
+	FetchWorkers   int // 读取文档的协程数
+	AnalyzeWorkers int // 分词的协程数
+	InvertWorkers  int // 生成倒排索引的协程数
+	Buffer         int // 阶段之间的通道容量
+	BatchSize      int // merge阶段每攒够BatchSize篇文档提交一次
+}
+
+func DefaultPipelineConfig() PipelineConfig {
+	cores := runtime.NumCPU()
+	return PipelineConfig{
+		FetchWorkers:   2,
+		AnalyzeWorkers: cores,
+		InvertWorkers:  cores / 2,
+		Buffer:         256,
+		BatchSize:      64,
+	}
+}
+
+func (pc *PipelineConfig) normalize() {
+	if pc.FetchWorkers <= 0 {
+		pc.FetchWorkers = 1
+	}
+	if pc.AnalyzeWorkers <= 0 {
+		pc.AnalyzeWorkers = 1
+	}
+	if pc.InvertWorkers <= 0 {
+		pc.InvertWorkers = 1
+	}
+	if pc.Buffer <= 0 {
+		pc.Buffer = 1
+	}
+	if pc.BatchSize <= 0 {
+		pc.BatchSize = 1
+	}
+}
+
+// 单个阶段的统计信息
+type StageMetrics struct {
+	Name    string
+	Workers int
+	In      int64         // 接收的条目数
+	Out     int64         // 发往下游的条目数
+	Errors  int64         // 出错的条目数
+	Busy    time.Duration // 处理耗时的累计
+	Blocked time.Duration // 等待下游的累计，数值大说明下游是瓶颈
+}
+
+type stageCounter struct {
+	name    string
+	workers int
+	in      int64
+	out     int64
+	errors  int64
+	busy    int64
+	blocked int64
+}
+
+func (sc *stageCounter) snapshot() StageMetrics {
+	return StageMetrics{
+		Name:    sc.name,
+		Workers: sc.workers,
+		In:      atomic.LoadInt64(&sc.in),
+		Out:     atomic.LoadInt64(&sc.out),
+		Errors:  atomic.LoadInt64(&sc.errors),
+		Busy:    time.Duration(atomic.LoadInt64(&sc.busy)),
+		Blocked: time.Duration(atomic.LoadInt64(&sc.blocked)),
+	}
+}
+
+func (sc *stageCounter) work(since time.Time) {
+	atomic.AddInt64(&sc.busy, int64(time.Since(since)))
+}
+
+// 跳过该文档的所有字段，不再发往下游
+var errSkip = errors.New("skip document")
+
+// 流水线中流转的单篇文档
+type docItem struct {
+	id      int64
+	doc     types.Document
+	fields  []string                          // 该文档需要构建的字段
+	tokens  map[string][]types.TokenMeta      // field -> tokens
+	indexes map[string]map[string]types.Index // field -> token -> index
+}
+
+// merge阶段提交的单个字段的一批构建结果
+type FieldBatch struct {
+	Info    []BuildInfo
+	Indexes map[string]types.Index // token -> index
+}
+
+type Pipeline struct {
+	cfg      PipelineConfig
+	indexer  *Indexer
+	fields   []string
+	indexers map[string]*Indexer      // 字段单独指定的Indexer
+	skip     func(int64, string) bool // 文档的某个字段已经构建过
+
+	done    chan struct{}
+	errOnce sync.Once
+	err     error
+
+	fetch   stageCounter
+	analyze stageCounter
+	invert  stageCounter
+	merge   stageCounter
+}
+
+// 倒排时使用的文档，UUID返回内部编号
+type numberedDoc struct {
+	types.Document
+	num int64
+}
+
+func (nd *numberedDoc) UUID() int64 {
+	return nd.num
+}
+
+// idr为默认的Indexer，fields为需要构建的字段
+func NewPipeline(cfg PipelineConfig, idr *Indexer, fields ...string) *Pipeline {
+	cfg.normalize()
+	return &Pipeline{
+		cfg:      cfg,
+		indexer:  idr,
+		fields:   fields,
+		indexers: make(map[string]*Indexer),
+		done:     make(chan struct{}),
+		fetch:    stageCounter{name: "fetch", workers: cfg.FetchWorkers},
+		analyze:  stageCounter{name: "analyze", workers: cfg.AnalyzeWorkers},
+		invert:   stageCounter{name: "invert", workers: cfg.InvertWorkers},
+		merge:    stageCounter{name: "merge", workers: 1},
+	}
+}
+
+// 为字段指定单独的Indexer，需在Run之前调用
+func (p *Pipeline) UseIndexer(field string, idr *Indexer) {
+	p.indexers[field] = idr
+}
+
+// 设置跳过规则，返回true的(文档,字段)不会被构建，需在Run之前调用
+func (p *Pipeline) Skip(f func(id int64, field string) bool) {
+	p.skip = f
+}
+
+func (p *Pipeline) indexerOf(field string) *Indexer {
+	if idr, ok := p.indexers[field]; ok {
+		return idr
+	}
+	return p.indexer
+}
+
+func (p *Pipeline) fail(err error) {
+	p.errOnce.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+}
+
+// 向下游发送，记录因背压阻塞的时间；流水线终止时返回false
+func (p *Pipeline) send(sc *stageCounter, ch chan<- *docItem, item *docItem) bool {
+	start := time.Now()
+	select {
+	case ch <- item:
+		atomic.AddInt64(&sc.blocked, int64(time.Since(start)))
+		atomic.AddInt64(&sc.out, 1)
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+func (p *Pipeline) Metrics() []StageMetrics {
+	return []StageMetrics{
+		p.fetch.snapshot(),
+		p.analyze.snapshot(),
+		p.invert.snapshot(),
+		p.merge.snapshot(),
+	}
+}
+
+// 启动n个worker处理in中的条目，全部退出后关闭out
+func (p *Pipeline) stage(
+	sc *stageCounter,
+	n int,
+	in <-chan *docItem,
+	out chan<- *docItem,
+	f func(*docItem) error,
+) {
+	wg := sync.WaitGroup{}
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				var (
+					item *docItem
+					ok   bool
+				)
+				select {
+				case item, ok = <-in:
+					if !ok {
+						return
+					}
+				case <-p.done:
+					return
+				}
+				atomic.AddInt64(&sc.in, 1)
+				start := time.Now()
+				err := f(item)
+				sc.work(start)
+				if err == errSkip {
+					continue
+				}
+				if err != nil {
+					atomic.AddInt64(&sc.errors, 1)
+					p.fail(fmt.Errorf("%s document %v: %w", sc.name, item.id, err))
+					return
+				}
+				if !p.send(sc, out, item) {
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+}
+
+// ids: 待构建的文档ID, commit: merge阶段每批文档的提交函数，参数为field -> 构建结果
+func (p *Pipeline) Run(
+	ids <-chan int64,
+	doc *document.DocumentManager,
+	commit func(map[string]*FieldBatch) error,
+) error {
+	var (
+		src      = make(chan *docItem, p.cfg.Buffer)
+		fetched  = make(chan *docItem, p.cfg.Buffer)
+		analyzed = make(chan *docItem, p.cfg.Buffer)
+		inverted = make(chan *docItem, p.cfg.Buffer)
+		nums     = doc.Numbers()
+	)
+
+	go func() {
+		defer close(src)
+		for {
+			select {
+			case id, ok := <-ids:
+				if !ok {
+					return
+				}
+				select {
+				case src <- &docItem{id: id}:
+				case <-p.done:
+					return
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	p.stage(&p.fetch, p.cfg.FetchWorkers, src, fetched, func(item *docItem) error {
+		for _, f := range p.fields {
+			if p.skip == nil || !p.skip(item.id, f) {
+				item.fields = append(item.fields, f)
+			}
+		}
+		if len(item.fields) == 0 {
+			return errSkip
+		}
+		item.doc = doc.GetDocument(item.id)
+		if item.doc == nil {
+			return errors.New("document not found")
+		}
+		return nil
+	})
+
+	p.stage(&p.analyze, p.cfg.AnalyzeWorkers, fetched, analyzed, func(item *docItem) error {
+		item.tokens = make(map[string][]types.TokenMeta, len(item.fields))
+		for _, f := range item.fields {
+			tokens, err := p.indexerOf(f).Analyze(item.doc, f)
+			if err != nil {
+				return err
+			}
+			item.tokens[f] = tokens
+		}
+		return nil
+	})
+
+	p.stage(&p.invert, p.cfg.InvertWorkers, analyzed, inverted, func(item *docItem) error {
+		item.indexes = make(map[string]map[string]types.Index, len(item.fields))
+		invert := item.doc
+		if nums != nil {
+			num, ok := nums.Num(item.id)
+			if !ok {
+				return document.ErrDocNumberNotFound
+			}
+			invert = &numberedDoc{Document: item.doc, num: int64(num)}
+		}
+		for _, f := range item.fields {
+			indexes := make(map[string]types.Index)
+			for _, v := range p.indexerOf(f).Invert(invert, item.tokens[f]) {
+				if s, ok := indexes[v.Token]; ok {
+					MergeTwoIndex(s, v.Zindex)
+				} else {
+					indexes[v.Token] = v.Zindex
+				}
+			}
+			item.indexes[f] = indexes
+		}
+		item.tokens = nil
+		return nil
+	})
+
+	p.mergeStage(inverted, commit)
+
+	return p.err
+}
+
+// merge阶段只有一个协程，按批次合并倒排索引并提交
+func (p *Pipeline) mergeStage(
+	in <-chan *docItem,
+	commit func(map[string]*FieldBatch) error,
+) {
+	var (
+		docs    = 0
+		batches = make(map[string]*FieldBatch)
+	)
+	flush := func() bool {
+		if docs == 0 {
+			return true
+		}
+		start := time.Now()
+		err := commit(batches)
+		p.merge.work(start)
+		if err != nil {
+			atomic.AddInt64(&p.merge.errors, 1)
+			p.fail(err)
+			return false
+		}
+		atomic.AddInt64(&p.merge.out, int64(docs))
+		docs = 0
+		batches = make(map[string]*FieldBatch)
+		return true
+	}
+
+	for {
+		select {
+		case item, ok := <-in:
+			if !ok {
+				// 上游全部退出，可能是完成也可能是出错
+				select {
+				case <-p.done:
+				default:
+					flush()
+				}
+				return
+			}
+			atomic.AddInt64(&p.merge.in, 1)
+			start := time.Now()
+			for f, indexes := range item.indexes {
+				fb, ok := batches[f]
+				if !ok {
+					fb = &FieldBatch{
+						Info:    make([]BuildInfo, 0, p.cfg.BatchSize),
+						Indexes: make(map[string]types.Index),
+					}
+					batches[f] = fb
+				}
+				bi := BuildInfo{
+					DocID: item.doc.UUID(),
+				}
+				for k, v := range indexes {
+					bi.IndexIDS = append(bi.IndexIDS, v.UUID())
+					if s, ok := fb.Indexes[k]; ok {
+						MergeTwoIndex(s, v)
+					} else {
+						fb.Indexes[k] = v
+					}
+				}
+				fb.Info = append(fb.Info, bi)
+			}
+			docs++
+			p.merge.work(start)
+			if docs >= p.cfg.BatchSize && !flush() {
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
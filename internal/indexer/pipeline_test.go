@@ -0,0 +1,396 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fts/internal/document"
+	"fts/internal/types"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testDoc struct {
+	ID    int64
+	Title string
+	Text  string
+}
+
+func (d *testDoc) Serial() []byte           { return []byte(d.Text) }
+func (d *testDoc) Dump(b []byte)            { d.Text = string(b) }
+func (d *testDoc) UUID() int64              { return d.ID }
+func (d *testDoc) FieldExist(f string) bool { return f == "Text" || f == "Title" }
+func (d *testDoc) FieldLen(f string) int64  { return int64(len(d.FetchField(f))) }
+func (d *testDoc) FetchField(f string) []byte {
+	switch f {
+	case "Text":
+		return []byte(d.Text)
+	case "Title":
+		return []byte(d.Title)
+	}
+	return nil
+}
+
+type testDocDisk struct {
+	sync.Mutex
+	docs map[int64]types.Document
+	ids  []int64
+}
+
+func (td *testDocDisk) GetDoc(id int64) types.Document {
+	td.Lock()
+	defer td.Unlock()
+	return td.docs[id]
+}
+func (td *testDocDisk) ReadDoc(id int64) (types.Document, error) { return td.GetDoc(id), nil }
+func (td *testDocDisk) AddDoc(doc types.Document) error {
+	td.Lock()
+	defer td.Unlock()
+	td.docs[doc.UUID()] = doc
+	td.ids = append(td.ids, doc.UUID())
+	return nil
+}
+func (td *testDocDisk) EnumDocTypes() []types.Document { return []types.Document{&testDoc{}} }
+func (td *testDocDisk) EnumDocsID(doc types.Document, size int) chan int64 {
+	ch := make(chan int64, size)
+	go func() {
+		for _, v := range td.ids {
+			ch <- v
+		}
+		close(ch)
+	}()
+	return ch
+}
+func (td *testDocDisk) Docs(types.Document) int64 { return int64(len(td.ids)) }
+func (td *testDocDisk) Flush()                    {}
+func (td *testDocDisk) SaveMeta()                 {}
+
+type testToken struct{ token string }
+
+func (t *testToken) Token() string                    { return t.token }
+func (t *testToken) SetToken(s string)                { t.token = s }
+func (t *testToken) GetMeta(interface{}) interface{}  { return nil }
+func (t *testToken) SetMeta(interface{}, interface{}) {}
+func (t *testToken) Copy() types.TokenMeta            { return &testToken{token: t.token} }
+
+type testBuilder struct {
+	field string
+}
+
+func (tb *testBuilder) UseSegmentor(types.Segmentor) {}
+func (tb *testBuilder) UseFilter(types.Filter)       {}
+func (tb *testBuilder) ErrExit(error)                {}
+
+func (tb *testBuilder) Analyze(text string) (res []types.TokenMeta) {
+	for _, v := range strings.Fields(text) {
+		res = append(res, &testToken{token: v})
+	}
+	return
+}
+
+func (tb *testBuilder) Build(doc types.Document, tokens []types.TokenMeta) (res []types.IndexMeta) {
+	for _, v := range tokens {
+		res = append(res, types.IndexMeta{
+			Token: v.Token(),
+			Zindex: &testIndex{
+				Token: v.Token(),
+				field: tb.field,
+				Maps:  map[int64]int16{doc.UUID(): 1},
+			},
+		})
+	}
+	return
+}
+
+type testIndex struct {
+	Token string
+	field string
+	Maps  map[int64]int16
+}
+
+func (ti *testIndex) Serial() []byte          { return nil }
+func (ti *testIndex) Dump([]byte)             {}
+func (ti *testIndex) Field() string           { return ti.field }
+func (ti *testIndex) UUID() int64             { return int64(len(ti.Token)) }
+func (ti *testIndex) QueryDoc(id int64) int16 { return ti.Maps[id] }
+func (ti *testIndex) QueryAllDoc() types.IndexQueryResult {
+	return types.IndexQueryResult{Info: ti.Maps}
+}
+func (ti *testIndex) Merge(i interface{}) bool {
+	in, ok := i.(*testIndex)
+	if !ok || in.Token != ti.Token {
+		return false
+	}
+	for id, v := range in.Maps {
+		ti.Maps[id] += v
+	}
+	return true
+}
+
+type testIndexManager struct {
+	indexes map[string]*testIndex
+}
+
+func (tim *testIndexManager) GetIndex(token string, field string) types.Index {
+	return tim.indexes[token]
+}
+func (tim *testIndexManager) AddIndex(token string, index types.Index) {
+	if s, ok := tim.indexes[token]; ok {
+		s.Merge(index)
+		return
+	}
+	tim.indexes[token] = index.(*testIndex)
+}
+
+func newTestDocs(n int) *document.DocumentManager {
+	disk := &testDocDisk{docs: make(map[int64]types.Document)}
+	words := []string{"beijing", "tibet", "dabie", "mountains"}
+	for i := 0; i < n; i++ {
+		disk.AddDoc(&testDoc{
+			ID:    int64(i + 1),
+			Title: words[i%len(words)],
+			Text:  words[i%len(words)] + " " + words[(i+1)%len(words)],
+		})
+	}
+	return document.NewDocumentManager(64, disk)
+}
+
+func TestPipelineBuild(t *testing.T) {
+	var (
+		docs = newTestDocs(100)
+		im   = &testIndexManager{indexes: make(map[string]*testIndex)}
+		p    = NewPipeline(PipelineConfig{
+			FetchWorkers:   2,
+			AnalyzeWorkers: 4,
+			InvertWorkers:  2,
+			Buffer:         4,
+			BatchSize:      7,
+		}, NewIndexer(&testBuilder{field: "Text"}), "Text")
+		built = 0
+	)
+
+	err := p.Run(docs.ChanDocsID(&testDoc{}), docs, func(fb map[string]*FieldBatch) error {
+		built += len(fb["Text"].Info)
+		for k, v := range fb["Text"].Indexes {
+			im.AddIndex(k, v)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, built)
+	assert.Equal(t, 4, len(im.indexes))
+	// 每个词出现在一半的文档中
+	for k, v := range im.indexes {
+		assert.Equal(t, 50, len(v.Maps), k)
+	}
+
+	for _, m := range p.Metrics() {
+		t.Logf("%+v", m)
+		assert.Equal(t, int64(100), m.In, m.Name)
+	}
+}
+
+// 文档有内部编号时倒排按编号记录，构建信息仍然是外部ID
+func TestPipelineNumbers(t *testing.T) {
+	var (
+		docs  = newTestDocs(20)
+		nums  = document.NewMemDocNumbers()
+		im    = &testIndexManager{indexes: make(map[string]*testIndex)}
+		p     = NewPipeline(PipelineConfig{BatchSize: 3}, NewIndexer(&testBuilder{field: "Text"}), "Text")
+		built = []int64{}
+	)
+	// 编号与外部ID不同
+	for i := 20; i >= 1; i-- {
+		nums.Assign(int64(i))
+	}
+	assert.Nil(t, docs.UseNumbers(nums))
+
+	err := p.Run(docs.ChanDocsID(&testDoc{}), docs, func(fb map[string]*FieldBatch) error {
+		for _, bi := range fb["Text"].Info {
+			built = append(built, bi.DocID)
+		}
+		for k, v := range fb["Text"].Indexes {
+			im.AddIndex(k, v)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, docs.DumpAllDocsID(), built)
+	// 第i篇文档(ID为i+1)包含beijing时i%4为0或3
+	for num := range im.indexes["beijing"].Maps {
+		id, ok := nums.ID(uint32(num))
+		assert.True(t, ok)
+		assert.Equal(t, int64(20-num), id)
+		assert.Contains(t, []int64{0, 3}, (id-1)%4)
+	}
+	assert.Equal(t, 10, len(im.indexes["beijing"].Maps))
+}
+
+func TestPipelineError(t *testing.T) {
+	var (
+		docs = newTestDocs(100)
+		p    = NewPipeline(PipelineConfig{BatchSize: 3}, NewIndexer(&testBuilder{}), "Text")
+		fail = errors.New("disk full")
+	)
+	commits := 0
+	err := p.Run(docs.ChanDocsID(&testDoc{}), docs, func(map[string]*FieldBatch) error {
+		commits++
+		if commits == 2 {
+			return fail
+		}
+		return nil
+	})
+	assert.Equal(t, fail, err)
+	assert.Equal(t, 2, commits)
+
+	// 字段不存在时在analyze阶段出错
+	p = NewPipeline(PipelineConfig{}, NewIndexer(&testBuilder{}), "Unknown")
+	err = p.Run(docs.ChanDocsID(&testDoc{}), docs, func(map[string]*FieldBatch) error {
+		return nil
+	})
+	assert.NotNil(t, err)
+}
+
+func TestPipelineMultiField(t *testing.T) {
+	var (
+		docs  = newTestDocs(100)
+		title = &testIndexManager{indexes: make(map[string]*testIndex)}
+		text  = &testIndexManager{indexes: make(map[string]*testIndex)}
+		p     = NewPipeline(PipelineConfig{BatchSize: 8}, NewIndexer(&testBuilder{field: "Text"}), "Title", "Text")
+		built = map[string]int{}
+	)
+	p.UseIndexer("Title", NewIndexer(&testBuilder{field: "Title"}))
+	// 奇数文档的Text已经构建过
+	p.Skip(func(id int64, field string) bool {
+		return field == "Text" && id%2 == 1
+	})
+
+	err := p.Run(docs.ChanDocsID(&testDoc{}), docs, func(fb map[string]*FieldBatch) error {
+		for f, b := range fb {
+			built[f] += len(b.Info)
+			im := text
+			if f == "Title" {
+				im = title
+			}
+			for k, v := range b.Indexes {
+				assert.Equal(t, f, v.Field())
+				im.AddIndex(k, v)
+			}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, built["Title"])
+	assert.Equal(t, 50, built["Text"])
+	assert.Equal(t, 4, len(title.indexes))
+	for k, v := range title.indexes {
+		assert.Equal(t, 25, len(v.Maps), k)
+	}
+	for k, v := range text.indexes {
+		assert.Equal(t, 25, len(v.Maps), k)
+	}
+	// 每篇文档只读取一次
+	assert.Equal(t, int64(100), p.Metrics()[0].In)
+	assert.Equal(t, int64(100), p.Metrics()[0].Out)
+
+	// 所有字段都被跳过的文档不会进入下游
+	p = NewPipeline(PipelineConfig{}, NewIndexer(&testBuilder{field: "Text"}), "Text")
+	p.Skip(func(int64, string) bool { return true })
+	err = p.Run(docs.ChanDocsID(&testDoc{}), docs, func(map[string]*FieldBatch) error {
+		t.Fatal("nothing to commit")
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), p.Metrics()[1].In)
+}
+
+// 阶段的错误通过回调通知，并返回给Build的调用者
+func TestIndexerManagerBuildError(t *testing.T) {
+	var (
+		docs = newTestDocs(20)
+		in   = &testIndexManager{indexes: make(map[string]*testIndex)}
+		im   = NewIndexerManager(t.TempDir(), &testBuilder{field: "Text"})
+		errs = []error{}
+		info = 0
+	)
+	im.OnBuild(func(bi []BuildInfo, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return err
+		}
+		info += len(bi)
+		return nil
+	})
+	err := im.BuildIndex(&testDoc{}, "Text", docs, in)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, info)
+	assert.Equal(t, 0, len(errs))
+
+	// 字段不存在，analyze阶段出错
+	err = im.BuildIndex(&testDoc{}, "Unknown", docs, in)
+	assert.NotNil(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "analyze document"), err.Error())
+	assert.Equal(t, []error{err}, errs)
+
+	// 回调可以替换返回的错误
+	wrapped := errors.New("build aborted")
+	im.OnBuild(func(bi []BuildInfo, err error) error {
+		if err != nil {
+			return wrapped
+		}
+		return nil
+	})
+	assert.Equal(t, wrapped, im.BuildIndex(&testDoc{}, "Unknown", docs, in))
+
+	// 回调自身返回的错误不再通知回调
+	calls := 0
+	im.OnBuild(func(bi []BuildInfo, err error) error {
+		calls++
+		return wrapped
+	})
+	assert.Equal(t, wrapped, im.BuildIndex(&testDoc{}, "Title", docs, in))
+	assert.Equal(t, 1, calls)
+}
+
+// 每批追加一条元数据记录，写了一半的尾部记录在加载时丢弃，丢弃的文档重新构建
+func TestIndexerManagerMeta(t *testing.T) {
+	var (
+		root = t.TempDir()
+		docs = newTestDocs(20)
+		in   = &testIndexManager{indexes: make(map[string]*testIndex)}
+		im   = NewIndexerManager(root, &testBuilder{field: "Text"})
+		path = root + "/" + meta
+	)
+	im.SetBatchSize(7)
+	assert.Nil(t, im.BuildIndex(&testDoc{}, "Text", docs, in))
+
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, b[:len(b)-3], 0666))
+	im = NewIndexerManager(root, &testBuilder{field: "Text"})
+	assert.Equal(t, int64(14), im.built("Text"))
+	assert.Equal(t, []string{"Text"}, im.fields["testDoc"])
+	info := 0
+	im.OnBuild(func(bi []BuildInfo, err error) error {
+		info += len(bi)
+		return err
+	})
+	assert.Nil(t, im.BuildIndex(&testDoc{}, "Text", docs, in))
+	assert.Equal(t, 6, info)
+	assert.Equal(t, int64(20), NewIndexerManager(root, &testBuilder{}).built("Text"))
+
+	// 旧格式的元数据加载后改写为记录
+	buf := new(bytes.Buffer)
+	e := gob.NewEncoder(buf)
+	e.Encode(map[string][]BuildInfo{"Text": {{DocID: 1}, {DocID: 2}}})
+	e.Encode(map[string][]string{"testDoc": {"Text"}})
+	assert.Nil(t, os.WriteFile(path, buf.Bytes(), 0666))
+	assert.Equal(t, int64(2), NewIndexerManager(root, &testBuilder{}).built("Text"))
+	b, _ = os.ReadFile(path)
+	assert.True(t, bytes.HasPrefix(b, []byte(metaMagic)))
+	assert.Equal(t, int64(2), NewIndexerManager(root, &testBuilder{}).built("Text"))
+}
@@ -0,0 +1,187 @@
+package query
+
+import (
+	"fts/internal/types"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	_ types.Automaton = (*PrefixAutomaton)(nil)
+	_ types.Automaton = (*WildcardAutomaton)(nil)
+)
+
+// 前缀自动机，状态i表示已经匹配了前缀的前i个字符，len(prefix)为接受状态并吸收后续任意字符
+type PrefixAutomaton struct {
+	prefix []rune
+}
+
+func NewPrefixAutomaton(prefix string) *PrefixAutomaton {
+	return &PrefixAutomaton{
+		prefix: []rune(prefix),
+	}
+}
+
+func (pa *PrefixAutomaton) Start() int {
+	return 0
+}
+
+func (pa *PrefixAutomaton) Step(s int, r rune) int {
+	if s < 0 {
+		return -1
+	}
+	if s == len(pa.prefix) {
+		return s
+	}
+	if pa.prefix[s] != r {
+		return -1
+	}
+	return s + 1
+}
+
+func (pa *PrefixAutomaton) Accept(s int) bool {
+	return s == len(pa.prefix)
+}
+
+// 惰性确定化的DFA状态表，Step时才生成新状态并缓存转移
+type lazyDFA struct {
+	ids   map[string]int // 状态的唯一标识 -> DFA状态
+	trans []map[rune]int // DFA状态转移缓存
+}
+
+func newLazyDFA() lazyDFA {
+	return lazyDFA{
+		ids: make(map[string]int),
+	}
+}
+
+// 返回key对应的状态，bool表示是否为新建的状态
+func (ld *lazyDFA) intern(key string) (int, bool) {
+	if id, ok := ld.ids[key]; ok {
+		return id, false
+	}
+	id := len(ld.trans)
+	ld.ids[key] = id
+	ld.trans = append(ld.trans, make(map[rune]int))
+	return id, true
+}
+
+func (ld *lazyDFA) next(s int, r rune) (int, bool) {
+	n, ok := ld.trans[s][r]
+	return n, ok
+}
+
+func (ld *lazyDFA) cache(s int, r rune, n int) {
+	ld.trans[s][r] = n
+}
+
+// 通配符自动机，'*'匹配任意个字符，'?'匹配单个字符
+// 按模式串位置构造NFA，Step时惰性地把位置集合确定化为DFA状态
+type WildcardAutomaton struct {
+	lazyDFA
+	pattern []rune
+	states  [][]int // DFA状态 -> NFA位置集合
+}
+
+func NewWildcardAutomaton(pattern string) *WildcardAutomaton {
+	wa := &WildcardAutomaton{
+		lazyDFA: newLazyDFA(),
+		pattern: []rune(pattern),
+	}
+	wa.state(wa.closure([]int{0}))
+	return wa
+}
+
+// 是否包含通配符
+func IsWildcard(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?")
+}
+
+// '*'可以不匹配任何字符，直接跳到下一个位置
+func (wa *WildcardAutomaton) closure(pos []int) []int {
+	res := []int{}
+	seen := make(map[int]bool)
+	for _, p := range pos {
+		for ; !seen[p]; p++ {
+			seen[p] = true
+			res = append(res, p)
+			if p == len(wa.pattern) || wa.pattern[p] != '*' {
+				break
+			}
+		}
+	}
+	return res
+}
+
+func (wa *WildcardAutomaton) state(pos []int) int {
+	if len(pos) == 0 {
+		return -1
+	}
+	// 位置集合排序后拼接作为key
+	sorted := make([]int, len(pos))
+	copy(sorted, pos)
+	sort.Ints(sorted)
+	sb := strings.Builder{}
+	for _, v := range sorted {
+		sb.WriteString(strconv.Itoa(v))
+		sb.WriteByte(',')
+	}
+	id, fresh := wa.intern(sb.String())
+	if fresh {
+		wa.states = append(wa.states, sorted)
+	}
+	return id
+}
+
+func (wa *WildcardAutomaton) Start() int {
+	return 0
+}
+
+func (wa *WildcardAutomaton) Step(s int, r rune) int {
+	if s < 0 {
+		return -1
+	}
+	if next, ok := wa.next(s, r); ok {
+		return next
+	}
+	next := []int{}
+	for _, p := range wa.states[s] {
+		if p == len(wa.pattern) {
+			continue
+		}
+		switch wa.pattern[p] {
+		case '*':
+			next = append(next, p)
+		case '?':
+			next = append(next, p+1)
+		default:
+			if wa.pattern[p] == r {
+				next = append(next, p+1)
+			}
+		}
+	}
+	id := wa.state(wa.closure(next))
+	wa.cache(s, r, id)
+	return id
+}
+
+func (wa *WildcardAutomaton) Accept(s int) bool {
+	if s < 0 {
+		return false
+	}
+	for _, p := range wa.states[s] {
+		if p == len(wa.pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// 模式串"abc*"且没有其他通配符时，退化成前缀自动机
+func NewPatternAutomaton(pattern string) types.Automaton {
+	if strings.HasSuffix(pattern, "*") && !IsWildcard(strings.TrimRight(pattern, "*")) {
+		return NewPrefixAutomaton(strings.TrimRight(pattern, "*"))
+	}
+	return NewWildcardAutomaton(pattern)
+}
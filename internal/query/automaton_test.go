@@ -0,0 +1,155 @@
+package query
+
+import (
+	"fts/internal/types"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func run(a types.Automaton, s string) bool {
+	st := a.Start()
+	for _, r := range s {
+		if st = a.Step(st, r); st < 0 {
+			return false
+		}
+	}
+	return a.Accept(st)
+}
+
+func TestWildcardAutomaton(t *testing.T) {
+	cases := []struct {
+		pattern string
+		match   []string
+		miss    []string
+	}{
+		{"bei*", []string{"bei", "beijing", "beihai"}, []string{"be", "abei", "tibet"}},
+		{"wi?d*card", []string{"wildcard", "windcard", "wildxxcard"}, []string{"widcard", "wildcar", "wildcards"}},
+		{"*ing", []string{"ing", "beijing", "sing"}, []string{"ingx", "in"}},
+		{"a*b*c", []string{"abc", "aXbYc", "abbbcc", "acbc"}, []string{"ab", "acb"}},
+		{"北?", []string{"北京", "北海"}, []string{"北", "南京"}},
+	}
+	for _, c := range cases {
+		a := NewPatternAutomaton(c.pattern)
+		for _, v := range c.match {
+			assert.True(t, run(a, v), "%v should match %v", c.pattern, v)
+		}
+		for _, v := range c.miss {
+			assert.False(t, run(a, v), "%v shouldn't match %v", c.pattern, v)
+		}
+	}
+	_, ok := NewPatternAutomaton("bei*").(*PrefixAutomaton)
+	assert.True(t, ok)
+}
+
+func TestLevenshteinAutomaton(t *testing.T) {
+	la := NewLevenshteinAutomaton("mountians", 1, 0, true)
+	assert.Equal(t, 1, la.Match("mountains"))
+	assert.Equal(t, 0, la.Match("mountians"))
+	assert.Equal(t, 1, la.Match("mountian"))
+	assert.Equal(t, 1, la.Match("mountxians"))
+	assert.Equal(t, -1, la.Match("fountains"))
+	assert.Equal(t, -1, la.Match("tibet"))
+
+	// 不计交换时，交换相邻字符需要两次编辑
+	la = NewLevenshteinAutomaton("mountians", 1, 0, false)
+	assert.Equal(t, -1, la.Match("mountains"))
+	la = NewLevenshteinAutomaton("mountians", 2, 0, false)
+	assert.Equal(t, 2, la.Match("mountains"))
+	assert.Equal(t, 2, la.Match("fountian"))
+
+	// 前缀必须精确匹配
+	la = NewLevenshteinAutomaton("beijing", 1, 2, true)
+	assert.Equal(t, 1, la.Match("beiking"))
+	assert.Equal(t, -1, la.Match("meijing"))
+	assert.Equal(t, -1, la.Match("b"))
+
+	// 距离上限为MAX_FUZZY_DISTANCE
+	la = NewLevenshteinAutomaton("abcdef", 5, 0, true)
+	assert.Equal(t, -1, la.Match("abc"))
+
+	// 与朴素的动态规划结果一致
+	words := []string{"", "a", "ab", "ba", "abc", "acb", "bca", "北京", "京北", "abcd", "badc", "xyz"}
+	for _, w1 := range words {
+		for _, k := range []int{0, 1, 2} {
+			la := NewLevenshteinAutomaton(w1, k, 0, true)
+			for _, w2 := range words {
+				d := osa(w1, w2)
+				if d > k {
+					d = -1
+				}
+				assert.Equal(t, d, la.Match(w2), "%v %v %v", w1, w2, k)
+			}
+		}
+	}
+}
+
+func osa(s1, s2 string) int {
+	a, b := []rune(s1), []rune(s2)
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j-1] + cost
+			if d[i-1][j]+1 < d[i][j] {
+				d[i][j] = d[i-1][j] + 1
+			}
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func TestRegexpAutomaton(t *testing.T) {
+	cases := []struct {
+		pattern string
+		match   []string
+		miss    []string
+	}{
+		{"/colou?r/", []string{"color", "colour"}, []string{"colouur", "colors", "xcolor"}},
+		{"err(or)?[0-9]+", []string{"err1", "error404"}, []string{"error", "err", "erro1"}},
+		{"^a.c$", []string{"abc", "a北c"}, []string{"ac", "abcd"}},
+		{"(foo|bar)*", []string{"", "foo", "barfoo"}, []string{"fo", "foob"}},
+		{"[^a-z]+", []string{"123", "北京"}, []string{"a1"}},
+	}
+	for _, c := range cases {
+		a, err := NewRegexpAutomaton(c.pattern)
+		assert.Nil(t, err, c.pattern)
+		for _, v := range c.match {
+			assert.True(t, run(a, v), "%v should match %v", c.pattern, v)
+		}
+		for _, v := range c.miss {
+			assert.False(t, run(a, v), "%v shouldn't match %v", c.pattern, v)
+		}
+	}
+
+	_, err := NewRegexpAutomaton("a{1,1000}")
+	assert.ErrorIs(t, err, ErrRegexpTooComplex)
+	_, err = NewRegexpAutomaton(`\bfoo`)
+	assert.ErrorIs(t, err, ErrRegexpNotSupport)
+	_, err = NewRegexpAutomaton("(")
+	assert.NotNil(t, err)
+
+	// 状态数超过限制时剪枝
+	old := REGEXP_MAX_STATES
+	REGEXP_MAX_STATES = 3
+	defer func() { REGEXP_MAX_STATES = old }()
+	a, _ := NewRegexpAutomaton("abcdef")
+	assert.False(t, run(a, "abcdef"))
+	assert.True(t, a.Exceeded())
+}
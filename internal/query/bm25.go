@@ -1,9 +1,10 @@
 package query
 
 import (
+	"fmt"
 	"fts/internal/types"
 	"math"
-	"strconv"
+	"sort"
 	"strings"
 )
 
@@ -24,6 +25,7 @@ func NewBM25Ranker(k1 float32, k2 float32, b float32) *BM25Ranker {
 // 完成BM25算法接口
 // l token -> ids
 // t token ->
+// 每个token组合的得分为组合中各文档得分的中位数，文档按得分降序
 func (bm *BM25Ranker) Rank(
 	field string, //字段名
 	l map[string][]types.Document, // token列表打开的文档
@@ -33,63 +35,162 @@ func (bm *BM25Ranker) Rank(
 ) []types.RankResult {
 	var (
 		result = make([]types.RankResult, 0)
+		avglen = avgFieldLen(field, open)
 	)
-	avglen := 0.0
-	for _, v := range open {
-		avglen += float64(v.FieldLen(field))
-	}
 	for key, docs := range l {
-		//todo
+		if len(docs) == 0 {
+			continue
+		}
 		var (
-			N       = len(open)
-			scores  = make([]float64, 0)
-			doms    = make([]types.Document, 0)
-			qscores = 0.0 // 子query在全token中的得分，一般是打开文档的得分均值
-			tokens  = strings.Split(key, prefix)
+			tokens = splitTokens(key)
+			scores = make([]float64, len(docs))
+			order  = make([]int, len(docs))
+			doms   = make([]types.Document, len(docs))
 		)
-		for _, d := range docs {
-			var qdscores = 0.0 // 子query在对于某个文档的相似性评估结果
-			for _, v := range tokens {
-				var qi int
-				if prefix == "&" {
-					qi = len(v)
-				} else {
-					qi = len(t[v].Maps)
-				}
-				idf := math.Log((float64(N-qi) + 0.5) / (float64(qi) + 0.5))
-
-				K := bm.k1 * (1 - bm.b + bm.b*float32(d.FieldLen(field))/float32(avglen))
-				xid, _ := strconv.ParseInt(v, 10, 64)
-				fi := float64(t[v].Maps[xid])
-				R := fi*float64(bm.k1) + fi/fi + float64(K)
-				qdscores += idf * R
-			}
-			var idx = 0
-			for ; idx < len(scores); idx++ {
-				if scores[idx] < qdscores {
-					break
-				}
-			}
-			if idx != len(scores) {
-				scores = append(scores[:idx], append([]float64{qdscores}, scores[idx+1:]...)...)
-				doms = append(doms[:idx], append([]types.Document{d}, doms[idx+1:]...)...)
-			} else {
-				scores = append(scores, qdscores)
-				doms = append(doms, d)
-			}
+		for i, d := range docs {
+			scores[i], _ = bm.score(field, tokens, t, d.UUID(), float64(d.FieldLen(field)), len(open), avglen, false)
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+		for i, o := range order {
+			doms[i] = docs[o]
 		}
-
-		mid := len(scores) / 2
-		qscores = scores[mid]
 
 		result = append(result, types.RankResult{
 			Token:  key,
 			Doc:    doms,
-			Scores: qscores,
+			Scores: scores[order[len(order)/2]],
 		})
-
-		qscores = 0.0
 	}
 
 	return result
 }
+
+// 文档id在token组合中的得分的组成，与Rank的计算相同，统计量与Rank打开的文档一致时得分相同
+func (bm *BM25Ranker) Explain(
+	field string,
+	key string,
+	t map[string]types.Pair,
+	stats types.FieldStats,
+	id int64,
+) *types.Explanation {
+	_, exp := bm.score(field, splitTokens(key), t, id, float64(stats.Lens[id]), stats.Docs, stats.AvgLen, true)
+	return exp
+}
+
+// 文档id在token组合中的得分，与Explain的Value相同，按统计量排序时使用
+func (bm *BM25Ranker) Score(
+	field string,
+	key string,
+	t map[string]types.Pair,
+	stats types.FieldStats,
+	id int64,
+) float64 {
+	score, _ := bm.score(field, splitTokens(key), t, id, float64(stats.Lens[id]), stats.Docs, stats.AvgLen, false)
+	return score
+}
+
+// 打开的文档的统计量，与Rank使用的相同
+func DocStats(field string, open map[int64]types.Document) types.FieldStats {
+	stats := types.FieldStats{
+		Docs:   len(open),
+		AvgLen: avgFieldLen(field, open),
+		Lens:   make(map[int64]int64, len(open)),
+	}
+	for id, d := range open {
+		stats.Lens[id] = d.FieldLen(field)
+	}
+	return stats
+}
+
+// 各查询的token组合都以"|"连接，prefix只区分与/或
+func splitTokens(key string) []string {
+	return strings.Split(key, "|")
+}
+
+// 打开的文档中字段的平均长度
+func avgFieldLen(field string, open map[int64]types.Document) float64 {
+	if len(open) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, v := range open {
+		total += float64(v.FieldLen(field))
+	}
+	return total / float64(len(open))
+}
+
+// 文档对各token的得分之和，每项为 boost * idf * tf
+// idf = ln(1 + (N - n + 0.5) / (n + 0.5))，N为打开的文档数，n为包含token的文档数
+// tf = f * (k1 + 1) / (f + k1 * (1 - b + b * dl / avgdl))，f为词频，dl为字段长度
+// explain为true时同时返回得分的组成
+func (bm *BM25Ranker) score(
+	field string,
+	tokens []string,
+	t map[string]types.Pair,
+	id int64,
+	dl float64,
+	N int,
+	avglen float64,
+	explain bool,
+) (float64, *types.Explanation) {
+	var (
+		k1    = float64(bm.k1)
+		b     = float64(bm.b)
+		total = 0.0
+		exp   *types.Explanation
+	)
+	if explain {
+		exp = &types.Explanation{Description: fmt.Sprintf("score(doc=%d, field=%s), sum of:", id, field)}
+	}
+	for _, v := range tokens {
+		p := t[v]
+		n := p.DocFreq
+		if n <= 0 {
+			n = int64(len(p.Maps))
+		}
+		idf := math.Log(1 + (float64(N)-float64(n)+0.5)/(float64(n)+0.5))
+
+		norm := 1.0
+		if avglen > 0 {
+			norm = 1 - b + b*dl/avglen
+		}
+		f := float64(p.Maps[id])
+		tf := 0.0
+		if f > 0 {
+			tf = f * (k1 + 1) / (f + k1*norm)
+		}
+		w := p.Weight
+		if w == 0 {
+			w = 1
+		}
+		total += w * idf * tf
+		if !explain {
+			continue
+		}
+		exp.Details = append(exp.Details, &types.Explanation{
+			Value:       w * idf * tf,
+			Description: fmt.Sprintf("weight(%s:%s), product of:", field, v),
+			Details: []*types.Explanation{
+				{Value: w, Description: "boost"},
+				{Value: idf, Description: "idf, ln(1 + (N - n + 0.5) / (n + 0.5)) from:", Details: []*types.Explanation{
+					{Value: float64(n), Description: "n, number of documents containing term"},
+					{Value: float64(N), Description: "N, number of matched documents"},
+				}},
+				{Value: tf, Description: "tf, freq * (k1 + 1) / (freq + k1 * norm) from:", Details: []*types.Explanation{
+					{Value: f, Description: "freq, occurrences of term within document"},
+					{Value: k1, Description: "k1, term saturation parameter"},
+					{Value: norm, Description: "norm, length norm 1 - b + b * dl / avgdl from:", Details: []*types.Explanation{
+						{Value: b, Description: "b, length normalization parameter"},
+						{Value: dl, Description: "dl, length of field"},
+						{Value: avglen, Description: "avgdl, average length of field in matched documents"},
+					}},
+				}},
+			},
+		})
+	}
+	if explain {
+		exp.Value = total
+	}
+	return total, exp
+}
@@ -0,0 +1,138 @@
+package query
+
+import (
+	"fts/internal/types"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testDoc struct {
+	id  int64
+	len int64
+}
+
+func (d *testDoc) Serial() []byte           { return nil }
+func (d *testDoc) Dump([]byte)              {}
+func (d *testDoc) UUID() int64              { return d.id }
+func (d *testDoc) FieldExist(string) bool   { return true }
+func (d *testDoc) FieldLen(string) int64    { return d.len }
+func (d *testDoc) FetchField(string) []byte { return nil }
+
+func TestBM25Explain(t *testing.T) {
+	docs := []types.Document{&testDoc{1, 10}, &testDoc{2, 40}, &testDoc{3, 20}}
+	open := map[int64]types.Document{}
+	for _, d := range docs {
+		open[d.UUID()] = d
+	}
+	infos := map[string]types.Pair{
+		"beijing": {Maps: map[int64]int16{1: 3, 2: 1, 3: 2}},
+		"tibet":   {Maps: map[int64]int16{2: 4}, Weight: 2},
+	}
+	bm := NewBM25Ranker(1.2, 0, 0.75)
+	res := bm.Rank("Text", map[string][]types.Document{
+		"beijing":       docs,
+		"beijing|tibet": {docs[1]},
+	}, infos, open, "|")
+	stats := DocStats("Text", open)
+	assert.Equal(t, 2, len(res))
+
+	for _, r := range res {
+		assert.False(t, math.IsNaN(r.Scores), r.Token)
+		// 组合内按得分降序，得分是中位数
+		prev := math.Inf(1)
+		for _, d := range r.Doc {
+			exp := bm.Explain("Text", r.Token, infos, stats, d.UUID())
+			assert.False(t, math.IsNaN(exp.Value))
+			assert.Equal(t, exp.Value, bm.Score("Text", r.Token, infos, stats, d.UUID()))
+			assert.LessOrEqual(t, exp.Value, prev)
+			prev = exp.Value
+		}
+		mid := bm.Explain("Text", r.Token, infos, stats, r.Doc[len(r.Doc)/2].UUID())
+		assert.InDelta(t, r.Scores, mid.Value, 1e-9, r.Token)
+	}
+
+	// 每个词项的得分为boost*idf*tf，各项之和为总分
+	exp := bm.Explain("Text", "beijing|tibet", infos, stats, docs[1].UUID())
+	assert.Equal(t, 2, len(exp.Details))
+	sum := 0.0
+	for _, term := range exp.Details {
+		assert.Equal(t, 3, len(term.Details))
+		assert.InDelta(t, term.Value, term.Details[0].Value*term.Details[1].Value*term.Details[2].Value, 1e-9)
+		sum += term.Value
+	}
+	assert.InDelta(t, exp.Value, sum, 1e-9)
+	assert.Equal(t, 2.0, exp.Details[1].Details[0].Value)
+	assert.True(t, strings.Contains(exp.String(), "weight(Text:tibet)"))
+	assert.True(t, strings.Contains(exp.String(), "\n    "))
+
+	// 不包含词项的文档该项得分为0
+	exp = bm.Explain("Text", "tibet", infos, stats, docs[0].UUID())
+	assert.Equal(t, 0.0, exp.Value)
+}
+
+// 按BM25排序token组合中的文档，返回文档id与组合的得分
+func rankIDs(bm *BM25Ranker, docs []types.Document, infos map[string]types.Pair, key string, prefix string) ([]int64, float64) {
+	open := map[int64]types.Document{}
+	for _, d := range docs {
+		open[d.UUID()] = d
+	}
+	res := bm.Rank("Text", map[string][]types.Document{key: docs}, infos, open, prefix)
+	ids := []int64{}
+	for _, d := range res[0].Doc {
+		ids = append(ids, d.UUID())
+	}
+	return ids, res[0].Scores
+}
+
+// 修正前的Rank：词频按token而不是文档id查找，tf项中的f/f为0/0，得分都是NaN；
+// 平均长度没有除以文档数；与查询用token的长度作为文档数；组合内插入时覆盖已有的文档
+func TestBM25Ranking(t *testing.T) {
+	bm := NewBM25Ranker(1.2, 0, 0.75)
+
+	// 词频高的在前，修正前得分为NaN，顺序不确定
+	docs := []types.Document{&testDoc{1, 10}, &testDoc{2, 10}, &testDoc{3, 10}}
+	ids, score := rankIDs(bm, docs, map[string]types.Pair{
+		"beijing": {Maps: map[int64]int16{1: 1, 2: 3, 3: 2}},
+	}, "beijing", "|")
+	assert.Equal(t, []int64{2, 3, 1}, ids)
+	assert.False(t, math.IsNaN(score))
+
+	// 词频相同时短的字段在前，修正前平均长度是总长度，长度几乎不影响得分
+	docs = []types.Document{&testDoc{1, 5}, &testDoc{2, 50}, &testDoc{3, 20}}
+	ids, _ = rankIDs(bm, docs, map[string]types.Pair{
+		"beijing": {Maps: map[int64]int16{1: 1, 2: 1, 3: 1}},
+	}, "beijing", "|")
+	assert.Equal(t, []int64{1, 3, 2}, ids)
+
+	// 组合中的文档全部保留，修正前插入到中间时覆盖了后一个文档
+	docs = []types.Document{}
+	maps := map[int64]int16{}
+	for i := int64(1); i <= 6; i++ {
+		docs = append(docs, &testDoc{i, 10})
+		maps[i] = int16(i % 4)
+	}
+	ids, _ = rankIDs(bm, docs, map[string]types.Pair{"beijing": {Maps: maps}}, "beijing", "|")
+	assert.ElementsMatch(t, []int64{1, 2, 3, 4, 5, 6}, ids)
+	assert.Equal(t, []int64{3, 2, 6, 1, 5, 4}, ids)
+
+	// 稀有的词项得分高；与查询同样按文档数计算idf，修正前用token的长度
+	docs = []types.Document{&testDoc{1, 10}, &testDoc{2, 10}, &testDoc{3, 10}, &testDoc{4, 10}}
+	infos := map[string]types.Pair{
+		"beijing": {Maps: map[int64]int16{1: 1, 2: 1, 3: 1}},
+		"tibet":   {Maps: map[int64]int16{4: 1}},
+	}
+	or, _ := rankIDs(bm, docs, infos, "beijing|tibet", "|")
+	and, _ := rankIDs(bm, docs, infos, "beijing|tibet", "&")
+	assert.Equal(t, int64(4), or[0])
+	assert.Equal(t, or, and)
+
+	// 一个文档、平均长度、词频为1时得分为idf = ln(1 + 0.5/1.5)，权重按倍数计入
+	docs = []types.Document{&testDoc{1, 10}}
+	_, score = rankIDs(bm, docs, map[string]types.Pair{"beijing": {Maps: map[int64]int16{1: 1}}}, "beijing", "|")
+	assert.InDelta(t, math.Log(4.0/3), score, 1e-9)
+	_, score = rankIDs(bm, docs, map[string]types.Pair{"beijing": {Maps: map[int64]int16{1: 1}, Weight: 2}}, "beijing", "|")
+	assert.InDelta(t, 2*math.Log(4.0/3), score, 1e-9)
+}
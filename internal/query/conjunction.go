@@ -0,0 +1,112 @@
+package query
+
+import (
+	"fts/internal/types"
+	"sort"
+)
+
+// 有序数组上的倒排迭代器，用于没有实现types.PostingsIndex的索引
+type sliceIterator struct {
+	ids  []int64
+	info map[int64]int16
+	pos  int
+}
+
+func NewSliceIterator(result types.IndexQueryResult) types.PostingsIterator {
+	return &sliceIterator{
+		ids:  result.Ids,
+		info: result.Info,
+		pos:  -1,
+	}
+}
+
+func (si *sliceIterator) Next() bool {
+	if si.pos < len(si.ids) {
+		si.pos++
+	}
+	return si.pos < len(si.ids)
+}
+
+func (si *sliceIterator) Advance(target int64) bool {
+	if si.pos < 0 {
+		si.pos = 0
+	}
+	if si.pos >= len(si.ids) {
+		return false
+	}
+	if si.ids[si.pos] >= target {
+		return true
+	}
+	// 倍增确定范围后二分
+	lo, step := si.pos, 1
+	for lo+step < len(si.ids) && si.ids[lo+step] < target {
+		lo += step
+		step <<= 1
+	}
+	hi := lo + step
+	if hi > len(si.ids) {
+		hi = len(si.ids)
+	}
+	si.pos = lo + sort.Search(hi-lo, func(i int) bool { return si.ids[lo+i] >= target })
+	return si.pos < len(si.ids)
+}
+
+func (si *sliceIterator) Doc() int64 {
+	return si.ids[si.pos]
+}
+
+func (si *sliceIterator) Freq() int16 {
+	return si.info[si.ids[si.pos]]
+}
+
+func (si *sliceIterator) Cost() int64 {
+	return int64(len(si.ids))
+}
+
+// 索引实现了types.PostingsIndex时按块读取，否则取出全部倒排
+func Postings(index types.Index) types.PostingsIterator {
+	if pi, ok := index.(types.PostingsIndex); ok {
+		return pi.Postings()
+	}
+	return NewSliceIterator(index.QueryAllDoc())
+}
+
+// 蛙跳求交集：以代价最小的迭代器领跑，其余迭代器Advance到领跑的文档，
+// 遇到更大的文档时领跑者跳过去，所有迭代器停在同一文档时调用collect，
+// collect中可以读取各迭代器的Freq
+func Conjunction(its []types.PostingsIterator, collect func(int64)) {
+	if len(its) == 0 {
+		return
+	}
+	sorted := append([]types.PostingsIterator{}, its...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Cost() < sorted[j].Cost() })
+	lead, others := sorted[0], sorted[1:]
+	if !lead.Next() {
+		return
+	}
+	target := lead.Doc()
+	for {
+		matched := true
+		for _, it := range others {
+			if !it.Advance(target) {
+				return
+			}
+			if doc := it.Doc(); doc > target {
+				if !lead.Advance(doc) {
+					return
+				}
+				target = lead.Doc()
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		collect(target)
+		if !lead.Next() {
+			return
+		}
+		target = lead.Doc()
+	}
+}
@@ -0,0 +1,215 @@
+package query
+
+import (
+	"fts/internal/bitmap"
+	"fts/internal/codec"
+	"fts/internal/common"
+	"fts/internal/types"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 倒排按块编码的索引
+type testPostingsIndex struct {
+	testIndex
+	data    []byte
+	readers []*codec.PostingsReader
+	all     int // QueryAllDoc的调用次数
+}
+
+func newTestPostingsIndex(ids []int64) *testPostingsIndex {
+	data, _ := codec.EncodePostings(ids, make([]int16, len(ids)))
+	return &testPostingsIndex{testIndex: testIndex{ids: ids}, data: data}
+}
+
+func (ti *testPostingsIndex) Postings() types.PostingsIterator {
+	pr, _ := codec.NewPostingsReader(ti.data)
+	ti.readers = append(ti.readers, pr)
+	return pr
+}
+
+func (ti *testPostingsIndex) QueryAllDoc() types.IndexQueryResult {
+	ti.all++
+	return ti.testIndex.QueryAllDoc()
+}
+
+func randomIds(r *rand.Rand, n int, max int64) []int64 {
+	set := make(map[int64]bool)
+	for len(set) < n {
+		set[r.Int63n(max)] = true
+	}
+	ids := make([]int64, 0, n)
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestConjunction(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		lists := [][]int64{
+			randomIds(r, 1+r.Intn(50), 2000),
+			randomIds(r, 1+r.Intn(1000), 2000),
+			randomIds(r, 1+r.Intn(1500), 2000),
+		}
+		expect := []int64{}
+		for i, v := range lists {
+			if i == 0 {
+				expect = v
+				continue
+			}
+			expect = common.CommonSubset(expect, v)
+		}
+		its := []types.PostingsIterator{}
+		for i, v := range lists {
+			if i%2 == 0 {
+				its = append(its, NewSliceIterator(types.IndexQueryResult{Ids: v}))
+			} else {
+				its = append(its, newTestPostingsIndex(v).Postings())
+			}
+		}
+		get := []int64{}
+		Conjunction(its, func(doc int64) { get = append(get, doc) })
+		assert.Equal(t, expect, get, "round %d", round)
+	}
+
+	// rare AND common只解码common的一小部分块
+	rare := newTestPostingsIndex([]int64{100, 50000, 99000})
+	commonIds := make([]int64, 100000)
+	for i := range commonIds {
+		commonIds[i] = int64(i)
+	}
+	frequent := newTestPostingsIndex(commonIds)
+	get := []int64{}
+	Conjunction([]types.PostingsIterator{frequent.Postings(), rare.Postings()}, func(doc int64) { get = append(get, doc) })
+	assert.Equal(t, []int64{100, 50000, 99000}, get)
+	assert.LessOrEqual(t, frequent.readers[0].Decoded(), 3)
+}
+
+func TestAndQuery(t *testing.T) {
+	qb := NewQueryBuilder(&testTokenizer{}, "Text")
+	qb.SetIndexManager(postingsDict{
+		"beijing":  newTestPostingsIndex([]int64{1, 2, 5, 9}),
+		"mountain": newTestPostingsIndex([]int64{2, 4, 5}),
+		"tibet":    newTestPostingsIndex([]int64{7}),
+	})
+
+	res, infos, docs, _, tokens := qb.queryA("Beijing mountain beijing", nil)
+	assert.Equal(t, []int64{2, 5}, docs)
+	assert.Equal(t, []string{"beijing", "mountain"}, tokens)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, []int64{2, 5}, res[0].Docs)
+	// 只保留命中文档的词频，文档数来自倒排
+	assert.Equal(t, 2, len(infos["beijing"].Maps))
+	assert.Equal(t, int64(4), infos["beijing"].DocFreq)
+
+	_, _, docs, _, _ = qb.queryA("beijing tibet", nil)
+	assert.Empty(t, docs)
+	res, _, docs, _, _ = qb.queryA("beijing nowhere", nil)
+	assert.Empty(t, docs)
+	assert.Empty(t, res)
+}
+
+func TestQueryFilter(t *testing.T) {
+	qb := NewQueryBuilder(&testTokenizer{}, "Text")
+	qb.SetIndexManager(postingsDict{
+		"beijing":  newTestPostingsIndex([]int64{1, 2, 5, 9}),
+		"mountain": newTestPostingsIndex([]int64{2, 4, 5}),
+	})
+
+	res, infos, docs, _, tokens := qb.QueryFilter("beijing mountain", types.AT_AND, bitmap.Of(1, 5, 7))
+	assert.Equal(t, []int64{5}, docs)
+	assert.Equal(t, []int64{5}, res[0].Docs)
+	// 过滤条件不是词项
+	assert.Equal(t, []string{"beijing", "mountain"}, tokens)
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, int64(4), infos["beijing"].DocFreq)
+
+	_, _, docs, _, _ = qb.QueryFilter("beijing mountain", types.AT_AND, nil)
+	assert.Empty(t, docs)
+
+	res, _, docs, _, _ = qb.QueryFilter("beijing mountain", types.AT_OR, bitmap.Of(1, 4, 7))
+	sort.Slice(docs, func(i, j int) bool { return docs[i] < docs[j] })
+	assert.Equal(t, []int64{1, 4}, docs)
+	assert.Equal(t, 1, len(res))
+	assert.ElementsMatch(t, []int64{1, 4}, res[0].Docs)
+}
+
+// 各级别都在遍历倒排时过滤，词项的文档数取过滤前的值
+func TestQueryFilterLevels(t *testing.T) {
+	dict := postingsDict{
+		"beijing":  newTestPostingsIndex([]int64{1, 2, 5, 9}),
+		"beihai":   newTestPostingsIndex([]int64{3, 9}),
+		"mountain": newTestPostingsIndex([]int64{2, 4, 5}),
+	}
+	qb := NewQueryBuilder(&testTokenizer{}, "Text")
+	qb.SetIndexManager(dict)
+	filter := bitmap.Of(2, 3, 4)
+
+	for _, c := range []struct {
+		text  string
+		level types.QueryLevel
+		args  []any
+		docs  []int64
+		all   bool // 按CONSTANT_SCORE打分，需要取出全部倒排
+	}{
+		{"beijing mountain", types.AT_OR, nil, []int64{2, 4}, false},
+		{"beijing mountain", types.AT_AND, nil, []int64{2}, false},
+		{"beijing mountain beihai", types.AT_LEAST, []any{false, true, 0.5}, []int64{2, 3, 4}, false},
+		{"beijnig", types.AT_FUZZY, []any{1, 0}, []int64{2}, false},
+		{"bei*", types.AT_WILDCARD, nil, []int64{2, 3}, true},
+		{"/bei.*/", types.AT_REGEXP, nil, []int64{2, 3}, true},
+	} {
+		for _, v := range dict {
+			v.all = 0
+		}
+		res, infos, docs, _, _ := qb.QueryFilter(c.text, c.level, filter, c.args...)
+		sort.Slice(docs, func(i, j int) bool { return docs[i] < docs[j] })
+		assert.Equal(t, c.docs, docs, c.text)
+		for _, r := range res {
+			assert.NotEmpty(t, r.Docs, c.text)
+			assert.Subset(t, c.docs, r.Docs, c.text)
+		}
+		for token, info := range infos {
+			if i, ok := dict[token]; ok {
+				assert.Equal(t, int64(len(i.ids)), info.DocFreq, token)
+			}
+		}
+		if c.all {
+			// 文档数是过滤前的并集大小
+			assert.Equal(t, int64(5), infos[c.text].DocFreq)
+			continue
+		}
+		for token, v := range dict {
+			assert.Equal(t, 0, v.all, "%v %v", c.text, token)
+		}
+	}
+
+	// 没有文档通过过滤时结果为空
+	res, _, docs, _, _ := qb.QueryFilter("beijing mountain", types.AT_OR, bitmap.Of(7))
+	assert.Empty(t, res)
+	assert.Empty(t, docs)
+}
+
+type postingsDict map[string]*testPostingsIndex
+
+func (pd postingsDict) GetIndex(token string, field string) types.Index {
+	if i, ok := pd[token]; ok {
+		return i
+	}
+	return nil
+}
+func (pd postingsDict) AddIndex(string, types.Index) {}
+
+func (pd postingsDict) Terms(field string, a types.Automaton, max int) ([]string, bool) {
+	td := testDict{}
+	for k := range pd {
+		td[k] = nil
+	}
+	return td.Terms(field, a, max)
+}
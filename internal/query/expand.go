@@ -0,0 +1,165 @@
+package query
+
+import (
+	"fts/internal/common"
+	"fts/internal/types"
+	"strings"
+	"unicode/utf8"
+)
+
+// 多词项查询(前缀、通配符等)展开后的打分方式
+type Rewrite uint8
+
+const (
+	CONSTANT_SCORE Rewrite = iota // 命中的文档同分，查询整体视作一个词项
+	SCORING_OR                    // 改写成展开词项的OR查询，按各词项分别打分
+)
+
+const DEFAULT_MAX_EXPANSIONS = 128
+
+// n<=0表示不限制展开数量
+func (eq *QueryBuilder) SetMaxExpansions(n int) {
+	eq.maxExpansions = n
+}
+
+func (eq *QueryBuilder) SetRewrite(r Rewrite) {
+	eq.rewrite = r
+}
+
+// 在词典上枚举自动机接受的词项，IndexManager不支持枚举时返回空
+func (eq *QueryBuilder) expandTerms(a types.Automaton) []string {
+	td, ok := eq.imanager.(types.TermDictionary)
+	if !ok {
+		common.DWARN("index manager can't enumerate terms")
+		return nil
+	}
+	terms, truncated := td.Terms(eq.field, a, eq.maxExpansions)
+	if truncated {
+		common.DWARN("term expansion truncated to %v terms", eq.maxExpansions)
+	}
+	return terms
+}
+
+// 前缀/通配符查询，例如 "bei*" "wi?d*card"
+func (eq *QueryBuilder) queryW(pattern string, filter types.DocFilter) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	return eq.queryTerms(pattern, eq.expandTerms(NewPatternAutomaton(pattern)), eq.rewrite, nil, filter)
+}
+
+// 正则查询，例如 "/colou?r/"，模式串不合法或过于复杂时返回空
+func (eq *QueryBuilder) queryR(pattern string, filter types.DocFilter) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	ra, err := NewRegexpAutomaton(pattern)
+	if err != nil {
+		common.DWARN("regexp %v: %v", pattern, err)
+		return nil, nil, nil, "|", nil
+	}
+	terms := eq.expandTerms(ra)
+	if ra.Exceeded() {
+		common.DWARN("regexp %v exceeded %v states, result may be incomplete", pattern, REGEXP_MAX_STATES)
+	}
+	return eq.queryTerms(pattern, terms, eq.rewrite, nil, filter)
+}
+
+// 模糊查询，args: 最大编辑距离(默认1)，需要精确匹配的前缀长度(默认0)
+// 总是改写成OR查询，词项按编辑距离降权
+func (eq *QueryBuilder) queryF(term string, filter types.DocFilter, args ...any) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	k, prefix := intArg(args, 0, 1), intArg(args, 1, 0)
+	la := NewLevenshteinAutomaton(term, k, prefix, true)
+	terms := eq.expandTerms(la)
+	weights := make(map[string]float64, len(terms))
+	for _, v := range terms {
+		weights[v] = FuzzyWeight(term, v, la.Match(v))
+	}
+	return eq.queryTerms(term, terms, SCORING_OR, weights, filter)
+}
+
+// 第i个参数，不存在或不是int时返回def
+func intArg(args []any, i int, def int) int {
+	if i >= len(args) {
+		return def
+	}
+	v, ok := args[i].(int)
+	if !ok {
+		common.DWARN("argument %v: %v(%T) is not int, use %v", i, args[i], args[i], def)
+		return def
+	}
+	return v
+}
+
+// 编辑距离为d的词项权重，距离相同时越短的词权重越低
+func FuzzyWeight(term string, token string, d int) float64 {
+	n := utf8.RuneCountInString(term)
+	if m := utf8.RuneCountInString(token); m < n {
+		n = m
+	}
+	return 1.0 - float64(d)/float64(n+1)
+}
+
+// 按rewrite组织展开后的词项，name为原始查询串，weights为各词项的权重(可为空)
+// filter不为nil时只保留其中的文档
+func (eq *QueryBuilder) queryTerms(
+	name string,
+	terms []string,
+	rewrite Rewrite,
+	weights map[string]float64,
+	filter types.DocFilter,
+) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	var (
+		infos  = make(map[string]types.Pair)
+		docs   = make([]int64, 0)
+		tokens = make([]string, 0)
+		// 常数得分需要过滤前的并集大小，合并后再过滤
+		pushdown = filter
+	)
+	if rewrite != SCORING_OR {
+		pushdown = nil
+	}
+
+	for _, v := range terms {
+		index := eq.imanager.GetIndex(v, eq.field)
+		if index == nil {
+			continue
+		}
+		result, df := termDocs(index, pushdown)
+		tokens = append(tokens, v)
+		infos[v] = types.Pair{
+			Maps:    result.Info,
+			Weight:  weights[v],
+			DocFreq: df,
+		}
+		docs = common.GetUnionSet(docs, result.Ids)
+	}
+	if len(tokens) == 0 {
+		return nil, infos, docs, "|", tokens
+	}
+
+	if rewrite == SCORING_OR {
+		result := []types.QueryReuslt{
+			{
+				Docs:   docs,
+				Tokens: strings.Join(tokens, "|"),
+			},
+		}
+		return result, infos, docs, "|", tokens
+	}
+
+	var df int64
+	if filter != nil {
+		df = int64(len(docs))
+		docs = filterIDs(docs, filter)
+	}
+	// 每篇文档都只计一次，得分与命中了哪个词项无关
+	maps := make(map[int64]int16, len(docs))
+	for _, v := range docs {
+		maps[v] = 1
+	}
+	result := []types.QueryReuslt{
+		{
+			Docs:   docs,
+			Tokens: name,
+		},
+	}
+	infos = map[string]types.Pair{
+		name: {Maps: maps, DocFreq: df},
+	}
+	return result, infos, docs, "|", []string{name}
+}
@@ -0,0 +1,201 @@
+package query
+
+import (
+	"fts/internal/types"
+	"strconv"
+	"strings"
+)
+
+var _ types.Automaton = (*LevenshteinAutomaton)(nil)
+
+// 编辑距离超过2时状态数增长很快，展开的词项也基本没有意义
+const MAX_FUZZY_DISTANCE = 2
+
+// Levenshtein自动机，接受与term编辑距离不超过k的词项
+// 前prefix个字符必须精确匹配，之后按动态规划的一行作为状态，惰性确定化
+// transpose为true时相邻字符交换算一次编辑(Damerau-Levenshtein的OSA变体)
+type LevenshteinAutomaton struct {
+	lazyDFA
+	prefix    []rune
+	term      []rune // 去掉前缀后剩余的部分
+	k         int
+	transpose bool
+	states    []levState
+}
+
+type levState struct {
+	pos  int   // 已精确匹配的前缀长度，等于len(prefix)后进入编辑距离阶段
+	row  []int // 当前行，row[j]表示已读入的串与term[:j]的编辑距离，上限k+1
+	prev []int // 上一行，用于计算交换
+	last rune  // 上一个读入的字符
+}
+
+func NewLevenshteinAutomaton(term string, k int, prefix int, transpose bool) *LevenshteinAutomaton {
+	if k < 0 {
+		k = 0
+	}
+	if k > MAX_FUZZY_DISTANCE {
+		k = MAX_FUZZY_DISTANCE
+	}
+	rs := []rune(term)
+	if prefix < 0 {
+		prefix = 0
+	}
+	if prefix > len(rs) {
+		prefix = len(rs)
+	}
+	la := &LevenshteinAutomaton{
+		lazyDFA:   newLazyDFA(),
+		prefix:    rs[:prefix],
+		term:      rs[prefix:],
+		k:         k,
+		transpose: transpose,
+	}
+	if prefix == 0 {
+		la.state(la.initial())
+	} else {
+		la.state(levState{})
+	}
+	return la
+}
+
+func (la *LevenshteinAutomaton) initial() levState {
+	row := make([]int, len(la.term)+1)
+	for j := range row {
+		row[j] = la.cap(j)
+	}
+	return levState{
+		pos: len(la.prefix),
+		row: row,
+	}
+}
+
+func (la *LevenshteinAutomaton) cap(v int) int {
+	if v > la.k+1 {
+		return la.k + 1
+	}
+	return v
+}
+
+func (la *LevenshteinAutomaton) state(st levState) int {
+	sb := strings.Builder{}
+	sb.WriteString(strconv.Itoa(st.pos))
+	sb.WriteByte('|')
+	for _, v := range st.row {
+		sb.WriteString(strconv.Itoa(v))
+		sb.WriteByte(',')
+	}
+	if la.transpose && st.row != nil {
+		sb.WriteByte('|')
+		for _, v := range st.prev {
+			sb.WriteString(strconv.Itoa(v))
+			sb.WriteByte(',')
+		}
+		sb.WriteByte('|')
+		sb.WriteRune(st.last)
+	}
+	id, fresh := la.intern(sb.String())
+	if fresh {
+		la.states = append(la.states, st)
+	}
+	return id
+}
+
+func (la *LevenshteinAutomaton) Start() int {
+	return 0
+}
+
+func (la *LevenshteinAutomaton) Step(s int, r rune) int {
+	if s < 0 {
+		return -1
+	}
+	if next, ok := la.next(s, r); ok {
+		return next
+	}
+	id := -1
+	if st, ok := la.step(la.states[s], r); ok {
+		id = la.state(st)
+	}
+	la.cache(s, r, id)
+	return id
+}
+
+func (la *LevenshteinAutomaton) step(st levState, r rune) (levState, bool) {
+	// 前缀阶段
+	if st.pos < len(la.prefix) {
+		if la.prefix[st.pos] != r {
+			return levState{}, false
+		}
+		if st.pos+1 == len(la.prefix) {
+			return la.initial(), true
+		}
+		return levState{pos: st.pos + 1}, true
+	}
+
+	row := make([]int, len(st.row))
+	row[0] = la.cap(st.row[0] + 1)
+	alive := row[0] <= la.k
+	for j := 1; j < len(row); j++ {
+		cost := 1
+		if la.term[j-1] == r {
+			cost = 0
+		}
+		v := st.row[j-1] + cost
+		if st.row[j]+1 < v {
+			v = st.row[j] + 1
+		}
+		if row[j-1]+1 < v {
+			v = row[j-1] + 1
+		}
+		if la.transpose && st.prev != nil && j >= 2 &&
+			la.term[j-1] == st.last && la.term[j-2] == r && st.prev[j-2]+1 < v {
+			v = st.prev[j-2] + 1
+		}
+		row[j] = la.cap(v)
+		if row[j] <= la.k {
+			alive = true
+		}
+	}
+	if !alive {
+		return levState{}, false
+	}
+	next := levState{
+		pos: st.pos,
+		row: row,
+	}
+	if la.transpose {
+		next.prev = st.row
+		next.last = r
+	}
+	return next, true
+}
+
+func (la *LevenshteinAutomaton) Accept(s int) bool {
+	return la.Distance(s) >= 0
+}
+
+// 状态s对应的编辑距离，不可接受时返回-1
+func (la *LevenshteinAutomaton) Distance(s int) int {
+	if s < 0 {
+		return -1
+	}
+	st := la.states[s]
+	if st.row == nil {
+		return -1
+	}
+	if d := st.row[len(st.row)-1]; d <= la.k {
+		return d
+	}
+	return -1
+}
+
+// 词项与term的编辑距离，超过k时返回-1
+func (la *LevenshteinAutomaton) Match(token string) int {
+	s := la.Start()
+	for _, r := range token {
+		if s = la.Step(s, r); s < 0 {
+			return -1
+		}
+	}
+	return la.Distance(s)
+}
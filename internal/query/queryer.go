@@ -10,8 +10,11 @@ package query
 // 	Rank(map[string][]Index) //
 // }
 import (
+	"fts/internal/bitmap"
+	"fts/internal/cache"
 	"fts/internal/common"
 	"fts/internal/types"
+	"math"
 	"strings"
 )
 
@@ -20,27 +23,54 @@ type QueryBuilder struct {
 	imanager  types.IndexManager
 	//ranker    types.Ranker
 	field string
+
+	maxExpansions int     // 多词项查询最多展开的词项数
+	rewrite       Rewrite // 多词项查询的打分方式
+
+	phonetic func(string) string // 拼写纠错时的读音归一化
+	freqs    types.Cache         // 拼写纠错时词项的文档频率
 }
 
 func NewQueryBuilder(tzr types.Tokenizer, field string) *QueryBuilder {
 	return &QueryBuilder{
-		Tokenizer: tzr,
-		field:     field,
+		Tokenizer:     tzr,
+		field:         field,
+		maxExpansions: DEFAULT_MAX_EXPANSIONS,
+		rewrite:       CONSTANT_SCORE,
+		freqs:         cache.Default(int64(SPELL_FREQ_CACHE)),
 	}
 }
 
 func (eq *QueryBuilder) Query(text string, l types.QueryLevel, args ...any) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	return eq.query(text, l, nil, args...)
+}
+
+// 在field上查询，其它与Query相同
+func (eq *QueryBuilder) QueryField(field string, text string, l types.QueryLevel, args ...any) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	fb := *eq
+	fb.field = field
+	return fb.Query(text, l, args...)
+}
+
+// filter不为nil时各级别都在遍历倒排时只保留其中的文档
+func (eq *QueryBuilder) query(text string, l types.QueryLevel, filter types.DocFilter, args ...any) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
 	if eq.Tokenizer == nil {
 		return nil, nil, nil, "", nil
 	}
 
 	switch l {
 	case types.AT_LEAST:
-		return eq.queryM(text, args[0].(bool), args[1].(bool), args[2:]...)
+		return eq.queryM(text, args[0].(bool), args[1].(bool), filter, args[2:]...)
 	case types.AT_OR:
-		return eq.queryU(text)
+		return eq.queryU(text, filter)
 	case types.AT_AND:
-		return eq.queryA(text)
+		return eq.queryA(text, filter)
+	case types.AT_WILDCARD:
+		return eq.queryW(text, filter)
+	case types.AT_FUZZY:
+		return eq.queryF(text, filter, args...)
+	case types.AT_REGEXP:
+		return eq.queryR(text, filter)
 	default:
 		return nil, nil, nil, "", nil
 	}
@@ -49,6 +79,7 @@ func (eq *QueryBuilder) Query(text string, l types.QueryLevel, args ...any) ([]t
 func (eq *QueryBuilder) queryM(text string,
 	expand bool,
 	sign bool,
+	filter types.DocFilter,
 	args ...any,
 ) ([]types.QueryReuslt,
 	map[string]types.Pair,
@@ -68,10 +99,11 @@ func (eq *QueryBuilder) queryM(text string,
 
 	for _, v := range eq.Tokenizer.Analyze(text) {
 		index := eq.imanager.GetIndex(v.Token(), eq.field)
-		result := index.QueryAllDoc()
+		result, df := termDocs(index, filter)
 		tokens = append(tokens, v.Token())
 		infos[v.Token()] = types.Pair{
-			Maps: result.Info,
+			Maps:    result.Info,
+			DocFreq: df,
 		}
 		docs = common.GetUnionSet(docs, result.Ids)
 		if _, ok := maps[v.Token()]; !ok {
@@ -142,7 +174,7 @@ func (eq *QueryBuilder) queryM(text string,
 }
 
 // all "|"
-func (eq *QueryBuilder) queryU(text string) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+func (eq *QueryBuilder) queryU(text string, filter types.DocFilter) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
 	var (
 		maps  = make(map[string][]int64)    //token 和文档的映射关系
 		infos = make(map[string]types.Pair) //文档出现的次数
@@ -154,10 +186,11 @@ func (eq *QueryBuilder) queryU(text string) ([]types.QueryReuslt, map[string]typ
 
 	for _, v := range eq.Tokenizer.Analyze(text) {
 		index := eq.imanager.GetIndex(v.Token(), eq.field)
-		result := index.QueryAllDoc()
+		result, df := termDocs(index, filter)
 		tokens = append(tokens, v.Token())
 		infos[v.Token()] = types.Pair{
-			Maps: result.Info,
+			Maps:    result.Info,
+			DocFreq: df,
 		}
 		docs = common.GetUnionSet(docs, result.Ids)
 		if _, ok := maps[v.Token()]; !ok {
@@ -169,7 +202,7 @@ func (eq *QueryBuilder) queryU(text string) ([]types.QueryReuslt, map[string]typ
 	var si []string
 	for k, v := range maps {
 		si = append(si, k)
-		id = append(id, common.GetUnionSet(id, v)...)
+		id = common.GetUnionSet(id, v)
 	}
 
 	loadmaps[strings.Join(si, "|")] = id
@@ -188,53 +221,103 @@ func (eq *QueryBuilder) queryU(text string) ([]types.QueryReuslt, map[string]typ
 	return result, infos, docs, "|", tokens
 }
 
-// all "&"
-func (eq *QueryBuilder) queryA(text string) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+// 与Query相同，但只返回filter中的文档，过滤条件不参与打分
+// 各级别都在遍历倒排时过滤：交集查询中filter作为不打分的倒排参与蛙跳；
+// 并集、至少k个、前缀/通配符/正则/模糊查询中每个词项的倒排与filter求交集后再合并，
+// 词项的文档数取过滤前的值，得分与不过滤时相同；
+// 前缀/通配符/正则查询按CONSTANT_SCORE打分时需要过滤前的并集大小，仍然取出全部倒排后裁剪
+func (eq *QueryBuilder) QueryFilter(text string, l types.QueryLevel, filter types.DocFilter, args ...any) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
+	if filter == nil {
+		filter = bitmap.New()
+	}
+	result, infos, docs, tag, tokens := eq.query(text, l, filter, args...)
+	// 去掉过滤后没有文档的组合
+	res := make([]types.QueryReuslt, 0, len(result))
+	for _, v := range result {
+		if len(v.Docs) > 0 {
+			res = append(res, v)
+		}
+	}
+	return res, infos, docs, tag, tokens
+}
+
+// 词项的文档与词频，filter不为nil时借助跳表只取出其中的文档，并返回过滤前的文档数
+// 不过滤时文档数返回0，即取len(Maps)
+func termDocs(index types.Index, filter types.DocFilter) (types.IndexQueryResult, int64) {
+	if filter == nil {
+		return index.QueryAllDoc(), 0
+	}
+	it := Postings(index)
+	res := types.IndexQueryResult{Ids: []int64{}, Info: make(map[int64]int16)}
+	Conjunction([]types.PostingsIterator{it, filter.Postings()}, func(doc int64) {
+		res.Ids = append(res.Ids, doc)
+		res.Info[doc] = it.Freq()
+	})
+	return res, it.Cost()
+}
+
+// 只保留在filter中的id
+func filterIDs(ids []int64, filter types.DocFilter) []int64 {
+	res := make([]int64, 0)
+	for _, id := range ids {
+		if id >= 0 && id <= math.MaxUint32 && filter.Contains(uint32(id)) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// all "&"，蛙跳求交集，只读取命中文档的词频，filter不为nil时只保留其中的文档
+func (eq *QueryBuilder) queryA(text string, filter types.DocFilter) ([]types.QueryReuslt, map[string]types.Pair, []int64, string, []string) {
 	var (
-		maps  = make(map[string][]int64)    //token 和文档的映射关系
-		infos = make(map[string]types.Pair) //文档出现的次数
-		docs  = make([]int64, 0)
-		//indexes  = make(map[int64]types.Index) //索引表
-		loadmaps = make(map[string][]int64) //
-		tokens   = make([]string, 0)
+		infos  = make(map[string]types.Pair) //命中文档的出现次数
+		docs   = make([]int64, 0)
+		its    = make([]types.PostingsIterator, 0)
+		tokens = make([]string, 0)
 	)
 
 	for _, v := range eq.Tokenizer.Analyze(text) {
+		if _, ok := infos[v.Token()]; ok {
+			continue
+		}
 		index := eq.imanager.GetIndex(v.Token(), eq.field)
-		result := index.QueryAllDoc()
+		if index == nil {
+			// 有词项不存在时交集为空
+			return nil, infos, docs, "|", tokens
+		}
+		it := Postings(index)
 		tokens = append(tokens, v.Token())
+		its = append(its, it)
 		infos[v.Token()] = types.Pair{
-			Maps: result.Info,
-		}
-		docs = common.GetUnionSet(docs, result.Ids)
-		if _, ok := maps[v.Token()]; !ok {
-			maps[v.Token()] = make([]int64, 0)
+			Maps:    make(map[int64]int16),
+			DocFreq: it.Cost(),
 		}
-		maps[v.Token()] = append(maps[v.Token()], result.Ids...)
 	}
-	var id []int64
-	var si []string
-	for k, v := range maps {
-		si = append(si, k)
-		id = append(id, common.GetUnionSet(id, v)...)
+	if len(its) == 0 {
+		return nil, infos, docs, "|", tokens
+	}
+	if filter != nil {
+		// 过滤条件排在词项之后，不记录词频
+		its = append(its, filter.Postings())
 	}
 
-	loadmaps[strings.Join(si, "&")] = id
-
-	// rank
-
-	result := []types.QueryReuslt{}
+	Conjunction(its, func(doc int64) {
+		docs = append(docs, doc)
+		for i, token := range tokens {
+			infos[token].Maps[doc] = its[i].Freq()
+		}
+	})
 
-	for k, v := range loadmaps {
-		result = append(result, types.QueryReuslt{
-			Docs:   v,
-			Tokens: k,
-		})
+	result := []types.QueryReuslt{
+		{
+			Docs:   docs,
+			Tokens: strings.Join(tokens, "|"),
+		},
 	}
-
 	return result, infos, docs, "|", tokens
 }
 
 func (eq *QueryBuilder) SetIndexManager(i types.IndexManager) {
 	eq.imanager = i
+	eq.freqs.Clear()
 }
@@ -0,0 +1,216 @@
+package query
+
+import (
+	"fts/internal/types"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testIndex struct {
+	ids []int64
+}
+
+func (ti *testIndex) Serial() []byte          { return nil }
+func (ti *testIndex) Dump([]byte)             {}
+func (ti *testIndex) Field() string           { return "Text" }
+func (ti *testIndex) UUID() int64             { return 0 }
+func (ti *testIndex) Merge(interface{}) bool  { return false }
+func (ti *testIndex) QueryDoc(id int64) int16 { return 1 }
+func (ti *testIndex) QueryAllDoc() types.IndexQueryResult {
+	info := make(map[int64]int16)
+	for _, v := range ti.ids {
+		info[v] = 1
+	}
+	return types.IndexQueryResult{Ids: ti.ids, Info: info}
+}
+
+// 用有序数组模拟词典
+type testDict map[string]*testIndex
+
+func (td testDict) GetIndex(token string, field string) types.Index {
+	if i, ok := td[token]; ok {
+		return i
+	}
+	return nil
+}
+func (td testDict) AddIndex(string, types.Index) {}
+func (td testDict) Terms(field string, a types.Automaton, max int) ([]string, bool) {
+	terms := []string{}
+	for k := range td {
+		terms = append(terms, k)
+	}
+	sort.Strings(terms)
+	res := []string{}
+	for _, v := range terms {
+		s := a.Start()
+		for _, r := range v {
+			if s = a.Step(s, r); s < 0 {
+				break
+			}
+		}
+		if s >= 0 && a.Accept(s) {
+			if max > 0 && len(res) >= max {
+				return res, true
+			}
+			res = append(res, v)
+		}
+	}
+	return res, false
+}
+
+type testToken struct{ token string }
+
+func (t *testToken) Token() string                    { return t.token }
+func (t *testToken) SetToken(s string)                { t.token = s }
+func (t *testToken) GetMeta(interface{}) interface{}  { return nil }
+func (t *testToken) SetMeta(interface{}, interface{}) {}
+func (t *testToken) Copy() types.TokenMeta            { return &testToken{token: t.token} }
+
+type testTokenizer struct{}
+
+func (tt *testTokenizer) UseSegmentor(types.Segmentor) {}
+func (tt *testTokenizer) UseFilter(types.Filter)       {}
+func (tt *testTokenizer) Analyze(text string) (res []types.TokenMeta) {
+	for _, v := range strings.Fields(strings.ToLower(text)) {
+		res = append(res, &testToken{token: v})
+	}
+	return
+}
+
+func newTestQueryBuilder() *QueryBuilder {
+	qb := NewQueryBuilder(&testTokenizer{}, "Text")
+	qb.SetIndexManager(testDict{
+		"beijing":   {ids: []int64{1, 2}},
+		"beihai":    {ids: []int64{3}},
+		"mountain":  {ids: []int64{2, 4}},
+		"mountains": {ids: []int64{5}},
+		"fountains": {ids: []int64{6}},
+		"tibet":     {ids: []int64{7}},
+		"北京":        {ids: []int64{8, 9}},
+	})
+	return qb
+}
+
+func TestWildcardQuery(t *testing.T) {
+	qb := newTestQueryBuilder()
+
+	res, infos, docs, _, tokens := qb.queryW("bei*", nil)
+	assert.Equal(t, []int64{1, 2, 3}, docs)
+	assert.Equal(t, []string{"bei*"}, tokens)
+	assert.Equal(t, 1, len(res))
+	assert.Equal(t, 3, len(infos["bei*"].Maps))
+
+	qb.SetRewrite(SCORING_OR)
+	res, infos, _, _, tokens = qb.queryW("?ountain*", nil)
+	assert.Equal(t, []string{"fountains", "mountain", "mountains"}, tokens)
+	assert.Equal(t, "fountains|mountain|mountains", res[0].Tokens)
+	assert.Equal(t, 3, len(infos))
+
+	qb.SetMaxExpansions(1)
+	_, _, docs, _, tokens = qb.queryW("*", nil)
+	assert.Equal(t, []string{"beihai"}, tokens)
+	assert.Equal(t, []int64{3}, docs)
+}
+
+func TestFuzzyQuery(t *testing.T) {
+	qb := newTestQueryBuilder()
+
+	_, infos, docs, _, tokens := qb.queryF("mountians", nil, 1, 0)
+	assert.Equal(t, []string{"mountains"}, tokens)
+	assert.Equal(t, []int64{5}, docs)
+	assert.InDelta(t, 0.9, infos["mountains"].Weight, 1e-9)
+
+	_, infos, docs, _, tokens = qb.queryF("mountians", nil, 2, 0)
+	assert.Equal(t, []string{"fountains", "mountain", "mountains"}, tokens)
+	assert.Equal(t, []int64{2, 4, 5, 6}, docs)
+	// 距离越远权重越低
+	assert.Less(t, infos["fountains"].Weight, infos["mountains"].Weight)
+
+	_, _, _, _, tokens = qb.queryF("mountians", nil, 2, 1)
+	assert.Equal(t, []string{"mountain", "mountains"}, tokens)
+
+	res, _, _, _, _ := qb.queryF("xyz", nil, 1, 0)
+	assert.Equal(t, 0, len(res))
+
+	// 参数类型不对时使用默认值
+	_, _, _, _, tokens = qb.Query("mountians", types.AT_FUZZY, "2", 1.5)
+	assert.Equal(t, []string{"mountains"}, tokens)
+	_, _, _, _, tokens = qb.Query("mountians", types.AT_FUZZY)
+	assert.Equal(t, []string{"mountains"}, tokens)
+}
+
+func TestSuggest(t *testing.T) {
+	qb := newTestQueryBuilder()
+
+	res := qb.Suggest("Mountians Tibet", 3)
+	assert.NotEmpty(t, res)
+	assert.Equal(t, "mountains tibet", res[0].Text)
+	assert.Equal(t, 1, res[0].Distance)
+	assert.Equal(t, int64(1), res[0].Freq)
+
+	// 距离相同时文档频率高的优先
+	res = qb.Suggest("mountainz", 3)
+	assert.Equal(t, "mountain", res[0].Text)
+	assert.Equal(t, "mountains", res[1].Text)
+
+	// 正确的查询不给出建议
+	assert.Empty(t, qb.Suggest("tibet", 3))
+	// 没有可替换的词项
+	assert.Empty(t, qb.Suggest("zzzzzz tibet", 3))
+
+	// 中文按字符计算编辑距离
+	res = qb.Suggest("北平", 3)
+	assert.Equal(t, "北京", res[0].Text)
+
+	// 读音相同的词项编辑距离记为1
+	res = qb.Suggest("背景", 3)
+	assert.Equal(t, 2, res[0].Distance)
+	qb.UsePhonetic(func(s string) string {
+		return map[string]string{"背景": "beijing", "北京": "beijing"}[s]
+	})
+	res = qb.Suggest("背景", 3)
+	assert.Equal(t, "北京", res[0].Text)
+	assert.Equal(t, 1, res[0].Distance)
+}
+
+// 文档频率只读取倒排的头部，并按词项缓存
+func TestSuggestDocFreq(t *testing.T) {
+	dict := postingsDict{
+		"mountain":  newTestPostingsIndex([]int64{2, 4}),
+		"mountains": newTestPostingsIndex([]int64{5}),
+		"fountains": newTestPostingsIndex([]int64{6}),
+	}
+	qb := NewQueryBuilder(&testTokenizer{}, "Text")
+	qb.SetIndexManager(dict)
+
+	res := qb.Suggest("mountainz", 3)
+	assert.Equal(t, "mountain", res[0].Text)
+	assert.Equal(t, int64(2), res[0].Freq)
+	for k, v := range dict {
+		assert.Equal(t, 0, v.all, k)
+		assert.LessOrEqual(t, len(v.readers), 1, k)
+	}
+	qb.Suggest("mountainz", 3)
+	assert.Equal(t, 1, len(dict["mountain"].readers))
+
+	// 索引变化后清空缓存
+	dict["mountains"] = newTestPostingsIndex([]int64{1, 3, 5})
+	qb.ClearCache()
+	res = qb.Suggest("mountainz", 3)
+	assert.Equal(t, "mountains", res[0].Text)
+}
+
+func TestRegexpQuery(t *testing.T) {
+	qb := newTestQueryBuilder()
+	qb.SetRewrite(SCORING_OR)
+
+	_, _, docs, _, tokens := qb.queryR("/[mf]ountains?/", nil)
+	assert.Equal(t, []string{"fountains", "mountain", "mountains"}, tokens)
+	assert.Equal(t, []int64{2, 4, 5, 6}, docs)
+
+	res, _, _, _, _ := qb.queryR("/(/", nil)
+	assert.Empty(t, res)
+}
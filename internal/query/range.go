@@ -0,0 +1,85 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"fts/internal/types"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidRange = errors.New("invalid range expression")
+
+// 日期值支持的格式，按顺序尝试，没有时区的按UTC解析
+var RANGE_DATE_LAYOUTS = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// 解析单个数值，整数原样返回，日期转为unix时间戳(秒)
+func ParseNumeric(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return v, nil
+	}
+	for _, layout := range RANGE_DATE_LAYOUTS {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %q is neither integer nor date", ErrInvalidRange, s)
+}
+
+// 解析范围查询 "[a TO b]"，[]为闭区间，{}为开区间，两端可以混用，"*"表示不限
+// 例如 "[2015-01-01 TO *}"、"{0 TO 100]"，区间为空时Min>Max
+func ParseRange(expr string) (types.NumericRange, error) {
+	nr := types.NumericRange{
+		Min: math.MinInt64,
+		Max: math.MaxInt64,
+	}
+	expr = strings.TrimSpace(expr)
+	if len(expr) < 2 {
+		return nr, fmt.Errorf("%w: %q", ErrInvalidRange, expr)
+	}
+	lb, rb := expr[0], expr[len(expr)-1]
+	if (lb != '[' && lb != '{') || (rb != ']' && rb != '}') {
+		return nr, fmt.Errorf("%w: %q should be enclosed by [] or {}", ErrInvalidRange, expr)
+	}
+	parts := strings.Split(expr[1:len(expr)-1], " TO ")
+	if len(parts) != 2 {
+		return nr, fmt.Errorf("%w: %q should be like [a TO b]", ErrInvalidRange, expr)
+	}
+	lo, hi := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+	if lo != "*" {
+		v, err := ParseNumeric(lo)
+		if err != nil {
+			return nr, err
+		}
+		if lb == '{' {
+			if v == math.MaxInt64 {
+				return types.NumericRange{Min: math.MaxInt64, Max: math.MinInt64}, nil
+			}
+			v++
+		}
+		nr.Min = v
+	}
+	if hi != "*" {
+		v, err := ParseNumeric(hi)
+		if err != nil {
+			return nr, err
+		}
+		if rb == '}' {
+			if v == math.MinInt64 {
+				return types.NumericRange{Min: math.MaxInt64, Max: math.MinInt64}, nil
+			}
+			v--
+		}
+		nr.Max = v
+	}
+	return nr, nil
+}
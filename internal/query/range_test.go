@@ -0,0 +1,39 @@
+package query
+
+import (
+	"fts/internal/types"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+	day := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	cases := []struct {
+		expr string
+		nr   types.NumericRange
+	}{
+		{"[1 TO 10]", types.NumericRange{Min: 1, Max: 10}},
+		{"{1 TO 10}", types.NumericRange{Min: 2, Max: 9}},
+		{"[-5 TO *]", types.NumericRange{Min: -5, Max: math.MaxInt64}},
+		{"{* TO 0]", types.NumericRange{Min: math.MinInt64, Max: 0}},
+		{"[2015-01-01 TO 2015-01-01 00:00:10]", types.NumericRange{Min: day, Max: day + 10}},
+		{" [2015-01-01T00:00:00Z TO 2015-01-02} ", types.NumericRange{Min: day, Max: day + 86399}},
+	}
+	for _, c := range cases {
+		nr, err := ParseRange(c.expr)
+		assert.Nil(t, err, c.expr)
+		assert.Equal(t, c.nr, nr, c.expr)
+	}
+
+	nr, err := ParseRange("{5 TO 6}")
+	assert.Nil(t, err)
+	assert.False(t, nr.Contains(5) || nr.Contains(6))
+
+	for _, v := range []string{"", "1 TO 2", "[1 to 2]", "[1 TO 2 TO 3]", "[a TO 2]", "(1 TO 2)"} {
+		_, err := ParseRange(v)
+		assert.ErrorIs(t, err, ErrInvalidRange, v)
+	}
+}
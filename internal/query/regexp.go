@@ -0,0 +1,200 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"fts/internal/types"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var _ types.Automaton = (*RegexpAutomaton)(nil)
+
+var (
+	ErrRegexpTooComplex = errors.New("regexp too complex")
+	ErrRegexpNotSupport = errors.New("regexp assertion not support")
+)
+
+// 正则查询的复杂度限制
+var (
+	REGEXP_MAX_LENGTH = 256   // 模式串的最大长度
+	REGEXP_MAX_REPEAT = 64    // {n,m}中m的最大值
+	REGEXP_MAX_INSTS  = 1024  // 编译后的最大指令数
+	REGEXP_MAX_STATES = 10000 // 确定化时最多生成的状态数，超过后不再展开
+)
+
+// 正则自动机，词项需要完整匹配模式串(隐含^...$)
+// 由regexp/syntax编译成NFA指令，Step时惰性确定化
+type RegexpAutomaton struct {
+	lazyDFA
+	prog     *syntax.Prog
+	states   [][]uint32 // DFA状态 -> 指令集合
+	exceeded bool       // 状态数超过限制
+}
+
+// 去掉"/colou?r/"两侧的斜杠
+func TrimRegexp(pattern string) string {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return pattern[1 : len(pattern)-1]
+	}
+	return pattern
+}
+
+func NewRegexpAutomaton(pattern string) (*RegexpAutomaton, error) {
+	pattern = TrimRegexp(pattern)
+	if len(pattern) > REGEXP_MAX_LENGTH {
+		return nil, fmt.Errorf("%w: pattern longer than %v", ErrRegexpTooComplex, REGEXP_MAX_LENGTH)
+	}
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkRegexp(re); err != nil {
+		return nil, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, err
+	}
+	if len(prog.Inst) > REGEXP_MAX_INSTS {
+		return nil, fmt.Errorf("%w: %v instructions", ErrRegexpTooComplex, len(prog.Inst))
+	}
+	ra := &RegexpAutomaton{
+		lazyDFA: newLazyDFA(),
+		prog:    prog,
+	}
+	ra.state(ra.closure([]uint32{uint32(prog.Start)}, true, false), true)
+	return ra, nil
+}
+
+// 限制重复次数，不支持单词边界等无法在词项上判断的断言
+func checkRegexp(re *syntax.Regexp) error {
+	switch re.Op {
+	case syntax.OpRepeat:
+		if re.Max > REGEXP_MAX_REPEAT || re.Min > REGEXP_MAX_REPEAT {
+			return fmt.Errorf("%w: repeat more than %v", ErrRegexpTooComplex, REGEXP_MAX_REPEAT)
+		}
+	case syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return ErrRegexpNotSupport
+	}
+	for _, v := range re.Sub {
+		if err := checkRegexp(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 沿空转移求闭包，start/end表示当前是否位于词项的开头/结尾
+func (ra *RegexpAutomaton) closure(pcs []uint32, start bool, end bool) []uint32 {
+	var (
+		res   = []uint32{}
+		seen  = make(map[uint32]bool)
+		stack = append([]uint32{}, pcs...)
+	)
+	for len(stack) > 0 {
+		pc := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[pc] {
+			continue
+		}
+		seen[pc] = true
+		inst := &ra.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstAlt, syntax.InstAltMatch:
+			stack = append(stack, inst.Out, inst.Arg)
+		case syntax.InstCapture, syntax.InstNop:
+			stack = append(stack, inst.Out)
+		case syntax.InstEmptyWidth:
+			op := syntax.EmptyOp(inst.Arg)
+			ok := true
+			if op&(syntax.EmptyBeginText|syntax.EmptyBeginLine) != 0 && !start {
+				ok = false
+			}
+			if op&(syntax.EmptyEndText|syntax.EmptyEndLine) != 0 && !end {
+				ok = false
+			}
+			if ok {
+				stack = append(stack, inst.Out)
+			} else {
+				// 保留下来，到达结尾时再判断
+				res = append(res, pc)
+			}
+		case syntax.InstFail:
+		default:
+			res = append(res, pc)
+		}
+	}
+	return res
+}
+
+func (ra *RegexpAutomaton) state(pcs []uint32, start bool) int {
+	if len(pcs) == 0 {
+		return -1
+	}
+	sort.Slice(pcs, func(i, j int) bool { return pcs[i] < pcs[j] })
+	sb := strings.Builder{}
+	if start {
+		sb.WriteByte('^')
+	}
+	for _, v := range pcs {
+		sb.WriteString(strconv.FormatUint(uint64(v), 10))
+		sb.WriteByte(',')
+	}
+	key := sb.String()
+	if _, ok := ra.ids[key]; !ok && len(ra.states) >= REGEXP_MAX_STATES {
+		ra.exceeded = true
+		return -1
+	}
+	id, fresh := ra.intern(key)
+	if fresh {
+		ra.states = append(ra.states, pcs)
+	}
+	return id
+}
+
+// 确定化时是否因状态数超限而剪枝，结果可能不完整
+func (ra *RegexpAutomaton) Exceeded() bool {
+	return ra.exceeded
+}
+
+func (ra *RegexpAutomaton) Start() int {
+	return 0
+}
+
+func (ra *RegexpAutomaton) Step(s int, r rune) int {
+	if s < 0 {
+		return -1
+	}
+	if next, ok := ra.next(s, r); ok {
+		return next
+	}
+	next := []uint32{}
+	for _, pc := range ra.states[s] {
+		inst := &ra.prog.Inst[pc]
+		switch inst.Op {
+		case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+			if inst.MatchRune(r) {
+				next = append(next, inst.Out)
+			}
+		}
+	}
+	id := ra.state(ra.closure(next, false, false), false)
+	ra.cache(s, r, id)
+	return id
+}
+
+func (ra *RegexpAutomaton) Accept(s int) bool {
+	if s < 0 {
+		return false
+	}
+	// 结尾处$等断言成立，重新求闭包
+	for _, pc := range ra.closure(ra.states[s], s == 0, true) {
+		if ra.prog.Inst[pc].Op == syntax.InstMatch {
+			return true
+		}
+	}
+	return false
+}
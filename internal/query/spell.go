@@ -0,0 +1,206 @@
+package query
+
+import (
+	"fts/internal/types"
+	"math"
+	"sort"
+	"strings"
+)
+
+var (
+	_ types.Speller       = (*QueryBuilder)(nil)
+	_ types.CachedQueryer = (*QueryBuilder)(nil)
+)
+
+var (
+	SPELL_CANDIDATES      = 5    // 每个词项保留的候选数
+	SPELL_DISTANCE_WEIGHT = 2.0  // 每一次编辑相当于文档频率的自然对数减少的量
+	SPELL_FREQ_CACHE      = 4096 // 缓存的词项文档频率个数
+)
+
+type spellCandidate struct {
+	term     string
+	distance int
+	freq     int64
+}
+
+// 读音归一化，例如汉字转拼音。设置后读音相同的词项也会作为候选，编辑距离记为1
+// 不设置时中文字段按字符计算编辑距离
+func (eq *QueryBuilder) UsePhonetic(f func(string) string) {
+	eq.phonetic = f
+}
+
+// 文档频率，词项不存在时返回0
+// 实现了types.PostingsIndex的索引只读取倒排的头部，结果按词项缓存
+func (eq *QueryBuilder) docFreq(term string) int64 {
+	if v, ok := eq.freqs.Get(term); ok {
+		return v.(int64)
+	}
+	f := int64(0)
+	if index := eq.imanager.GetIndex(term, eq.field); index != nil {
+		f = Postings(index).Cost()
+	}
+	eq.freqs.Put(term, f)
+	return f
+}
+
+// 清空缓存的文档频率，索引变化后调用
+func (eq *QueryBuilder) ClearCache() {
+	eq.freqs.Clear()
+}
+
+// 根据索引中实际存在的词项给出纠正后的查询，按编辑距离和文档频率排序
+// 查询串与索引使用同一个Tokenizer，英文词干化后的词项也能对上
+func (eq *QueryBuilder) Suggest(text string, n int) []types.Suggestion {
+	if eq.Tokenizer == nil || n <= 0 {
+		return nil
+	}
+	if _, ok := eq.imanager.(types.TermDictionary); !ok {
+		return nil
+	}
+
+	var (
+		tokens   = []string{}
+		cands    = [][]spellCandidate{}
+		homonyms map[string][]string
+	)
+	for _, v := range eq.Tokenizer.Analyze(text) {
+		tokens = append(tokens, v.Token())
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	if eq.phonetic != nil {
+		homonyms = eq.homonyms()
+	}
+
+	for _, t := range tokens {
+		cs := eq.spellCandidates(t, homonyms)
+		if len(cs) == 0 {
+			// 没有任何可替换的词项，无法给出建议
+			return nil
+		}
+		cands = append(cands, cs)
+	}
+
+	// beam search组合各词项的候选
+	type beam struct {
+		terms    []string
+		distance int
+		freq     int64
+		score    float64
+	}
+	beams := []beam{{freq: math.MaxInt64}}
+	width := n + SPELL_CANDIDATES
+	for _, cs := range cands {
+		next := make([]beam, 0, len(beams)*len(cs))
+		for _, b := range beams {
+			for _, c := range cs {
+				terms := make([]string, len(b.terms), len(b.terms)+1)
+				copy(terms, b.terms)
+				freq := b.freq
+				if c.freq < freq {
+					freq = c.freq
+				}
+				next = append(next, beam{
+					terms:    append(terms, c.term),
+					distance: b.distance + c.distance,
+					freq:     freq,
+					score:    b.score + spellScore(c),
+				})
+			}
+		}
+		sort.SliceStable(next, func(i, j int) bool {
+			return next[i].score > next[j].score
+		})
+		if len(next) > width {
+			next = next[:width]
+		}
+		beams = next
+	}
+
+	res := make([]types.Suggestion, 0, n)
+	for _, b := range beams {
+		if b.distance == 0 {
+			// 与原查询相同
+			continue
+		}
+		res = append(res, types.Suggestion{
+			Text:     strings.Join(b.terms, " "),
+			Terms:    b.terms,
+			Distance: b.distance,
+			Freq:     b.freq,
+			Score:    b.score,
+		})
+		if len(res) == n {
+			break
+		}
+	}
+	return res
+}
+
+func spellScore(c spellCandidate) float64 {
+	return math.Log(float64(c.freq)+1) - SPELL_DISTANCE_WEIGHT*float64(c.distance)
+}
+
+// 单个词项的候选：读音相同的词项、自身(存在时)、编辑距离为1的词项，没有时放宽到2
+func (eq *QueryBuilder) spellCandidates(term string, homonyms map[string][]string) []spellCandidate {
+	var (
+		res  = []spellCandidate{}
+		seen = make(map[string]bool)
+	)
+	add := func(t string, d int) {
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		if f := eq.docFreq(t); f > 0 {
+			res = append(res, spellCandidate{
+				term:     t,
+				distance: d,
+				freq:     f,
+			})
+		}
+	}
+
+	if homonyms != nil {
+		for _, v := range homonyms[eq.phonetic(term)] {
+			if v == term {
+				add(v, 0)
+			} else {
+				add(v, 1)
+			}
+		}
+	}
+	for k := 1; k <= MAX_FUZZY_DISTANCE; k++ {
+		la := NewLevenshteinAutomaton(term, k, 0, true)
+		for _, v := range eq.expandTerms(la) {
+			add(v, la.Match(v))
+		}
+		if len(res) > 1 || (len(res) == 1 && res[0].term != term) {
+			break
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].distance != res[j].distance {
+			return res[i].distance < res[j].distance
+		}
+		return res[i].freq > res[j].freq
+	})
+	if len(res) > SPELL_CANDIDATES {
+		res = res[:SPELL_CANDIDATES]
+	}
+	return res
+}
+
+// 读音 -> 词项
+func (eq *QueryBuilder) homonyms() map[string][]string {
+	td := eq.imanager.(types.TermDictionary)
+	terms, _ := td.Terms(eq.field, NewPrefixAutomaton(""), 0)
+	res := make(map[string][]string)
+	for _, v := range terms {
+		key := eq.phonetic(v)
+		res[key] = append(res[key], v)
+	}
+	return res
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fts/internal/common"
+	"fts/internal/types"
 	"sync"
 	"unicode/utf8"
 )
@@ -360,3 +361,51 @@ func (rt *RadixTree) Delete(key string) {
 	}
 
 }
+
+func (p Pair) Key() string {
+	return p.key
+}
+
+func (p Pair) Data() interface{} {
+	return p.data
+}
+
+// 枚举自动机接受的key，沿树边逐字符推进自动机，死状态的子树直接剪枝
+// max<=0表示不限制数量，超过max时返回的bool为true
+func (rt *RadixTree) Intersect(a types.Automaton, max int) ([]Pair, bool) {
+	rt.RLock()
+	defer rt.RUnlock()
+	res := []Pair{}
+	truncated := rt.root.intersect(a, a.Start(), "", &res, max)
+	return res, truncated
+}
+
+func (rn *radixNode) intersect(a types.Automaton, state int, prefix string, res *[]Pair, max int) bool {
+	rn.RLock()
+	defer rn.RUnlock()
+	for _, v := range rn.childs {
+		s := state
+		for _, r := range v.key {
+			if s = a.Step(s, r); s < 0 {
+				break
+			}
+		}
+		if s < 0 {
+			continue
+		}
+		key := prefix + v.key
+		if v.end && a.Accept(s) {
+			if max > 0 && len(*res) >= max {
+				return true
+			}
+			*res = append(*res, Pair{
+				key:  key,
+				data: v.data,
+			})
+		}
+		if v.intersect(a, s, key, res, max) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"fts/internal/query"
 	"math/rand"
 	"sync"
 	"testing"
@@ -86,3 +87,32 @@ func TestRadixTree(t *testing.T) {
 	assert.Equal(t, false, ok, "delete key shouldn't be detected")
 
 }
+
+func TestRadixIntersect(t *testing.T) {
+	tree := NewRadixTree()
+	for i, v := range []string{"ra", "rax", "raxid", "rapp", "rxaid", "rxxid", "beijing"} {
+		tree.Insert(v, i)
+	}
+
+	keys := func(ps []Pair) []string {
+		res := []string{}
+		for _, v := range ps {
+			res = append(res, v.Key())
+		}
+		return res
+	}
+
+	ps, truncated := tree.Intersect(query.NewPatternAutomaton("ra*"), 0)
+	assert.False(t, truncated)
+	assert.ElementsMatch(t, []string{"ra", "rax", "raxid", "rapp"}, keys(ps))
+
+	ps, _ = tree.Intersect(query.NewPatternAutomaton("r?x*d"), 0)
+	assert.ElementsMatch(t, []string{"raxid", "rxxid"}, keys(ps))
+
+	ps, truncated = tree.Intersect(query.NewPatternAutomaton("r*"), 3)
+	assert.True(t, truncated)
+	assert.Equal(t, 3, len(ps))
+
+	ps, _ = tree.Intersect(query.NewPatternAutomaton("x*"), 0)
+	assert.Equal(t, 0, len(ps))
+}
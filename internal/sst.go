@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"fts/internal/common"
 	"io"
 	"log"
 	"math"
+	"sort"
 	"sync"
 	"unsafe"
 )
@@ -16,9 +19,14 @@ var (
 	HASH_WAY    = 4
 	FILTER_SIZE = 1024 * 2
 
-	ErrNoSpace = errors.New("no space of sst")
+	ErrNoSpace      = errors.New("no space of sst")
+	ErrSSTInvariant = errors.New("sst page invariant violated")
 )
 
+// 页头中Crc32字段的位置，在PageID Size Cap之后
+// 校验和覆盖整个页面，计算时该字段按0处理
+const SST_CRC32_OFFSET = 24
+
 type SortSuffixTable struct {
 	sync.RWMutex
 	header  PageHeader
@@ -214,42 +222,49 @@ func (sst *SortSuffixTable) SearchRangeRecord(low, high string) []Record {
 
 }
 
+// 序列化为SST_SIZE大小的页面，页头在前，记录从页尾向前写
 func (sst *SortSuffixTable) Dump() (b []byte, err error) {
-	b = make([]byte, 0, SST_SIZE) // len 0 cap
-	err = sst.header.Dump(b)
-	if err != nil {
-		return
-	}
-
-	w := bytes.NewBuffer(b[len(b):])
-	var xlen int32
+	b = make([]byte, SST_SIZE)
 
-	offset := sst.header.Cap
+	offset := int64(len(b))
 	for _, v := range sst.Records {
-		xlen = int32(len(v.Suffix))
-		offset -= (int64(xlen) + int64(unsafe.Sizeof(int64(0))) + int64(unsafe.Sizeof(int(0))))
-		w = bytes.NewBuffer(b[offset:])
+		w := bytes.NewBuffer(make([]byte, 0, 8+4+len(v.Suffix)+1))
 		if err = binary.Write(w, binary.BigEndian, v.ID); err != nil {
 			return
 		}
-		if err = binary.Write(w, binary.BigEndian, xlen); err != nil {
-			return
-		}
-		if err = binary.Write(w, binary.BigEndian, []byte(v.Suffix)); err != nil {
+		if err = binary.Write(w, binary.BigEndian, int32(len(v.Suffix))); err != nil {
 			return
 		}
+		w.WriteString(v.Suffix)
 		if err = binary.Write(w, binary.BigEndian, v.RefCount); err != nil {
 			return
 		}
+		offset -= int64(w.Len())
+		if offset < 0 {
+			return nil, ErrNoSpace
+		}
+		copy(b[offset:], w.Bytes())
+	}
 
+	sst.header.Offset = offset
+	sst.header.Size = int64(len(sst.Records))
+	sst.header.Crc32 = 0
+	w := bytes.NewBuffer(make([]byte, 0, SST_SIZE))
+	if err = sst.header.Dump(w); err != nil {
+		return
+	}
+	if int64(w.Len()) > offset {
+		return nil, ErrNoSpace
 	}
+	copy(b, w.Bytes())
 
+	crc := common.GetCrc32(b)
+	binary.BigEndian.PutUint64(b[SST_CRC32_OFFSET:], uint64(crc))
+	sst.header.Crc32 = int64(crc)
 	return
 }
 
-func (ph *PageHeader) Dump(b []byte) error {
-
-	w := bytes.NewBuffer(b)
+func (ph *PageHeader) Dump(w io.Writer) error {
 	var err error
 	if err = binary.Write(w, binary.BigEndian, ph.PageID); err != nil {
 		return err
@@ -376,47 +391,35 @@ func (ph *PageHeader) Serial(b []byte) (int64, error) {
 
 	ph.Min, err = readString(r, xlen)
 
-	i += int64(len(ph.Max))
+	i += int64(len(ph.Min))
 	return i, err
 }
-func (sst *SortSuffixTable) Serial(b []byte) error {
 
+// 从页面反序列化，校验和不一致时返回*common.CorruptionError
+func (sst *SortSuffixTable) Serial(b []byte) error {
 	var (
-		rb   int64
-		err  error
-		xlen int32
+		err    error
+		record Record
 	)
-
-	rb, err = sst.header.Serial(b)
-
-	if err != nil {
-		return err
-	}
-
-	r := bytes.NewReader(b[rb:])
-
-	if err = binary.Read(r, binary.BigEndian, &xlen); err != nil {
-		return err
+	if len(b) < SST_CRC32_OFFSET+8 {
+		return io.ErrUnexpectedEOF
 	}
-
-	sst.header.Max, err = readString(r, xlen)
-
-	if err != nil {
+	expect := uint32(binary.BigEndian.Uint64(b[SST_CRC32_OFFSET:]))
+	page := append([]byte{}, b...)
+	binary.BigEndian.PutUint64(page[SST_CRC32_OFFSET:], 0)
+	if err = common.VerifyCrc32("", 0, page, expect); err != nil {
 		return err
 	}
 
-	if err = binary.Read(r, binary.BigEndian, &xlen); err != nil {
+	if _, err = sst.header.Serial(b); err != nil {
 		return err
 	}
-
-	sst.header.Min, err = readString(r, xlen)
-
-	if err != nil {
-		return err
+	if sst.header.Offset < 0 || sst.header.Offset > int64(len(b)) {
+		return io.ErrUnexpectedEOF
 	}
-	var record Record
 
-	r = bytes.NewReader(b[sst.header.Offset:])
+	sst.Records = sst.Records[:0]
+	r := bytes.NewReader(b[sst.header.Offset:])
 	for {
 		record, err = readRecord(r)
 		if err != nil {
@@ -431,9 +434,46 @@ func (sst *SortSuffixTable) Serial(b []byte) error {
 	}
 }
 
+// 检查记录按后缀严格递增，页头的Min/Max/Size与记录一致
+func (sst *SortSuffixTable) Verify() error {
+	for i := 1; i < len(sst.Records); i++ {
+		if sst.Records[i].Suffix <= sst.Records[i-1].Suffix {
+			return fmt.Errorf("%w: page %d record %q after %q", ErrSSTInvariant, sst.header.PageID, sst.Records[i].Suffix, sst.Records[i-1].Suffix)
+		}
+	}
+	if sst.header.Size != int64(len(sst.Records)) {
+		return fmt.Errorf("%w: page %d size %d but %d records", ErrSSTInvariant, sst.header.PageID, sst.header.Size, len(sst.Records))
+	}
+	if n := len(sst.Records); n > 0 && (sst.header.Min != sst.Records[0].Suffix || sst.header.Max != sst.Records[n-1].Suffix) {
+		return fmt.Errorf("%w: page %d range [%q, %q] but records [%q, %q]", ErrSSTInvariant, sst.header.PageID,
+			sst.header.Min, sst.header.Max, sst.Records[0].Suffix, sst.Records[n-1].Suffix)
+	}
+	return nil
+}
+
+// 按记录重新排序并计算页头的Min/Max/Size，相同的后缀合并引用计数
+func (sst *SortSuffixTable) rebuildHeader() {
+	sort.SliceStable(sst.Records, func(i, j int) bool {
+		return sst.Records[i].Suffix < sst.Records[j].Suffix
+	})
+	records := sst.Records[:0]
+	for _, v := range sst.Records {
+		if n := len(records); n > 0 && records[n-1].Suffix == v.Suffix {
+			records[n-1].RefCount += v.RefCount
+			continue
+		}
+		records = append(records, v)
+	}
+	sst.Records = records
+	sst.header.Size = int64(len(records))
+	if len(records) > 0 {
+		sst.header.Min, sst.header.Max = records[0].Suffix, records[len(records)-1].Suffix
+	}
+}
+
 func readRecord(r io.Reader) (Record, error) {
 	var (
-		xlen   int64
+		xlen   int32
 		err    error
 		record Record
 	)
@@ -5,6 +5,7 @@ import (
 	"container/list"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"fts/internal/common"
 	"io"
 	"os"
@@ -38,46 +39,29 @@ func NewSSTM(root string) *SstManager {
 	return sstm
 }
 
-func (sm *SstManager) Search(s string) (*Record, bool) {
-	cnt := 0
-retry:
-	for iter := sm.ca.Front(); iter != nil; iter = iter.Next() {
-		xv := iter.Value.(*SortSuffixTable)
-
-		if re := xv.SearchRecord(s); re != nil {
-			return re, true
-		}
-	}
-	cnt++
-	sm.getRecordPage(s)
-	if cnt >= 2 {
-		sm.flushAll()
-	}
-	goto retry
+// 查找后缀对应的记录，不存在时返回ErrNotFoundKey，
+// 页面损坏且其他页面也没有找到时返回*common.CorruptionError
+func (sm *SstManager) Search(s string) (*Record, error) {
+	re, _, err := sm.search(s)
+	return re, err
 }
 
-func (sm *SstManager) search(s string) (*Record, *SortSuffixTable, bool) {
+func (sm *SstManager) search(s string) (*Record, *SortSuffixTable, error) {
 	for iter := sm.ca.Front(); iter != nil; iter = iter.Next() {
 		xv := iter.Value.(*SortSuffixTable)
 
 		if re := xv.SearchRecord(s); re != nil {
-			return re, xv, true
+			return re, xv, nil
 		}
 	}
-	var (
-		re  *Record
-		sst *SortSuffixTable
-	)
 
-	re, sst = sm.getRecordPage(s)
-
-	return re, sst, re != nil
+	return sm.getRecordPage(s)
 }
 func (sm *SstManager) Update(s string, re Record) error {
-	_, sst, ok := sm.search(s)
+	_, sst, err := sm.search(s)
 
-	if !ok {
-		return ErrNotFoundKey
+	if err != nil {
+		return err
 	}
 
 	return sst.UpdateRecord(s, re)
@@ -157,9 +141,9 @@ func (sm *SstManager) SearchRange(low, high string) []Record {
 
 		sm.f.ReadAt(b, pk.loc)
 
-		page := NewSSTDump(b)
-
-		if page == nil {
+		page, err := sm.loadPage(b, pk.loc)
+		if err != nil {
+			common.DFAIL("load sst page %v", err)
 			return
 		}
 
@@ -192,12 +176,66 @@ func (sm *SstManager) init() {
 	}
 }
 
-func (sm *SstManager) getRecordPage(s string) (*Record, *SortSuffixTable) {
+// 反序列化loc处的页面，校验失败时补充文件与偏移
+func (sm *SstManager) loadPage(b []byte, loc int64) (*SortSuffixTable, error) {
+	page := NewSST(0)
+	if err := page.Serial(b); err != nil {
+		var ce *common.CorruptionError
+		if errors.As(err, &ce) {
+			ce.Path, ce.Offset = sm.f.Name(), loc
+		}
+		return nil, err
+	}
+	return page, nil
+}
+
+// 逐页读取磁盘上的页面，检查校验和、页内记录以及内存中的页头
+// repair为true时按记录重新计算页头并写回，校验和不一致的页面无法修复
+func (sm *SstManager) Verify(repair bool) []error {
+	errs := []error{}
+	for idx, loc := range sm.locations {
+		b := make([]byte, SST_SIZE)
+		if _, err := sm.f.ReadAt(b, loc); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		page, err := sm.loadPage(b, loc)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err = page.Verify(); err == nil && page.header.PageID != sm.headers[idx].PageID {
+			err = fmt.Errorf("%w: page %d at %d but header says %d", ErrSSTInvariant, page.header.PageID, loc, sm.headers[idx].PageID)
+		}
+		if err == nil {
+			continue
+		}
+		errs = append(errs, err)
+		if !repair {
+			continue
+		}
+		page.rebuildHeader()
+		if b, err = page.Dump(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err = sm.f.WriteAt(b, loc); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sm.headers[idx] = page.header
+	}
+	return errs
+}
+
+// 从磁盘读取可能包含s的页面，损坏的页面跳过，其他页面都没有找到时返回损坏的错误
+func (sm *SstManager) getRecordPage(s string) (*Record, *SortSuffixTable, error) {
 
 	if sm.ca.Len() > int(CACHE_NODE) {
 		sm.flushUntilIdle()
 	}
 
+	var corrupt error
 	sl := make([]*SortSuffixTable, 0)
 	for idx, v := range sm.headers {
 		if v.Min < s && s < v.Max && v.bloom.TestString(s) {
@@ -205,14 +243,15 @@ func (sm *SstManager) getRecordPage(s string) (*Record, *SortSuffixTable) {
 			b := make([]byte, SST_SIZE)
 			sm.f.ReadAt(b, sm.locations[idx])
 
-			sst := NewSSTDump(b)
-			if sst == nil {
-				panic("sst dump error")
+			sst, err := sm.loadPage(b, sm.locations[idx])
+			if err != nil {
+				common.DFAIL("load sst page %v", err)
+				corrupt = err
+				continue
 			}
 			sl = append(sl, sst)
 		}
 	}
-	var re *Record
 
 	defer func() {
 		for _, v := range sl {
@@ -220,11 +259,14 @@ func (sm *SstManager) getRecordPage(s string) (*Record, *SortSuffixTable) {
 		}
 	}()
 	for ixd, v := range sl {
-		if re = v.SearchRecord(s); re != nil {
-			return re, sl[ixd]
+		if re := v.SearchRecord(s); re != nil {
+			return re, sl[ixd], nil
 		}
 	}
-	return nil, nil
+	if corrupt != nil {
+		return nil, nil, corrupt
+	}
+	return nil, nil, ErrNotFoundKey
 }
 func (sm *SstManager) flushPage(loc int64) {
 	xv := sm.ca.Front().Value
@@ -385,9 +427,9 @@ func (sm *SstManager) readChunkAndCache(size int) {
 	con:
 		off += int64(bys)
 		for i := 0; i < bys; i += SST_SIZE {
-			nm := NewSSTDump(b[i : i+SST_SIZE])
-			if nm == nil {
-				panic("unformat sst")
+			nm, err := sm.loadPage(b[i:i+SST_SIZE], off+int64(i))
+			if err != nil {
+				panic(err)
 			}
 			sm.headers = append(sm.headers, nm.header)
 			sm.locations = append(sm.locations, off+int64(i))
@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"errors"
+	"fts/internal/common"
 	"math/rand"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -35,3 +38,70 @@ func TestSST(t *testing.T) {
 	n := rand.Intn(len(data))
 	assert.Equal(t, data[n], *sst.SearchRecord(data[n].Suffix))
 }
+
+func TestSSTChecksum(t *testing.T) {
+	sst := NewSST(7)
+	sst.Records = []Record{
+		{ID: 1, Suffix: "ab", RefCount: 1},
+		{ID: 2, Suffix: "cd", RefCount: 2},
+		{ID: 3, Suffix: "玲珑", RefCount: 3},
+	}
+	sst.header.Min, sst.header.Max = "ab", "玲珑"
+	b, err := sst.Dump()
+	assert.Nil(t, err)
+	assert.Equal(t, SST_SIZE, len(b))
+	assert.NotEqual(t, int64(0), sst.header.Crc32)
+
+	n := NewSST(0)
+	assert.Nil(t, n.Serial(b))
+	assert.Equal(t, int64(7), n.header.PageID)
+	assert.Equal(t, sst.header.Crc32, n.header.Crc32)
+	assert.Equal(t, sst.Records, n.Records)
+	assert.Equal(t, "ab", n.header.Min)
+	assert.Equal(t, "玲珑", n.header.Max)
+
+	b[len(b)-1] ^= 0xff
+	err = NewSST(0).Serial(b)
+	assert.True(t, errors.Is(err, common.ErrCorrupted))
+	var ce *common.CorruptionError
+	assert.True(t, errors.As(err, &ce))
+	assert.Equal(t, uint32(sst.header.Crc32), ce.Expect)
+}
+
+// 损坏的页面跳过，其他页面找不到时返回损坏的错误而不是panic
+func TestSSTManagerCorruptPage(t *testing.T) {
+	f, err := os.CreateTemp("", "sst")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sm := &SstManager{f: f}
+	for i, suffixes := range [][]string{{"ba", "bb", "bc"}, {"aa", "ab", "ac"}} {
+		page := NewSST(int64(i))
+		for _, v := range suffixes {
+			page.Records = append(page.Records, Record{ID: int64(i), Suffix: v, RefCount: 1})
+			page.header.bloom.AddString(v)
+		}
+		page.header.Min, page.header.Max = "0", "z"
+		b, err := page.Dump()
+		assert.Nil(t, err)
+		f.WriteAt(b, int64(i*SST_SIZE))
+		sm.headers = append(sm.headers, page.header)
+		sm.locations = append(sm.locations, int64(i*SST_SIZE))
+	}
+	f.WriteAt([]byte{0xff, 0xff}, int64(SST_SIZE-2))
+
+	re, err := sm.Search("ab")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), re.ID)
+
+	_, err = sm.Search("bb")
+	assert.True(t, errors.Is(err, common.ErrCorrupted))
+	var ce *common.CorruptionError
+	assert.True(t, errors.As(err, &ce))
+	assert.Equal(t, f.Name(), ce.Path)
+
+	_, err = sm.Search("zz")
+	assert.Equal(t, ErrNotFoundKey, err)
+	assert.Equal(t, ErrNotFoundKey, sm.Update("ad", Record{}))
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"bytes"
 	"encoding/gob"
+	"fts/internal/types"
 	"sync"
 	"unicode/utf8"
 )
@@ -290,3 +291,47 @@ func (t *Trie) Delete(key string) {
 	}
 
 }
+
+func (t Tuple) Key() string {
+	return t.key
+}
+
+func (t Tuple) Data() interface{} {
+	return t.data
+}
+
+// 枚举自动机接受的key，死状态的子树直接剪枝
+// max<=0表示不限制数量，超过max时返回的bool为true
+func (t *Trie) Intersect(a types.Automaton, max int) ([]Tuple, bool) {
+	if t.root == nil {
+		return nil, false
+	}
+	res := []Tuple{}
+	truncated := t.root.intersect(a, a.Start(), []rune{}, &res, max)
+	return res, truncated
+}
+
+func (tn *TrieNode) intersect(a types.Automaton, state int, prefix []rune, res *[]Tuple, max int) bool {
+	tn.RLock()
+	defer tn.RUnlock()
+	for _, v := range tn.childs {
+		s := a.Step(state, v.ch)
+		if s < 0 {
+			continue
+		}
+		key := append(prefix, v.ch)
+		if v.end && a.Accept(s) {
+			if max > 0 && len(*res) >= max {
+				return true
+			}
+			*res = append(*res, Tuple{
+				key:  string(key),
+				data: v.data,
+			})
+		}
+		if v.intersect(a, s, key, res, max) {
+			return true
+		}
+	}
+	return false
+}
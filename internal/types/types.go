@@ -1,7 +1,9 @@
 package types
 
 import (
+	"fmt"
 	"io"
+	"strings"
 )
 
 type Cache interface {
@@ -60,6 +62,40 @@ type Document interface {
 	FetchField(string) []byte
 }
 
+// 带有热度的文档，整段文本补全时作为权重
+type PopularDocument interface {
+	Document
+	Popularity() int64
+}
+
+// 可以识别身份的文档，Identity是计算UUID时哈希的字符串，用于发现不同文档的UUID冲突
+type IdentityDocument interface {
+	Document
+	Identity() string
+}
+
+// 可以改用其它ID的文档，SetUUID之后UUID返回新的ID
+type RenamableDocument interface {
+	IdentityDocument
+	SetUUID(int64)
+}
+
+// 带有数值字段的文档，例如发布时间、链接数，日期统一为unix时间戳(秒)
+type NumericDocument interface {
+	Document
+	NumericField(string) (int64, bool)
+}
+
+// 数值范围，两端都是闭区间
+type NumericRange struct {
+	Min int64
+	Max int64
+}
+
+func (nr NumericRange) Contains(v int64) bool {
+	return v >= nr.Min && v <= nr.Max
+}
+
 type IndexQueryResult struct {
 	Ids  []int64         //有序数组
 	Info map[int64]int16 //具体信息
@@ -73,6 +109,21 @@ type Index interface {
 	QueryAllDoc() IndexQueryResult
 }
 
+// 按文档ID升序遍历倒排列表，Next或Advance返回false后遍历结束
+type PostingsIterator interface {
+	Next() bool
+	Advance(int64) bool // 移动到第一个不小于参数的文档，当前文档已经满足时不移动
+	Doc() int64
+	Freq() int16
+	Cost() int64 // 文档数，求交集时先遍历代价小的
+}
+
+// 不需要解码全部倒排就可以遍历的索引
+type PostingsIndex interface {
+	Index
+	Postings() PostingsIterator
+}
+
 type IndexDiskManager interface {
 	EnumFields() []string
 	GetIndex(int64, string) Index //id,filed
@@ -87,13 +138,20 @@ type DocID struct {
 
 type DocDiskManager interface {
 	GetDoc(int64) Document
-	AddDoc(Document) //反复添加，覆盖
+	ReadDoc(int64) (Document, error) // 返回读取错误，例如数据损坏
+	AddDoc(Document) error           //反复添加，覆盖；文档没有写入时返回错误，例如ID冲突被拒绝
 	EnumDocTypes() []Document
 	EnumDocsID(Document, int) chan int64
 	Docs(Document) int64
 	Flush()
 	SaveMeta()
 }
+
+// 可以自检的磁盘结构，返回发现的问题，参数为true时重建可以由其它数据推导出的部分
+type Verifier interface {
+	Verify(bool) []error
+}
+
 type DocumentLoader interface {
 	Load(chan Document, chan error)
 	ErrExit(error)
@@ -104,6 +162,20 @@ type IndexManager interface {
 	AddIndex(string, Index)
 }
 
+// 有限状态自动机，用于在词典上做前缀、通配符、模糊等匹配
+// 状态用int表示，Step返回负数表示死状态，后续不可能再匹配
+type Automaton interface {
+	Start() int
+	Step(int, rune) int
+	Accept(int) bool
+}
+
+// 可以按自动机枚举词项的IndexManager
+type TermDictionary interface {
+	// field,automaton,max 返回匹配的词项，以及是否因超过max被截断，max<=0不限制
+	Terms(string, Automaton, int) ([]string, bool)
+}
+
 type IndexMeta struct {
 	Token  string
 	Zindex Index
@@ -116,7 +188,7 @@ type IndexBuilder interface {
 
 type DiskCodec interface {
 	BindR(io.Reader)
-	BingW(io.Writer)
+	BindW(io.Writer)
 	Encode([]byte) (int64, error)
 	Decode() ([]byte, error)
 }
@@ -124,9 +196,12 @@ type DiskCodec interface {
 type QueryLevel uint8
 
 const (
-	AT_LEAST = iota // OR NOT
-	AT_OR           // common union set
-	AT_AND          // common min set
+	AT_LEAST    = iota // OR NOT
+	AT_OR              // common union set
+	AT_AND             // common min set
+	AT_WILDCARD        // prefix* / wi?d*card, expand against term dictionary
+	AT_FUZZY           // terms within edit distance, expand against term dictionary
+	AT_REGEXP          // /colou?r/, expand against term dictionary
 )
 
 // 一个元组形成的查询结果
@@ -140,8 +215,47 @@ type Queryer interface {
 	SetIndexManager(IndexManager)
 }
 
+// 可以查询指定字段的查询器，Query只查询构造时指定的字段
+type FieldQueryer interface {
+	Queryer
+	QueryField(string, string, QueryLevel, ...any) ([]QueryReuslt, map[string]Pair, []int64, string, []string) // field, text
+}
+
+// 按内部编号的过滤条件，例如位图，与倒排直接求交集
+type DocFilter interface {
+	Contains(uint32) bool
+	Postings() PostingsIterator // 按编号升序遍历
+}
+
+// 支持过滤的查询器，filter只限制命中的文档，不作为词项参与打分
+type FilteredQueryer interface {
+	Queryer
+	QueryFilter(string, QueryLevel, DocFilter, ...any) ([]QueryReuslt, map[string]Pair, []int64, string, []string)
+}
+
+// 拼写纠错的建议
+type Suggestion struct {
+	Text     string   // 纠正后的查询，词项以空格分隔
+	Terms    []string // 纠正后的词项，均存在于索引中
+	Distance int      // 与原查询的编辑距离之和
+	Freq     int64    // 各词项文档频率中的最小值
+	Score    float64
+}
+
+// 缓存了索引信息(例如文档频率)的Queryer，索引变化后需要清空
+type CachedQueryer interface {
+	ClearCache()
+}
+
+// 可以根据索引词典给出拼写纠错建议的Queryer
+type Speller interface {
+	Suggest(string, int) []Suggestion // text,n
+}
+
 type Pair struct {
-	Maps map[int64]int16
+	Maps    map[int64]int16
+	Weight  float64 // 词项的权重，0视为1
+	DocFreq int64   // 词项的文档数，Maps只包含命中的文档时设置，0时取len(Maps)
 }
 type RankResult struct {
 	Token  string
@@ -151,3 +265,38 @@ type RankResult struct {
 type Ranker interface {
 	Rank(string, map[string][]Document, map[string]Pair, map[int64]Document, string) []RankResult //
 }
+
+// 得分的组成，Value由Details按Description所说的方式算出
+type Explanation struct {
+	Value       float64
+	Description string
+	Details     []*Explanation
+}
+
+// 缩进的树形表示
+func (e *Explanation) String() string {
+	sb := &strings.Builder{}
+	e.write(sb, 0)
+	return sb.String()
+}
+
+func (e *Explanation) write(sb *strings.Builder, depth int) {
+	fmt.Fprintf(sb, "%s%g = %s\n", strings.Repeat("  ", depth), e.Value, e.Description)
+	for _, v := range e.Details {
+		v.write(sb, depth+1)
+	}
+}
+
+// 打分用到的字段统计量，可以由打开的文档得到，也可以从保存的字段长度读取
+type FieldStats struct {
+	Docs   int             // 参与打分的文档数
+	AvgLen float64         // 这些文档中字段的平均长度
+	Lens   map[int64]int64 // 文档(与Pair.Maps的键相同，引擎中为内部编号) -> 字段长度
+}
+
+// 可以解释得分的Ranker，按统计量计算，不需要打开文档
+// 给出结果的token组合与文档id，返回文档在该组合中的得分的组成，Value为得分
+type Explainer interface {
+	Explain(string, string, map[string]Pair, FieldStats, int64) *Explanation // field,tokens,infos,stats,id
+	Score(string, string, map[string]Pair, FieldStats, int64) float64        // 与Explain的Value相同，不生成解释
+}